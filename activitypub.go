@@ -0,0 +1,831 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"src/github.com/julienschmidt/httprouter"
+	"src/github.com/pkg/errors"
+)
+
+// Users are ActivityPub actors, so blogs can be followed from Mastodon and
+// other servers. Posts are sent to remote followers as Create, Update and
+// Delete activities through the delivery queue. Incoming activities are
+// checked and applied in the background, fetching keys of other servers
+// must not keep requests waiting.
+
+const (
+	activityContentType = "application/activity+json"
+	activityContext     = "https://www.w3.org/ns/activitystreams"
+	publicAudience      = "https://www.w3.org/ns/activitystreams#Public"
+	federationUserAgent = "golangBlog/1.0"
+	// activities bigger than that aren't read
+	maxActivitySize = 1 << 20
+	// remote actors are fetched again after that
+	actorCacheTTL = time.Hour
+)
+
+var actorKeyBits = 2048
+
+// RemoteFollower is an actor of another server following the user
+type RemoteFollower struct {
+	Actor string
+	Inbox string
+	// inbox shared by all actors of the server, activities for several
+	// followers from there are delivered once
+	SharedInbox string
+	Since       time.Time
+}
+
+type apKey struct {
+	ID           string `json:"id"`
+	Owner        string `json:"owner"`
+	PublicKeyPem string `json:"publicKeyPem"`
+}
+
+type apEndpoints struct {
+	SharedInbox string `json:"sharedInbox,omitempty"`
+}
+
+type apImage struct {
+	Type      string `json:"type"`
+	MediaType string `json:"mediaType,omitempty"`
+	URL       string `json:"url"`
+}
+
+type apActor struct {
+	Context           interface{}  `json:"@context,omitempty"`
+	ID                string       `json:"id"`
+	Type              string       `json:"type"`
+	PreferredUsername string       `json:"preferredUsername"`
+	Name              string       `json:"name,omitempty"`
+	Summary           string       `json:"summary,omitempty"`
+	URL               string       `json:"url,omitempty"`
+	Icon              *apImage     `json:"icon,omitempty"`
+	Inbox             string       `json:"inbox"`
+	Outbox            string       `json:"outbox,omitempty"`
+	Followers         string       `json:"followers,omitempty"`
+	Endpoints         *apEndpoints `json:"endpoints,omitempty"`
+	PublicKey         apKey        `json:"publicKey"`
+	// a key document has these at the top level instead of publicKey
+	Owner        string `json:"owner,omitempty"`
+	PublicKeyPem string `json:"publicKeyPem,omitempty"`
+}
+
+type apTag struct {
+	Type string `json:"type"`
+	Href string `json:"href"`
+	Name string `json:"name"`
+}
+
+type apNote struct {
+	Context      interface{} `json:"@context,omitempty"`
+	ID           string      `json:"id"`
+	Type         string      `json:"type"`
+	AttributedTo string      `json:"attributedTo,omitempty"`
+	Content      string      `json:"content,omitempty"`
+	URL          string      `json:"url,omitempty"`
+	Published    *time.Time  `json:"published,omitempty"`
+	Updated      *time.Time  `json:"updated,omitempty"`
+	To           []string    `json:"to,omitempty"`
+	Cc           []string    `json:"cc,omitempty"`
+	Tag          []apTag     `json:"tag,omitempty"`
+	Attachment   []apImage   `json:"attachment,omitempty"`
+}
+
+type apActivity struct {
+	Context   interface{} `json:"@context,omitempty"`
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	Actor     string      `json:"actor"`
+	Published *time.Time  `json:"published,omitempty"`
+	To        []string    `json:"to,omitempty"`
+	Cc        []string    `json:"cc,omitempty"`
+	Object    interface{} `json:"object"`
+}
+
+type apCollection struct {
+	Context      interface{}   `json:"@context,omitempty"`
+	ID           string        `json:"id"`
+	Type         string        `json:"type"`
+	TotalItems   int           `json:"totalItems"`
+	OrderedItems []interface{} `json:"orderedItems,omitempty"`
+}
+
+// apInbound is an incoming activity, objects are either embedded or links
+type apInbound struct {
+	ID     string          `json:"id"`
+	Type   string          `json:"type"`
+	Actor  string          `json:"actor"`
+	Object json.RawMessage `json:"object"`
+}
+
+func (a apInbound) object() apInbound {
+	var id string
+	if json.Unmarshal(a.Object, &id) == nil {
+		return apInbound{ID: id}
+	}
+	var obj apInbound
+	json.Unmarshal(a.Object, &obj)
+	return obj
+}
+
+func actorURL(username string) string {
+	return baseURL + "/users/" + username + "/actor"
+}
+
+func keyURL(username string) string {
+	return actorURL(username) + "#main-key"
+}
+
+// federationHost is the host in the handles of users
+func federationHost() string {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return baseURL
+	}
+	return u.Host
+}
+
+// FediverseHandle is the name to find the user by from other servers
+func (u User) FediverseHandle() string {
+	return "@" + u.Username + "@" + federationHost()
+}
+
+// makeActorKey makes and saves the key of a user who doesn't have one yet.
+// Generating a key is slow, so storeMu isn't held meanwhile.
+func makeActorKey(username string) error {
+	storeMu.Lock()
+	us := getUser(username)
+	missing := us != nil && us.ActorKey == ""
+	storeMu.Unlock()
+	if !missing {
+		return nil
+	}
+	key, err := rsa.GenerateKey(rand.Reader, actorKeyBits)
+	if err != nil {
+		return errors.Wrap(err, "can't generate actor key")
+	}
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	// another request could have made one meanwhile
+	if us.ActorKey != "" {
+		return nil
+	}
+	us.ActorKey = encodePrivateKey(key)
+	return us.refreshUserInfo()
+}
+
+// actorKey returns the key signing activities of the user, it's made
+// and saved the first time it's needed unless makeActorKey made it before
+func (u *User) actorKey() (*rsa.PrivateKey, error) {
+	if u.ActorKey != "" {
+		return decodePrivateKey(u.ActorKey)
+	}
+	key, err := rsa.GenerateKey(rand.Reader, actorKeyBits)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't generate actor key")
+	}
+	u.ActorKey = encodePrivateKey(key)
+	err = u.refreshUserInfo()
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func absoluteURL(link string) string {
+	if strings.HasPrefix(link, "/") {
+		return baseURL + link
+	}
+	return link
+}
+
+func (u *User) actor() (apActor, error) {
+	key, err := u.actorKey()
+	if err != nil {
+		return apActor{}, err
+	}
+	pem, err := encodePublicKey(&key.PublicKey)
+	if err != nil {
+		return apActor{}, errors.Wrap(err, "can't encode public key")
+	}
+	actor := apActor{
+		Context:           []string{activityContext, "https://w3id.org/security/v1"},
+		ID:                actorURL(u.Username),
+		Type:              "Person",
+		PreferredUsername: u.Username,
+		Name:              u.DisplayedName(),
+		Summary:           html.EscapeString(u.Bio),
+		URL:               baseURL + "/users/" + u.Username + "/",
+		Icon:              &apImage{Type: "Image", MediaType: "image/png", URL: absoluteURL(u.AvatarURL())},
+		Inbox:             baseURL + "/users/" + u.Username + "/inbox",
+		Outbox:            baseURL + "/users/" + u.Username + "/outbox",
+		Followers:         baseURL + "/users/" + u.Username + "/followers",
+		PublicKey:         apKey{ID: keyURL(u.Username), Owner: actorURL(u.Username), PublicKeyPem: pem},
+	}
+	if strings.HasSuffix(u.Avatar, ".jpg") {
+		actor.Icon.MediaType = "image/jpeg"
+	}
+	return actor, nil
+}
+
+// note renders the post the way Mastodon shows short posts
+func (u User) note(p Post) apNote {
+	var content strings.Builder
+	fmt.Fprintf(&content, "<p><strong>%s</strong></p><p>%s</p>", html.EscapeString(p.Title),
+		strings.Replace(html.EscapeString(p.Body), "\n", "<br>", -1))
+	var tags []apTag
+	if len(p.Tags) > 0 {
+		content.WriteString("<p>")
+		for i, tag := range p.Tags {
+			href := baseURL + "/tags/" + tag
+			if i > 0 {
+				content.WriteString(" ")
+			}
+			fmt.Fprintf(&content, `<a href="%s" class="mention hashtag" rel="tag">#<span>%s</span></a>`, href, tag)
+			tags = append(tags, apTag{Type: "Hashtag", Href: href, Name: "#" + tag})
+		}
+		content.WriteString("</p>")
+	}
+	published := p.Date.UTC()
+	note := apNote{
+		ID:           postURL(u.Username, p.ID),
+		Type:         "Note",
+		AttributedTo: actorURL(u.Username),
+		Content:      content.String(),
+		URL:          postURL(u.Username, p.ID),
+		Published:    &published,
+		To:           []string{publicAudience},
+		Cc:           []string{baseURL + "/users/" + u.Username + "/followers"},
+		Tag:          tags,
+	}
+	// the first revision is the post as it was written
+	if len(p.Revisions) > 1 {
+		updated := p.Revisions[len(p.Revisions)-1].Date.UTC()
+		note.Updated = &updated
+	}
+	for _, name := range p.Images {
+		mediaType := "image/png"
+		if filepath.Ext(name) == ".jpg" {
+			mediaType = "image/jpeg"
+		}
+		note.Attachment = append(note.Attachment, apImage{Type: "Image", MediaType: mediaType, URL: baseURL + "/media/" + name})
+	}
+	return note
+}
+
+func (u User) createActivity(p Post) apActivity {
+	note := u.note(p)
+	return apActivity{
+		ID:        note.ID + "#create",
+		Type:      "Create",
+		Actor:     note.AttributedTo,
+		Published: note.Published,
+		To:        note.To,
+		Cc:        note.Cc,
+		Object:    note,
+	}
+}
+
+// followerInboxes returns the inboxes to deliver to, each once
+func (u User) followerInboxes() []string {
+	seen := make(map[string]bool)
+	var inboxes []string
+	for _, f := range u.RemoteFollowers {
+		inbox := f.Inbox
+		if f.SharedInbox != "" {
+			inbox = f.SharedInbox
+		}
+		if !seen[inbox] {
+			seen[inbox] = true
+			inboxes = append(inboxes, inbox)
+		}
+	}
+	return inboxes
+}
+
+// sendToFollowers queues the activity for all remote followers,
+// failures are logged since the change itself is already made
+func (u User) sendToFollowers(activity apActivity) {
+	if len(u.RemoteFollowers) == 0 {
+		return
+	}
+	activity.Context = activityContext
+	data, err := json.Marshal(activity)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, inbox := range u.followerInboxes() {
+		err = enqueueDelivery(u.Username, inbox, data)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// federatePost tells remote followers about a published post being created,
+// edited or deleted
+func (u User) federatePost(activityType string, p Post) {
+	if len(u.RemoteFollowers) == 0 {
+		return
+	}
+	if activityType == "Create" {
+		u.sendToFollowers(u.createActivity(p))
+		return
+	}
+	note := u.note(p)
+	var object interface{} = note
+	if activityType == "Delete" {
+		object = apNote{ID: note.ID, Type: "Tombstone"}
+	}
+	u.sendToFollowers(apActivity{
+		ID:     fmt.Sprintf("%s#%s-%d", note.ID, strings.ToLower(activityType), time.Now().UnixNano()),
+		Type:   activityType,
+		Actor:  note.AttributedTo,
+		To:     note.To,
+		Cc:     note.Cc,
+		Object: object,
+	})
+}
+
+// wantsActivity tells whether the request asks for ActivityPub JSON instead of a page
+func wantsActivity(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, activityContentType) || strings.Contains(accept, "application/ld+json")
+}
+
+func writeActivity(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", activityContentType+"; charset=utf-8")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// federatedUser returns the user of the :username parameter, disabled users aren't federated
+func federatedUser(ps httprouter.Params) *User {
+	us := getUser(ps.ByName("username"))
+	if us == nil || us.Disabled {
+		return nil
+	}
+	return us
+}
+
+type webfingerLink struct {
+	Rel  string `json:"rel"`
+	Type string `json:"type,omitempty"`
+	Href string `json:"href"`
+}
+
+type webfingerJSON struct {
+	Subject string          `json:"subject"`
+	Aliases []string        `json:"aliases"`
+	Links   []webfingerLink `json:"links"`
+}
+
+// webfingerHandler finds actors by acct:username@host or by their URL
+func webfingerHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	resource := r.FormValue("resource")
+	var username string
+	if strings.HasPrefix(resource, "acct:") {
+		acct := strings.TrimPrefix(strings.TrimPrefix(resource, "acct:"), "@")
+		i := strings.LastIndex(acct, "@")
+		if i < 0 || !strings.EqualFold(acct[i+1:], federationHost()) {
+			http.NotFound(w, r)
+			return
+		}
+		username = acct[:i]
+	} else if strings.HasPrefix(resource, baseURL+"/users/") {
+		username = strings.SplitN(strings.TrimPrefix(resource, baseURL+"/users/"), "/", 2)[0]
+	}
+	us := federatedUser(httprouter.Params{{"username", username}})
+	if us == nil {
+		http.NotFound(w, r)
+		return
+	}
+	profile := baseURL + "/users/" + us.Username + "/"
+	w.Header().Set("Content-Type", "application/jrd+json; charset=utf-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	err := json.NewEncoder(w).Encode(webfingerJSON{
+		Subject: "acct:" + us.Username + "@" + federationHost(),
+		Aliases: []string{actorURL(us.Username), profile},
+		Links: []webfingerLink{
+			{Rel: "self", Type: activityContentType, Href: actorURL(us.Username)},
+			{Rel: "http://webfinger.net/rel/profile-page", Type: "text/html", Href: profile},
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func actorHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	err := makeActorKey(ps.ByName("username"))
+	if err != nil {
+		panic(err)
+	}
+	storeMu.Lock()
+	var actor apActor
+	us := federatedUser(ps)
+	if us != nil {
+		actor, err = us.actor()
+	}
+	storeMu.Unlock()
+	if us == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		panic(err)
+	}
+	writeActivity(w, actor)
+}
+
+// outboxHandler lists Create activities of the latest posts
+func outboxHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	us := federatedUser(ps)
+	if us == nil {
+		http.NotFound(w, r)
+		return
+	}
+	outbox := apCollection{
+		Context:    activityContext,
+		ID:         baseURL + "/users/" + us.Username + "/outbox",
+		Type:       "OrderedCollection",
+		TotalItems: len(us.Posts),
+	}
+	for i, p := range us.Posts {
+		if i == feedSize {
+			break
+		}
+		outbox.OrderedItems = append(outbox.OrderedItems, us.createActivity(p))
+	}
+	writeActivity(w, outbox)
+}
+
+// followersHandler tells how many remote followers there are, not who they are
+func followersHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	us := federatedUser(ps)
+	if us == nil {
+		http.NotFound(w, r)
+		return
+	}
+	writeActivity(w, apCollection{
+		Context:    activityContext,
+		ID:         baseURL + "/users/" + us.Username + "/followers",
+		Type:       "OrderedCollection",
+		TotalItems: len(us.RemoteFollowers),
+	})
+}
+
+// noteHandler answers postHandler when the post is asked for as a Note
+func noteHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	us, post := findPost(ps)
+	if post == nil || us.Disabled {
+		http.NotFound(w, r)
+		return
+	}
+	note := us.note(*post)
+	note.Context = activityContext
+	writeActivity(w, note)
+}
+
+// inboxItem is a received activity waiting to be checked
+type inboxItem struct {
+	Username string
+	// the request without its body, for the signature
+	Request *http.Request
+	Body    []byte
+}
+
+var inboxQueue = make(chan inboxItem, 100)
+
+// inboxHandler takes signed activities for the user and leaves
+// them for the inbox worker
+func inboxHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	storeMu.Lock()
+	us := federatedUser(ps)
+	storeMu.Unlock()
+	if us == nil {
+		http.NotFound(w, r)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxActivitySize+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxActivitySize {
+		http.Error(w, "Activity is too big", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if _, err := signatureKeyID(r); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	req := r.Clone(r.Context())
+	req.Body = nil
+	select {
+	case inboxQueue <- inboxItem{us.Username, req, body}:
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "Too many activities, try again later", http.StatusServiceUnavailable)
+	}
+}
+
+type cachedActor struct {
+	Actor   apActor
+	Fetched time.Time
+}
+
+// actorCache keeps remote actors by their ID and key ID
+var actorCache = struct {
+	sync.Mutex
+	actors map[string]cachedActor
+}{actors: make(map[string]cachedActor)}
+
+// fetchActorDocument gets the actor or the key document at id, signed with key
+// since some servers only answer known servers
+func fetchActorDocument(id, keyID string, key *rsa.PrivateKey) (apActor, error) {
+	req, err := http.NewRequest("GET", id, nil)
+	if err != nil || (req.URL.Scheme != "https" && req.URL.Scheme != "http") {
+		return apActor{}, errors.Errorf("%s isn't an actor link", id)
+	}
+	req.Header.Set("Accept", activityContentType)
+	req.Header.Set("User-Agent", federationUserAgent)
+	err = signRequest(req, keyID, key, nil)
+	if err != nil {
+		return apActor{}, err
+	}
+	resp, err := federationClient.Do(req)
+	if err != nil {
+		return apActor{}, errors.Wrap(err, "can't fetch actor")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return apActor{}, errors.Errorf("%s answered %s", id, resp.Status)
+	}
+	var actor apActor
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxActivitySize)).Decode(&actor)
+	if err != nil {
+		return apActor{}, errors.Wrap(err, "broken actor "+id)
+	}
+	return actor, nil
+}
+
+// fetchActor gets the actor a signature key at id belongs to
+func fetchActor(id, keyID string, key *rsa.PrivateKey) (apActor, error) {
+	actor, err := fetchActorDocument(id, keyID, key)
+	if err != nil {
+		return apActor{}, err
+	}
+	if actor.PublicKey.PublicKeyPem == "" && actor.PublicKeyPem != "" {
+		// a key document, its owner is the actor
+		owner, err := fetchActorDocument(actor.Owner, keyID, key)
+		if err != nil || owner.ID != actor.Owner || owner.PublicKey.ID != actor.ID {
+			return apActor{}, errors.Errorf("key %s doesn't belong to %s", actor.ID, actor.Owner)
+		}
+		actor = owner
+	}
+	err = checkActorKey(actor, id)
+	if err != nil {
+		return apActor{}, err
+	}
+	return actor, nil
+}
+
+// checkActorKey makes sure that the key is the key of the actor and that
+// the actor lives where the key does, so that a server can't answer
+// with actors of other servers to pass their activities for theirs
+func checkActorKey(actor apActor, keyID string) error {
+	keyLink, err := url.Parse(keyID)
+	if err != nil {
+		return errors.Errorf("%s isn't a key link", keyID)
+	}
+	actorLink, err := url.Parse(actor.ID)
+	if err != nil || actorLink.Scheme != keyLink.Scheme || actorLink.Host != keyLink.Host {
+		return errors.Errorf("actor %s isn't on the server of key %s", actor.ID, keyID)
+	}
+	if actor.PublicKey.ID != keyID || actor.PublicKey.Owner != actor.ID {
+		return errors.Errorf("key %s isn't a key of %s", keyID, actor.ID)
+	}
+	return nil
+}
+
+// cachedFetchActor is fetchActor remembering the results for actorCacheTTL
+func cachedFetchActor(id, keyID string, key *rsa.PrivateKey, refresh bool) (apActor, error) {
+	actorCache.Lock()
+	cached, ok := actorCache.actors[id]
+	actorCache.Unlock()
+	if ok && !refresh && time.Since(cached.Fetched) < actorCacheTTL {
+		return cached.Actor, nil
+	}
+	actor, err := fetchActor(id, keyID, key)
+	if err != nil {
+		return actor, err
+	}
+	actorCache.Lock()
+	actorCache.actors[id] = cachedActor{actor, time.Now()}
+	actorCache.Unlock()
+	return actor, nil
+}
+
+// processInboxItem checks the signature of a received activity and applies it
+func processInboxItem(item inboxItem) error {
+	err := makeActorKey(item.Username)
+	if err != nil {
+		return err
+	}
+	storeMu.Lock()
+	us := getUser(item.Username)
+	var key *rsa.PrivateKey
+	if us != nil {
+		key, err = us.actorKey()
+	}
+	storeMu.Unlock()
+	if us == nil || err != nil {
+		return errors.Errorf("inbox of %s isn't available: %v", item.Username, err)
+	}
+
+	keyID, err := signatureKeyID(item.Request)
+	if err != nil {
+		return err
+	}
+	var actor apActor
+	for _, refresh := range []bool{false, true} {
+		actor, err = cachedFetchActor(keyID, keyURL(item.Username), key, refresh)
+		if err != nil {
+			return err
+		}
+		var public *rsa.PublicKey
+		public, err = decodePublicKey(actor.PublicKey.PublicKeyPem)
+		if err == nil {
+			err = verifyRequest(item.Request, item.Body, public, time.Now())
+		}
+		// the key may have changed since it was cached
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return errors.Wrap(err, "bad signature from "+keyID)
+	}
+
+	var activity apInbound
+	err = json.Unmarshal(item.Body, &activity)
+	if err != nil {
+		return errors.Wrap(err, "broken activity")
+	}
+	if activity.Actor != actor.ID {
+		return errors.Errorf("activity of %s is signed by %s", activity.Actor, actor.ID)
+	}
+
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	us = getUser(item.Username)
+	if us == nil {
+		return nil
+	}
+	return us.receive(activity, item.Body, actor)
+}
+
+// startInbox applies received activities in the background
+func startInbox() {
+	go func() {
+		for item := range inboxQueue {
+			err := processInboxItem(item)
+			if err != nil {
+				log.Println("inbox:", err)
+			}
+		}
+	}()
+}
+
+// postByURL finds a post of the user by its Note ID
+func (u *User) postByURL(link string) *Post {
+	prefix := baseURL + "/users/" + u.Username + "/posts/"
+	if !strings.HasPrefix(link, prefix) {
+		return nil
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(link, prefix))
+	if err != nil {
+		return nil
+	}
+	return u.getPost(id)
+}
+
+func (u *User) removeRemoteFollower(actor string) bool {
+	for i, f := range u.RemoteFollowers {
+		if f.Actor == actor {
+			u.RemoteFollowers = append(u.RemoteFollowers[:i], u.RemoteFollowers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// receive applies an activity of the remote actor to the user, it's
+// called under storeMu once the signature is checked
+func (u *User) receive(activity apInbound, raw []byte, from apActor) error {
+	changed := false
+	switch activity.Type {
+	case "Follow":
+		if activity.object().ID != actorURL(u.Username) {
+			return errors.Errorf("%s isn't a follow of %s", activity.ID, u.Username)
+		}
+		u.removeRemoteFollower(from.ID)
+		follower := RemoteFollower{Actor: from.ID, Inbox: from.Inbox, Since: time.Now().UTC()}
+		if from.Endpoints != nil {
+			follower.SharedInbox = from.Endpoints.SharedInbox
+		}
+		u.RemoteFollowers = append(u.RemoteFollowers, follower)
+		changed = true
+
+		sum := sha256.Sum256([]byte(activity.ID))
+		accept, err := json.Marshal(apActivity{
+			Context: activityContext,
+			ID:      actorURL(u.Username) + "#accept-" + hex.EncodeToString(sum[:8]),
+			Type:    "Accept",
+			Actor:   actorURL(u.Username),
+			Object:  json.RawMessage(raw),
+		})
+		if err == nil {
+			err = enqueueDelivery(u.Username, from.Inbox, accept)
+		}
+		if err != nil {
+			log.Println(err)
+		}
+
+	case "Undo":
+		obj := activity.object()
+		if obj.Actor != "" && obj.Actor != activity.Actor {
+			return errors.Errorf("%s undoes an activity of %s", activity.Actor, obj.Actor)
+		}
+		switch obj.Type {
+		case "Follow":
+			changed = u.removeRemoteFollower(from.ID)
+		case "Like":
+			post := u.postByURL(obj.object().ID)
+			if post != nil {
+				changed = post.removeLike(from.ID)
+			}
+		}
+
+	case "Like":
+		post := u.postByURL(activity.object().ID)
+		if post == nil {
+			return errors.Errorf("%s likes an unknown post %s", from.ID, activity.object().ID)
+		}
+		changed = post.addLike(from.ID)
+
+	case "Delete":
+		// the remote account is gone
+		if activity.object().ID == from.ID {
+			changed = u.removeRemoteFollower(from.ID)
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return u.refreshUserInfo()
+}
+
+func (p *Post) addLike(actor string) bool {
+	for _, a := range p.Likes {
+		if a == actor {
+			return false
+		}
+	}
+	p.Likes = append(p.Likes, actor)
+	p.Changed = time.Now().UTC()
+	return true
+}
+
+func (p *Post) removeLike(actor string) bool {
+	for i, a := range p.Likes {
+		if a == actor {
+			p.Likes = append(p.Likes[:i], p.Likes[i+1:]...)
+			p.Changed = time.Now().UTC()
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"src/github.com/julienschmidt/httprouter"
+)
+
+// fakeServer is another ActivityPub server with one actor,
+// it keeps what's delivered to its inbox
+type fakeServer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+	// keyID is what send signs with, the key of the actor by default
+	keyID string
+
+	mu       sync.Mutex
+	status   int
+	received []*http.Request
+	bodies   [][]byte
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeServer{key: key, status: http.StatusAccepted}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/actor", func(w http.ResponseWriter, r *http.Request) {
+		pem, _ := encodePublicKey(&key.PublicKey)
+		json.NewEncoder(w).Encode(apActor{
+			ID:                f.URL + "/actor",
+			Type:              "Person",
+			PreferredUsername: "remote",
+			Inbox:             f.URL + "/inbox",
+			PublicKey:         apKey{ID: f.URL + "/actor#main-key", Owner: f.URL + "/actor", PublicKeyPem: pem},
+		})
+	})
+	// actors claiming to be of another server, or to own a key of another actor
+	mux.HandleFunc("/impostor", func(w http.ResponseWriter, r *http.Request) {
+		pem, _ := encodePublicKey(&key.PublicKey)
+		json.NewEncoder(w).Encode(apActor{ID: "https://other.example/actor", Type: "Person", Inbox: f.URL + "/inbox",
+			PublicKey: apKey{ID: f.URL + "/impostor#main-key", Owner: "https://other.example/actor", PublicKeyPem: pem}})
+	})
+	mux.HandleFunc("/thief", func(w http.ResponseWriter, r *http.Request) {
+		pem, _ := encodePublicKey(&key.PublicKey)
+		json.NewEncoder(w).Encode(apActor{ID: f.URL + "/thief", Type: "Person", Inbox: f.URL + "/inbox",
+			PublicKey: apKey{ID: f.URL + "/actor#main-key", Owner: f.URL + "/actor", PublicKeyPem: pem}})
+	})
+	mux.HandleFunc("/inbox", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.received = append(f.received, r)
+		f.bodies = append(f.bodies, body)
+		w.WriteHeader(f.status)
+	})
+	f.Server = httptest.NewServer(mux)
+	return f
+}
+
+func (f *fakeServer) actor() string {
+	return f.URL + "/actor"
+}
+
+// send delivers the activity of the fake actor to the inbox of username
+// and returns what the inbox worker would get
+func (f *fakeServer) send(t *testing.T, username string, activity map[string]interface{}) (int, inboxItem) {
+	body, _ := json.Marshal(activity)
+	req := httptest.NewRequest("POST", baseURL+"/users/"+username+"/inbox", bytes.NewReader(body))
+	keyID := f.keyID
+	if keyID == "" {
+		keyID = f.actor() + "#main-key"
+	}
+	signRequest(req, keyID, f.key, body)
+	w := httptest.NewRecorder()
+	inboxHandler(w, req, httprouter.Params{{"username", username}})
+	if w.Code != http.StatusAccepted {
+		return w.Code, inboxItem{}
+	}
+	return w.Code, <-inboxQueue
+}
+
+// withFederation keeps deliveries of a test in a temporary directory
+// and lets requests reach test servers
+func withFederation(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "deliveries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldDir, oldBits := deliveryDir, actorKeyBits
+	deliveryDir, actorKeyBits, allowPrivateAddresses = dir, 1024, true
+	return func() {
+		deliveryDir, actorKeyBits, allowPrivateAddresses = oldDir, oldBits, false
+		os.RemoveAll(dir)
+		actorCache.Lock()
+		actorCache.actors = make(map[string]cachedActor)
+		actorCache.Unlock()
+		users = nil
+		os.Remove("data/accounts/testUser.txt")
+	}
+}
+
+// getDecoded requests url from the handler and decodes a successful response into v
+func getDecoded(t *testing.T, decode func([]byte, interface{}) error, req *http.Request,
+	handler httprouter.Handle, ps httprouter.Params, v interface{}) int {
+	w := httptest.NewRecorder()
+	handler(w, req, ps)
+	if w.Code == 200 {
+		err := decode(w.Body.Bytes(), v)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code
+}
+
+func getActivity(t *testing.T, url string, handler httprouter.Handle, ps httprouter.Params, v interface{}) int {
+	req := httptest.NewRequest("GET", url, nil)
+	req.Header.Set("Accept", activityContentType)
+	return getDecoded(t, json.Unmarshal, req, handler, ps, v)
+}
+
+func TestWebfinger(t *testing.T) {
+	defer withFederation(t)()
+	users = append(users, &User{Username: "testUser", Password: "testPassword", ID: 1, Role: RoleAuthor},
+		&User{Username: "gone", Password: "testPassword", ID: 2, Role: RoleAuthor, Disabled: true})
+
+	for resource, code := range map[string]int{
+		"acct:testUser@localhost:8080":  200,
+		"acct:@testUser@localhost:8080": 200,
+		actorURL("testUser"):            200,
+		"acct:testUser@example.com":     404,
+		"acct:gone@localhost:8080":      404,
+		"acct:nobody@localhost:8080":    404,
+		"":                              404,
+	} {
+		var jrd webfingerJSON
+		url := "http://localhost:8080/.well-known/webfinger?resource=" + resource
+		if getActivity(t, url, webfingerHandler, nil, &jrd) != code {
+			t.Errorf("TestWebfinger --> FAILED: %s", resource)
+		}
+		if code == 200 && (jrd.Subject != "acct:testUser@localhost:8080" || jrd.Links[0].Href != actorURL("testUser")) {
+			t.Errorf("TestWebfinger --> FAILED: %s", resource)
+		}
+	}
+}
+
+func TestActorAndOutbox(t *testing.T) {
+	defer withFederation(t)()
+	us := &User{Username: "testUser", Password: "testPassword", ID: 1, Role: RoleAuthor, Bio: "<b>hi</b>"}
+	users = append(users, us)
+	us.addPost(Post{Title: "first", Body: "one", Date: time.Now().Add(-time.Hour)})
+	us.addPost(Post{Title: "second", Body: "two <i>\nlines", Date: time.Now(), Tags: []string{"go"}, Images: []string{"a.jpg"}})
+	ps := httprouter.Params{{"username", "testUser"}}
+
+	var actor apActor
+	if getActivity(t, actorURL("testUser"), actorHandler, ps, &actor) != 200 {
+		t.Fatal("TestActorAndOutbox --> FAILED")
+	}
+	if actor.ID != actorURL("testUser") || actor.Inbox != baseURL+"/users/testUser/inbox" || actor.Summary != "&lt;b&gt;hi&lt;/b&gt;" {
+		t.Errorf("TestActorAndOutbox --> FAILED")
+	}
+	// the key is kept, so the actor doesn't change
+	public, err := decodePublicKey(actor.PublicKey.PublicKeyPem)
+	key, _ := us.actorKey()
+	if err != nil || public.N.Cmp(key.N) != 0 {
+		t.Errorf("TestActorAndOutbox --> FAILED")
+	}
+	saved, _ := readAccount("testUser")
+	if saved.ActorKey != us.ActorKey {
+		t.Errorf("TestActorAndOutbox --> FAILED")
+	}
+
+	var outbox struct {
+		TotalItems   int
+		OrderedItems []struct {
+			Type   string
+			Object apNote
+		}
+	}
+	if getActivity(t, baseURL+"/users/testUser/outbox", outboxHandler, ps, &outbox) != 200 ||
+		outbox.TotalItems != 2 || outbox.OrderedItems[0].Type != "Create" {
+		t.Fatal("TestActorAndOutbox --> FAILED")
+	}
+	note := outbox.OrderedItems[0].Object
+	if note.ID != postURL("testUser", 2) || note.Tag[0].Name != "#go" || note.Attachment[0].MediaType != "image/jpeg" ||
+		!strings.HasPrefix(note.Content, "<p><strong>second</strong></p><p>two &lt;i&gt;<br>lines</p>") {
+		t.Errorf("TestActorAndOutbox --> FAILED")
+	}
+
+	// post pages are Notes for ActivityPub clients
+	var fetched apNote
+	if getActivity(t, postURL("testUser", 1), postHandler, append(ps, httprouter.Param{"id", "1"}), &fetched) != 200 ||
+		fetched.ID != postURL("testUser", 1) {
+		t.Errorf("TestActorAndOutbox --> FAILED")
+	}
+	us.Disabled = true
+	if getActivity(t, actorURL("testUser"), actorHandler, ps, &actor) != 404 {
+		t.Errorf("TestActorAndOutbox --> FAILED")
+	}
+}
+
+func TestInbox(t *testing.T) {
+	defer withFederation(t)()
+	remote := newFakeServer(t)
+	defer remote.Close()
+	us := &User{Username: "testUser", Password: "testPassword", ID: 1, Role: RoleAuthor}
+	users = append(users, us)
+	us.addPost(Post{Title: "first", Body: "one", Date: time.Now()})
+
+	follow := map[string]interface{}{"id": remote.URL + "/follows/1", "type": "Follow", "actor": remote.actor(), "object": actorURL("testUser")}
+	code, item := remote.send(t, "testUser", follow)
+	if code != http.StatusAccepted {
+		t.Fatal("TestInbox --> FAILED", code)
+	}
+	err := processInboxItem(item)
+	if err != nil || len(us.RemoteFollowers) != 1 || us.RemoteFollowers[0].Inbox != remote.URL+"/inbox" {
+		t.Fatal("TestInbox --> FAILED", err)
+	}
+
+	// the follow is accepted with a delivery signed by the user
+	deliverDue(time.Now())
+	if len(remote.received) != 1 || !strings.Contains(string(remote.bodies[0]), `"type":"Accept"`) {
+		t.Fatal("TestInbox --> FAILED")
+	}
+	key, _ := us.actorKey()
+	if verifyRequest(remote.received[0], remote.bodies[0], &key.PublicKey, time.Now()) != nil {
+		t.Errorf("TestInbox --> FAILED")
+	}
+
+	// new posts reach the follower
+	us.addPost(Post{Title: "second", Body: "two", Date: time.Now()})
+	us.deletePost(1)
+	deliverDue(time.Now())
+	all := string(bytes.Join(remote.bodies, nil))
+	if len(remote.received) != 3 || !strings.Contains(all, `"type":"Create"`) || !strings.Contains(all, `"type":"Tombstone"`) {
+		t.Errorf("TestInbox --> FAILED")
+	}
+
+	like := map[string]interface{}{"id": remote.URL + "/likes/1", "type": "Like", "actor": remote.actor(), "object": postURL("testUser", 2)}
+	_, item = remote.send(t, "testUser", like)
+	if processInboxItem(item) != nil || len(us.Posts[0].Likes) != 1 {
+		t.Errorf("TestInbox --> FAILED")
+	}
+	_, item = remote.send(t, "testUser", map[string]interface{}{"id": remote.URL + "/undo/1", "type": "Undo", "actor": remote.actor(), "object": like})
+	if processInboxItem(item) != nil || len(us.Posts[0].Likes) != 0 {
+		t.Errorf("TestInbox --> FAILED")
+	}
+
+	// activities must be signed by their actor
+	forged := map[string]interface{}{"id": "https://other.example/undo", "type": "Undo", "actor": "https://other.example/actor", "object": follow}
+	_, item = remote.send(t, "testUser", forged)
+	if processInboxItem(item) == nil || len(us.RemoteFollowers) != 1 {
+		t.Errorf("TestInbox --> FAILED")
+	}
+	_, item = remote.send(t, "testUser", map[string]interface{}{"id": remote.URL + "/undo/2", "type": "Undo", "actor": remote.actor(), "object": follow})
+	item.Body = bytes.Replace(item.Body, []byte("undo/2"), []byte("undo/3"), 1)
+	if processInboxItem(item) == nil || len(us.RemoteFollowers) != 1 {
+		t.Errorf("TestInbox --> FAILED")
+	}
+
+	_, item = remote.send(t, "testUser", map[string]interface{}{"id": remote.URL + "/undo/2", "type": "Undo", "actor": remote.actor(), "object": follow})
+	if processInboxItem(item) != nil || len(us.RemoteFollowers) != 0 {
+		t.Errorf("TestInbox --> FAILED")
+	}
+	saved, _ := readAccount("testUser")
+	if len(saved.RemoteFollowers) != 0 {
+		t.Errorf("TestInbox --> FAILED")
+	}
+
+	// the actor of the key must be on its server and own it
+	for _, keyID := range []string{remote.URL + "/impostor#main-key", remote.URL + "/thief#main-key"} {
+		remote.keyID = keyID
+		actor := "https://other.example/actor"
+		if strings.Contains(keyID, "thief") {
+			actor = remote.URL + "/thief"
+		}
+		_, item = remote.send(t, "testUser", map[string]interface{}{"id": remote.URL + "/likes/2", "type": "Like", "actor": actor, "object": postURL("testUser", 2)})
+		if processInboxItem(item) == nil || len(us.Posts[0].Likes) != 0 {
+			t.Errorf("TestInbox --> FAILED: %s", keyID)
+		}
+	}
+	remote.keyID = ""
+
+	// unsigned activities aren't taken
+	req := httptest.NewRequest("POST", baseURL+"/users/testUser/inbox", strings.NewReader("{}"))
+	w := httptest.NewRecorder()
+	inboxHandler(w, req, httprouter.Params{{"username", "testUser"}})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("TestInbox --> FAILED")
+	}
+}
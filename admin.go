@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/rand"
+	"html/template"
+	"math/big"
+	"net/http"
+	"strconv"
+
+	"src/github.com/asaskevich/govalidator"
+	"src/github.com/julienschmidt/httprouter"
+	"src/github.com/pkg/errors"
+)
+
+type adminPage struct {
+	Viewer *User
+	Users  []*User
+	User   *User
+	// a temporary password set by the administrator, shown once
+	NewPassword string
+	Roles       []string
+}
+
+func adminHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	usernameCookie, err := sessionCookie(r)
+	// the account could be deleted after requireRole let the request in
+	if err != nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	tpl, err := template.ParseFiles("templates/header.html", "templates/admin.html")
+	if err != nil {
+		panic(err)
+	}
+
+	err = tpl.ExecuteTemplate(w, "admin", adminPage{Viewer: getUser(usernameCookie.Value), Users: users, Roles: roles})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func adminUserHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	usernameCookie, err := sessionCookie(r)
+	if err != nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	us := getUser(ps.ByName("username"))
+	if us == nil {
+		http.NotFound(w, r)
+		return
+	}
+	tpl, err := parseTemplates("templates/header.html", "templates/adminUser.html")
+	if err != nil {
+		panic(err)
+	}
+
+	err = tpl.ExecuteTemplate(w, "adminUser", adminPage{Viewer: getUser(usernameCookie.Value), User: us, Roles: roles})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// adminTarget returns the account an admin action is applied to.
+// Administrators can't lock themselves out, so actions on the own
+// account are refused unless allowSelf is set.
+func adminTarget(w http.ResponseWriter, r *http.Request, ps httprouter.Params, allowSelf bool) *User {
+	usernameCookie, err := sessionCookie(r)
+	if err != nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return nil
+	}
+	us := getUser(ps.ByName("username"))
+	if us == nil {
+		http.NotFound(w, r)
+		return nil
+	}
+	if !allowSelf && us.Username == usernameCookie.Value {
+		http.Error(w, "You can't do it with your own account", http.StatusBadRequest)
+		return nil
+	}
+	return us
+}
+
+func adminDisableHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	us := adminTarget(w, r, ps, false)
+	if us == nil {
+		return
+	}
+	us.Disabled = true
+	err := us.refreshUserInfo()
+	if err != nil {
+		panic(err)
+	}
+	http.Redirect(w, r, "/admin", http.StatusFound)
+}
+
+func adminEnableHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	us := adminTarget(w, r, ps, false)
+	if us == nil {
+		return
+	}
+	us.Disabled = false
+	err := us.refreshUserInfo()
+	if err != nil {
+		panic(err)
+	}
+	// posts that came due meanwhile are published now
+	wakeScheduler()
+	http.Redirect(w, r, "/admin", http.StatusFound)
+}
+
+func adminRoleHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	us := adminTarget(w, r, ps, false)
+	if us == nil {
+		return
+	}
+	changed := *us
+	changed.Role = r.FormValue("role")
+	_, err := govalidator.ValidateStruct(changed)
+	if changed.Role == "" || err != nil {
+		http.Error(w, "Unknown role", http.StatusBadRequest)
+		return
+	}
+	us.Role = changed.Role
+	err = us.refreshUserInfo()
+	if err != nil {
+		panic(err)
+	}
+	http.Redirect(w, r, "/admin", http.StatusFound)
+}
+
+func adminPasswordHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	us := adminTarget(w, r, ps, true)
+	if us == nil {
+		return
+	}
+	password, err := randomPassword(12)
+	if err != nil {
+		panic(err)
+	}
+	usernameCookie, _ := sessionCookie(r)
+	us.Password = password
+	err = us.refreshUserInfo()
+	if err != nil {
+		panic(err)
+	}
+	// the new password ends the sessions of the account, the admin's own is issued again
+	if us.Username == usernameCookie.Value {
+		setSession(w, us)
+	}
+
+	tpl, err := parseTemplates("templates/header.html", "templates/adminUser.html")
+	if err != nil {
+		panic(err)
+	}
+
+	err = tpl.ExecuteTemplate(w, "adminUser", adminPage{
+		Viewer:      getUser(usernameCookie.Value),
+		User:        us,
+		NewPassword: password,
+		Roles:       roles,
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func adminDeletePostHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	us := adminTarget(w, r, ps, true)
+	if us == nil {
+		return
+	}
+	id, err := strconv.Atoi(ps.ByName("id"))
+	if err != nil || us.deletePost(id) != nil {
+		http.NotFound(w, r)
+		return
+	}
+	err = us.refreshUserInfo()
+	if err != nil {
+		panic(err)
+	}
+	http.Redirect(w, r, "/admin/users/"+us.Username, http.StatusFound)
+}
+
+// randomPassword returns an alphanumeric password passing User validation
+func randomPassword(n int) (string, error) {
+	const alphabet = "abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	buf := make([]byte, n)
+	for i := range buf {
+		k, err := rand.Int(rand.Reader, big.NewInt(int64(len(alphabet))))
+		if err != nil {
+			return "", errors.Wrap(err, "can't generate password")
+		}
+		buf[i] = alphabet[k.Int64()]
+	}
+	return string(buf), nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"src/github.com/julienschmidt/httprouter"
+)
+
+func adminRequest(url string) *http.Request {
+	req := httptest.NewRequest("POST", url, nil)
+	req.AddCookie(sessionFor("testAdmin"))
+	req.ParseForm()
+	return req
+}
+
+func TestAdminDisableEnableHandlers(t *testing.T) {
+	defer func() {
+		users = nil
+		os.Remove("data/accounts/testUser.txt")
+	}()
+	users = append(users, &User{Username: "testAdmin", Password: "testPassword", ID: 1, Role: RoleAdmin})
+	users = append(users, &User{Username: "testUser", Password: "testPassword", ID: 2, Role: RoleAuthor})
+
+	w := httptest.NewRecorder()
+	adminDisableHandler(w, adminRequest("http://127.0.0.1/admin/users/testUser/disable"),
+		httprouter.Params{{"username", "testUser"}})
+	if w.Result().StatusCode != 302 || !getUser("testUser").Disabled {
+		t.Errorf("TestAdminDisableEnableHandlers --> FAILED")
+	}
+	if tryToLogIn("testUser", "testPassword") != Disabled || tryToLogIn("testUser", "wrong") != WrongPassword {
+		t.Errorf("TestAdminDisableEnableHandlers --> FAILED")
+	}
+
+	w = httptest.NewRecorder()
+	adminEnableHandler(w, adminRequest("http://127.0.0.1/admin/users/testUser/enable"),
+		httprouter.Params{{"username", "testUser"}})
+	if w.Result().StatusCode != 302 || getUser("testUser").Disabled {
+		t.Errorf("TestAdminDisableEnableHandlers --> FAILED")
+	}
+
+	w = httptest.NewRecorder()
+	adminDisableHandler(w, adminRequest("http://127.0.0.1/admin/users/testAdmin/disable"),
+		httprouter.Params{{"username", "testAdmin"}})
+	if w.Result().StatusCode != 400 || getUser("testAdmin").Disabled {
+		t.Errorf("TestAdminDisableEnableHandlers --> FAILED")
+	}
+}
+
+func TestAdminRoleHandler(t *testing.T) {
+	defer func() {
+		users = nil
+		os.Remove("data/accounts/testUser.txt")
+	}()
+	users = append(users, &User{Username: "testAdmin", Password: "testPassword", ID: 1, Role: RoleAdmin})
+	users = append(users, &User{Username: "testUser", Password: "testPassword", ID: 2, Role: RoleAuthor})
+
+	req := adminRequest("http://127.0.0.1/admin/users/testUser/role")
+	req.Form.Set("role", "emperor")
+	w := httptest.NewRecorder()
+	adminRoleHandler(w, req, httprouter.Params{{"username", "testUser"}})
+	if w.Result().StatusCode != 400 || getUser("testUser").Role != RoleAuthor {
+		t.Errorf("TestAdminRoleHandler --> FAILED")
+	}
+
+	req.Form.Set("role", RoleModerator)
+	w = httptest.NewRecorder()
+	adminRoleHandler(w, req, httprouter.Params{{"username", "testUser"}})
+	if w.Result().StatusCode != 302 || getUser("testUser").Role != RoleModerator {
+		t.Errorf("TestAdminRoleHandler --> FAILED")
+	}
+}
+
+func TestAdminPasswordHandler(t *testing.T) {
+	defer func() {
+		users = nil
+		os.Remove("data/accounts/testUser.txt")
+	}()
+	users = append(users, &User{Username: "testAdmin", Password: "testPassword", ID: 1, Role: RoleAdmin})
+	users = append(users, &User{Username: "testUser", Password: "testPassword", ID: 2, Role: RoleAuthor})
+
+	w := httptest.NewRecorder()
+	adminPasswordHandler(w, adminRequest("http://127.0.0.1/admin/users/testUser/password"),
+		httprouter.Params{{"username", "testUser"}})
+
+	password := getUser("testUser").Password
+	if w.Result().StatusCode != 200 || password == "testPassword" || !strings.Contains(w.Body.String(), password) {
+		t.Errorf("TestAdminPasswordHandler --> FAILED")
+	}
+	if tryToLogIn("testUser", password) != Correct {
+		t.Errorf("TestAdminPasswordHandler --> FAILED")
+	}
+}
+
+func TestAdminDeletePostHandler(t *testing.T) {
+	defer func() {
+		users = nil
+		os.Remove("data/accounts/testUser.txt")
+	}()
+	users = append(users, &User{Username: "testAdmin", Password: "testPassword", ID: 1, Role: RoleAdmin})
+	users = append(users, &User{Username: "testUser", Password: "testPassword", ID: 2, Role: RoleAuthor})
+	us := getUser("testUser")
+	us.addPost(Post{Title: "first", Body: "body", Date: time.Now()})
+	us.addPost(Post{Title: "second", Body: "body", Date: time.Now()})
+
+	w := httptest.NewRecorder()
+	adminDeletePostHandler(w, adminRequest("http://127.0.0.1/admin/users/testUser/posts/1/delete"),
+		httprouter.Params{{"username", "testUser"}, {"id", "1"}})
+	if w.Result().StatusCode != 302 || us.PostCount != 1 || us.Posts[0].Title != "second" {
+		t.Errorf("TestAdminDeletePostHandler --> FAILED")
+	}
+
+	w = httptest.NewRecorder()
+	adminDeletePostHandler(w, adminRequest("http://127.0.0.1/admin/users/testUser/posts/1/delete"),
+		httprouter.Params{{"username", "testUser"}, {"id", "1"}})
+	if w.Result().StatusCode != 404 {
+		t.Errorf("TestAdminDeletePostHandler --> FAILED")
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	defer func() {
+		users = nil
+	}()
+	users = append(users, &User{Username: "testAdmin", Password: "testPassword", ID: 1, Role: RoleAdmin})
+	users = append(users, &User{Username: "testUser", Password: "testPassword", ID: 2, Role: RoleAuthor, PostCount: 7})
+	req := httptest.NewRequest("GET", "http://127.0.0.1/admin", nil)
+	req.AddCookie(sessionFor("testAdmin"))
+	w := httptest.NewRecorder()
+
+	adminHandler(w, req, nil)
+
+	if w.Result().StatusCode != 200 || !strings.Contains(w.Body.String(), "<td>7</td>") {
+		t.Errorf("TestAdminHandler --> FAILED")
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"src/github.com/asaskevich/govalidator"
+	"src/github.com/pkg/errors"
+)
+
+// backupVersion is the version of the archive layout
+const backupVersion = 1
+
+const manifestName = "manifest.json"
+
+// BackupManifest is the last file of a backup archive
+type BackupManifest struct {
+	Version       int
+	SchemaVersion int
+	Created       time.Time
+	Files         []BackupFile
+}
+
+// BackupFile is a file of the data directory, Path is relative to it
+type BackupFile struct {
+	Path   string
+	Size   int64
+	SHA256 string
+}
+
+// writeBackup archives the regular files of dir into a tar.gz at dst.
+// The caller holds storeMu and deliveryMu, so only media files are added
+// meanwhile, and they're written under a .tmp name that isn't archived.
+func writeBackup(dir, dst string) (BackupManifest, error) {
+	manifest := BackupManifest{Version: backupVersion, SchemaVersion: schemaVersion, Created: time.Now().UTC()}
+	err := os.MkdirAll(filepath.Dir(dst), 0700)
+	if err != nil {
+		return manifest, errors.Wrap(err, "can't create backup directory")
+	}
+	// a half written archive never takes the name of a backup
+	tmp := dst + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return manifest, errors.Wrap(err, "can't create backup")
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	err = filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		// data archives of users are copies that can be prepared again
+		if err == nil && info.IsDir() && file == filepath.Join(dir, "takeouts") {
+			return filepath.SkipDir
+		}
+		// sockets and such aren't data
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		// files being written, they appear under their names once complete
+		if filepath.Ext(file) == ".tmp" {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		err = tw.WriteHeader(&tar.Header{
+			Name:    "data/" + rel,
+			Mode:    0600,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+		if err != nil {
+			return err
+		}
+		src, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		sum := sha256.New()
+		n, err := io.Copy(tw, io.TeeReader(io.LimitReader(src, info.Size()), sum))
+		if err != nil {
+			return err
+		}
+		if n != info.Size() {
+			return errors.Errorf("%s changed while it was archived", file)
+		}
+		manifest.Files = append(manifest.Files, BackupFile{rel, n, hex.EncodeToString(sum.Sum(nil))})
+		return nil
+	})
+	if err != nil {
+		return manifest, errors.Wrap(err, "can't archive data")
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return manifest, errors.Wrap(err, "can't write manifest")
+	}
+	err = tw.WriteHeader(&tar.Header{Name: manifestName, Mode: 0600, Size: int64(len(data)), ModTime: manifest.Created})
+	if err == nil {
+		_, err = tw.Write(data)
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = f.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		return manifest, errors.Wrap(err, "can't write backup")
+	}
+	return manifest, nil
+}
+
+// extractBackup unpacks the archive at src into dir checking it against its manifest
+func extractBackup(src, dir string) (BackupManifest, error) {
+	var manifest BackupManifest
+	f, err := os.Open(src)
+	if err != nil {
+		return manifest, errors.Wrap(err, "can't open backup")
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return manifest, errors.Wrap(err, "not a backup archive")
+	}
+	tr := tar.NewReader(gz)
+
+	sums := make(map[string]BackupFile)
+	seenManifest := false
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return manifest, errors.Wrap(err, "broken backup archive")
+		}
+		if h.Name == manifestName {
+			err = json.NewDecoder(tr).Decode(&manifest)
+			if err != nil {
+				return manifest, errors.Wrap(err, "broken manifest")
+			}
+			seenManifest = true
+			continue
+		}
+		rel := strings.TrimPrefix(h.Name, "data/")
+		if rel == h.Name || path.Clean(rel) != rel || rel == ".." || strings.HasPrefix(rel, "../") ||
+			path.IsAbs(rel) || h.Typeflag != tar.TypeReg {
+			return manifest, errors.Errorf("unexpected entry %q in backup", h.Name)
+		}
+		file := filepath.Join(dir, filepath.FromSlash(rel))
+		err = os.MkdirAll(filepath.Dir(file), 0700)
+		if err != nil {
+			return manifest, errors.Wrap(err, "can't extract backup")
+		}
+		dst, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return manifest, errors.Wrap(err, "can't extract backup")
+		}
+		sum := sha256.New()
+		n, err := io.Copy(io.MultiWriter(dst, sum), tr)
+		dst.Close()
+		if err != nil {
+			return manifest, errors.Wrap(err, "can't extract backup")
+		}
+		sums[rel] = BackupFile{rel, n, hex.EncodeToString(sum.Sum(nil))}
+	}
+
+	if !seenManifest {
+		return manifest, errors.New("backup doesn't have a manifest")
+	}
+	if manifest.Version != backupVersion {
+		return manifest, errors.Errorf("backup version %d isn't supported", manifest.Version)
+	}
+	if manifest.SchemaVersion > schemaVersion {
+		return manifest, errors.Errorf("backup is made by a newer version of the blog, schema %d", manifest.SchemaVersion)
+	}
+	if len(manifest.Files) != len(sums) {
+		return manifest, errors.Errorf("backup has %d files, manifest lists %d", len(sums), len(manifest.Files))
+	}
+	for _, expected := range manifest.Files {
+		if sums[expected.Path] != expected {
+			return manifest, errors.Errorf("%s doesn't match the manifest", expected.Path)
+		}
+	}
+	return manifest, nil
+}
+
+// validateAccount checks the user and all of its posts
+func validateAccount(us User) error {
+	_, err := govalidator.ValidateStruct(us)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("user:%s ID:%v doesn't pass validation", us.Username, us.ID))
+	}
+	for _, p := range append(append([]Post(nil), us.Posts...), us.Drafts...) {
+		_, err = govalidator.ValidateStruct(p)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("user:%s ID:%v post %v doesn't pass validation", us.Username, us.ID, p.ID))
+		}
+	}
+	return nil
+}
+
+// checkAccounts validates account files in dir the way they are checked when loaded
+func checkAccounts(dir string) error {
+	files, err := ioutil.ReadDir(filepath.Join(dir, "accounts"))
+	if err != nil {
+		return errors.Wrap(err, "backup doesn't have accounts")
+	}
+	ids := make(map[int]string)
+	for _, file := range files {
+		data, err := ioutil.ReadFile(filepath.Join(dir, "accounts", file.Name()))
+		if err != nil {
+			return errors.Wrap(err, "can't read "+file.Name())
+		}
+		// backups of older versions are upgraded when the server loads them
+		data, _, err = migrateAccount(data)
+		if err != nil {
+			return errors.Wrap(err, file.Name())
+		}
+		var us User
+		err = json.Unmarshal(data, &us)
+		if err != nil {
+			return errors.Wrap(err, file.Name()+" isn't an account")
+		}
+		err = validateAccount(us)
+		if err != nil {
+			return err
+		}
+		if file.Name() != us.Username+".txt" {
+			return errors.Errorf("%s keeps the account of %s", file.Name(), us.Username)
+		}
+		if other, ok := ids[us.ID]; ok {
+			return errors.Errorf("%s and %s have the same ID %v", other, us.Username, us.ID)
+		}
+		ids[us.ID] = us.Username
+	}
+	return nil
+}
+
+// restoreBackup replaces dir with the content of the archive at src if it's
+// valid. The replaced directory is kept next to it and its name is returned.
+func restoreBackup(src, dir string) (string, error) {
+	tmp := dir + ".restore"
+	err := os.RemoveAll(tmp)
+	if err != nil {
+		return "", errors.Wrap(err, "can't clean up an earlier restore")
+	}
+	_, err = extractBackup(src, tmp)
+	if err == nil {
+		err = checkAccounts(tmp)
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+
+	old := dir + ".old-" + time.Now().UTC().Format("20060102-150405")
+	err = os.Rename(dir, old)
+	if os.IsNotExist(err) {
+		old, err = "", nil
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		return "", errors.Wrap(err, "can't move the current data away")
+	}
+	err = os.Rename(tmp, dir)
+	if err != nil {
+		return old, errors.Wrap(err, "can't put the restored data in place")
+	}
+	return old, nil
+}
+
+// backupPath is the file a backup is written to, the path is absolute
+// because the command may be run by the server in another directory
+func backupPath(args []string) (string, error) {
+	dst := filepath.Join("backups", "blog-"+time.Now().UTC().Format("20060102-150405")+".tar.gz")
+	if len(args) > 0 {
+		dst = args[0]
+	}
+	return filepath.Abs(dst)
+}
+
+func backupCommand(args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return errors.New(commandUsage)
+	}
+	// the delivery worker changes the queue without storeMu
+	deliveryMu.Lock()
+	manifest, err := writeBackup("data", args[0])
+	deliveryMu.Unlock()
+	if err != nil {
+		return err
+	}
+	var size int64
+	for _, f := range manifest.Files {
+		size += f.Size
+	}
+	fmt.Fprintf(out, "backed up %d files, %d bytes to %s\n", len(manifest.Files), size, args[0])
+	return nil
+}
+
+func restoreCommand(args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return errors.New(commandUsage)
+	}
+	old, err := restoreBackup(args[0], "data")
+	if err != nil {
+		return err
+	}
+	files, _ := ioutil.ReadDir("data/accounts")
+	names := make([]string, len(files))
+	for i, f := range files {
+		names[i] = strings.TrimSuffix(f.Name(), ".txt")
+	}
+	sort.Strings(names)
+	fmt.Fprintf(out, "restored %d accounts: %s\n", len(names), strings.Join(names, ", "))
+	if old != "" {
+		fmt.Fprintln(out, "the replaced data is in", old)
+	}
+	return nil
+}
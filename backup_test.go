@@ -0,0 +1,143 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testDataDir makes a data directory with one account and one media file
+func testDataDir(t *testing.T, root string) string {
+	dir := filepath.Join(root, "data")
+	os.MkdirAll(filepath.Join(dir, "accounts"), 0700)
+	os.MkdirAll(filepath.Join(dir, "media"), 0700)
+	us := User{Username: "testUser", Password: "testPassword", ID: 1, Role: RoleAuthor,
+		Posts: []Post{{ID: 1, Title: "title", Body: "body", Status: StatusPublished}}}
+	data, _ := json.Marshal(us)
+	err := ioutil.WriteFile(filepath.Join(dir, "accounts", "testUser.txt"), data, 0600)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dir, "media", "image.png"), testPNG(4, 4), 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// testArchive writes a tar.gz with the given files in that order
+func testArchive(t *testing.T, file string, names []string, contents [][]byte) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for i, name := range names {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(contents[i]))})
+		tw.Write(contents[i])
+	}
+	tw.Close()
+	gz.Close()
+	err := ioutil.WriteFile(file, buf.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestBackupRestore(t *testing.T) {
+	root, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	dir := testDataDir(t, root)
+	archive := filepath.Join(root, "backups", "test.tar.gz")
+	// prepared data archives and files being written aren't backed up
+	os.MkdirAll(filepath.Join(dir, "takeouts"), 0700)
+	ioutil.WriteFile(filepath.Join(dir, "takeouts", "testUser.zip"), []byte("zip"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "media", "other.png.123.tmp"), []byte("png"), 0600)
+
+	manifest, err := writeBackup(dir, archive)
+	if err != nil || len(manifest.Files) != 2 || manifest.SchemaVersion != schemaVersion {
+		t.Fatal("TestBackupRestore --> FAILED", err)
+	}
+	if info, err := os.Stat(archive); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("TestBackupRestore --> FAILED")
+	}
+
+	// changes after the backup are undone and kept aside
+	ioutil.WriteFile(filepath.Join(dir, "accounts", "other.txt"), []byte("{}"), 0600)
+	old, err := restoreBackup(archive, dir)
+	if err != nil || old == "" {
+		t.Fatal("TestBackupRestore --> FAILED", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "accounts", "other.txt")); !os.IsNotExist(err) {
+		t.Errorf("TestBackupRestore --> FAILED")
+	}
+	if _, err := os.Stat(filepath.Join(old, "accounts", "other.txt")); err != nil {
+		t.Errorf("TestBackupRestore --> FAILED")
+	}
+	restored, _ := ioutil.ReadFile(filepath.Join(dir, "media", "image.png"))
+	if !bytes.Equal(restored, testPNG(4, 4)) {
+		t.Errorf("TestBackupRestore --> FAILED")
+	}
+	if _, err := os.Stat(dir + ".restore"); !os.IsNotExist(err) {
+		t.Errorf("TestBackupRestore --> FAILED")
+	}
+}
+
+func TestRestoreChecksArchive(t *testing.T) {
+	root, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	dir := testDataDir(t, root)
+	archive := filepath.Join(root, "bad.tar.gz")
+	account, _ := ioutil.ReadFile(filepath.Join(dir, "accounts", "testUser.txt"))
+	manifest := func(files ...BackupFile) []byte {
+		data, _ := json.Marshal(BackupManifest{Version: backupVersion, SchemaVersion: schemaVersion, Files: files})
+		return data
+	}
+	invalid := []byte(`{"Username":"bad name!"}`)
+	good := BackupFile{"accounts/testUser.txt", int64(len(account)), sha256Hex(account)}
+
+	tests := []struct {
+		name     string
+		names    []string
+		contents [][]byte
+	}{
+		{"no manifest", []string{"data/accounts/testUser.txt"}, [][]byte{account}},
+		{"wrong checksum", []string{"data/accounts/testUser.txt", manifestName},
+			[][]byte{[]byte(strings.Replace(string(account), "body", "BODY", 1)), manifest(good)}},
+		{"unlisted file", []string{"data/accounts/testUser.txt", "data/extra", manifestName},
+			[][]byte{account, []byte("x"), manifest(good)}},
+		{"path outside data", []string{"data/../evil", manifestName}, [][]byte{[]byte("x"), manifest()}},
+		{"invalid account", []string{"data/accounts/testUser.txt", manifestName},
+			[][]byte{invalid, manifest(BackupFile{"accounts/testUser.txt", int64(len(invalid)), sha256Hex(invalid)})}},
+		{"newer schema", []string{manifestName}, [][]byte{[]byte(`{"Version":1,"SchemaVersion":99}`)}},
+	}
+	for _, test := range tests {
+		testArchive(t, archive, test.names, test.contents)
+		if _, err := restoreBackup(archive, dir); err == nil {
+			t.Errorf("TestRestoreChecksArchive --> FAILED: %s", test.name)
+		}
+		// live data isn't touched
+		if data, _ := ioutil.ReadFile(filepath.Join(dir, "accounts", "testUser.txt")); !bytes.Equal(data, account) {
+			t.Errorf("TestRestoreChecksArchive --> FAILED: %s", test.name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "evil")); !os.IsNotExist(err) {
+		t.Errorf("TestRestoreChecksArchive --> FAILED")
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"src/github.com/asaskevich/govalidator"
+	"src/github.com/pkg/errors"
+)
+
+const commandUsage = `usage:
+  blog                                    start the server
+  blog export-static [-force] [dir]
+  blog user add [-role role] [-email email] <username> [password]
+  blog user list
+  blog user passwd <username> [password]
+  blog user disable|enable <username>
+  blog user delete <username>
+  blog post list <username>
+  blog post delete <username> <id>
+  blog import [-dry-run] [-timezone zone] <username> <export.xml|markdown dir>
+  blog backup [file.tar.gz]
+  blog restore <file.tar.gz>              the server has to be stopped
+  blog migrate [-dry-run]                 the server has to be stopped unless it's a dry run
+passwords are generated when they aren't given`
+
+// adminSocket is where the running server takes user, post, import and backup commands,
+// without it they would change or read account files under the server's feet
+var adminSocket = "data/admin.sock"
+
+type adminReply struct {
+	Output string
+	Error  string
+}
+
+// command runs the subcommand in args. User, post, import, backup and
+// export-static commands are sent to the running server if there is one
+// and are run on data/accounts otherwise.
+func command(args []string, out io.Writer) error {
+	switch args[0] {
+	case "user", "post", "import", "backup", "export-static":
+		// paths are resolved here since the server may run in another directory
+		switch {
+		case args[0] == "backup":
+			dst, err := backupPath(args[1:])
+			if err != nil {
+				return err
+			}
+			args = []string{"backup", dst}
+		case args[0] == "export-static":
+			var err error
+			args, err = exportStaticArgs(args)
+			if err != nil {
+				return err
+			}
+		case args[0] == "import" && len(args) > 2:
+			src, err := filepath.Abs(args[len(args)-1])
+			if err != nil {
+				return err
+			}
+			args = append(args[:len(args)-1:len(args)-1], src)
+		}
+		conn, err := net.Dial("unix", adminSocket)
+		if err == nil {
+			defer conn.Close()
+			return remoteCommand(conn, args, out)
+		}
+		if args[0] == "backup" {
+			return runCommand(args, out)
+		}
+		err = loadUsers()
+		if err != nil {
+			return err
+		}
+		return runCommand(args, out)
+	case "restore":
+		conn, err := net.Dial("unix", adminSocket)
+		if err == nil {
+			conn.Close()
+			return errors.New("the server is running, stop it before restoring")
+		}
+		return restoreCommand(args[1:], out)
+	case "migrate":
+		conn, err := net.Dial("unix", adminSocket)
+		running := err == nil
+		if running {
+			conn.Close()
+		}
+		return migrateCommand(args[1:], running, out)
+	case "help", "-h", "-help", "--help":
+		fmt.Fprintln(out, commandUsage)
+		return nil
+	}
+	return errors.Errorf("unknown command %q\n%s", args[0], commandUsage)
+}
+
+func remoteCommand(conn net.Conn, args []string, out io.Writer) error {
+	err := json.NewEncoder(conn).Encode(args)
+	if err != nil {
+		return errors.Wrap(err, "can't send the command to the server")
+	}
+	var reply adminReply
+	err = json.NewDecoder(conn).Decode(&reply)
+	if err != nil {
+		return errors.Wrap(err, "can't read the answer of the server")
+	}
+	io.WriteString(out, reply.Output)
+	if reply.Error != "" {
+		return errors.New(reply.Error)
+	}
+	return nil
+}
+
+// serveAdminSocket listens for commands on path, they are run one at a time
+// along with requests. Only the owner of the server can connect.
+func serveAdminSocket(path string) error {
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return errors.Errorf("%s is used by another server", path)
+	}
+	// left by a server that was killed
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return errors.Wrap(err, "can't listen on the admin socket")
+	}
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		l.Close()
+		return errors.Wrap(err, "can't protect the admin socket")
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			go handleAdminConn(conn)
+		}
+	}()
+	return nil
+}
+
+func handleAdminConn(conn net.Conn) {
+	defer conn.Close()
+	var args []string
+	err := json.NewDecoder(conn).Decode(&args)
+	if err != nil || len(args) == 0 {
+		json.NewEncoder(conn).Encode(adminReply{Error: "a command is expected"})
+		return
+	}
+	// arguments after the command name may be passwords
+	fmt.Println("admin command:", strings.Join(args[:minInt(2, len(args))], " "))
+
+	var out bytes.Buffer
+	storeMu.Lock()
+	err = runCommand(args, &out)
+	storeMu.Unlock()
+	reply := adminReply{Output: out.String()}
+	if err != nil {
+		reply.Error = err.Error()
+	}
+	json.NewEncoder(conn).Encode(reply)
+}
+
+// runCommand runs a user, post, import, backup or export-static command on the loaded users
+func runCommand(args []string, out io.Writer) error {
+	if len(args) > 0 && args[0] == "backup" {
+		return backupCommand(args[1:], out)
+	}
+	if len(args) > 0 && args[0] == "import" {
+		return importCommand(args[1:], out)
+	}
+	if len(args) > 0 && args[0] == "export-static" {
+		return exportStaticCommand(args[1:], out)
+	}
+	if len(args) < 2 {
+		return errors.New(commandUsage)
+	}
+	name, args := args[0]+" "+args[1], args[2:]
+	switch name {
+	case "user add":
+		return userAddCommand(args, out)
+	case "user list":
+		return userListCommand(out)
+	case "post list":
+		if len(args) != 1 {
+			return errors.New(commandUsage)
+		}
+		us := getUser(args[0])
+		if us == nil {
+			return errors.Errorf("user %s doesn't exist", args[0])
+		}
+		return postListCommand(us, out)
+	}
+
+	if len(args) < 1 {
+		return errors.New(commandUsage)
+	}
+	us := getUser(args[0])
+	if us == nil {
+		return errors.Errorf("user %s doesn't exist", args[0])
+	}
+	switch name {
+	case "user passwd":
+		password, err := commandPassword(args[1:], out)
+		if err != nil {
+			return err
+		}
+		changed := *us
+		changed.Password = password
+		_, err = govalidator.ValidateStruct(changed)
+		if err != nil {
+			return errors.Wrap(err, "invalid password")
+		}
+		us.Password = password
+	case "user disable":
+		us.Disabled = true
+	case "user enable":
+		us.Disabled = false
+		wakeScheduler()
+	case "user delete":
+		return deleteUser(us)
+	case "post delete":
+		if len(args) != 2 {
+			return errors.New(commandUsage)
+		}
+		id, err := strconv.Atoi(args[1])
+		if err != nil {
+			return errors.Errorf("%q isn't a post ID", args[1])
+		}
+		if us.deletePost(id) != nil && us.deleteDraft(id) != nil {
+			return errors.Errorf("user %s doesn't have a post with ID %v", us.Username, id)
+		}
+	default:
+		return errors.Errorf("unknown command %q\n%s", name, commandUsage)
+	}
+	return us.refreshUserInfo()
+}
+
+// commandPassword is the password in args or a generated one that is printed
+func commandPassword(args []string, out io.Writer) (string, error) {
+	if len(args) > 0 {
+		return args[0], nil
+	}
+	password, err := randomPassword(12)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintln(out, "password:", password)
+	return password, nil
+}
+
+func userAddCommand(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("user add", flag.ContinueOnError)
+	flags.SetOutput(out)
+	role := flags.String("role", RoleAuthor, "admin, moderator, author or reader")
+	email := flags.String("email", "", "address for password resets")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() < 1 {
+		return errors.New(commandUsage)
+	}
+	username := flags.Arg(0)
+	if UsernameExists(username) {
+		return errors.Errorf("user %s already exists", username)
+	}
+	if *email != "" && (!govalidator.IsEmail(*email) || getUserByEmail(*email) != nil) {
+		return errors.Errorf("email %s is invalid or taken", *email)
+	}
+	password, err := commandPassword(flags.Args()[1:], out)
+	if err != nil {
+		return err
+	}
+
+	err = addUserToUsers(username, password)
+	if err != nil {
+		return err
+	}
+	us := getUser(username)
+	us.Role, us.Email = *role, *email
+	err = us.refreshUserInfo()
+	if err != nil {
+		users = users[:len(users)-1]
+		return err
+	}
+	setID()
+	fmt.Fprintf(out, "added %s with ID %v\n", us.Username, us.ID)
+	return nil
+}
+
+func userListCommand(out io.Writer) error {
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tUSERNAME\tROLE\tSTATUS\tPOSTS\tEMAIL")
+	for _, us := range usersPage(0, len(users)) {
+		status := "active"
+		if us.Disabled {
+			status = "disabled"
+		}
+		fmt.Fprintf(tw, "%v\t%s\t%s\t%s\t%v\t%s\n", us.ID, us.Username, us.Role, status, us.PostCount, us.Email)
+	}
+	return tw.Flush()
+}
+
+func postListCommand(us *User, out io.Writer) error {
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSTATUS\tDATE\tCOMMENTS\tTITLE")
+	for _, posts := range [][]Post{us.Drafts, us.Posts} {
+		for _, p := range posts {
+			status := p.Status
+			if status == "" {
+				status = StatusPublished
+			}
+			date := p.Date
+			if p.Status == StatusScheduled {
+				date = p.PublishAt
+			}
+			fmt.Fprintf(tw, "%v\t%s\t%s\t%v\t%s\n", p.ID, status, date.Format("2006-01-02 15:04"), len(p.Comments), p.Title)
+		}
+	}
+	return tw.Flush()
+}
+
+// deleteUser removes the account with its posts and its comments on posts
+// of others, others stop following it. Sessions of the account end with it.
+func deleteUser(us *User) error {
+	err := os.Remove("data/accounts/" + us.Username + ".txt")
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "can't remove the account file")
+	}
+	for i, u := range users {
+		if u == us {
+			users = append(users[:i], users[i+1:]...)
+			break
+		}
+	}
+	for _, p := range us.Posts {
+		postIndex.delete(us.Username, p.ID)
+	}
+	// the archive would go to whoever registers the name next
+	err = removeTakeout(us.Username)
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		changed := u.IsFollowing(us.Username)
+		if changed {
+			u.unfollow(us.Username)
+		}
+		for i := range u.Posts {
+			if u.Posts[i].deleteCommentsBy(us.Username) {
+				changed = true
+			}
+		}
+		if changed {
+			err = u.refreshUserInfo()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
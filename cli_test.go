@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readAccount(username string) (User, error) {
+	var us User
+	data, err := ioutil.ReadFile("data/accounts/" + username + ".txt")
+	if err == nil {
+		err = json.Unmarshal(data, &us)
+	}
+	return us, err
+}
+
+func TestUserCommands(t *testing.T) {
+	oldID := ID
+	defer func() {
+		users = nil
+		ID = oldID
+		os.Remove("data/accounts/testUser.txt")
+		os.Remove("data/accounts/testUser2.txt")
+		postIndex = newSearchIndex()
+	}()
+	var out bytes.Buffer
+
+	err := runCommand([]string{"user", "add", "-role", "moderator", "-email", "test@example.com", "testUser", "testPassword"}, &out)
+	saved, _ := readAccount("testUser")
+	if err != nil || saved.Role != RoleModerator || saved.Email != "test@example.com" || saved.Password != "testPassword" {
+		t.Errorf("TestUserCommands --> FAILED")
+	}
+	if runCommand([]string{"user", "add", "testUser"}, &out) == nil ||
+		runCommand([]string{"user", "add", "-role", "king", "testUser2"}, &out) == nil || len(users) != 1 {
+		t.Errorf("TestUserCommands --> FAILED")
+	}
+
+	out.Reset()
+	err = runCommand([]string{"user", "passwd", "testUser"}, &out)
+	saved, _ = readAccount("testUser")
+	if err != nil || !strings.HasPrefix(out.String(), "password: ") ||
+		strings.TrimSpace(strings.TrimPrefix(out.String(), "password: ")) != saved.Password {
+		t.Errorf("TestUserCommands --> FAILED")
+	}
+	if runCommand([]string{"user", "passwd", "testUser", "bad password!"}, &out) == nil {
+		t.Errorf("TestUserCommands --> FAILED")
+	}
+
+	err = runCommand([]string{"user", "disable", "testUser"}, &out)
+	saved, _ = readAccount("testUser")
+	if err != nil || !saved.Disabled {
+		t.Errorf("TestUserCommands --> FAILED")
+	}
+
+	out.Reset()
+	err = runCommand([]string{"user", "list"}, &out)
+	if err != nil || !strings.Contains(out.String(), "testUser") || !strings.Contains(out.String(), "disabled") {
+		t.Errorf("TestUserCommands --> FAILED")
+	}
+
+	runCommand([]string{"user", "add", "testUser2", "testPassword"}, &out)
+	getUser("testUser2").follow("testUser")
+	getUser("testUser2").addPost(Post{Title: "title", Body: "body", Date: time.Now().UTC()})
+	post := getUser("testUser2").getPost(1)
+	post.addComment(Comment{Author: "testUser", Body: "first"})
+	post.addComment(Comment{Author: "testUser2", Body: "reply", ParentID: 1})
+	post.addComment(Comment{Author: "testUser2", Body: "other"})
+	err = runCommand([]string{"user", "delete", "testUser"}, &out)
+	if _, statErr := os.Stat("data/accounts/testUser.txt"); err != nil || !os.IsNotExist(statErr) ||
+		getUser("testUser") != nil || getUser("testUser2").IsFollowing("testUser") {
+		t.Errorf("TestUserCommands --> FAILED")
+	}
+	if len(post.Comments) != 1 || post.Comments[0].Body != "other" {
+		t.Errorf("TestUserCommands --> FAILED")
+	}
+	if runCommand([]string{"user", "disable", "testUser"}, &out) == nil {
+		t.Errorf("TestUserCommands --> FAILED")
+	}
+}
+
+func TestUserIDsAfterDelete(t *testing.T) {
+	// accounts of the repository aren't loaded
+	dir, err := ioutil.TempDir("", "accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, _ := os.Getwd()
+	os.MkdirAll(filepath.Join(dir, "data/accounts"), 0700)
+	os.Chdir(dir)
+	oldID := ID
+	defer func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+		users = nil
+		ID = oldID
+		postIndex = newSearchIndex()
+	}()
+	users, ID = nil, 1
+	var out bytes.Buffer
+	for _, name := range []string{"testUser", "testUser2"} {
+		if err := runCommand([]string{"user", "add", name, "testPassword"}, &out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := runCommand([]string{"user", "delete", "testUser"}, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	// a restart loads the accounts again
+	users, ID = nil, 1
+	if err := loadUsers(); err != nil {
+		t.Fatal(err)
+	}
+	if err := runCommand([]string{"user", "add", "testUser3", "testPassword"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[int]bool)
+	for _, us := range users {
+		if seen[us.ID] {
+			t.Errorf("TestUserIDsAfterDelete --> FAILED: ID %d is taken twice", us.ID)
+		}
+		seen[us.ID] = true
+	}
+}
+
+func TestPostCommands(t *testing.T) {
+	defer func() {
+		users = nil
+		os.Remove("data/accounts/testUser.txt")
+	}()
+	us := &User{Username: "testUser", Password: "testPassword", ID: 1, Role: RoleAuthor}
+	users = append(users, us)
+	us.addPost(Post{Title: "published", Body: "body", Date: time.Now()})
+	us.addDraft(Post{Title: "draft", Body: "body"})
+
+	var out bytes.Buffer
+	err := runCommand([]string{"post", "list", "testUser"}, &out)
+	if err != nil || !strings.Contains(out.String(), "published") || !strings.Contains(out.String(), "draft") {
+		t.Errorf("TestPostCommands --> FAILED")
+	}
+
+	err = runCommand([]string{"post", "delete", "testUser", "1"}, &out)
+	saved, _ := readAccount("testUser")
+	if err != nil || len(saved.Posts) != 0 || len(saved.Drafts) != 1 {
+		t.Errorf("TestPostCommands --> FAILED")
+	}
+	err = runCommand([]string{"post", "delete", "testUser", "2"}, &out)
+	if err != nil || len(us.Drafts) != 0 {
+		t.Errorf("TestPostCommands --> FAILED")
+	}
+	if runCommand([]string{"post", "delete", "testUser", "2"}, &out) == nil ||
+		runCommand([]string{"post", "delete", "testUser", "x"}, &out) == nil {
+		t.Errorf("TestPostCommands --> FAILED")
+	}
+}
+
+func TestAdminSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		users = nil
+		os.RemoveAll(dir)
+	}()
+	users = append(users, &User{Username: "testUser", Password: "testPassword", ID: 1, Role: RoleAuthor})
+	path := filepath.Join(dir, "admin.sock")
+	err = serveAdminSocket(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("TestAdminSocket --> FAILED")
+	}
+	if serveAdminSocket(path) == nil {
+		t.Errorf("TestAdminSocket --> FAILED")
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	err = remoteCommand(conn, []string{"user", "list"}, &out)
+	conn.Close()
+	if err != nil || !strings.Contains(out.String(), "testUser") {
+		t.Errorf("TestAdminSocket --> FAILED")
+	}
+
+	conn, err = net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = remoteCommand(conn, []string{"user", "disable", "nobody"}, &out)
+	conn.Close()
+	if err == nil || !strings.Contains(err.Error(), "doesn't exist") {
+		t.Errorf("TestAdminSocket --> FAILED")
+	}
+	// the export reads users of the server instead of loading account files
+	public := filepath.Join(dir, "public")
+	conn, err = net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	err = remoteCommand(conn, []string{"export-static", public}, &out)
+	conn.Close()
+	if _, statErr := os.Stat(filepath.Join(public, "users", "testUser", "index.html")); err != nil || statErr != nil ||
+		!strings.Contains(out.String(), "Exported to "+public) {
+		t.Errorf("TestAdminSocket --> FAILED: %v", err)
+	}
+}
+
+func TestExportStaticArgs(t *testing.T) {
+	wd, _ := os.Getwd()
+	for _, c := range []struct{ args, want []string }{
+		{[]string{"export-static"}, []string{"export-static", filepath.Join(wd, "public")}},
+		{[]string{"export-static", "-force"}, []string{"export-static", "-force", filepath.Join(wd, "public")}},
+		{[]string{"export-static", "-force", "out"}, []string{"export-static", "-force", filepath.Join(wd, "out")}},
+		{[]string{"export-static", "/srv/blog"}, []string{"export-static", "/srv/blog"}},
+	} {
+		got, err := exportStaticArgs(c.args)
+		if err != nil || strings.Join(got, " ") != strings.Join(c.want, " ") {
+			t.Errorf("TestExportStaticArgs --> FAILED: %v", got)
+		}
+	}
+}
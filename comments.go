@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"src/github.com/asaskevich/govalidator"
+	"src/github.com/julienschmidt/httprouter"
+	"src/github.com/pkg/errors"
+)
+
+// Comment is stored inside its Post, so comments are saved
+// to the account file of the post's author together with posts
+type Comment struct {
+	ID int `valid:"-"`
+	// ParentID is the ID of the comment this one replies to, 0 for top level comments
+	ParentID int       `valid:"-"`
+	Author   string    `valid:"required"`
+	Body     string    `valid:"required, ascii, runelength(1|300)"`
+	Date     time.Time `valid:"-"`
+}
+
+// ThreadedComment is a comment placed in the thread for rendering
+type ThreadedComment struct {
+	Comment
+	Depth     int
+	CanDelete bool
+}
+
+func (p Post) CommentCount() int {
+	return len(p.Comments)
+}
+
+func (p *Post) getComment(id int) *Comment {
+	for i := range p.Comments {
+		if p.Comments[i].ID == id {
+			return &p.Comments[i]
+		}
+	}
+	return nil
+}
+
+func (p *Post) addComment(c Comment) error {
+	_, err := govalidator.ValidateStruct(c)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to add a comment to post ID:%v: "+
+			"it doesn't pass validation\n", p.ID))
+	}
+	if c.ParentID != 0 && p.getComment(c.ParentID) == nil {
+		return errors.Errorf("post ID:%v doesn't have a comment with ID %v to reply to", p.ID, c.ParentID)
+	}
+	p.LastCommentID++
+	c.ID = p.LastCommentID
+	p.Comments = append(p.Comments, c)
+	return nil
+}
+
+// deleteComment removes the comment together with all replies to it
+func (p *Post) deleteComment(id int) error {
+	if p.getComment(id) == nil {
+		return errors.Errorf("post ID:%v doesn't have a comment with ID %v", p.ID, id)
+	}
+	removed := map[int]bool{id: true}
+	// replies always come after the comment they answer
+	kept := p.Comments[:0]
+	for _, c := range p.Comments {
+		if removed[c.ID] || removed[c.ParentID] {
+			removed[c.ID] = true
+			continue
+		}
+		kept = append(kept, c)
+	}
+	p.Comments = kept
+	p.Changed = time.Now().UTC()
+	return nil
+}
+
+// deleteCommentsBy removes the comments of author the way deleteComment
+// does and tells whether there were any
+func (p *Post) deleteCommentsBy(author string) bool {
+	found := false
+	for _, c := range append([]Comment(nil), p.Comments...) {
+		// a reply could have gone with a comment removed before
+		if c.Author == author && p.getComment(c.ID) != nil {
+			p.deleteComment(c.ID)
+			found = true
+		}
+	}
+	return found
+}
+
+// thread orders comments depth-first so that replies follow their parent
+func (p Post) thread() []ThreadedComment {
+	children := make(map[int][]Comment)
+	for _, c := range p.Comments {
+		children[c.ParentID] = append(children[c.ParentID], c)
+	}
+	var result []ThreadedComment
+	var walk func(parent, depth int)
+	walk = func(parent, depth int) {
+		for _, c := range children[parent] {
+			result = append(result, ThreadedComment{Comment: c, Depth: depth})
+			walk(c.ID, depth+1)
+		}
+	}
+	walk(0, 0)
+	return result
+}
+
+// canDeleteComment tells whether viewer may remove c from a post of owner:
+// the post owner, the comment author and moderators can do it
+func canDeleteComment(viewer *User, owner string, c Comment) bool {
+	if viewer == nil {
+		return false
+	}
+	return viewer.Username == owner || viewer.Username == c.Author || viewer.HasRole(RoleAdmin, RoleModerator)
+}
+
+type postPage struct {
+	Owner    *User
+	Post     *Post
+	Viewer   *User
+	Comments []ThreadedComment
+	Invalid  bool
+}
+
+// findPost resolves the :username and :id parameters
+func findPost(ps httprouter.Params) (*User, *Post) {
+	us := getUser(ps.ByName("username"))
+	if us == nil {
+		return nil, nil
+	}
+	id, err := strconv.Atoi(ps.ByName("id"))
+	if err != nil {
+		return us, nil
+	}
+	return us, us.getPost(id)
+}
+
+func postHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if wantsActivity(r) {
+		noteHandler(w, r, ps)
+		return
+	}
+	w.Header().Add("Link", "<"+baseURL+"/webmention>; rel=\"webmention\"")
+	usernameCookie, err := sessionCookie(r)
+	if err == http.ErrNoCookie {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	us, post := findPost(ps)
+	if post == nil {
+		http.NotFound(w, r)
+		return
+	}
+	viewer := getUser(usernameCookie.Value)
+	page := postPage{Owner: us, Post: post, Viewer: viewer, Invalid: r.FormValue("invalid") != ""}
+	for _, c := range post.thread() {
+		c.CanDelete = canDeleteComment(viewer, us.Username, c.Comment)
+		page.Comments = append(page.Comments, c)
+	}
+	tpl, err := parseTemplates("templates/header.html", "templates/post.html")
+	if err != nil {
+		panic(err)
+	}
+
+	err = tpl.ExecuteTemplate(w, "post", page)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func newCommentHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	usernameCookie, err := sessionCookie(r)
+	if err == http.ErrNoCookie {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	us, post := findPost(ps)
+	if post == nil {
+		http.NotFound(w, r)
+		return
+	}
+	permalink := fmt.Sprintf("/users/%s/posts/%d", us.Username, post.ID)
+	parentID, _ := strconv.Atoi(r.FormValue("parent"))
+
+	err = post.addComment(Comment{
+		ParentID: parentID,
+		Author:   usernameCookie.Value,
+		Body:     r.FormValue("body"),
+		Date:     time.Now().UTC(),
+	})
+	if err != nil {
+		http.Redirect(w, r, permalink+"?invalid=1", http.StatusFound)
+		return
+	}
+	err = us.refreshUserInfo()
+	if err != nil {
+		panic(err)
+	}
+	http.Redirect(w, r, fmt.Sprintf("%s#comment%d", permalink, post.LastCommentID), http.StatusFound)
+}
+
+func deleteCommentHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	usernameCookie, err := sessionCookie(r)
+	if err == http.ErrNoCookie {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	us, post := findPost(ps)
+	if post == nil {
+		http.NotFound(w, r)
+		return
+	}
+	id, _ := strconv.Atoi(ps.ByName("cid"))
+	c := post.getComment(id)
+	if c == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !canDeleteComment(getUser(usernameCookie.Value), us.Username, *c) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	err = post.deleteComment(id)
+	if err != nil {
+		panic(err)
+	}
+	err = us.refreshUserInfo()
+	if err != nil {
+		panic(err)
+	}
+	http.Redirect(w, r, fmt.Sprintf("/users/%s/posts/%d", us.Username, post.ID), http.StatusFound)
+}
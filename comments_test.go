@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"src/github.com/julienschmidt/httprouter"
+)
+
+func TestAddComment(t *testing.T) {
+	post := Post{ID: 1, Title: "title", Body: "body", Date: time.Now()}
+
+	if post.addComment(Comment{Author: "testUser", Body: "first"}) != nil || post.Comments[0].ID != 1 {
+		t.Errorf("TestAddComment --> FAILED")
+	}
+	if post.addComment(Comment{Author: "testUser", Body: "reply", ParentID: 1}) != nil || post.CommentCount() != 2 {
+		t.Errorf("TestAddComment --> FAILED")
+	}
+	if post.addComment(Comment{Author: "testUser", Body: "reply to nothing", ParentID: 5}) == nil {
+		t.Errorf("TestAddComment --> FAILED")
+	}
+	if post.addComment(Comment{Author: "testUser", Body: ""}) == nil {
+		t.Errorf("TestAddComment --> FAILED")
+	}
+	if post.addComment(Comment{Author: "testUser", Body: "¡¡¡¡"}) == nil {
+		t.Errorf("TestAddComment --> FAILED")
+	}
+	if post.addComment(Comment{Author: "testUser", Body: strings.Repeat("a", 301)}) == nil {
+		t.Errorf("TestAddComment --> FAILED")
+	}
+	if post.addComment(Comment{Body: "anonymous"}) == nil {
+		t.Errorf("TestAddComment --> FAILED")
+	}
+}
+
+func TestCommentThread(t *testing.T) {
+	post := Post{ID: 1}
+	post.addComment(Comment{Author: "a", Body: "1"})
+	post.addComment(Comment{Author: "b", Body: "2"})
+	post.addComment(Comment{Author: "c", Body: "1.1", ParentID: 1})
+	post.addComment(Comment{Author: "d", Body: "1.1.1", ParentID: 3})
+	post.addComment(Comment{Author: "e", Body: "2.1", ParentID: 2})
+
+	var got []string
+	for _, c := range post.thread() {
+		got = append(got, strings.Repeat(">", c.Depth)+c.Body)
+	}
+	if strings.Join(got, " ") != "1 >1.1 >>1.1.1 2 >2.1" {
+		t.Errorf("TestCommentThread --> FAILED")
+	}
+
+	if post.deleteComment(3) != nil || post.CommentCount() != 3 || post.getComment(4) != nil {
+		t.Errorf("TestCommentThread --> FAILED")
+	}
+	if post.deleteComment(3) == nil {
+		t.Errorf("TestCommentThread --> FAILED")
+	}
+}
+
+func TestCanDeleteComment(t *testing.T) {
+	c := Comment{ID: 1, Author: "commenter", Body: "body"}
+	owner := &User{Username: "owner", Role: RoleAuthor}
+	commenter := &User{Username: "commenter", Role: RoleReader}
+	stranger := &User{Username: "stranger", Role: RoleAuthor}
+	moderator := &User{Username: "moderator", Role: RoleModerator}
+
+	if !canDeleteComment(owner, "owner", c) || !canDeleteComment(commenter, "owner", c) ||
+		canDeleteComment(stranger, "owner", c) || !canDeleteComment(moderator, "owner", c) ||
+		canDeleteComment(nil, "owner", c) {
+		t.Errorf("TestCanDeleteComment --> FAILED")
+	}
+}
+
+func TestNewCommentHandler(t *testing.T) {
+	defer func() {
+		users = nil
+		os.Remove("data/accounts/testUser.txt")
+	}()
+	users = append(users, &User{Username: "testUser", Password: "testPassword", ID: 1})
+	users = append(users, &User{Username: "testReader", Password: "testPassword", ID: 2, Role: RoleReader})
+	us := getUser("testUser")
+	us.addPost(Post{Title: "title", Body: "body", Date: time.Now()})
+	ps := httprouter.Params{{"username", "testUser"}, {"id", "1"}}
+
+	req := httptest.NewRequest("POST", "http://127.0.0.1/users/testUser/posts/1/comments", nil)
+	req.AddCookie(sessionFor("testReader"))
+	req.ParseForm()
+	req.Form.Set("body", "nice post")
+	w := httptest.NewRecorder()
+	newCommentHandler(w, req, ps)
+
+	l, _ := w.Result().Location()
+	if w.Result().StatusCode != 302 || l.Path != "/users/testUser/posts/1" || us.Posts[0].CommentCount() != 1 ||
+		us.Posts[0].Comments[0].Author != "testReader" {
+		t.Errorf("TestNewCommentHandler --> FAILED")
+	}
+
+	req.Form.Set("body", "¡¡¡¡")
+	w = httptest.NewRecorder()
+	newCommentHandler(w, req, ps)
+	l, _ = w.Result().Location()
+	if l.Query().Get("invalid") == "" || us.Posts[0].CommentCount() != 1 {
+		t.Errorf("TestNewCommentHandler --> FAILED")
+	}
+
+	w = httptest.NewRecorder()
+	newCommentHandler(w, req, httprouter.Params{{"username", "testUser"}, {"id", "2"}})
+	if w.Result().StatusCode != 404 {
+		t.Errorf("TestNewCommentHandler --> FAILED")
+	}
+}
+
+func TestDeleteCommentHandler(t *testing.T) {
+	defer func() {
+		users = nil
+		os.Remove("data/accounts/testUser.txt")
+	}()
+	users = append(users, &User{Username: "testUser", Password: "testPassword", ID: 1, Role: RoleAuthor})
+	users = append(users, &User{Username: "stranger", Password: "testPassword", ID: 2, Role: RoleAuthor})
+	us := getUser("testUser")
+	us.addPost(Post{Title: "title", Body: "body", Date: time.Now()})
+	us.Posts[0].addComment(Comment{Author: "someone", Body: "spam"})
+	ps := httprouter.Params{{"username", "testUser"}, {"id", "1"}, {"cid", "1"}}
+
+	for _, viewer := range []string{"stranger", "testUser"} {
+		req := httptest.NewRequest("POST", "http://127.0.0.1/users/testUser/posts/1/comments/1/delete", nil)
+		req.AddCookie(sessionFor(viewer))
+		w := httptest.NewRecorder()
+
+		deleteCommentHandler(w, req, ps)
+
+		if viewer == "stranger" && (w.Result().StatusCode != 403 || us.Posts[0].CommentCount() != 1) {
+			t.Errorf("TestDeleteCommentHandler --> FAILED")
+		}
+		if viewer == "testUser" && (w.Result().StatusCode != 302 || us.Posts[0].CommentCount() != 0) {
+			t.Errorf("TestDeleteCommentHandler --> FAILED")
+		}
+	}
+}
+
+func TestPostHandler(t *testing.T) {
+	defer func() {
+		users = nil
+	}()
+	users = append(users, &User{Username: "testUser", Password: "testPassword", ID: 1, Role: RoleAuthor})
+	us := getUser("testUser")
+	us.addPost(Post{Title: "title", Body: "body", Date: time.Now()})
+	us.Posts[0].addComment(Comment{Author: "someone", Body: "first comment"})
+	req := httptest.NewRequest("GET", "http://127.0.0.1/users/testUser/posts/1", nil)
+	req.AddCookie(sessionFor("testUser"))
+	w := httptest.NewRecorder()
+
+	postHandler(w, req, httprouter.Params{{"username", "testUser"}, {"id", "1"}})
+
+	body := w.Body.String()
+	if w.Result().StatusCode != 200 || !strings.Contains(body, "first comment") || !strings.Contains(body, "/comments/1/delete") {
+		t.Errorf("TestPostHandler --> FAILED")
+	}
+}
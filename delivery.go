@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"src/github.com/pkg/errors"
+)
+
+// deliveryDir keeps activities waiting to be delivered, one file each,
+// so deliveries queued by commands run without the server aren't lost
+var deliveryDir = "data/deliveries"
+
+// delays between attempts, a delivery is dropped when they run out
+var retryDelays = []time.Duration{
+	time.Minute, 5 * time.Minute, 30 * time.Minute, 2 * time.Hour, 6 * time.Hour, 12 * time.Hour, 24 * time.Hour,
+}
+
+// allowPrivateAddresses lets federation requests reach loopback and private
+// networks. Addresses come from other servers, so it's only for tests.
+var allowPrivateAddresses = false
+
+var deliveryWake = make(chan struct{}, 1)
+
+// deliveryMu is held while the worker changes the queue,
+// backups take it to see the queue as it is
+var deliveryMu sync.Mutex
+
+// Delivery is an activity of a user on the way to a remote inbox
+type Delivery struct {
+	ID          string
+	Username    string
+	Inbox       string
+	Activity    json.RawMessage
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string
+}
+
+// federationClient is used for all requests to other servers
+var federationClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				ip := net.ParseIP(host)
+				if !allowPrivateAddresses && (ip == nil || ip.IsLoopback() || ip.IsPrivate() ||
+					ip.IsLinkLocalUnicast() || ip.IsUnspecified() || ip.IsMulticast()) {
+					return errors.Errorf("address %s isn't public", host)
+				}
+				return nil
+			},
+		}).DialContext,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 3 {
+			return errors.New("too many redirects")
+		}
+		return nil
+	},
+}
+
+func (d Delivery) path() string {
+	return filepath.Join(deliveryDir, d.ID+".json")
+}
+
+// save writes the delivery through a temporary file,
+// so the worker never reads a half written one
+func (d Delivery) save() error {
+	err := os.MkdirAll(deliveryDir, 0700)
+	if err != nil {
+		return errors.Wrap(err, "can't create delivery directory")
+	}
+	data, err := json.Marshal(d)
+	if err != nil {
+		return errors.Wrap(err, "can't encode delivery")
+	}
+	tmp := d.path() + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err == nil {
+		err = os.Rename(tmp, d.path())
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "can't save delivery")
+	}
+	return nil
+}
+
+// enqueueDelivery queues the activity of the user for the inbox
+func enqueueDelivery(username, inbox string, activity []byte) error {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return errors.Wrap(err, "can't make delivery ID")
+	}
+	d := Delivery{
+		ID:          time.Now().UTC().Format("20060102150405") + "-" + hex.EncodeToString(id),
+		Username:    username,
+		Inbox:       inbox,
+		Activity:    activity,
+		NextAttempt: time.Now(),
+	}
+	err = d.save()
+	if err != nil {
+		return err
+	}
+	wakeDeliveries()
+	return nil
+}
+
+// queuedDeliveries reads the queue, broken files are skipped
+func queuedDeliveries() ([]Delivery, error) {
+	files, err := ioutil.ReadDir(deliveryDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "can't read deliveries")
+	}
+	var deliveries []Delivery
+	for _, file := range files {
+		if filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(deliveryDir, file.Name()))
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		var d Delivery
+		err = json.Unmarshal(data, &d)
+		if err != nil || d.ID+".json" != file.Name() {
+			log.Println("broken delivery", file.Name(), err)
+			continue
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, nil
+}
+
+// deliveryError is a failed delivery, permanent ones aren't retried
+type deliveryError struct {
+	error
+	permanent bool
+}
+
+// deliver posts the activity signed by the user's key
+func deliver(d Delivery) error {
+	err := makeActorKey(d.Username)
+	if err != nil {
+		return deliveryError{err, false}
+	}
+	storeMu.Lock()
+	us := getUser(d.Username)
+	var key *rsa.PrivateKey
+	if us != nil {
+		key, err = us.actorKey()
+	}
+	storeMu.Unlock()
+	if us == nil {
+		return deliveryError{errors.Errorf("user %s doesn't exist", d.Username), true}
+	}
+	if err != nil {
+		return deliveryError{err, false}
+	}
+
+	req, err := http.NewRequest("POST", d.Inbox, bytes.NewReader(d.Activity))
+	if err != nil {
+		return deliveryError{err, true}
+	}
+	req.Header.Set("Content-Type", activityContentType)
+	req.Header.Set("User-Agent", federationUserAgent)
+	err = signRequest(req, keyURL(d.Username), key, d.Activity)
+	if err != nil {
+		return deliveryError{err, false}
+	}
+	resp, err := federationClient.Do(req)
+	if err != nil {
+		return deliveryError{err, false}
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16))
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	// the inbox won't take it however many times it's sent
+	case resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusRequestTimeout:
+		return deliveryError{errors.Errorf("%s answered %s", d.Inbox, resp.Status), true}
+	}
+	return deliveryError{errors.Errorf("%s answered %s", d.Inbox, resp.Status), false}
+}
+
+// deliverDue attempts the deliveries whose time has come and returns
+// the time of the next attempt, zero when the queue is empty
+func deliverDue(now time.Time) time.Time {
+	deliveries, err := queuedDeliveries()
+	if err != nil {
+		log.Println(err)
+	}
+	var next time.Time
+	for _, d := range deliveries {
+		if d.NextAttempt.After(now) {
+			if next.IsZero() || d.NextAttempt.Before(next) {
+				next = d.NextAttempt
+			}
+			continue
+		}
+		err := deliver(d)
+		deliveryMu.Lock()
+		if err == nil {
+			os.Remove(d.path())
+			deliveryMu.Unlock()
+			continue
+		}
+		d.Attempts++
+		d.LastError = err.Error()
+		de, ok := err.(deliveryError)
+		if ok && de.permanent || d.Attempts > len(retryDelays) {
+			log.Printf("delivery %s to %s dropped after %d attempts: %v", d.ID, d.Inbox, d.Attempts, err)
+			os.Remove(d.path())
+			deliveryMu.Unlock()
+			continue
+		}
+		d.NextAttempt = now.Add(retryDelays[d.Attempts-1])
+		err = d.save()
+		deliveryMu.Unlock()
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if next.IsZero() || d.NextAttempt.Before(next) {
+			next = d.NextAttempt
+		}
+	}
+	return next
+}
+
+// startDelivery sends queued activities in the background, the queue
+// left by the previous run is sent right after a restart
+func startDelivery() {
+	go func() {
+		for {
+			next := deliverDue(time.Now())
+
+			var timer *time.Timer
+			var fire <-chan time.Time
+			if !next.IsZero() {
+				timer = time.NewTimer(time.Until(next))
+				fire = timer.C
+			}
+			select {
+			case <-fire:
+			case <-deliveryWake:
+			}
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+	}()
+}
+
+func wakeDeliveries() {
+	select {
+	case deliveryWake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDeliverDue(t *testing.T) {
+	defer withFederation(t)()
+	remote := newFakeServer(t)
+	defer remote.Close()
+	users = append(users, &User{Username: "testUser", Password: "testPassword", ID: 1, Role: RoleAuthor})
+
+	remote.status = http.StatusInternalServerError
+	err := enqueueDelivery("testUser", remote.URL+"/inbox", []byte(`{"type":"Create"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	next := deliverDue(now)
+	queued, _ := queuedDeliveries()
+	if len(queued) != 1 || queued[0].Attempts != 1 || !next.Equal(now.Add(retryDelays[0])) || queued[0].LastError == "" {
+		t.Fatal("TestDeliverDue --> FAILED")
+	}
+	// it isn't retried before its time
+	deliverDue(now.Add(time.Second))
+	if len(remote.received) != 1 {
+		t.Errorf("TestDeliverDue --> FAILED")
+	}
+
+	remote.status = http.StatusAccepted
+	next = deliverDue(next)
+	queued, _ = queuedDeliveries()
+	if len(queued) != 0 || !next.IsZero() || len(remote.received) != 2 {
+		t.Errorf("TestDeliverDue --> FAILED")
+	}
+
+	// inboxes that are gone aren't tried again
+	remote.status = http.StatusGone
+	enqueueDelivery("testUser", remote.URL+"/inbox", []byte(`{"type":"Create"}`))
+	deliverDue(time.Now())
+	if queued, _ = queuedDeliveries(); len(queued) != 0 {
+		t.Errorf("TestDeliverDue --> FAILED")
+	}
+
+	// nor are deliveries that ran out of attempts
+	remote.status = http.StatusServiceUnavailable
+	d := Delivery{ID: "last", Username: "testUser", Inbox: remote.URL + "/inbox", Activity: []byte(`{}`), Attempts: len(retryDelays)}
+	d.save()
+	deliverDue(time.Now())
+	if _, err := os.Stat(d.path()); !os.IsNotExist(err) {
+		t.Errorf("TestDeliverDue --> FAILED")
+	}
+
+	// a key that can't be saved is tried again later
+	users = append(users, &User{Username: "brokenUser", Password: "testPassword", Role: RoleAuthor})
+	d = Delivery{ID: "broken", Username: "brokenUser", Inbox: remote.URL + "/inbox", Activity: []byte(`{}`)}
+	d.save()
+	deliverDue(time.Now())
+	if queued, _ = queuedDeliveries(); len(queued) != 1 || queued[0].Attempts != 1 {
+		t.Errorf("TestDeliverDue --> FAILED")
+	}
+}
+
+func TestFederationClientRefusesPrivateAddresses(t *testing.T) {
+	remote := newFakeServer(t)
+	defer remote.Close()
+	resp, err := federationClient.Get(remote.URL + "/actor")
+	if err == nil {
+		resp.Body.Close()
+		t.Errorf("TestFederationClientRefusesPrivateAddresses --> FAILED")
+	}
+}
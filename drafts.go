@@ -0,0 +1,333 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"src/github.com/asaskevich/govalidator"
+	"src/github.com/julienschmidt/httprouter"
+	"src/github.com/pkg/errors"
+)
+
+const (
+	StatusDraft     = "draft"
+	StatusScheduled = "scheduled"
+	StatusPublished = "published"
+)
+
+// format of datetime-local inputs
+const publishAtFormat = "2006-01-02T15:04"
+
+// storeMu guards users, which requests, the scheduler and the other
+// workers change. Handlers take it with locked or only around their use
+// of users, it's never held while a client is read from or written to.
+var storeMu sync.Mutex
+
+// schedulerWake makes the scheduler look at the schedule again
+var schedulerWake = make(chan struct{}, 1)
+
+// IsPublished tells whether the post can be seen by others,
+// posts saved before statuses were added don't have one
+func (p Post) IsPublished() bool {
+	return p.Status == "" || p.Status == StatusPublished
+}
+
+// addDraft saves a draft or a scheduled post, they are kept apart from
+// published posts and get IDs from the same sequence
+func (u *User) addDraft(post Post) error {
+	if post.Status == "" {
+		post.Status = StatusDraft
+	}
+	_, err := govalidator.ValidateStruct(post)
+	if err == nil {
+		err = checkTags(post.Tags)
+	}
+	if err == nil && post.IsPublished() {
+		err = errors.New("published posts aren't drafts")
+	}
+	if err == nil && post.Status == StatusScheduled && post.PublishAt.IsZero() {
+		err = errors.New("scheduled posts need a publishing time")
+	}
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("user:%s ID:%v failed to add a draft: "+
+			"it doesn't pass validation\n", u.Username, u.ID))
+	}
+	u.LastPostID++
+	post.ID = u.LastPostID
+	u.Drafts = appendPost(u.Drafts, post)
+	return nil
+}
+
+func (u *User) getDraft(id int) *Post {
+	for i := range u.Drafts {
+		if u.Drafts[i].ID == id {
+			return &u.Drafts[i]
+		}
+	}
+	return nil
+}
+
+func (u *User) deleteDraft(id int) error {
+	for i := range u.Drafts {
+		if u.Drafts[i].ID == id {
+			u.Drafts = append(u.Drafts[:i], u.Drafts[i+1:]...)
+			return nil
+		}
+	}
+	return errors.Errorf("user:%s ID:%v doesn't have a draft with ID %v", u.Username, u.ID, id)
+}
+
+// schedule makes the draft be published at the given time,
+// a zero time turns it back into a plain draft
+func (u *User) schedule(id int, at time.Time) error {
+	draft := u.getDraft(id)
+	if draft == nil {
+		return errors.Errorf("user:%s ID:%v doesn't have a draft with ID %v", u.Username, u.ID, id)
+	}
+	if at.IsZero() {
+		draft.Status, draft.PublishAt = StatusDraft, time.Time{}
+	} else {
+		draft.Status, draft.PublishAt = StatusScheduled, at.UTC()
+	}
+	return nil
+}
+
+// publishDraft moves the draft to posts dated with the given time
+func (u *User) publishDraft(id int, at time.Time) error {
+	draft := u.getDraft(id)
+	if draft == nil {
+		return errors.Errorf("user:%s ID:%v doesn't have a draft with ID %v", u.Username, u.ID, id)
+	}
+	post := *draft
+	post.Status, post.PublishAt, post.Date = StatusPublished, time.Time{}, at.UTC()
+	err := u.deleteDraft(id)
+	if err != nil {
+		return err
+	}
+	u.Posts = insertPost(u.Posts, post)
+	u.PostCount++
+	postIndex.add(u.Username, post)
+	u.federatePost("Create", post)
+	u.sendWebmentions(post)
+	return nil
+}
+
+// insertPost puts the post into posts sorted newest first. Scheduled posts
+// published after a downtime may be older than the latest ones.
+func insertPost(posts []Post, post Post) []Post {
+	i := 0
+	for i < len(posts) && posts[i].Date.After(post.Date) {
+		i++
+	}
+	posts = append(posts, Post{})
+	copy(posts[i+1:], posts[i:])
+	posts[i] = post
+	return posts
+}
+
+// publishDue publishes the scheduled posts whose time has come and returns
+// the time of the next scheduled one, zero when nothing else is scheduled.
+// Posts of disabled accounts stay scheduled until they are enabled again.
+func publishDue(now time.Time) time.Time {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	var next time.Time
+	for _, us := range users {
+		if us.Disabled {
+			continue
+		}
+		changed := false
+		// iterate over a copy since publishing removes drafts
+		for _, draft := range append([]Post(nil), us.Drafts...) {
+			if draft.Status != StatusScheduled {
+				continue
+			}
+			if draft.PublishAt.After(now) {
+				if next.IsZero() || draft.PublishAt.Before(next) {
+					next = draft.PublishAt
+				}
+				continue
+			}
+			err := us.publishDraft(draft.ID, draft.PublishAt)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			changed = true
+		}
+		if changed {
+			err := us.refreshUserInfo()
+			if err != nil {
+				log.Println(err)
+			}
+		}
+	}
+	return next
+}
+
+// startScheduler publishes scheduled posts in the background. The schedule
+// is read from the loaded users, so overdue posts are published right
+// after a restart.
+func startScheduler() {
+	go func() {
+		for {
+			next := publishDue(time.Now())
+
+			var timer *time.Timer
+			var fire <-chan time.Time
+			if !next.IsZero() {
+				timer = time.NewTimer(time.Until(next))
+				fire = timer.C
+			}
+			select {
+			case <-fire:
+			case <-schedulerWake:
+			}
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+	}()
+}
+
+func wakeScheduler() {
+	select {
+	case schedulerWake <- struct{}{}:
+	default:
+	}
+}
+
+// parsePublishAt reads a datetime-local value in the user's time zone,
+// only future times are accepted
+func parsePublishAt(s string, u *User, now time.Time) (time.Time, error) {
+	at, err := time.ParseInLocation(publishAtFormat, s, u.location())
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "invalid publishing time")
+	}
+	if !at.After(now) {
+		return time.Time{}, errors.Errorf("publishing time %v has passed", at)
+	}
+	return at.UTC(), nil
+}
+
+type draftsPage struct {
+	*User
+	Viewer  *User
+	Invalid bool
+}
+
+func draftsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	usernameCookie, err := sessionCookie(r)
+	if err == http.ErrNoCookie {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	if usernameCookie.Value != ps.ByName("username") {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	us := getUser(usernameCookie.Value)
+	tpl, err := parseTemplates("templates/header.html", "templates/drafts.html")
+	if err != nil {
+		panic(err)
+	}
+
+	err = tpl.ExecuteTemplate(w, "drafts", draftsPage{User: us, Viewer: us, Invalid: r.FormValue("invalid") != ""})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// findDraft resolves the :username and :id parameters for the owner of the draft
+func findDraft(w http.ResponseWriter, r *http.Request, ps httprouter.Params) (*User, *Post) {
+	usernameCookie, err := sessionCookie(r)
+	if err == http.ErrNoCookie {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return nil, nil
+	}
+	if usernameCookie.Value != ps.ByName("username") {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return nil, nil
+	}
+	us := getUser(usernameCookie.Value)
+	id, _ := strconv.Atoi(ps.ByName("id"))
+	draft := us.getDraft(id)
+	if draft == nil {
+		http.NotFound(w, r)
+		return nil, nil
+	}
+	return us, draft
+}
+
+// findOwnPost is findPost that also finds drafts, for their owner
+func findOwnPost(ps httprouter.Params) (*User, *Post) {
+	us, post := findPost(ps)
+	if post == nil && us != nil {
+		id, _ := strconv.Atoi(ps.ByName("id"))
+		post = us.getDraft(id)
+	}
+	return us, post
+}
+
+func publishDraftHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	us, draft := findDraft(w, r, ps)
+	if draft == nil {
+		return
+	}
+	id := draft.ID
+	err := us.publishDraft(id, time.Now())
+	if err != nil {
+		panic(err)
+	}
+	err = us.refreshUserInfo()
+	if err != nil {
+		panic(err)
+	}
+	http.Redirect(w, r, fmt.Sprintf("/users/%s/posts/%d", us.Username, id), http.StatusFound)
+}
+
+func scheduleDraftHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	us, draft := findDraft(w, r, ps)
+	if draft == nil {
+		return
+	}
+	var at time.Time
+	if r.FormValue("publishAt") != "" {
+		var err error
+		at, err = parsePublishAt(r.FormValue("publishAt"), us, time.Now())
+		if err != nil {
+			http.Redirect(w, r, "/users/"+us.Username+"/drafts?invalid=1", http.StatusFound)
+			return
+		}
+	}
+	err := us.schedule(draft.ID, at)
+	if err != nil {
+		panic(err)
+	}
+	err = us.refreshUserInfo()
+	if err != nil {
+		panic(err)
+	}
+	wakeScheduler()
+	http.Redirect(w, r, "/users/"+us.Username+"/drafts", http.StatusFound)
+}
+
+func deleteDraftHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	us, draft := findDraft(w, r, ps)
+	if draft == nil {
+		return
+	}
+	err := us.deleteDraft(draft.ID)
+	if err != nil {
+		panic(err)
+	}
+	err = us.refreshUserInfo()
+	if err != nil {
+		panic(err)
+	}
+	http.Redirect(w, r, "/users/"+us.Username+"/drafts", http.StatusFound)
+}
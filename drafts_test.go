@@ -0,0 +1,186 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"src/github.com/julienschmidt/httprouter"
+)
+
+func TestAddDraft(t *testing.T) {
+	us := User{Username: "testUser", Password: "testPassword", ID: 1}
+	us.addPost(Post{Title: "published", Body: "body", Date: time.Now().UTC()})
+
+	if us.addDraft(Post{Title: "draft", Body: "body"}) != nil || len(us.Drafts) != 1 ||
+		us.Drafts[0].ID != 2 || us.Drafts[0].Status != StatusDraft || us.PostCount != 1 {
+		t.Errorf("TestAddDraft --> FAILED")
+	}
+	if us.addDraft(Post{Title: "scheduled", Body: "body", Status: StatusScheduled}) == nil {
+		t.Errorf("TestAddDraft --> FAILED")
+	}
+	if us.addDraft(Post{Title: "wrong", Body: "body", Status: "hidden"}) == nil {
+		t.Errorf("TestAddDraft --> FAILED")
+	}
+	if us.getPost(2) != nil || us.getDraft(2) == nil {
+		t.Errorf("TestAddDraft --> FAILED")
+	}
+}
+
+func TestInsertPost(t *testing.T) {
+	date := time.Date(2018, 4, 5, 10, 0, 0, 0, time.UTC)
+	posts := []Post{{ID: 3, Date: date.Add(2 * time.Hour)}, {ID: 1, Date: date}}
+	posts = insertPost(posts, Post{ID: 2, Date: date.Add(time.Hour)})
+	posts = insertPost(posts, Post{ID: 4, Date: date.Add(3 * time.Hour)})
+	posts = insertPost(posts, Post{ID: 0, Date: date.Add(-time.Hour)})
+	for i, id := range []int{4, 3, 2, 1, 0} {
+		if posts[i].ID != id {
+			t.Errorf("TestInsertPost --> FAILED")
+		}
+	}
+}
+
+func TestPublishDue(t *testing.T) {
+	defer func() {
+		users = nil
+		os.Remove("data/accounts/testUser.txt")
+	}()
+	now := time.Date(2018, 4, 5, 10, 0, 0, 0, time.UTC)
+	users = append(users, &User{Username: "testUser", Password: "testPassword", ID: 1})
+	us := getUser("testUser")
+	us.addPost(Post{Title: "old", Body: "body", Date: now.Add(-time.Hour)})
+	us.addPost(Post{Title: "new", Body: "body", Date: now})
+	us.addDraft(Post{Title: "overdue", Body: "body", Status: StatusScheduled, PublishAt: now.Add(-30 * time.Minute)})
+	us.addDraft(Post{Title: "later", Body: "body", Status: StatusScheduled, PublishAt: now.Add(2 * time.Hour)})
+	us.addDraft(Post{Title: "soon", Body: "body", Status: StatusScheduled, PublishAt: now.Add(time.Hour)})
+	us.addDraft(Post{Title: "draft", Body: "body"})
+
+	next := publishDue(now)
+	if !next.Equal(now.Add(time.Hour)) || us.PostCount != 3 || len(us.Drafts) != 3 ||
+		us.Posts[1].Title != "overdue" || !us.Posts[1].Date.Equal(now.Add(-30*time.Minute)) ||
+		us.Posts[1].Status != StatusPublished || !us.Posts[1].PublishAt.IsZero() {
+		t.Errorf("TestPublishDue --> FAILED")
+	}
+	// the account file is saved, so a restart doesn't publish it again
+	if _, err := os.Stat("data/accounts/testUser.txt"); err != nil {
+		t.Errorf("TestPublishDue --> FAILED")
+	}
+
+	// posts of disabled accounts wait until they are enabled
+	us.Disabled = true
+	next = publishDue(now.Add(3 * time.Hour))
+	if !next.IsZero() || us.PostCount != 3 || len(us.Drafts) != 3 {
+		t.Errorf("TestPublishDue --> FAILED")
+	}
+	us.Disabled = false
+
+	next = publishDue(now.Add(3 * time.Hour))
+	if !next.IsZero() || us.PostCount != 5 || len(us.Drafts) != 1 || us.Posts[0].Title != "later" {
+		t.Errorf("TestPublishDue --> FAILED")
+	}
+}
+
+func TestParsePublishAt(t *testing.T) {
+	us := &User{TimeZone: "Europe/Moscow"}
+	now := time.Date(2018, 4, 5, 10, 0, 0, 0, time.UTC)
+	at, err := parsePublishAt("2018-04-05T14:30", us, now)
+	if err != nil || !at.Equal(time.Date(2018, 4, 5, 11, 30, 0, 0, time.UTC)) {
+		t.Errorf("TestParsePublishAt --> FAILED")
+	}
+	if _, err := parsePublishAt("2018-04-05T12:30", us, now); err == nil {
+		t.Errorf("TestParsePublishAt --> FAILED")
+	}
+	if _, err := parsePublishAt("tomorrow", us, now); err == nil {
+		t.Errorf("TestParsePublishAt --> FAILED")
+	}
+}
+
+func TestNewPostPostHandlerScheduled(t *testing.T) {
+	defer func() {
+		users = nil
+		os.Remove("data/accounts/testUser.txt")
+	}()
+	users = append(users, &User{Username: "testUser", Password: "testPassword", ID: 1})
+	req := httptest.NewRequest("POST", "http://127.0.0.1/users/testUser/newPost", nil)
+	req.AddCookie(sessionFor("testUser"))
+	req.ParseForm()
+	req.Form.Set("title", "title")
+	req.Form.Set("body", "body")
+	req.Form.Set("status", StatusScheduled)
+	req.Form.Set("publishAt", time.Now().Add(-time.Hour).Format(publishAtFormat))
+	w := httptest.NewRecorder()
+
+	newPostPostHandler(w, req, httprouter.Params{{"username", "testUser"}})
+	l, _ := w.Result().Location()
+	if l.Path != "/users/testUser/newPostInvalidSymbols" || len(getUser("testUser").Drafts) != 0 {
+		t.Errorf("TestNewPostPostHandlerScheduled --> FAILED")
+	}
+
+	req.Form.Set("publishAt", time.Now().Add(time.Hour).Format(publishAtFormat))
+	w = httptest.NewRecorder()
+	newPostPostHandler(w, req, httprouter.Params{{"username", "testUser"}})
+	l, _ = w.Result().Location()
+	us := getUser("testUser")
+	if l.Path != "/users/testUser/drafts" || len(us.Drafts) != 1 || us.PostCount != 0 ||
+		us.Drafts[0].Status != StatusScheduled || us.Drafts[0].PublishAt.IsZero() {
+		t.Errorf("TestNewPostPostHandlerScheduled --> FAILED")
+	}
+}
+
+func TestDraftsAreHidden(t *testing.T) {
+	defer func() {
+		users = nil
+	}()
+	users = append(users, &User{Username: "testUser", Password: "testPassword", ID: 1})
+	users = append(users, &User{Username: "AnotherTestUser", Password: "testPassword", ID: 2})
+	getUser("testUser").addDraft(Post{Title: "secret", Body: "body"})
+
+	req := httptest.NewRequest("GET", "http://127.0.0.1/users/testUser/posts/1", nil)
+	req.AddCookie(sessionFor("testUser"))
+	w := httptest.NewRecorder()
+	postHandler(w, req, httprouter.Params{{"username", "testUser"}, {"id", "1"}})
+	if w.Code != http.StatusNotFound {
+		t.Errorf("TestDraftsAreHidden --> FAILED")
+	}
+
+	req = httptest.NewRequest("GET", "http://127.0.0.1/users/testUser/drafts", nil)
+	req.AddCookie(sessionFor("AnotherTestUser"))
+	w = httptest.NewRecorder()
+	draftsHandler(w, req, httprouter.Params{{"username", "testUser"}})
+	if w.Code != http.StatusForbidden {
+		t.Errorf("TestDraftsAreHidden --> FAILED")
+	}
+
+	req = httptest.NewRequest("GET", "http://127.0.0.1/users/testUser/drafts", nil)
+	req.AddCookie(sessionFor("testUser"))
+	w = httptest.NewRecorder()
+	draftsHandler(w, req, httprouter.Params{{"username", "testUser"}})
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "secret") {
+		t.Errorf("TestDraftsAreHidden --> FAILED")
+	}
+}
+
+func TestPublishDraftHandler(t *testing.T) {
+	defer func() {
+		users = nil
+		os.Remove("data/accounts/testUser.txt")
+	}()
+	users = append(users, &User{Username: "testUser", Password: "testPassword", ID: 1})
+	us := getUser("testUser")
+	us.addDraft(Post{Title: "draft", Body: "body", Date: time.Now().Add(-time.Hour).UTC()})
+	req := httptest.NewRequest("POST", "http://127.0.0.1/users/testUser/drafts/1/publish", nil)
+	req.AddCookie(sessionFor("testUser"))
+	w := httptest.NewRecorder()
+
+	before := time.Now()
+	publishDraftHandler(w, req, httprouter.Params{{"username", "testUser"}, {"id", "1"}})
+
+	l, _ := w.Result().Location()
+	if l.Path != "/users/testUser/posts/1" || len(us.Drafts) != 0 || us.PostCount != 1 ||
+		us.Posts[0].Date.Before(before) {
+		t.Errorf("TestPublishDraftHandler --> FAILED")
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"src/github.com/pkg/errors"
+)
+
+// exportStateFile remembers what the last export wrote, it's kept in the output directory
+const exportStateFile = ".export.json"
+
+// staticFuncs replace template functions that make no sense in files:
+// "3 hours ago" would be wrong a day after the export
+var staticFuncs = template.FuncMap{
+	"ago": func(t time.Time) string { return localTime(t, nil) },
+}
+
+// links to pages and files of the site, "//host" links aren't ours
+var siteLinkPattern = regexp.MustCompile(`(href|src)="(/[^/"][^"]*|/)"`)
+
+// Modified is the time the post, its revisions, comments, likes or
+// mentions last changed
+func (p Post) Modified() time.Time {
+	modified := p.Date
+	for _, r := range p.Revisions {
+		if r.Date.After(modified) {
+			modified = r.Date
+		}
+	}
+	for _, c := range p.Comments {
+		if c.Date.After(modified) {
+			modified = c.Date
+		}
+	}
+	for _, m := range p.Mentions {
+		if m.Date.After(modified) {
+			modified = m.Date
+		}
+	}
+	if p.Changed.After(modified) {
+		modified = p.Changed
+	}
+	return modified
+}
+
+type exportState struct {
+	// Posts maps post pages to Modified of their posts when they were written
+	Posts map[string]time.Time
+	// Files are all files of the export, the ones not written again are removed
+	Files []string
+}
+
+// staticExport writes the public part of the site into Dir as plain files
+type staticExport struct {
+	Dir string
+	// Force renders post pages whose posts didn't change too,
+	// they show names and avatars of other users that could
+	Force   bool
+	Written int
+	Skipped int
+
+	tpl   *template.Template
+	old   exportState
+	state exportState
+	files map[string]bool
+}
+
+// staticPath turns a site link into the path of its file in the export
+func staticPath(link string) string {
+	fragment := ""
+	if i := strings.Index(link, "#"); i >= 0 {
+		link, fragment = link[:i], link[i:]
+	}
+	p := strings.Trim(link, "/")
+	switch {
+	case p == "" || p == "userList":
+		p = "index.html"
+	case !strings.Contains(path.Base(p), "."):
+		p += "/index.html"
+	}
+	return p + fragment
+}
+
+// relativeLinks rewrites site links of a page at the given path of the export
+// to relative ones, so the export can be opened from disk or put anywhere
+func relativeLinks(page []byte, name string) []byte {
+	prefix := strings.Repeat("../", strings.Count(name, "/"))
+	return siteLinkPattern.ReplaceAllFunc(page, func(m []byte) []byte {
+		sub := siteLinkPattern.FindSubmatch(m)
+		return []byte(fmt.Sprintf(`%s="%s%s"`, sub[1], prefix, staticPath(string(sub[2]))))
+	})
+}
+
+// write saves data at the given path of the export unless the file is the same already
+func (e *staticExport) write(name string, data []byte) error {
+	e.files[name] = true
+	file := filepath.Join(e.Dir, filepath.FromSlash(name))
+	if old, err := ioutil.ReadFile(file); err == nil && bytes.Equal(old, data) {
+		e.Skipped++
+		return nil
+	}
+	err := os.MkdirAll(filepath.Dir(file), 0755)
+	if err != nil {
+		return errors.Wrap(err, "can't create export directory")
+	}
+	err = ioutil.WriteFile(file, data, 0644)
+	if err != nil {
+		return errors.Wrap(err, "can't write "+name)
+	}
+	e.Written++
+	return nil
+}
+
+// keep marks a file of the previous export as still needed if it exists
+func (e *staticExport) keep(name string) bool {
+	if _, err := os.Stat(filepath.Join(e.Dir, filepath.FromSlash(name))); err != nil {
+		return false
+	}
+	e.files[name] = true
+	e.Skipped++
+	return true
+}
+
+func (e *staticExport) render(name, tplName string, data interface{}) error {
+	var buf bytes.Buffer
+	err := e.tpl.ExecuteTemplate(&buf, tplName, data)
+	if err != nil {
+		return errors.Wrap(err, "can't render "+name)
+	}
+	return e.write(name, relativeLinks(buf.Bytes(), name))
+}
+
+func (e *staticExport) copyFile(src, name string) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return errors.Wrap(err, "can't read "+src)
+	}
+	return e.write(name, data)
+}
+
+func (e *staticExport) exportUser(us *User) error {
+	all := Pagination{Page: 1, Pages: 1}
+	err := e.render("users/"+us.Username+"/index.html", "userPage", userPage{User: us, PagePosts: us.Posts, Pages: all})
+	if err != nil {
+		return err
+	}
+	// the user page links it
+	feed, err := userJSONFeed(us)
+	if err != nil {
+		return errors.Wrap(err, "can't encode the feed of "+us.Username)
+	}
+	err = e.write("users/"+us.Username+"/feed.json", feed)
+	if err != nil {
+		return err
+	}
+	for i := range us.Posts {
+		post := &us.Posts[i]
+		name := fmt.Sprintf("users/%s/posts/%d/index.html", us.Username, post.ID)
+		modified := post.Modified()
+		e.state.Posts[name] = modified
+		if e.Force || modified.After(e.old.Posts[name]) || !e.keep(name) {
+			err = e.render(name, "post", postPage{Owner: us, Post: post, Comments: post.thread()})
+			if err != nil {
+				return err
+			}
+		}
+		// uploaded images never change, so existing ones aren't read again
+		for _, img := range post.Images {
+			for _, file := range []string{img, thumbName(img)} {
+				if e.keep("media/" + file) {
+					continue
+				}
+				err = e.copyFile(filepath.Join(mediaDir, file), "media/"+file)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if us.Avatar != "" {
+		file := thumbName(us.Avatar)
+		if !e.keep("media/" + file) {
+			return e.copyFile(filepath.Join(mediaDir, file), "media/"+file)
+		}
+		return nil
+	}
+	var buf bytes.Buffer
+	err = png.Encode(&buf, newIdenticon(us.Username).Image())
+	if err != nil {
+		return errors.Wrap(err, "can't encode the avatar of "+us.Username)
+	}
+	return e.write("users/"+us.Username+"/avatar.png", buf.Bytes())
+}
+
+func (e *staticExport) exportTags() error {
+	seen := make(map[string]bool)
+	var tags []string
+	for _, us := range users {
+		if us.Disabled {
+			continue
+		}
+		for _, p := range us.Posts {
+			for _, tag := range p.Tags {
+				if !seen[tag] {
+					seen[tag] = true
+					tags = append(tags, tag)
+				}
+			}
+		}
+	}
+	sort.Strings(tags)
+	for _, tag := range tags {
+		entries := postsWithTag(tag)
+		err := e.render("tags/"+tag+"/index.html", "tag", tagPage{
+			Tag:     tag,
+			Entries: entries,
+			Total:   len(entries),
+			Pages:   Pagination{Page: 1, Pages: 1},
+		})
+		if err != nil {
+			return err
+		}
+		if len(entries) > feedSize {
+			entries = entries[:feedSize]
+		}
+		feed, err := rssXML("#"+tag, baseURL+"/tags/"+tag, "Posts tagged with "+tag, entries)
+		if err != nil {
+			return errors.Wrap(err, "can't render the feed of "+tag)
+		}
+		err = e.write("tags/"+tag+"/feed.xml", feed)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// run exports the member list, pages of users with their posts, tag pages
+// with feeds and images. Post pages whose posts didn't change since the
+// previous export into the same directory are left as they are, other
+// files are only rewritten when their content differs.
+func (e *staticExport) run() error {
+	var err error
+	e.tpl, err = template.New("").Funcs(templateFuncs).Funcs(staticFuncs).ParseFiles(
+		"templates/staticHeader.html", "templates/userList.html", "templates/userPage.html",
+		"templates/post.html", "templates/tag.html", "templates/pagination.html")
+	if err != nil {
+		return errors.Wrap(err, "can't parse templates")
+	}
+	e.files = make(map[string]bool)
+	e.state = exportState{Posts: make(map[string]time.Time)}
+	if data, err := ioutil.ReadFile(filepath.Join(e.Dir, exportStateFile)); err == nil {
+		err = json.Unmarshal(data, &e.old)
+		if err != nil {
+			return errors.Wrap(err, "can't read the previous export state")
+		}
+	}
+
+	// disabled accounts aren't public, like on the live site
+	var listed []*User
+	for _, us := range usersPage(0, len(users)) {
+		if !us.Disabled {
+			listed = append(listed, us)
+		}
+	}
+	err = e.render("index.html", "userList", userListPage{
+		Users: listed,
+		Total: len(listed),
+		Pages: Pagination{Page: 1, Pages: 1},
+	})
+	if err != nil {
+		return err
+	}
+	for _, us := range listed {
+		err = e.exportUser(us)
+		if err != nil {
+			return err
+		}
+	}
+	err = e.exportTags()
+	if err != nil {
+		return err
+	}
+	images, err := ioutil.ReadDir("images")
+	if err != nil {
+		return errors.Wrap(err, "can't read images")
+	}
+	for _, img := range images {
+		if img.IsDir() {
+			continue
+		}
+		err = e.copyFile(filepath.Join("images", img.Name()), "images/"+img.Name())
+		if err != nil {
+			return err
+		}
+	}
+
+	// files of deleted posts, users and tags
+	for _, name := range e.old.Files {
+		if e.files[name] {
+			continue
+		}
+		file := filepath.Join(e.Dir, filepath.FromSlash(name))
+		os.Remove(file)
+		// removes directories left empty, fails harmlessly on others
+		for dir := filepath.Dir(file); dir != filepath.Clean(e.Dir); dir = filepath.Dir(dir) {
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+	}
+	for name := range e.files {
+		e.state.Files = append(e.state.Files, name)
+	}
+	sort.Strings(e.state.Files)
+	data, err := json.MarshalIndent(e.state, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "can't save the export state")
+	}
+	err = ioutil.WriteFile(filepath.Join(e.Dir, exportStateFile), data, 0644)
+	if err != nil {
+		return errors.Wrap(err, "can't save the export state")
+	}
+	return nil
+}
+
+// exportStaticArgs gives the export-static command an absolute output
+// directory, "public" in the current one by default
+func exportStaticArgs(args []string) ([]string, error) {
+	dir := "public"
+	if n := len(args); n > 1 && !strings.HasPrefix(args[n-1], "-") {
+		dir, args = args[n-1], args[:n-1]
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't resolve "+dir)
+	}
+	return append(args[:len(args):len(args)], abs), nil
+}
+
+// exportStaticCommand is "export-static [-force] [dir]", it writes
+// a read-only copy of the blog to dir, "public" by default
+func exportStaticCommand(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("export-static", flag.ContinueOnError)
+	flags.SetOutput(out)
+	force := flags.Bool("force", false, "render all post pages even if their posts didn't change")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	e := staticExport{Dir: "public", Force: *force}
+	if flags.NArg() > 0 {
+		e.Dir = flags.Arg(0)
+	}
+	err = e.run()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Exported to %s: %d files written, %d unchanged\n", e.Dir, e.Written, e.Skipped)
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStaticPath(t *testing.T) {
+	tests := map[string]string{
+		"/":                           "index.html",
+		"/userList":                   "index.html",
+		"/users/alice/":               "users/alice/index.html",
+		"/users/alice/posts/3":        "users/alice/posts/3/index.html",
+		"/users/alice/avatar.png":     "users/alice/avatar.png",
+		"/tags/go":                    "tags/go/index.html",
+		"/tags/go/feed.xml":           "tags/go/feed.xml",
+		"/images/logotype.png":        "images/logotype.png",
+		"/users/bob/posts/1#comment2": "users/bob/posts/1/index.html#comment2",
+	}
+	for link, expected := range tests {
+		if staticPath(link) != expected {
+			t.Errorf("TestStaticPath --> FAILED")
+		}
+	}
+}
+
+func TestRelativeLinks(t *testing.T) {
+	page := `<a href="/users/bob/"><img src="/media/a.png"></a> <a href="//example.com/x"> <a href="http://example.com/">`
+	expected := `<a href="../../../../users/bob/index.html"><img src="../../../../media/a.png"></a> <a href="//example.com/x"> <a href="http://example.com/">`
+	if string(relativeLinks([]byte(page), "users/alice/posts/1/index.html")) != expected {
+		t.Errorf("TestRelativeLinks --> FAILED")
+	}
+	if string(relativeLinks([]byte(`<a href="/">`), "index.html")) != `<a href="index.html">` {
+		t.Errorf("TestRelativeLinks --> FAILED")
+	}
+}
+
+func TestPostModified(t *testing.T) {
+	date := time.Date(2018, 4, 5, 10, 0, 0, 0, time.UTC)
+	post := Post{Date: date}
+	if !post.Modified().Equal(date) {
+		t.Errorf("TestPostModified --> FAILED")
+	}
+	post.Revisions = []Revision{{Number: 1, Date: date}, {Number: 2, Date: date.Add(time.Hour)}}
+	post.Comments = []Comment{{ID: 1, Date: date.Add(30 * time.Minute)}}
+	if !post.Modified().Equal(date.Add(time.Hour)) {
+		t.Errorf("TestPostModified --> FAILED")
+	}
+	post.Mentions = []Mention{{Source: "https://other.example/a", Date: date.Add(2 * time.Hour)}}
+	if !post.Modified().Equal(date.Add(2 * time.Hour)) {
+		t.Errorf("TestPostModified --> FAILED")
+	}
+	post.removeMention("https://other.example/a")
+	if !post.Modified().After(date.Add(2 * time.Hour)) {
+		t.Errorf("TestPostModified --> FAILED")
+	}
+}
+
+func TestStaticExport(t *testing.T) {
+	defer func() {
+		users = nil
+	}()
+	addTaggedPosts()
+	dir, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	e := staticExport{Dir: dir}
+	err = e.run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"index.html", "users/alice/index.html", "users/alice/posts/1/index.html",
+		"users/bob/posts/1/index.html", "users/bob/avatar.png", "users/bob/feed.json", "tags/go/index.html", "tags/web/feed.xml",
+		"images/logotype.png", exportStateFile} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("TestStaticExport --> FAILED")
+		}
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "users/alice/posts/1/index.html"))
+	page := string(data)
+	if !strings.Contains(page, `href="../../../../tags/go/index.html"`) || strings.Contains(page, "<form") ||
+		strings.Contains(page, "logout") {
+		t.Errorf("TestStaticExport --> FAILED")
+	}
+
+	// nothing changed
+	e = staticExport{Dir: dir}
+	err = e.run()
+	if err != nil || e.Written != 0 {
+		t.Errorf("TestStaticExport --> FAILED")
+	}
+
+	// a new comment renders the page of its post again, a deleted post loses its page
+	alice := getUser("alice")
+	post := alice.getPost(1)
+	post.Comments = append(post.Comments, Comment{ID: 1, Author: "bob", Body: "nice one", Date: time.Now().UTC()})
+	alice.deletePost(2)
+	e = staticExport{Dir: dir}
+	err = e.run()
+	if err != nil || e.Written == 0 {
+		t.Errorf("TestStaticExport --> FAILED")
+	}
+	data, _ = ioutil.ReadFile(filepath.Join(dir, "users/alice/posts/1/index.html"))
+	if !strings.Contains(string(data), "nice one") {
+		t.Errorf("TestStaticExport --> FAILED")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "users/alice/posts/2")); !os.IsNotExist(err) {
+		t.Errorf("TestStaticExport --> FAILED")
+	}
+
+	// deleting the comment and a like leave no dates of their own
+	post = alice.getPost(1)
+	post.deleteComment(1)
+	post.addLike("https://remote.example/users/carol")
+	e = staticExport{Dir: dir}
+	err = e.run()
+	data, _ = ioutil.ReadFile(filepath.Join(dir, "users/alice/posts/1/index.html"))
+	if err != nil || e.Written == 0 || strings.Contains(string(data), "nice one") || !strings.Contains(string(data), "Liked 1 times") {
+		t.Errorf("TestStaticExport --> FAILED")
+	}
+	// disabled accounts and their tags leave the export
+	getUser("bob").Disabled = true
+	e = staticExport{Dir: dir}
+	err = e.run()
+	data, _ = ioutil.ReadFile(filepath.Join(dir, "index.html"))
+	if err != nil || strings.Contains(string(data), "bob") {
+		t.Errorf("TestStaticExport --> FAILED")
+	}
+	for _, name := range []string{"users/bob", "tags/web"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("TestStaticExport --> FAILED: %s", name)
+		}
+	}
+}
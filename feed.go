@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"src/github.com/julienschmidt/httprouter"
+)
+
+// number of posts in a feed
+const feedSize = 20
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string   `xml:"title"`
+	Link        string   `xml:"link"`
+	Description string   `xml:"description"`
+	Author      string   `xml:"author"`
+	Categories  []string `xml:"category"`
+	GUID        string   `xml:"guid"`
+	PubDate     string   `xml:"pubDate"`
+}
+
+func postURL(author string, id int) string {
+	return fmt.Sprintf("%s/users/%s/posts/%d", baseURL, author, id)
+}
+
+// rssXML renders entries as an RSS 2.0 channel
+func rssXML(title, link, description string, entries []TimelineEntry) ([]byte, error) {
+	feed := rssFeed{Version: "2.0", Channel: rssChannel{Title: title, Link: link, Description: description}}
+	for _, e := range entries {
+		url := postURL(e.Author, e.ID)
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			Title:       e.Title,
+			Link:        url,
+			Description: e.Body,
+			Author:      e.Author,
+			Categories:  e.Tags,
+			GUID:        url,
+			PubDate:     e.Date.Format(time.RFC1123Z),
+		})
+	}
+	if len(entries) > 0 {
+		feed.Channel.LastBuildDate = entries[0].Date.Format(time.RFC1123Z)
+	}
+	data, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
+
+func writeRSS(w http.ResponseWriter, title, link, description string, entries []TimelineEntry) {
+	data, err := rssXML(title, link, description, entries)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	w.Write(data)
+}
+
+// JSON Feed 1.1 (https://jsonfeed.org/version/1.1)
+type jsonFeed struct {
+	Version     string           `json:"version"`
+	Title       string           `json:"title"`
+	HomePageURL string           `json:"home_page_url"`
+	FeedURL     string           `json:"feed_url"`
+	Description string           `json:"description,omitempty"`
+	Icon        string           `json:"icon,omitempty"`
+	Authors     []jsonFeedAuthor `json:"authors,omitempty"`
+	Items       []jsonFeedItem   `json:"items"`
+}
+
+type jsonFeedAuthor struct {
+	Name   string `json:"name"`
+	URL    string `json:"url,omitempty"`
+	Avatar string `json:"avatar,omitempty"`
+}
+
+type jsonFeedItem struct {
+	ID            string               `json:"id"`
+	URL           string               `json:"url"`
+	Title         string               `json:"title"`
+	ContentText   string               `json:"content_text"`
+	DatePublished string               `json:"date_published"`
+	DateModified  string               `json:"date_modified,omitempty"`
+	Tags          []string             `json:"tags,omitempty"`
+	Image         string               `json:"image,omitempty"`
+	Attachments   []jsonFeedAttachment `json:"attachments,omitempty"`
+}
+
+type jsonFeedAttachment struct {
+	URL      string `json:"url"`
+	MimeType string `json:"mime_type"`
+}
+
+// jsonFeedItems renders entries as JSON Feed items, the first image
+// of a post is its image
+func jsonFeedItems(entries []TimelineEntry) []jsonFeedItem {
+	items := []jsonFeedItem{}
+	for _, e := range entries {
+		url := postURL(e.Author, e.ID)
+		item := jsonFeedItem{
+			ID:            url,
+			URL:           url,
+			Title:         e.Title,
+			ContentText:   e.Body,
+			DatePublished: e.Date.UTC().Format(time.RFC3339),
+			Tags:          e.Tags,
+		}
+		if len(e.Revisions) > 1 {
+			item.DateModified = e.Revisions[len(e.Revisions)-1].Date.UTC().Format(time.RFC3339)
+		}
+		for _, name := range e.Images {
+			mimeType := "image/png"
+			if filepath.Ext(name) == ".jpg" {
+				mimeType = "image/jpeg"
+			}
+			if item.Image == "" {
+				item.Image = baseURL + "/media/" + name
+			}
+			item.Attachments = append(item.Attachments, jsonFeedAttachment{URL: baseURL + "/media/" + name, MimeType: mimeType})
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+// userJSONFeed renders the latest posts of a user as a JSON Feed
+func userJSONFeed(us *User) ([]byte, error) {
+	var entries []TimelineEntry
+	for _, p := range us.Posts {
+		if len(entries) == feedSize {
+			break
+		}
+		entries = append(entries, TimelineEntry{Author: us.Username, Post: p})
+	}
+	home := baseURL + "/users/" + us.Username + "/"
+	return json.Marshal(jsonFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       us.DisplayedName(),
+		HomePageURL: home,
+		FeedURL:     home + "feed.json",
+		Description: us.Bio,
+		Icon:        baseURL + us.AvatarURL(),
+		Authors:     []jsonFeedAuthor{{Name: us.DisplayedName(), URL: home, Avatar: baseURL + us.AvatarURL()}},
+		Items:       jsonFeedItems(entries),
+	})
+}
+
+// userFeedHandler serves the latest posts of a user as a JSON Feed
+func userFeedHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	us := getUser(ps.ByName("username"))
+	if us == nil || us.Disabled {
+		http.NotFound(w, r)
+		return
+	}
+	data, err := userJSONFeed(us)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/feed+json; charset=utf-8")
+	w.Write(data)
+}
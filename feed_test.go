@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"src/github.com/julienschmidt/httprouter"
+)
+
+func TestUserFeedHandler(t *testing.T) {
+	us := &User{Username: "testUser", Password: "testPassword", ID: 1, Role: RoleAuthor, DisplayName: "Test"}
+	users = append(users, us)
+	defer func() {
+		users = nil
+		for len(webmentionQueue) > 0 {
+			<-webmentionQueue
+		}
+	}()
+	date := time.Date(2018, 4, 5, 11, 0, 0, 0, time.UTC)
+	us.addPost(Post{Title: "first", Body: "one", Date: date, Tags: []string{"go"}})
+	us.addPost(Post{Title: "second", Body: "two", Date: date.Add(time.Hour), Images: []string{"a.jpg", "b.png"}})
+	us.editPost(1, Revision{Title: "first", Body: "one, edited", Tags: []string{"go"}, Date: date.Add(2 * time.Hour)})
+
+	req := httptest.NewRequest("GET", "http://127.0.0.1/users/testUser/feed.json", nil)
+	w := httptest.NewRecorder()
+	userFeedHandler(w, req, httprouter.Params{{"username", "testUser"}})
+	var feed jsonFeed
+	err := json.Unmarshal(w.Body.Bytes(), &feed)
+	if err != nil || w.Header().Get("Content-Type") != "application/feed+json; charset=utf-8" {
+		t.Fatal("TestUserFeedHandler --> FAILED", err)
+	}
+	if feed.Version != "https://jsonfeed.org/version/1.1" || feed.Title != "Test" ||
+		feed.FeedURL != baseURL+"/users/testUser/feed.json" || len(feed.Items) != 2 {
+		t.Fatal("TestUserFeedHandler --> FAILED")
+	}
+	second, first := feed.Items[0], feed.Items[1]
+	if second.ID != postURL("testUser", 2) || second.Image != baseURL+"/media/a.jpg" || len(second.Attachments) != 2 ||
+		second.Attachments[1].MimeType != "image/png" || second.DateModified != "" {
+		t.Errorf("TestUserFeedHandler --> FAILED")
+	}
+	if first.ContentText != "one, edited" || first.DatePublished != "2018-04-05T11:00:00Z" ||
+		first.DateModified != "2018-04-05T13:00:00Z" || first.Tags[0] != "go" {
+		t.Errorf("TestUserFeedHandler --> FAILED")
+	}
+
+	us.Disabled = true
+	w = httptest.NewRecorder()
+	userFeedHandler(w, req, httprouter.Params{{"username", "testUser"}})
+	if w.Code != 404 {
+		t.Errorf("TestUserFeedHandler --> FAILED")
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"src/github.com/julienschmidt/httprouter"
+	"src/github.com/pkg/errors"
+)
+
+var timelinePageSize = 10
+
+func (u User) IsFollowing(username string) bool {
+	for _, f := range u.Following {
+		if f == username {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *User) follow(username string) error {
+	if username == u.Username {
+		return errors.New("users can't follow themselves")
+	}
+	if !UsernameExists(username) {
+		return errors.Errorf("user %s doesn't exist", username)
+	}
+	if u.IsFollowing(username) {
+		return nil
+	}
+	u.Following = append(u.Following, username)
+	return nil
+}
+
+func (u *User) unfollow(username string) {
+	for i, f := range u.Following {
+		if f == username {
+			u.Following = append(u.Following[:i], u.Following[i+1:]...)
+			return
+		}
+	}
+}
+
+type TimelineEntry struct {
+	Author string
+	Post
+}
+
+// timelineCursor points at the last entry of a timeline page, the next page
+// starts right after it. Entries are ordered by time descending, then by
+// author and by post ID descending, which is a total order.
+type timelineCursor struct {
+	time   time.Time
+	author string
+	id     int
+}
+
+func (c timelineCursor) String() string {
+	return fmt.Sprintf("%d_%d_%s", c.time.UnixNano(), c.id, c.author)
+}
+
+func parseTimelineCursor(s string) (timelineCursor, error) {
+	parts := strings.SplitN(s, "_", 3)
+	if len(parts) != 3 {
+		return timelineCursor{}, errors.Errorf("malformed timeline cursor %q", s)
+	}
+	nano, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return timelineCursor{}, errors.Wrap(err, "malformed timeline cursor")
+	}
+	id, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return timelineCursor{}, errors.Wrap(err, "malformed timeline cursor")
+	}
+	return timelineCursor{time: time.Unix(0, nano), author: parts[2], id: id}, nil
+}
+
+// after tells whether the post of author goes after the cursor
+func (c timelineCursor) after(author string, p Post) bool {
+	t := p.Date
+	if !t.Equal(c.time) {
+		return t.Before(c.time)
+	}
+	if author != c.author {
+		return author > c.author
+	}
+	return p.ID < c.id
+}
+
+// timelineSource is the not yet consumed part of the posts of one followee
+type timelineSource struct {
+	author string
+	posts  []Post
+}
+
+type timelineHeap []*timelineSource
+
+func (h timelineHeap) Len() int { return len(h) }
+
+func (h timelineHeap) Less(i, j int) bool {
+	a, b := h[i].posts[0], h[j].posts[0]
+	ta, tb := a.Date, b.Date
+	if !ta.Equal(tb) {
+		return ta.After(tb)
+	}
+	if h[i].author != h[j].author {
+		return h[i].author < h[j].author
+	}
+	return a.ID > b.ID
+}
+
+func (h timelineHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *timelineHeap) Push(x interface{}) { *h = append(*h, x.(*timelineSource)) }
+
+func (h *timelineHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// timeline merges posts of the followed users, newest first. Every user's
+// posts are already sorted, so only the head of each list takes part in
+// the merge and a page costs O(F log P + n log F) for F followees.
+// It returns up to limit entries after the cursor and the cursor for
+// the next page, which is empty on the last page.
+func (u User) timeline(cursor *timelineCursor, limit int) ([]TimelineEntry, string) {
+	h := make(timelineHeap, 0, len(u.Following))
+	for _, username := range u.Following {
+		followee := getUser(username)
+		if followee == nil {
+			continue
+		}
+		posts := followee.Posts
+		if cursor != nil {
+			start := sort.Search(len(posts), func(i int) bool {
+				return cursor.after(followee.Username, posts[i])
+			})
+			posts = posts[start:]
+		}
+		if len(posts) > 0 {
+			h = append(h, &timelineSource{author: followee.Username, posts: posts})
+		}
+	}
+	heap.Init(&h)
+
+	var entries []TimelineEntry
+	for h.Len() > 0 && len(entries) < limit {
+		src := h[0]
+		entries = append(entries, TimelineEntry{Author: src.author, Post: src.posts[0]})
+		src.posts = src.posts[1:]
+		if len(src.posts) == 0 {
+			heap.Pop(&h)
+		} else {
+			heap.Fix(&h, 0)
+		}
+	}
+	if h.Len() == 0 || len(entries) == 0 {
+		return entries, ""
+	}
+	last := entries[len(entries)-1]
+	return entries, timelineCursor{time: last.Date, author: last.Author, id: last.ID}.String()
+}
+
+func followHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	usernameCookie, err := sessionCookie(r)
+	if err == http.ErrNoCookie {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	username := ps.ByName("username")
+	us := getUser(usernameCookie.Value)
+	err = us.follow(username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = us.refreshUserInfo()
+	if err != nil {
+		panic(err)
+	}
+	http.Redirect(w, r, "/users/"+username, http.StatusFound)
+}
+
+func unfollowHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	usernameCookie, err := sessionCookie(r)
+	if err == http.ErrNoCookie {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	username := ps.ByName("username")
+	us := getUser(usernameCookie.Value)
+	us.unfollow(username)
+	err = us.refreshUserInfo()
+	if err != nil {
+		panic(err)
+	}
+	http.Redirect(w, r, "/users/"+username, http.StatusFound)
+}
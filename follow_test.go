@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"src/github.com/julienschmidt/httprouter"
+)
+
+func TestFollow(t *testing.T) {
+	defer func() {
+		users = nil
+	}()
+	users = append(users, &User{Username: "testUser", Password: "testPassword", ID: 1})
+	users = append(users, &User{Username: "testUser1", Password: "testPassword", ID: 2})
+	us := getUser("testUser")
+
+	if us.follow("testUser") == nil || us.follow("nobody") == nil {
+		t.Errorf("TestFollow --> FAILED")
+	}
+	if us.follow("testUser1") != nil || us.follow("testUser1") != nil || len(us.Following) != 1 ||
+		!us.IsFollowing("testUser1") {
+		t.Errorf("TestFollow --> FAILED")
+	}
+	us.unfollow("testUser1")
+	if us.IsFollowing("testUser1") || len(us.Following) != 0 {
+		t.Errorf("TestFollow --> FAILED")
+	}
+}
+
+// addTimelinePosts gives the user n posts published every step starting at start
+func addTimelinePosts(us *User, n int, start time.Time, step time.Duration) {
+	for i := 0; i < n; i++ {
+		us.addPost(Post{
+			Title: fmt.Sprintf("%s%d", us.Username, i),
+			Body:  "body",
+			Date:  start.Add(time.Duration(i) * step).UTC(),
+		})
+	}
+}
+
+func TestTimeline(t *testing.T) {
+	defer func() {
+		users = nil
+	}()
+	start := time.Date(2018, 5, 4, 16, 0, 0, 0, time.Local)
+	reader := &User{Username: "reader", Password: "testPassword", ID: 1}
+	users = append(users, reader)
+	for i := 0; i < 30; i++ {
+		us := &User{Username: fmt.Sprintf("writer%02d", i), Password: "testPassword", ID: i + 2}
+		users = append(users, us)
+		// writers post at the same moments, so order depends on the tie-breakers too
+		addTimelinePosts(us, 5, start.Add(time.Duration(i%3)*time.Second), 3*time.Second)
+		if i%2 == 0 {
+			reader.follow(us.Username)
+		}
+	}
+	addTimelinePosts(reader, 3, start, time.Second)
+
+	var all []TimelineEntry
+	var cursor *timelineCursor
+	for pages := 0; pages < 100; pages++ {
+		entries, next := reader.timeline(cursor, 7)
+		all = append(all, entries...)
+		if next == "" {
+			break
+		}
+		c, err := parseTimelineCursor(next)
+		if err != nil {
+			t.Errorf("TestTimeline --> FAILED")
+			return
+		}
+		cursor = &c
+	}
+	if len(all) != 15*5 {
+		t.Errorf("TestTimeline --> FAILED")
+		return
+	}
+	seen := make(map[string]bool)
+	for i, e := range all {
+		if !strings.HasPrefix(e.Title, e.Author) || e.Author == "reader" || seen[e.Title] {
+			t.Errorf("TestTimeline --> FAILED")
+		}
+		seen[e.Title] = true
+		if i > 0 && (all[i-1].Date.Before(e.Date) ||
+			all[i-1].Date.Equal(e.Date) && all[i-1].Author > e.Author) {
+			t.Errorf("TestTimeline --> FAILED")
+		}
+	}
+}
+
+func TestParseTimelineCursor(t *testing.T) {
+	c := timelineCursor{time: time.Unix(1525438658, 0), author: "ducker", id: 3}
+	parsed, err := parseTimelineCursor(c.String())
+	if err != nil || parsed != c {
+		t.Errorf("TestParseTimelineCursor --> FAILED")
+	}
+	for _, s := range []string{"", "1_2", "a_2_user", "1_b_user"} {
+		if _, err := parseTimelineCursor(s); err == nil {
+			t.Errorf("TestParseTimelineCursor --> FAILED")
+		}
+	}
+}
+
+func TestFollowHandler(t *testing.T) {
+	defer func() {
+		users = nil
+		os.Remove("data/accounts/testUser.txt")
+	}()
+	users = append(users, &User{Username: "testUser", Password: "testPassword", ID: 1})
+	users = append(users, &User{Username: "testUser1", Password: "testPassword", ID: 2})
+	req := httptest.NewRequest("POST", "http://127.0.0.1/users/testUser1/follow", nil)
+	req.AddCookie(sessionFor("testUser"))
+	w := httptest.NewRecorder()
+
+	followHandler(w, req, httprouter.Params{{"username", "testUser1"}})
+
+	l, _ := w.Result().Location()
+	if w.Result().StatusCode != 302 || l.Path != "/users/testUser1" || !getUser("testUser").IsFollowing("testUser1") {
+		t.Errorf("TestFollowHandler --> FAILED")
+	}
+
+	w = httptest.NewRecorder()
+	unfollowHandler(w, req, httprouter.Params{{"username", "testUser1"}})
+	if w.Result().StatusCode != 302 || getUser("testUser").IsFollowing("testUser1") {
+		t.Errorf("TestFollowHandler --> FAILED")
+	}
+
+	w = httptest.NewRecorder()
+	followHandler(w, req, httprouter.Params{{"username", "nobody"}})
+	if w.Result().StatusCode != 400 {
+		t.Errorf("TestFollowHandler --> FAILED")
+	}
+}
+
+func TestUsersHandlerTimeline(t *testing.T) {
+	defer func() {
+		users = nil
+	}()
+	users = append(users, &User{Username: "testUser", Password: "testPassword", ID: 1, Following: []string{"testUser1"}})
+	users = append(users, &User{Username: "testUser1", Password: "testPassword", ID: 2})
+	addTimelinePosts(getUser("testUser1"), timelinePageSize+1, time.Now().Add(-time.Hour), time.Minute)
+	req := httptest.NewRequest("GET", "http://127.0.0.1/users/testUser/", nil)
+	req.AddCookie(sessionFor("testUser"))
+	w := httptest.NewRecorder()
+
+	usersHandler(w, req, httprouter.Params{{"username", "testUser"}})
+
+	body := w.Body.String()
+	if w.Result().StatusCode != 200 || !strings.Contains(body, "testUser110") || strings.Contains(body, "<b>testUser10</b>") ||
+		!strings.Contains(body, "?before=") {
+		t.Errorf("TestUsersHandlerTimeline --> FAILED")
+	}
+}
@@ -4,28 +4,71 @@ import (
 	"fmt"
 	"encoding/json"
 	"io/ioutil"
+	"strings"
+	"time"
 
 	"src/github.com/pkg/errors"
 	"src/github.com/asaskevich/govalidator"
 )
 
 // base format: Mon Jan 2 15:04:05 -0700 MST 2006
+// dates are kept in time.Time now, the format is only used to read old account files
 var timeFormat = "01.02.2006 15:04:05"
 var ID = 1
 var users []*User
 
+// baseURL is used to build absolute links, e.g. in emails
+var baseURL = "http://localhost:8080"
+
 const (
 	NoMatch       = "no match"
 	WrongPassword = "wrong password"
+	Disabled      = "disabled"
 	Correct       = "correct"
 )
 
 type User struct {
 	Username  string `valid:"alphanum, required, runelength(3|16)"`
 	Password  string `valid:"alphanum, required, runelength(3|16)"`
-	ID        int    `json:"id, int"valid:"required"`
+	ID        int    `json:"id" valid:"required"`
 	PostCount int    `valid:"-"`
 	Posts     []Post `valid:"-"`
+	// drafts and scheduled posts, newest first
+	Drafts  []Post   `valid:"-"`
+	Uploads []Upload `valid:"-"`
+	Email   string   `valid:"email, optional"`
+
+	DisplayName string `valid:"runelength(1|40), optional"`
+	Bio         string `valid:"runelength(1|300), optional"`
+	Website     string `valid:"url, runelength(1|200), optional"`
+	// name of the avatar image in mediaDir
+	Avatar string `valid:"-"`
+
+	Role     string `valid:"in(admin|moderator|author|reader)"`
+	Disabled bool   `valid:"-"`
+	// the last ID given to a post, IDs of deleted posts aren't reused
+	LastPostID int `valid:"-"`
+	// usernames of the users whose posts are shown in the timeline
+	Following []string `valid:"-"`
+	// IANA name of the zone dates are shown in, the server zone when empty
+	TimeZone string `valid:"-"`
+
+	// PEM of the key signing ActivityPub activities of the user
+	ActorKey string `valid:"-"`
+	// actors of other servers following the user
+	RemoteFollowers []RemoteFollower `valid:"-"`
+
+	// tokens of apps publishing through Micropub
+	Tokens []AppToken `valid:"-"`
+
+	TOTPSecret    string   `valid:"-"`
+	TOTPLastStep  int64    `valid:"-"`
+	RecoveryCodes []string `valid:"-"`
+	// offered to the user on the 2FA page until it's confirmed
+	totpPending string
+
+	// version of the account file format, see migrations
+	SchemaVersion int `valid:"-"`
 }
 
 func getUser(username string) *User {
@@ -37,10 +80,43 @@ func getUser(username string) *User {
 	return nil
 }
 
+func getUserByEmail(email string) *User {
+	if email == "" {
+		return nil
+	}
+	for _, us := range users {
+		if strings.EqualFold(email, us.Email) {
+			return us
+		}
+	}
+	return nil
+}
+
 type Post struct {
-	Title string `valid:"required, ascii, runelength(1|30)"`
-	Body  string `valid:"required, ascii, runelength(1|300)"`
-	Date  string `valid:"-"`
+	ID    int       `valid:"-"`
+	Title string    `valid:"required, ascii, runelength(1|30)"`
+	Body  string    `valid:"required, ascii, runelength(1|300)"`
+	Date  time.Time `valid:"-"`
+	// checked by checkTags
+	Tags   []string `valid:"-"`
+	Status string   `valid:"in(draft|scheduled|published)"`
+	// names of attached images in mediaDir
+	Images []string `valid:"-"`
+	// when a scheduled post is going to be published
+	PublishAt time.Time `valid:"-"`
+
+	// every version of the post, the last one is the current
+	Revisions []Revision `valid:"-"`
+
+	Comments      []Comment `valid:"-"`
+	LastCommentID int       `valid:"-"`
+	// IDs of remote actors who liked the post
+	Likes []string `valid:"-"`
+	// pages of other sites linking the post, received as webmentions
+	Mentions []Mention `valid:"-"`
+	// when a comment, a like or a mention was last removed or a like added,
+	// changes that don't leave a date of their own in the post
+	Changed time.Time `valid:"-"`
 }
 
 func (u User) NoPosts() bool {
@@ -49,17 +125,88 @@ func (u User) NoPosts() bool {
 
 func (u *User) addPost(post Post) error {
 	_, err := govalidator.ValidateStruct(post)
+	if err == nil {
+		err = checkTags(post.Tags)
+	}
 	if err != nil {
 		return errors.Wrap(err, fmt.Sprintf("user:%s ID:%v failed to add a new post: "+
 			"it doesn't pass validation\n", u.Username, u.ID))
 	}
+	if post.ID == 0 {
+		u.LastPostID++
+		post.ID = u.LastPostID
+	}
+	post.Status = StatusPublished
 	u.Posts = appendPost(u.Posts, post)
 	u.PostCount++
+	postIndex.add(u.Username, post)
+	u.federatePost("Create", post)
+	u.sendWebmentions(post)
+	return nil
+}
+
+func (u *User) getPost(id int) *Post {
+	for i := range u.Posts {
+		if u.Posts[i].ID == id {
+			return &u.Posts[i]
+		}
+	}
+	return nil
+}
+
+func (u *User) deletePost(id int) error {
+	for i := range u.Posts {
+		if u.Posts[i].ID == id {
+			deleted := u.Posts[i]
+			u.Posts = append(u.Posts[:i], u.Posts[i+1:]...)
+			u.PostCount--
+			postIndex.delete(u.Username, id)
+			u.federatePost("Delete", deleted)
+			return nil
+		}
+	}
+	return errors.Errorf("user:%s ID:%v doesn't have a post with ID %v", u.Username, u.ID, id)
+}
+
+// editPost replaces the title, the body and tags of a post or a draft with
+// the ones of rev and keeps the previous content in the history.
+// The date of the post stays the same.
+func (u *User) editPost(id int, rev Revision) error {
+	post := u.getPost(id)
+	draft := post == nil
+	if draft {
+		post = u.getDraft(id)
+	}
+	if post == nil {
+		return errors.Errorf("user:%s ID:%v doesn't have a post with ID %v", u.Username, u.ID, id)
+	}
+	if post.Title == rev.Title && post.Body == rev.Body && strings.Join(post.Tags, ",") == strings.Join(rev.Tags, ",") {
+		return nil
+	}
+	edited := *post
+	// posts are stored without history until they are edited for the first time
+	edited.Revisions = post.History(u.Username)
+	edited.Title, edited.Body, edited.Tags = rev.Title, rev.Body, rev.Tags
+	_, err := govalidator.ValidateStruct(edited)
+	if err == nil {
+		err = checkTags(edited.Tags)
+	}
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("user:%s ID:%v failed to edit post ID:%v: "+
+			"it doesn't pass validation\n", u.Username, u.ID, id))
+	}
+	rev.Number = len(edited.Revisions) + 1
+	edited.Revisions = append(edited.Revisions, rev)
+	*post = edited
+	if !draft {
+		postIndex.add(u.Username, edited)
+		u.federatePost("Update", edited)
+	}
 	return nil
 }
 
 func (p Post) isEmpty() bool {
-	if p.Title != "" && p.Body != "" && p.Date != "" {
+	if p.Title != "" && p.Body != "" && !p.Date.IsZero() {
 		return false
 	}
 	return true
@@ -89,6 +236,9 @@ func tryToLogIn(incLogin string, incPassword string) string {
 				if us.Password != incPassword {
 					return WrongPassword
 				}
+				if us.Disabled {
+					return Disabled
+				}
 			}
 		}
 	}
@@ -102,6 +252,9 @@ func addUserToServer(incLogin string, incPassword string) error {
 		ID:        ID,
 		PostCount: 0,
 		Posts:     make([]Post, 0),
+		Role:      RoleAuthor,
+
+		SchemaVersion: schemaVersion,
 	}
 	_, err := govalidator.ValidateStruct(newUser)
 	if err != nil {
@@ -118,6 +271,7 @@ func addUserToServer(incLogin string, incPassword string) error {
 }
 
 func (u User) refreshUserInfo() error {
+	u.SchemaVersion = schemaVersion
 	_, err := govalidator.ValidateStruct(u)
 	if err != nil {
 		return errors.Wrap(err, fmt.Sprintf("new user struct is invalid: %v", u))
@@ -139,6 +293,7 @@ func addUserToUsers(incLogin string, incPassword string) error {
 		ID:        ID,
 		PostCount: 0,
 		Posts:     make([]Post, 0),
+		Role:      RoleAuthor,
 	}
 	_, err := govalidator.ValidateStruct(newUser)
 	if err != nil {
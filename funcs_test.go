@@ -1,6 +1,7 @@
 package main
 
 import (
+	"reflect"
 	"testing"
 	"time"
 )
@@ -20,7 +21,7 @@ func TestGetUser (t *testing.T) {
 		t.Errorf("TestGetUser --> FAILED")
 	}
 	for i:=0; i < desUser.PostCount; i++ {
-		if desUser.Posts[i] != checkUser.Posts[i] {
+		if !reflect.DeepEqual(desUser.Posts[i], checkUser.Posts[i]) {
 			t.Errorf("TestGetUser --> FAILED")
 		}
 	}
@@ -46,12 +47,12 @@ func TestIsEmpty (t *testing.T) {
 	nonEmpty := Post{
 		Title: "title",
 		Body: "body",
-		Date: time.Now().Format(timeFormat),
+		Date: time.Now(),
 	}
 	empty := Post{
 		Title: "",
 		Body: "",
-		Date: "",
+		Date: time.Time{},
 	}
 
 	if !empty.isEmpty() {
@@ -105,8 +106,42 @@ func TestAddUserToUsers (t *testing.T) {
 		t.Errorf("TestGetUser --> FAILED")
 	}
 	for i:=0; i < desUser.PostCount; i++ {
-		if desUser.Posts[i] != checkUser.Posts[i] {
+		if !reflect.DeepEqual(desUser.Posts[i], checkUser.Posts[i]) {
 			t.Errorf("TestGetUser --> FAILED")
 		}
 	}
-}
\ No newline at end of file
+}
+func TestDeletePost (t *testing.T) {
+	testUser := User{Username:"testUser", Password:"testPassword", ID:1}
+	testUser.addPost(Post{Title:"first", Body:"body", Date:time.Now()})
+	testUser.addPost(Post{Title:"second", Body:"body", Date:time.Now()})
+	testUser.addPost(Post{Title:"third", Body:"body", Date:time.Now()})
+
+	if testUser.deletePost(2) != nil || testUser.PostCount != 2 || testUser.getPost(2) != nil {
+		t.Errorf("TestDeletePost --> FAILED")
+	}
+	if testUser.deletePost(2) == nil {
+		t.Errorf("TestDeletePost --> FAILED")
+	}
+	testUser.addPost(Post{Title:"fourth", Body:"body", Date:time.Now()})
+	if testUser.Posts[0].ID != 4 || testUser.getPost(3).Title != "third" {
+		t.Errorf("TestDeletePost --> FAILED")
+	}
+}
+
+func TestEditPost (t *testing.T) {
+	testUser := User{Username:"testUser", Password:"testPassword", ID:1}
+	date := time.Now()
+	testUser.addPost(Post{Title:"first", Body:"body", Date:date})
+
+	if testUser.editPost(1, Revision{Title:"edited", Body:"new body", Tags:[]string{"go"}}) != nil || testUser.Posts[0].Title != "edited" ||
+		testUser.Posts[0].Body != "new body" || !testUser.Posts[0].Date.Equal(date) || testUser.Posts[0].Tags[0] != "go" {
+		t.Errorf("TestEditPost --> FAILED")
+	}
+	if testUser.editPost(1, Revision{Title:"", Body:"new body"}) == nil || testUser.Posts[0].Title != "edited" {
+		t.Errorf("TestEditPost --> FAILED")
+	}
+	if testUser.editPost(2, Revision{Title:"title", Body:"body"}) == nil {
+		t.Errorf("TestEditPost --> FAILED")
+	}
+}
@@ -1,15 +1,23 @@
 package main
 
 import (
+	"fmt"
 	"html/template"
 	"net/http"
+	"strings"
 	"time"
 
+	"src/github.com/asaskevich/govalidator"
 	"src/github.com/julienschmidt/httprouter"
 )
 
+// parseTemplates is template.ParseFiles with templateFuncs available
+func parseTemplates(filenames ...string) (*template.Template, error) {
+	return template.New("").Funcs(templateFuncs).ParseFiles(filenames...)
+}
+
 func mainGetHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	c, err := r.Cookie("username")
+	c, err := sessionCookie(r)
 	if err == http.ErrNoCookie {
 		tpl, err := template.ParseFiles("templates/noCookie.html", "templates/footer.html", "templates/noCookieHeader.html")
 		if err != nil {
@@ -28,20 +36,30 @@ func mainGetHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params)
 }
 
 func mainPostHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	usernameCookie, err := r.Cookie("username")
+	usernameCookie, err := sessionCookie(r)
 	if err != http.ErrNoCookie {
 		http.Redirect(w, r, "/users/"+usernameCookie.Value, http.StatusFound)
 		return
 	}
 	if tryToLogIn(r.FormValue("username"), r.FormValue("password")) == Correct {
-		usernameCookie := &http.Cookie{
-			Name:    "username",
-			Value:   r.FormValue("username"),
-			Expires: time.Now().Add(10 * time.Minute),
-			Path:    "/",
+		if getUser(r.FormValue("username")).TwoFactorEnabled() {
+			if twoFactorLocked(r.FormValue("username"), time.Now()) {
+				http.Redirect(w, r, "/tooManyCodes", http.StatusFound)
+				return
+			}
+			start2FA(r.FormValue("username"))
+			pendingCookie := &http.Cookie{
+				Name:     "pending2fa",
+				Value:    makePending2FA(r.FormValue("username"), time.Now()),
+				Expires:  time.Now().Add(pending2FATTL),
+				Path:     "/",
+				HttpOnly: true,
+			}
+			http.SetCookie(w, pendingCookie)
+			http.Redirect(w, r, "/login2fa", http.StatusFound)
+			return
 		}
-		http.SetCookie(w, usernameCookie)
-		http.Redirect(w, r, "/users/"+usernameCookie.Value, http.StatusFound)
+		logIn(w, r, r.FormValue("username"))
 		return
 	}
 	if tryToLogIn(r.FormValue("username"), r.FormValue("password")) == NoMatch {
@@ -50,11 +68,62 @@ func mainPostHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params
 	}
 	if tryToLogIn(r.FormValue("username"), r.FormValue("password")) == WrongPassword {
 		http.Redirect(w, r, "/incorrectPassword", http.StatusFound)
+		return
 	}
+	if tryToLogIn(r.FormValue("username"), r.FormValue("password")) == Disabled {
+		http.Redirect(w, r, "/accountDisabled", http.StatusFound)
+	}
+}
+
+// sessionTTL is how long a login lasts
+var sessionTTL = 10 * time.Minute
+
+// sessionPurpose signs sessions of u. The password takes part in it like
+// in reset tokens, so sessions end when the password is changed and don't
+// carry over to a new account registered under the name of a deleted one.
+func sessionPurpose(u *User) string {
+	return "session|" + u.Password
+}
+
+// setSession issues the session cookie of u
+func setSession(w http.ResponseWriter, u *User) {
+	usernameCookie := &http.Cookie{
+		Name:    "username",
+		Value:   signedValue(sessionPurpose(u), u.Username, time.Now().Add(sessionTTL)),
+		Expires: time.Now().Add(sessionTTL),
+		Path:    "/",
+	}
+	http.SetCookie(w, usernameCookie)
+}
+
+// logIn issues the session cookie and sends the user to their page
+func logIn(w http.ResponseWriter, r *http.Request, username string) {
+	setSession(w, getUser(username))
+	http.Redirect(w, r, "/users/"+username, http.StatusFound)
+}
+
+// sessionCookie is r.Cookie("username") for the session set by logIn,
+// the cookie it returns holds the username. Forged and expired sessions
+// and sessions of deleted or disabled accounts are http.ErrNoCookie, as if
+// the user wasn't logged in. It reads users, so it's called under storeMu.
+func sessionCookie(r *http.Request) (*http.Cookie, error) {
+	c, err := r.Cookie("username")
+	if err != nil {
+		return nil, err
+	}
+	us := getUser(strings.SplitN(c.Value, "|", 2)[0])
+	if us == nil || us.Disabled {
+		return nil, http.ErrNoCookie
+	}
+	username, ok := checkSignedValue(sessionPurpose(us), c.Value, time.Now())
+	if !ok {
+		return nil, http.ErrNoCookie
+	}
+	return &http.Cookie{Name: c.Name, Value: username}, nil
 }
 
 func logoutHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	_, err := r.Cookie("username")
+	_, err := sessionCookie(r)
 	if err == http.ErrNoCookie {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
@@ -69,11 +138,15 @@ func logoutHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params)
 }
 
 func newPostGetHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	_, err := r.Cookie("username")
+	usernameCookie, err := sessionCookie(r)
 	if err == http.ErrNoCookie {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
+	if usernameCookie.Value != ps.ByName("username") {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
 	tpl, err := template.ParseFiles("templates/header.html", "templates/newPost.html")
 	if err != nil {
 		panic(err)
@@ -87,38 +160,105 @@ func newPostGetHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Par
 }
 
 func newPostPostHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	_, err := r.Cookie("username")
+	storeMu.Lock()
+	usernameCookie, err := sessionCookie(r)
+	storeMu.Unlock()
 	if err == http.ErrNoCookie {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
+	if usernameCookie.Value != ps.ByName("username") {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
 	username := ps.ByName("username")
-
+	limitUploads(w, r)
+	tags, err := parseTags(r.FormValue("tags"))
+	if err != nil {
+		http.Redirect(w, r, "/users/"+username+"/newPostInvalidSymbols", http.StatusFound)
+		return
+	}
 	newPost := Post{
 		Title: r.FormValue("title"),
 		Body:  r.FormValue("body"),
-		Date:  time.Now().Format(timeFormat),
+		Date:  time.Now().UTC(),
+		Tags:  tags,
+	}
+	// images are stored only for posts that are going to be kept
+	err = validatePost(newPost)
+	if err != nil {
+		http.Redirect(w, r, "/users/"+username+"/newPostInvalidSymbols", http.StatusFound)
+		return
+	}
+	// images are read and stored before storeMu is taken
+	uploads, err := formImages(r)
+	if err != nil {
+		http.Redirect(w, r, "/users/"+username+"/newPostInvalidSymbols", http.StatusFound)
+		return
 	}
 
-	err = getUser(username).addPost(newPost)
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	added := false
+	defer func() {
+		if !added {
+			discardUploads(uploads)
+		}
+	}()
+	us := getUser(username)
+	if us == nil {
+		http.NotFound(w, r)
+		return
+	}
+	newPost.Images, err = postImages(us, r, uploads)
 	if err != nil {
 		http.Redirect(w, r, "/users/"+username+"/newPostInvalidSymbols", http.StatusFound)
 		return
 	}
-	err = getUser(username).refreshUserInfo()
+
+	switch r.FormValue("status") {
+	case StatusDraft:
+		err = us.addDraft(newPost)
+	case StatusScheduled:
+		newPost.Status = StatusScheduled
+		newPost.PublishAt, err = parsePublishAt(r.FormValue("publishAt"), us, time.Now())
+		if err == nil {
+			err = us.addDraft(newPost)
+		}
+	default:
+		err = us.addPost(newPost)
+	}
+	if err != nil {
+		http.Redirect(w, r, "/users/"+username+"/newPostInvalidSymbols", http.StatusFound)
+		return
+	}
+	added = true
+	for _, upload := range uploads {
+		us.addUpload(upload)
+	}
+	err = us.refreshUserInfo()
 	if err != nil {
 		panic(err)
 	}
 
+	if r.FormValue("status") == StatusDraft || r.FormValue("status") == StatusScheduled {
+		wakeScheduler()
+		http.Redirect(w, r, "/users/"+username+"/drafts", http.StatusFound)
+		return
+	}
 	http.Redirect(w, r, "/users/"+username, http.StatusFound)
 }
 
 func newPostInvalidSymbolsGetHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	_, err := r.Cookie("username")
+	usernameCookie, err := sessionCookie(r)
 	if err == http.ErrNoCookie {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
+	if usernameCookie.Value != ps.ByName("username") {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
 	tpl, err := template.ParseFiles("templates/header.html", "templates/newPostInvalidSymbols.html")
 	if err != nil {
 		panic(err)
@@ -131,8 +271,108 @@ func newPostInvalidSymbolsGetHandler(w http.ResponseWriter, r *http.Request, ps
 	}
 }
 
+func editPostGetHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	usernameCookie, err := sessionCookie(r)
+	if err == http.ErrNoCookie {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	if usernameCookie.Value != ps.ByName("username") {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	us, post := findOwnPost(ps)
+	if post == nil {
+		http.NotFound(w, r)
+		return
+	}
+	tpl, err := template.ParseFiles("templates/header.html", "templates/editPost.html")
+	if err != nil {
+		panic(err)
+	}
+
+	err = tpl.ExecuteTemplate(w, "editPost", struct {
+		*User
+		Post    *Post
+		Tags    string
+		Invalid bool
+	}{us, post, strings.Join(post.Tags, ", "), r.FormValue("invalid") != ""})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func editPostPostHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	usernameCookie, err := sessionCookie(r)
+	if err == http.ErrNoCookie {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	if usernameCookie.Value != ps.ByName("username") {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	us, post := findOwnPost(ps)
+	if post == nil {
+		http.NotFound(w, r)
+		return
+	}
+	permalink := fmt.Sprintf("/users/%s/posts/%d", us.Username, post.ID)
+	if !post.IsPublished() {
+		permalink = "/users/" + us.Username + "/drafts"
+	}
+
+	tags, err := parseTags(r.FormValue("tags"))
+	if err == nil {
+		err = us.editPost(post.ID, Revision{
+			Author: usernameCookie.Value,
+			Date:   time.Now().UTC(),
+			Title:  r.FormValue("title"),
+			Body:   r.FormValue("body"),
+			Tags:   tags,
+		})
+	}
+	if err != nil {
+		http.Redirect(w, r, fmt.Sprintf("/users/%s/posts/%d/edit?invalid=1", us.Username, post.ID), http.StatusFound)
+		return
+	}
+	err = us.refreshUserInfo()
+	if err != nil {
+		panic(err)
+	}
+
+	http.Redirect(w, r, permalink, http.StatusFound)
+}
+
+func deletePostHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	usernameCookie, err := sessionCookie(r)
+	if err == http.ErrNoCookie {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	if usernameCookie.Value != ps.ByName("username") {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	us, post := findPost(ps)
+	if post == nil {
+		http.NotFound(w, r)
+		return
+	}
+	err = us.deletePost(post.ID)
+	if err != nil {
+		panic(err)
+	}
+	err = us.refreshUserInfo()
+	if err != nil {
+		panic(err)
+	}
+
+	http.Redirect(w, r, "/users/"+us.Username, http.StatusFound)
+}
+
 func registerGetHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	usernameCookie, err := r.Cookie("username")
+	usernameCookie, err := sessionCookie(r)
 	if err != http.ErrNoCookie {
 		http.Redirect(w, r, "/users/"+usernameCookie.Value, http.StatusFound)
 		return
@@ -149,17 +389,22 @@ func registerGetHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Par
 }
 
 func registerPostHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	usernameCookie, err := r.Cookie("username")
+	usernameCookie, err := sessionCookie(r)
 	if err != http.ErrNoCookie {
 		http.Redirect(w, r, "/users/"+usernameCookie.Value, http.StatusFound)
 		return
 	}
 	incAccount := r.FormValue("account")
 	incPassword := r.FormValue("password")
+	incEmail := strings.TrimSpace(r.FormValue("email"))
 	if UsernameExists(incAccount) {
 		http.Redirect(w, r, "/registerUsernameAlreadyTaken", http.StatusFound)
 		return
 	}
+	if incEmail != "" && (!govalidator.IsEmail(incEmail) || getUserByEmail(incEmail) != nil) {
+		http.Redirect(w, r, "/registerInvalidSymbols", http.StatusFound)
+		return
+	}
 	err = addUserToServer(incAccount, incPassword)
 	if err != nil {
 		http.Redirect(w, r, "/registerInvalidSymbols", http.StatusFound)
@@ -170,6 +415,14 @@ func registerPostHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Pa
 		http.Redirect(w, r, "/registerInvalidSymbols", http.StatusFound)
 		return
 	}
+	if incEmail != "" {
+		us := getUser(incAccount)
+		us.Email = incEmail
+		err = us.refreshUserInfo()
+		if err != nil {
+			panic(err)
+		}
+	}
 
 	setID()
 	registerSuccessCookie := http.Cookie{
@@ -182,7 +435,7 @@ func registerPostHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Pa
 }
 
 func registerUsernameAlreadyTakenGetHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	usernameCookie, err := r.Cookie("username")
+	usernameCookie, err := sessionCookie(r)
 	if err != http.ErrNoCookie {
 		http.Redirect(w, r, "/users/"+usernameCookie.Value, http.StatusFound)
 		return
@@ -199,7 +452,7 @@ func registerUsernameAlreadyTakenGetHandler(w http.ResponseWriter, r *http.Reque
 }
 
 func registerInvalidSymbolsGetHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	usernameCookie, err := r.Cookie("username")
+	usernameCookie, err := sessionCookie(r)
 	if err != http.ErrNoCookie {
 		http.Redirect(w, r, "/users/"+usernameCookie.Value, http.StatusFound)
 		return
@@ -216,7 +469,7 @@ func registerInvalidSymbolsGetHandler(w http.ResponseWriter, r *http.Request, _
 }
 
 func registerSuccessHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	usernameCookie, err := r.Cookie("username")
+	usernameCookie, err := sessionCookie(r)
 	if err != http.ErrNoCookie {
 		http.Redirect(w, r, "/users/"+usernameCookie.Value, http.StatusFound)
 		return
@@ -239,7 +492,7 @@ func registerSuccessHandler(w http.ResponseWriter, r *http.Request, _ httprouter
 }
 
 func incorrectPasswordGetHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	usernameCookie, err := r.Cookie("username")
+	usernameCookie, err := sessionCookie(r)
 	if err != http.ErrNoCookie {
 		http.Redirect(w, r, "/users/"+usernameCookie.Value, http.StatusFound)
 		return
@@ -255,18 +508,41 @@ func incorrectPasswordGetHandler(w http.ResponseWriter, r *http.Request, _ httpr
 	}
 }
 
+func accountDisabledGetHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	tpl, err := template.ParseFiles("templates/noCookieHeader.html", "templates/accountDisabled.html")
+	if err != nil {
+		panic(err)
+	}
+
+	err = tpl.ExecuteTemplate(w, "accountDisabled", nil)
+	if err != nil {
+		panic(err)
+	}
+}
+
+type userListPage struct {
+	Users  []*User
+	Total  int
+	Viewer *User
+	Pages  Pagination
+}
+
 func userListHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	_, err := r.Cookie("username")
+	usernameCookie, err := sessionCookie(r)
 	if err == http.ErrNoCookie {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
-	tpl, err := template.ParseFiles("templates/header.html", "templates/userList.html")
+	tpl, err := template.ParseFiles("templates/header.html", "templates/userList.html", "templates/pagination.html")
 	if err != nil {
 		panic(err)
 	}
 
-	err = tpl.ExecuteTemplate(w, "userList", users)
+	start, end, pages := paginate(r, len(users), usersPerPage)
+	pages.setLinkHeader(w)
+	page := userListPage{Users: usersPage(start, end), Total: len(users), Viewer: getUser(usernameCookie.Value), Pages: pages}
+
+	err = tpl.ExecuteTemplate(w, "userList", page)
 	if err != nil {
 		panic(err)
 	}
@@ -274,32 +550,61 @@ func userListHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params
 
 func usersHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	username := ps.ByName("username")
-	usernameCookie, err := r.Cookie("username")
+	usernameCookie, err := sessionCookie(r)
 	if err == http.ErrNoCookie {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
+	if getUser(username) == nil {
+		http.NotFound(w, r)
+		return
+	}
+	user := getUser(username)
+	start, end, pages := paginate(r, len(user.Posts), postsPerPage)
+	pages.setLinkHeader(w)
 	if usernameCookie.Value != username {
-		user := getUser(username)
-		tpl, err := template.ParseFiles("templates/header.html", "templates/userPage.html")
+		tpl, err := parseTemplates("templates/header.html", "templates/userPage.html", "templates/pagination.html")
 		if err != nil {
 			panic(err)
 		}
 
-		err = tpl.ExecuteTemplate(w, "userPage", user)
+		page := userPage{User: user, Viewer: getUser(usernameCookie.Value), PagePosts: user.postsPage(start, end), Pages: pages}
+		err = tpl.ExecuteTemplate(w, "userPage", page)
 		if err != nil {
 			panic(err)
 		}
 	} else {
-		user := getUser(username)
-		tpl, err := template.ParseFiles("templates/header.html", "templates/homePage.html")
+		page := userPage{User: user, Viewer: user, PagePosts: user.postsPage(start, end), Pages: pages}
+		var cursor *timelineCursor
+		if before := r.FormValue("before"); before != "" {
+			c, err := parseTimelineCursor(before)
+			if err != nil {
+				http.Error(w, "Bad request", http.StatusBadRequest)
+				return
+			}
+			cursor = &c
+		}
+		page.Timeline, page.NextCursor = user.timeline(cursor, timelinePageSize)
+
+		tpl, err := parseTemplates("templates/header.html", "templates/homePage.html", "templates/pagination.html")
 		if err != nil {
 			panic(err)
 		}
 
-		err = tpl.ExecuteTemplate(w, "homePage", user)
+		err = tpl.ExecuteTemplate(w, "homePage", page)
 		if err != nil {
 			panic(err)
 		}
 	}
+}
+
+// userPage is rendered both as the home page and as a page of another user
+type userPage struct {
+	*User
+	Viewer *User
+	// posts of the requested page
+	PagePosts  []Post
+	Pages      Pagination
+	Timeline   []TimelineEntry
+	NextCursor string
 }
\ No newline at end of file
@@ -3,12 +3,19 @@ package main
 import (
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"testing"
 	"src/github.com/julienschmidt/httprouter"
 	"time"
 	"strconv"
+	"strings"
 )
 
+// sessionFor is the cookie of a logged in user, the user is added to users before
+func sessionFor(username string) *http.Cookie {
+	return &http.Cookie{Name: "username", Value: signedValue(sessionPurpose(getUser(username)), username, time.Now().Add(sessionTTL))}
+}
+
 func TestUserDataValidation (t *testing.T) {
 	if alright := addUserToServer("account", "password"); alright != nil {
 		t.Errorf("TestUserDataValidation --> FAILED")
@@ -32,28 +39,32 @@ func TestUserDataValidation (t *testing.T) {
 
 func TestPostValidation (t *testing.T) {
 	testUser := User{}
-	if alright := testUser.addPost(Post{"title", "body", "now"}); alright != nil {
+	if alright := testUser.addPost(Post{Title: "title", Body: "body", Date: time.Now()}); alright != nil {
 		t.Errorf("TestPostValidation --> FAILED")
 	}
-	if nilPost := testUser.addPost(Post{"", "", ""}); nilPost == nil {
+	if nilPost := testUser.addPost(Post{Title: "", Body: "", Date: time.Time{}}); nilPost == nil {
 		t.Errorf("TestPostValidation --> FAILED")
 	}
-	if longPost := testUser.addPost(Post{"tooMuchLettersTooMuchLettersToo", "tooMuchLettersTooMuchLetters" +
+	if longPost := testUser.addPost(Post{Title: "tooMuchLettersTooMuchLettersToo", Body: "tooMuchLettersTooMuchLetters" +
 		"TooMuchLettersTooMuchLettersTooMuchLettersTooMuchLettersTooMuchLettersTooMuchLettersTooMuchLetters" +
 		"TooMuchLettersTooMuchLettersTooMuchLettersTooMuchLettersTooMuchLettersTooMuchLettersTooMuchLetters" +
 		"TooMuchLettersTooMuchLettersTooMuchLettersTooMuchLettersTooMuchLettersTooMuchLettersTooMuch" +
-		"Letters", "now"}); longPost == nil {
+		"Letters", Date: time.Now()}); longPost == nil {
 		t.Errorf("TestPostValidation --> FAILED")
 	}
-	if nonASCII := testUser.addPost(Post{"¡¡¡¡", "¡¡¡¡", "now"}); nonASCII == nil {
+	if nonASCII := testUser.addPost(Post{Title: "¡¡¡¡", Body: "¡¡¡¡", Date: time.Now()}); nonASCII == nil {
 		t.Errorf("TestPostValidation --> FAILED")
 	}
 }
 
 func TestMainGetHandlerWithCookie(t *testing.T) {
+	defer func() {
+		users = nil
+	}()
+	users = append(users, &User{Username:"testUser", Password:"testPassword"})
 	url := "http://127.0.0.1/"
 	req := httptest.NewRequest("GET", url, nil)
-	req.AddCookie(&http.Cookie{Name: "username", Value: "testUser"})
+	req.AddCookie(sessionFor("testUser"))
 	w := httptest.NewRecorder()
 
 	mainGetHandler(w, req, nil)
@@ -81,9 +92,13 @@ func TestMainGetHandlerWithoutCookie(t *testing.T) {
 }
 
 func TestMainPostHandlerWithCookie(t *testing.T) {
+	defer func() {
+		users = nil
+	}()
+	users = append(users, &User{Username:"testUser", Password:"testPassword"})
 	url := "http://127.0.0.1/"
 	req := httptest.NewRequest("POST", url, nil)
-	req.AddCookie(&http.Cookie{Name: "username", Value: "testUser"})
+	req.AddCookie(sessionFor("testUser"))
 	w := httptest.NewRecorder()
 
 	mainPostHandler(w, req, nil)
@@ -161,15 +176,20 @@ func TestMainPostHandlerCorrectData(t *testing.T) {
 	result := w.Result()
 
 	l, _ := result.Location()
-	if result.StatusCode != 302 || l.Path != "/users/testUser" || result.Cookies()[0].Value != "testUser" {
+	username, ok := checkSignedValue(sessionPurpose(users[0]), result.Cookies()[0].Value, time.Now())
+	if result.StatusCode != 302 || l.Path != "/users/testUser" || !ok || username != "testUser" {
 		t.Errorf("TestMainPostHandlerCorrectData --> FAILED")
 	}
 }
 
 func TestLogoutHandlerWithCookie(t *testing.T) {
+	defer func() {
+		users = nil
+	}()
+	users = append(users, &User{Username:"testUser", Password:"testPassword"})
 	url := "http://127.0.0.1/logout"
 	req := httptest.NewRequest("GET", url, nil)
-	req.AddCookie(&http.Cookie{Name: "username", Value: "testUser"})
+	req.AddCookie(sessionFor("testUser"))
 	w := httptest.NewRecorder()
 
 	logoutHandler(w, req, nil)
@@ -216,8 +236,8 @@ func TestNewPostGetHandlerWithCookie(t *testing.T) {
 	}()
 	url := "http://127.0.0.1/testUset/newPost"
 	req := httptest.NewRequest("GET", url, nil)
-	req.AddCookie(&http.Cookie{Name:"username", Value:"testUser"})
 	users = append(users, &User{Username:"testUser", Password:"testPassword"})
+	req.AddCookie(sessionFor("testUser"))
 
 	w := httptest.NewRecorder()
 
@@ -246,13 +266,16 @@ func TestNewPostPostHandlerWithoutCookie(t *testing.T) {
 }
 
 func TestNewPostPostHandlerInvalidSymbols (t *testing.T) {
+	defer func() {
+		users = nil
+	}()
 	url := "http://127.0.0.1/users/testUser/newPost"
 	req := httptest.NewRequest("POST", url, nil)
-	req.AddCookie(&http.Cookie{Name:"username", Value:"testUser"})
+	users = append(users, &User{Username:"testUser", Password:"testPassword"})
+	req.AddCookie(sessionFor("testUser"))
 	req.ParseForm()
 	req.Form.Set("title", "¡¡¡¡")
 	req.Form.Set("body", "¡¡¡¡")
-	users = append(users, &User{Username:"testUser", Password:"testPassword"})
 	w := httptest.NewRecorder()
 
 	newPostPostHandler(w, req, httprouter.Params{{"username", "testUser"}})
@@ -270,9 +293,9 @@ func TestNewPostPostHandlerSuccess(t *testing.T) {
 	}()
 	url := "http://127.0.0.1/testUset/newPost"
 	req := httptest.NewRequest("POST", url, nil)
-	req.AddCookie(&http.Cookie{Name:"username", Value:"testUser"})
-	req.ParseForm()
 	users = append(users, &User{Username:"testUser", Password:"testPassword"})
+	req.AddCookie(sessionFor("testUser"))
+	req.ParseForm()
 	us := getUser("testUser")
 	us.ID = 1
 
@@ -280,13 +303,20 @@ func TestNewPostPostHandlerSuccess(t *testing.T) {
 
 	for i:= 0; i < 10; i++ {
 		pc := us.PostCount
-		newPost := Post{"title"+strconv.Itoa(i), "body"+strconv.Itoa(i), time.Now().Format(timeFormat)}
+		newPost := Post{ID: us.LastPostID + 1, Title: "title"+strconv.Itoa(i), Body: "body"+strconv.Itoa(i), Status: StatusPublished}
 		req.Form.Set("title", "title"+strconv.Itoa(i))
 		req.Form.Set("body", "body"+strconv.Itoa(i))
+		before := time.Now()
 		newPostPostHandler(w, req, httprouter.Params{{"username", "testUser"}})
 		result := w.Result()
 		l, _ := result.Location()
-		if result.StatusCode != 302 || l.Path != "/users/testUser" || us.Posts[0] != newPost || us.PostCount != pc+1 {
+		added := us.Posts[0]
+		if added.Date.Before(before) || added.Date.After(time.Now()) || added.Date.Location() != time.UTC {
+			t.Errorf("TestNewPostPostHandlerSuccess --> FAILED")
+			return
+		}
+		newPost.Date = added.Date
+		if result.StatusCode != 302 || l.Path != "/users/testUser" || !reflect.DeepEqual(added, newPost) || us.PostCount != pc+1 {
 			t.Errorf("TestNewPostPostHandlerSuccess --> FAILED")
 			return
 		}
@@ -314,9 +344,9 @@ func TestNewPostInvalidSymbolsGetHandlerWithCookie(t *testing.T) {
 	}()
 	url := "http://127.0.0.1/testUset/newPostInvalidSymbols"
 	req := httptest.NewRequest("GET", url, nil)
-	req.AddCookie(&http.Cookie{Name:"username", Value:"testUser"})
-	req.ParseForm()
 	users = append(users, &User{Username:"testUser", Password:"testPassword"})
+	req.AddCookie(sessionFor("testUser"))
+	req.ParseForm()
 	us := getUser("testUser")
 	us.ID = 1
 
@@ -346,9 +376,13 @@ func TestRegisterGetHandlerWithoutCookie(t *testing.T) {
 }
 
 func TestRegisterGetHandlerWithCookie (t *testing.T) {
+	defer func() {
+		users = nil
+	}()
+	users = append(users, &User{Username:"testUser", Password:"testPassword"})
 	url := "http://127.0.0.1/register"
 	req := httptest.NewRequest("GET", url, nil)
-	req.AddCookie(&http.Cookie{Name:"username", Value:"testUser"})
+	req.AddCookie(sessionFor("testUser"))
 	w := httptest.NewRecorder()
 
 	registerGetHandler(w, req, nil)
@@ -362,9 +396,13 @@ func TestRegisterGetHandlerWithCookie (t *testing.T) {
 }
 
 func TestRegisterPostHandlerWithCookie (t *testing.T) {
+	defer func() {
+		users = nil
+	}()
+	users = append(users, &User{Username:"testUser", Password:"testPassword"})
 	url := "http://127.0.0.1/register"
 	req := httptest.NewRequest("POST", url, nil)
-	req.AddCookie(&http.Cookie{Name:"username", Value:"testUser"})
+	req.AddCookie(sessionFor("testUser"))
 	w := httptest.NewRecorder()
 
 	registerPostHandler(w, req, nil)
@@ -399,7 +437,7 @@ func TestRegisterPostHandlerSuccess (t *testing.T) {
 		t.Errorf("TestRegisterPostHandlerSuccess --> FAILED")
 	}
 	for i:=0; i < desUser.PostCount; i++ {
-		if desUser.Posts[i] != users[0].Posts[i] {
+		if !reflect.DeepEqual(desUser.Posts[i], users[0].Posts[i]) {
 			t.Errorf("TestRegisterPostHandlerSuccess --> FAILED")
 		}
 	}
@@ -426,9 +464,13 @@ func TestRegisterSuccessHandlerWithoutSuccessCookie (t *testing.T) {
 }
 
 func TestRegisterSuccessHandlerWithUsernameCookie (t *testing.T) {
+	defer func() {
+		users = nil
+	}()
+	users = append(users, &User{Username:"testUser", Password:"testPassword"})
 	url := "http://127.0.0.1/registerSuccess"
 	req := httptest.NewRequest("GET", url, nil)
-	req.AddCookie(&http.Cookie{Name: "username", Value: "testUser"})
+	req.AddCookie(sessionFor("testUser"))
 	w := httptest.NewRecorder()
 
 	registerSuccessHandler(w, req, nil)
@@ -457,9 +499,13 @@ func TestRegisterSuccessHandler (t *testing.T) {
 }
 
 func TestRegisterGetHandlerUsernameAlreadyTakenWithCookie (t *testing.T) {
+	defer func() {
+		users = nil
+	}()
+	users = append(users, &User{Username:"testUser", Password:"testPassword"})
 	url := "http://127.0.0.1/registerUsernameAlreadyTaken"
 	req := httptest.NewRequest("GET", url, nil)
-	req.AddCookie(&http.Cookie{Name:"username", Value:"testUser"})
+	req.AddCookie(sessionFor("testUser"))
 	w := httptest.NewRecorder()
 
 	registerUsernameAlreadyTakenGetHandler(w, req, nil)
@@ -523,9 +569,13 @@ func TestRegisterPostHandlerUsernameAlreadyTaken (t *testing.T) {
 }
 
 func TestRegisterGetHandlerInvalidSymbolsWithCookie (t *testing.T) {
+	defer func() {
+		users = nil
+	}()
+	users = append(users, &User{Username:"testUser", Password:"testPassword"})
 	url := "http://127.0.0.1/registerInvalidSymbols"
 	req := httptest.NewRequest("GET", url, nil)
-	req.AddCookie(&http.Cookie{Name:"username", Value:"testUser"})
+	req.AddCookie(sessionFor("testUser"))
 	w := httptest.NewRecorder()
 
 	registerInvalidSymbolsGetHandler(w, req, nil)
@@ -559,9 +609,13 @@ func TestRegisterPostHandlerInvalidSymbols (t *testing.T) {
 }
 
 func TestIncorrectPasswordGetHandlerWithCookie(t *testing.T) {
+	defer func() {
+		users = nil
+	}()
+	users = append(users, &User{Username:"testUser", Password:"testPassword"})
 	url := "http://127.0.0.1/"
 	req := httptest.NewRequest("GET", url, nil)
-	req.AddCookie(&http.Cookie{Name:"username", Value:"testUser"})
+	req.AddCookie(sessionFor("testUser"))
 	w := httptest.NewRecorder()
 
 	incorrectPasswordGetHandler(w, req, nil)
@@ -606,9 +660,13 @@ func TestUserListHandlerWithoutCookie (t *testing.T) {
 }
 
 func TestUserListHandler (t *testing.T) {
+	defer func() {
+		users = nil
+	}()
+	users = append(users, &User{Username:"testUser", Password:"testPassword"})
 	url := "http://127.0.0.1/userList"
 	req := httptest.NewRequest("GET", url, nil)
-	req.AddCookie(&http.Cookie{Name:"username", Value:"testUser"})
+	req.AddCookie(sessionFor("testUser"))
 	w := httptest.NewRecorder()
 
 	userListHandler(w, req, nil)
@@ -618,6 +676,15 @@ func TestUserListHandler (t *testing.T) {
 	if result.StatusCode != 200 {
 		t.Errorf("TestUserListHandlerWithoutCookie --> FAILED")
 	}
+
+	// a disabled account is logged out of pages that don't check roles too
+	getUser("testUser").Disabled = true
+	w = httptest.NewRecorder()
+	userListHandler(w, req, nil)
+	l, _ := w.Result().Location()
+	if w.Code != 302 || l.Path != "/" {
+		t.Errorf("TestUserListHandler --> FAILED")
+	}
 }
 
 func TestUsersHandlerWithoutCookie (t *testing.T) {
@@ -642,8 +709,8 @@ func TestUsersHandlerHomepage (t *testing.T) {
 	}()
 	url := "http://127.0.0.1/users/testUser"
 	req := httptest.NewRequest("GET", url, nil)
-	req.AddCookie(&http.Cookie{Name:"username", Value:"testUser"})
 	users = append(users, &User{Username:"testUser", Password:"testPassword", ID:1})
+	req.AddCookie(sessionFor("testUser"))
 	w := httptest.NewRecorder()
 
 	usersHandler(w, req, httprouter.Params{{"username", "testUser"}})
@@ -661,8 +728,9 @@ func TestUsersHandlerUserPage (t *testing.T) {
 	}()
 	url := "http://127.0.0.1/users/AnotherTestUser"
 	req := httptest.NewRequest("GET", url, nil)
-	req.AddCookie(&http.Cookie{Name:"username", Value:"testUser"})
 	users = append(users, &User{Username:"AnotherTestUser", Password:"testPassword", ID:1})
+	users = append(users, &User{Username:"testUser", Password:"testPassword", ID:2})
+	req.AddCookie(sessionFor("testUser"))
 	w := httptest.NewRecorder()
 
 	usersHandler(w, req, httprouter.Params{{"username", "AnotherTestUser"}})
@@ -674,3 +742,98 @@ func TestUsersHandlerUserPage (t *testing.T) {
 	}
 }
 
+
+func TestEditPostPostHandler(t *testing.T) {
+	defer func() {
+		users = nil
+	}()
+	users = append(users, &User{Username:"testUser", Password:"testPassword", ID:1})
+	users = append(users, &User{Username:"AnotherTestUser", Password:"testPassword", ID:2})
+	us := getUser("testUser")
+	us.addPost(Post{Title:"title", Body:"body", Date:time.Now().UTC()})
+	req := httptest.NewRequest("POST", "http://127.0.0.1/users/testUser/posts/1/edit", nil)
+	req.AddCookie(sessionFor("AnotherTestUser"))
+	req.ParseForm()
+	req.Form.Set("title", "new title")
+	req.Form.Set("body", "¡¡¡¡")
+	w := httptest.NewRecorder()
+
+	editPostPostHandler(w, req, httprouter.Params{{"username", "testUser"}, {"id", "1"}})
+	if w.Code != http.StatusForbidden {
+		t.Errorf("TestEditPostPostHandler --> FAILED")
+	}
+
+	req.Header.Del("Cookie")
+	req.AddCookie(sessionFor("testUser"))
+	w = httptest.NewRecorder()
+	editPostPostHandler(w, req, httprouter.Params{{"username", "testUser"}, {"id", "1"}})
+	l, _ := w.Result().Location()
+	if l.Path != "/users/testUser/posts/1/edit" || us.Posts[0].Body != "body" {
+		t.Errorf("TestEditPostPostHandler --> FAILED")
+	}
+
+	req.Form.Set("body", "new body")
+	w = httptest.NewRecorder()
+	editPostPostHandler(w, req, httprouter.Params{{"username", "testUser"}, {"id", "1"}})
+	l, _ = w.Result().Location()
+	if l.Path != "/users/testUser/posts/1" || us.Posts[0].Title != "new title" || us.Posts[0].Body != "new body" {
+		t.Errorf("TestEditPostPostHandler --> FAILED")
+	}
+}
+
+func TestDeletePostHandler(t *testing.T) {
+	defer func() {
+		users = nil
+	}()
+	users = append(users, &User{Username:"testUser", Password:"testPassword", ID:1})
+	us := getUser("testUser")
+	us.addPost(Post{Title:"title", Body:"body", Date:time.Now().UTC()})
+	req := httptest.NewRequest("POST", "http://127.0.0.1/users/testUser/posts/1/delete", nil)
+	req.AddCookie(sessionFor("testUser"))
+	w := httptest.NewRecorder()
+
+	deletePostHandler(w, req, httprouter.Params{{"username", "testUser"}, {"id", "2"}})
+	if w.Code != http.StatusNotFound {
+		t.Errorf("TestDeletePostHandler --> FAILED")
+	}
+
+	w = httptest.NewRecorder()
+	deletePostHandler(w, req, httprouter.Params{{"username", "testUser"}, {"id", "1"}})
+	l, _ := w.Result().Location()
+	if l.Path != "/users/testUser" || us.PostCount != 0 || len(us.Posts) != 0 {
+		t.Errorf("TestDeletePostHandler --> FAILED")
+	}
+}
+
+func TestSessionCookie(t *testing.T) {
+	defer func() {
+		users = nil
+	}()
+	users = append(users, &User{Username: "testUser", Password: "testPassword"}, &User{Username: "admin", Password: "testPassword"})
+	users = append(users, &User{Username: "disabled", Password: "testPassword", Disabled: true})
+	old := &User{Username: "gone", Password: "oldPassword"}
+	users = append(users, old)
+	oldSession := sessionFor("gone").Value
+	// the account is deleted and its name taken again
+	users[3] = &User{Username: "gone", Password: "newPassword"}
+
+	for value, username := range map[string]string{
+		sessionFor("testUser").Value:       "testUser",
+		"testUser":                         "",
+		sessionFor("testUser").Value + "0": "",
+		strings.Replace(sessionFor("testUser").Value, "testUser", "admin", 1):               "",
+		signedValue(sessionPurpose(users[0]), "testUser", time.Now().Add(-time.Minute)): "",
+		signedValue("session", "testUser", time.Now().Add(sessionTTL)):                  "",
+		makePending2FA("testUser", time.Now()):                                          "",
+		signedValue(sessionPurpose(old), "nobody", time.Now().Add(sessionTTL)):          "",
+		oldSession:                   "",
+		sessionFor("disabled").Value: "",
+	} {
+		req := httptest.NewRequest("GET", "http://127.0.0.1/", nil)
+		req.AddCookie(&http.Cookie{Name: "username", Value: value})
+		c, err := sessionCookie(req)
+		if (username == "" && err != http.ErrNoCookie) || (username != "" && (err != nil || c.Value != username)) {
+			t.Errorf("TestSessionCookie --> FAILED: %s", value)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"src/github.com/pkg/errors"
+)
+
+// HTTP Signatures as Mastodon and other ActivityPub servers use them:
+// draft-cavage-http-signatures-12 with rsa-sha256 keys
+
+// signatures whose Date is further from now are refused
+const signatureMaxSkew = 12 * time.Hour
+
+func digestHeader(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// signingString builds the string the headers are signed as, the host of
+// incoming requests is in r.Host
+func signingString(r *http.Request, headers []string) (string, error) {
+	lines := make([]string, len(headers))
+	for i, h := range headers {
+		var value string
+		switch h {
+		case "(request-target)":
+			value = strings.ToLower(r.Method) + " " + r.URL.RequestURI()
+		case "host":
+			value = r.Host
+			if value == "" {
+				value = r.URL.Host
+			}
+		default:
+			vs := r.Header[http.CanonicalHeaderKey(h)]
+			if len(vs) == 0 {
+				return "", errors.Errorf("signed header %s is missing", h)
+			}
+			value = strings.Join(vs, ", ")
+		}
+		lines[i] = h + ": " + value
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// signRequest signs r with key, body is nil for requests without one
+func signRequest(r *http.Request, keyID string, key *rsa.PrivateKey, body []byte) error {
+	r.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	headers := []string{"(request-target)", "host", "date"}
+	if body != nil {
+		r.Header.Set("Digest", digestHeader(body))
+		headers = append(headers, "digest")
+	}
+	s, err := signingString(r, headers)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256([]byte(s))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return errors.Wrap(err, "can't sign request")
+	}
+	r.Header.Set("Signature", fmt.Sprintf(`keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		keyID, strings.Join(headers, " "), base64.StdEncoding.EncodeToString(sig)))
+	return nil
+}
+
+// parseSignature reads the parameters of a Signature header
+func parseSignature(header string) map[string]string {
+	params := make(map[string]string)
+	for _, part := range strings.Split(header, ",") {
+		i := strings.Index(part, "=")
+		if i < 0 {
+			continue
+		}
+		params[strings.TrimSpace(part[:i])] = strings.Trim(strings.TrimSpace(part[i+1:]), `"`)
+	}
+	return params
+}
+
+// signatureKeyID returns the key the request claims to be signed with
+func signatureKeyID(r *http.Request) (string, error) {
+	keyID := parseSignature(r.Header.Get("Signature"))["keyId"]
+	if keyID == "" {
+		return "", errors.New("request isn't signed")
+	}
+	return keyID, nil
+}
+
+// verifyRequest checks the signature of r made with key. Requests with
+// a body must sign its digest, so the body can't be replaced.
+func verifyRequest(r *http.Request, body []byte, key *rsa.PublicKey, now time.Time) error {
+	params := parseSignature(r.Header.Get("Signature"))
+	if params["algorithm"] != "" && params["algorithm"] != "rsa-sha256" && params["algorithm"] != "hs2019" {
+		return errors.Errorf("signature algorithm %s isn't supported", params["algorithm"])
+	}
+	headers := strings.Fields(strings.ToLower(params["headers"]))
+	if len(headers) == 0 {
+		headers = []string{"date"}
+	}
+	signed := make(map[string]bool)
+	for _, h := range headers {
+		signed[h] = true
+	}
+	if !signed["(request-target)"] || !signed["host"] || !signed["date"] || (body != nil && !signed["digest"]) {
+		return errors.New("signature doesn't cover the required headers")
+	}
+
+	date, err := http.ParseTime(r.Header.Get("Date"))
+	if err != nil {
+		return errors.Wrap(err, "bad date")
+	}
+	if d := now.Sub(date); d > signatureMaxSkew || d < -signatureMaxSkew {
+		return errors.Errorf("request is dated %s", date)
+	}
+	if body != nil && r.Header.Get("Digest") != digestHeader(body) {
+		return errors.New("digest doesn't match the body")
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(params["signature"])
+	if err != nil {
+		return errors.Wrap(err, "bad signature")
+	}
+	s, err := signingString(r, headers)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256([]byte(s))
+	err = rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig)
+	if err != nil {
+		return errors.New("signature doesn't match")
+	}
+	return nil
+}
+
+func encodePrivateKey(key *rsa.PrivateKey) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+}
+
+func decodePrivateKey(s string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, errors.New("not a PEM key")
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+func encodePublicKey(key *rsa.PublicKey) (string, error) {
+	data, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: data})), nil
+}
+
+// decodePublicKey reads PKIX and PKCS#1 public keys, servers publish both
+func decodePublicKey(s string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, errors.New("not a PEM key")
+	}
+	if block.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("only RSA keys are supported")
+	}
+	return rsaKey, nil
+}
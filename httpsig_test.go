@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSignRequest(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+	other, _ := rsa.GenerateKey(rand.Reader, 1024)
+	body := []byte(`{"type":"Follow"}`)
+	req := httptest.NewRequest("POST", "http://example.com/users/alice/inbox", bytes.NewReader(body))
+	err := signRequest(req, "https://remote.example/actor#main-key", key, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := signatureKeyID(req); id != "https://remote.example/actor#main-key" {
+		t.Errorf("TestSignRequest --> FAILED")
+	}
+	now := time.Now()
+	if verifyRequest(req, body, &key.PublicKey, now) != nil {
+		t.Errorf("TestSignRequest --> FAILED")
+	}
+	if verifyRequest(req, []byte(`{"type":"Like"}`), &key.PublicKey, now) == nil ||
+		verifyRequest(req, body, &other.PublicKey, now) == nil ||
+		verifyRequest(req, body, &key.PublicKey, now.Add(13*time.Hour)) == nil {
+		t.Errorf("TestSignRequest --> FAILED")
+	}
+	// another inbox can't be given the same request
+	req.URL.Path = "/users/bob/inbox"
+	if verifyRequest(req, body, &key.PublicKey, now) == nil {
+		t.Errorf("TestSignRequest --> FAILED")
+	}
+
+	// a request signed without its body
+	get := httptest.NewRequest("POST", "http://example.com/users/alice/inbox", bytes.NewReader(body))
+	signRequest(get, "key", key, nil)
+	if verifyRequest(get, nil, &key.PublicKey, now) != nil || verifyRequest(get, body, &key.PublicKey, now) == nil {
+		t.Errorf("TestSignRequest --> FAILED")
+	}
+}
+
+func TestDecodePublicKey(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+	pkix, err := encodePublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs1 := string(pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&key.PublicKey)}))
+	for _, s := range []string{pkix, pkcs1} {
+		decoded, err := decodePublicKey(s)
+		if err != nil || decoded.N.Cmp(key.N) != 0 {
+			t.Errorf("TestDecodePublicKey --> FAILED")
+		}
+	}
+	if _, err := decodePublicKey("not a key"); err == nil {
+		t.Errorf("TestDecodePublicKey --> FAILED")
+	}
+	private, err := decodePrivateKey(encodePrivateKey(key))
+	if err != nil || private.D.Cmp(key.D) != 0 {
+		t.Errorf("TestDecodePublicKey --> FAILED")
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"strings"
+
+	"src/github.com/julienschmidt/httprouter"
+)
+
+const (
+	identiconCells  = 5
+	identiconCell   = 20
+	identiconSize   = identiconCells*identiconCell + 2*identiconMargin
+	identiconMargin = 10
+)
+
+// Identicon is a symmetric 5x5 pattern of one color made from a username hash
+type Identicon struct {
+	Color color.RGBA
+	// Cells[y][x] are filled cells, the right half mirrors the left one
+	Cells [identiconCells][identiconCells]bool
+	// Hash identifies the picture for caching
+	Hash string
+}
+
+func newIdenticon(username string) Identicon {
+	sum := sha256.Sum256([]byte(username))
+	id := Identicon{Hash: hex.EncodeToString(sum[:8])}
+	// saturated colors of any hue look better than random bytes
+	hue := float64(int(sum[0])<<8|int(sum[1])) / 65536
+	id.Color = hslToRGB(hue, 0.45+float64(sum[2])/255*0.2, 0.45+float64(sum[3])/255*0.15)
+	bit := 0
+	for x := 0; x < (identiconCells+1)/2; x++ {
+		for y := 0; y < identiconCells; y++ {
+			filled := sum[4+bit/8]>>(uint(bit)%8)&1 == 1
+			id.Cells[y][x] = filled
+			id.Cells[y][identiconCells-1-x] = filled
+			bit++
+		}
+	}
+	return id
+}
+
+// hslToRGB converts a color with all components in [0, 1]
+func hslToRGB(h, s, l float64) color.RGBA {
+	var q float64
+	if l < 0.5 {
+		q = l * (1 + s)
+	} else {
+		q = l + s - l*s
+	}
+	p := 2*l - q
+	channel := func(t float64) uint8 {
+		if t < 0 {
+			t++
+		}
+		if t > 1 {
+			t--
+		}
+		var v float64
+		switch {
+		case t < 1.0/6:
+			v = p + (q-p)*6*t
+		case t < 1.0/2:
+			v = q
+		case t < 2.0/3:
+			v = p + (q-p)*(2.0/3-t)*6
+		default:
+			v = p
+		}
+		return uint8(v*255 + 0.5)
+	}
+	return color.RGBA{channel(h + 1.0/3), channel(h), channel(h - 1.0/3), 255}
+}
+
+func (id Identicon) Image() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, identiconSize, identiconSize))
+	draw.Draw(img, img.Bounds(), &image.Uniform{color.RGBA{240, 240, 240, 255}}, image.ZP, draw.Src)
+	for y := range id.Cells {
+		for x, filled := range id.Cells[y] {
+			if !filled {
+				continue
+			}
+			cell := image.Rect(0, 0, identiconCell, identiconCell).
+				Add(image.Pt(identiconMargin+x*identiconCell, identiconMargin+y*identiconCell))
+			draw.Draw(img, cell, &image.Uniform{id.Color}, image.ZP, draw.Src)
+		}
+	}
+	return img
+}
+
+func (id Identicon) SVG() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`,
+		identiconSize, identiconSize, identiconSize, identiconSize)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="#f0f0f0"/>`, identiconSize, identiconSize)
+	fmt.Fprintf(&b, `<g fill="#%02x%02x%02x">`, id.Color.R, id.Color.G, id.Color.B)
+	for y := range id.Cells {
+		for x, filled := range id.Cells[y] {
+			if filled {
+				fmt.Fprintf(&b, `<rect x="%d" y="%d" width="%d" height="%d"/>`,
+					identiconMargin+x*identiconCell, identiconMargin+y*identiconCell, identiconCell, identiconCell)
+			}
+		}
+	}
+	b.WriteString("</g></svg>")
+	return b.String()
+}
+
+// identiconHandler serves avatars for users without an uploaded one,
+// the picture never changes for a username so it's cached for long
+func identiconHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	us := getUser(ps.ByName("username"))
+	if us == nil {
+		http.NotFound(w, r)
+		return
+	}
+	svg := strings.HasSuffix(r.URL.Path, ".svg")
+	id := newIdenticon(us.Username)
+	etag := `"` + id.Hash + `"`
+	if svg {
+		etag = `"` + id.Hash + `-svg"`
+	}
+	w.Header().Set("Cache-Control", "public, max-age=604800")
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if svg {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write([]byte(id.SVG()))
+		return
+	}
+	var buf bytes.Buffer
+	err := png.Encode(&buf, id.Image())
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(buf.Bytes())
+}
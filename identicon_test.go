@@ -0,0 +1,83 @@
+package main
+
+import (
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"src/github.com/julienschmidt/httprouter"
+)
+
+func TestIdenticon(t *testing.T) {
+	a, b := newIdenticon("alice"), newIdenticon("bob")
+	if a != newIdenticon("alice") || a == b || a.Hash == b.Hash {
+		t.Errorf("TestIdenticon --> FAILED")
+	}
+	for y := range a.Cells {
+		for x := range a.Cells[y] {
+			if a.Cells[y][x] != a.Cells[y][identiconCells-1-x] {
+				t.Errorf("TestIdenticon --> FAILED")
+			}
+		}
+	}
+	img := a.Image()
+	if img.Bounds().Dx() != identiconSize || img.At(0, 0) != img.At(identiconSize-1, identiconSize-1) {
+		t.Errorf("TestIdenticon --> FAILED")
+	}
+}
+
+func TestHSLToRGB(t *testing.T) {
+	if c := hslToRGB(0, 1, 0.5); c.R != 255 || c.G != 0 || c.B != 0 {
+		t.Errorf("TestHSLToRGB --> FAILED")
+	}
+	if c := hslToRGB(1.0/3, 1, 0.5); c.R != 0 || c.G != 255 || c.B != 0 {
+		t.Errorf("TestHSLToRGB --> FAILED")
+	}
+	if c := hslToRGB(0.5, 0, 0.5); c.R != 128 || c.G != 128 || c.B != 128 {
+		t.Errorf("TestHSLToRGB --> FAILED")
+	}
+}
+
+func TestIdenticonHandler(t *testing.T) {
+	defer func() {
+		users = nil
+	}()
+	users = append(users, &User{Username: "testUser", Password: "testPassword", ID: 1})
+
+	req := httptest.NewRequest("GET", "http://127.0.0.1/users/testUser/avatar.png", nil)
+	w := httptest.NewRecorder()
+	identiconHandler(w, req, httprouter.Params{{"username", "testUser"}})
+
+	img, err := png.Decode(w.Body)
+	etag := w.Header().Get("ETag")
+	if w.Code != 200 || err != nil || img.Bounds().Dx() != identiconSize || etag == "" ||
+		!strings.Contains(w.Header().Get("Cache-Control"), "max-age") {
+		t.Errorf("TestIdenticonHandler --> FAILED")
+	}
+
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	identiconHandler(w, req, httprouter.Params{{"username", "testUser"}})
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("TestIdenticonHandler --> FAILED")
+	}
+
+	req = httptest.NewRequest("GET", "http://127.0.0.1/users/testUser/avatar.svg", nil)
+	w = httptest.NewRecorder()
+	identiconHandler(w, req, httprouter.Params{{"username", "testUser"}})
+	if w.Header().Get("Content-Type") != "image/svg+xml" || !strings.HasPrefix(w.Body.String(), "<svg") ||
+		w.Header().Get("ETag") == etag {
+		t.Errorf("TestIdenticonHandler --> FAILED")
+	}
+
+	w = httptest.NewRecorder()
+	identiconHandler(w, req, httprouter.Params{{"username", "nobody"}})
+	if w.Code != http.StatusNotFound {
+		t.Errorf("TestIdenticonHandler --> FAILED")
+	}
+	if (User{Username: "testUser"}).AvatarURL() != "/users/testUser/avatar.png" {
+		t.Errorf("TestIdenticonHandler --> FAILED")
+	}
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"src/github.com/asaskevich/govalidator"
+	"src/github.com/pkg/errors"
+)
+
+// wxrItem is an item of a WordPress export, only fields the blog has are read
+type wxrItem struct {
+	Title      string `xml:"title"`
+	Content    string `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+	PostDate   string `xml:"http://wordpress.org/export/1.2/ post_date"`
+	DateGMT    string `xml:"http://wordpress.org/export/1.2/ post_date_gmt"`
+	Status     string `xml:"http://wordpress.org/export/1.2/ status"`
+	Type       string `xml:"http://wordpress.org/export/1.2/ post_type"`
+	Categories []struct {
+		Domain   string `xml:"domain,attr"`
+		Nicename string `xml:"nicename,attr"`
+		Name     string `xml:",chardata"`
+	} `xml:"category"`
+}
+
+type wxrExport struct {
+	Items []wxrItem `xml:"channel>item"`
+}
+
+// importItem is a post read from another blog, Source tells where it's from in reports
+type importItem struct {
+	Source string
+	Post   Post
+	// why the item can't be imported, it's skipped when set
+	Problem string
+}
+
+type importReport struct {
+	Imported int
+	Skipped  []importItem
+}
+
+// formats of dates in WordPress exports and front matter
+var importDateFormats = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// Jekyll keeps the date in names like 2018-04-05-hello.md
+var jekyllNamePattern = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2})-`)
+
+var (
+	htmlCommentPattern = regexp.MustCompile(`(?s)<!--.*?-->`)
+	htmlBreakPattern   = regexp.MustCompile(`(?i)<br\s*/?>|</p>|</h[1-6]>|</li>|</blockquote>`)
+	htmlTagPattern     = regexp.MustCompile(`(?s)<[^>]*>`)
+	blankLinesPattern  = regexp.MustCompile(`\n{3,}`)
+	tagSlugPattern     = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+// asciiPunctuation replaces typographic characters editors put everywhere,
+// post bodies are ASCII only
+var asciiPunctuation = strings.NewReplacer(
+	"‘", "'", "’", "'", "“", `"`, "”", `"`,
+	"–", "-", "—", "--", "…", "...", " ", " ",
+)
+
+// parseImportDate reads a date in loc unless it has its own offset
+func parseImportDate(s string, loc *time.Location) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, format := range importDateFormats {
+		if t, err := time.ParseInLocation(format, s, loc); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, errors.Errorf("unknown date format %q", s)
+}
+
+// htmlToText turns the HTML of a post into the plain text posts have here
+func htmlToText(s string) string {
+	s = htmlCommentPattern.ReplaceAllString(s, "")
+	s = htmlBreakPattern.ReplaceAllString(s, "\n")
+	s = htmlTagPattern.ReplaceAllString(s, "")
+	s = asciiPunctuation.Replace(html.UnescapeString(s))
+	lines := strings.Split(strings.Replace(s, "\r\n", "\n", -1), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSpace(lines[i])
+	}
+	return strings.TrimSpace(blankLinesPattern.ReplaceAllString(strings.Join(lines, "\n"), "\n\n"))
+}
+
+// tagSlug makes a tag of a category name like "Web Development"
+func tagSlug(s string) string {
+	return strings.Trim(tagSlugPattern.ReplaceAllString(strings.ToLower(s), "-"), "-")
+}
+
+// importTags turns names into tags without duplicates
+func importTags(names []string) []string {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, name := range names {
+		tag := tagSlug(name)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// readWXR reads posts of a WordPress export, dates without an offset are in loc
+func readWXR(r io.Reader, loc *time.Location) ([]importItem, error) {
+	var export wxrExport
+	err := xml.NewDecoder(r).Decode(&export)
+	if err != nil {
+		return nil, errors.Wrap(err, "not a WordPress export")
+	}
+	var items []importItem
+	for i, it := range export.Items {
+		// pages, attachments and menu items aren't posts
+		if it.Type != "" && it.Type != "post" {
+			continue
+		}
+		item := importItem{Source: fmt.Sprintf("item %d", i+1)}
+		item.Post.Title = strings.TrimSpace(asciiPunctuation.Replace(html.UnescapeString(it.Title)))
+		item.Post.Body = htmlToText(it.Content)
+		var names []string
+		for _, c := range it.Categories {
+			name := c.Nicename
+			if name == "" {
+				name = c.Name
+			}
+			if (c.Domain == "post_tag" || c.Domain == "category") && name != "uncategorized" {
+				names = append(names, name)
+			}
+		}
+		item.Post.Tags = importTags(names)
+
+		// the GMT date is zero for drafts that were never published
+		date, err := parseImportDate(it.DateGMT, time.UTC)
+		if err != nil || date.Year() < 1970 {
+			date, err = parseImportDate(it.PostDate, loc)
+		}
+		if err != nil {
+			item.Problem = err.Error()
+		}
+		item.Post.Date = date
+		switch it.Status {
+		case "publish", "":
+			item.Post.Status = StatusPublished
+			scheduleFuturePost(&item.Post, time.Now())
+		case "future":
+			item.Post.Status, item.Post.PublishAt = StatusScheduled, date
+		default:
+			// pending, private and drafts
+			item.Post.Status = StatusDraft
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// parseFrontMatter splits a Markdown file into its YAML front matter and body.
+// Only what Jekyll and Hugo posts use is understood: scalars, inline lists
+// like [a, b] and block lists of "- item" lines, values are kept as lists.
+func parseFrontMatter(data []byte) (map[string][]string, string, error) {
+	text := strings.Replace(string(data), "\r\n", "\n", -1)
+	if !strings.HasPrefix(text, "---\n") {
+		return nil, "", errors.New("no front matter")
+	}
+	end := strings.Index(text[4:], "\n---")
+	if end < 0 {
+		return nil, "", errors.New("front matter isn't closed")
+	}
+	header, body := text[4:4+end], text[4+end+4:]
+	body = strings.TrimPrefix(body, "\n")
+
+	fields := make(map[string][]string)
+	key := ""
+	scanner := bufio.NewScanner(strings.NewReader(header))
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "- ") && key != "" {
+			fields[key] = append(fields[key], yamlScalar(trimmed[2:]))
+			continue
+		}
+		// nested maps aren't used by posts
+		if line != trimmed {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			return nil, "", errors.Errorf("can't read front matter line %q", line)
+		}
+		key = strings.ToLower(strings.TrimSpace(line[:i]))
+		value := strings.TrimSpace(line[i+1:])
+		switch {
+		case value == "":
+			fields[key] = nil
+		case strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]"):
+			fields[key] = nil
+			for _, v := range strings.Split(value[1:len(value)-1], ",") {
+				if v = yamlScalar(v); v != "" {
+					fields[key] = append(fields[key], v)
+				}
+			}
+		default:
+			fields[key] = []string{yamlScalar(value)}
+		}
+	}
+	return fields, body, nil
+}
+
+// yamlScalar unquotes a value and drops a trailing comment
+func yamlScalar(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	if i := strings.Index(s, " #"); i >= 0 {
+		s = strings.TrimSpace(s[:i])
+	}
+	return s
+}
+
+// scheduleFuturePost makes a published post dated in the future a scheduled
+// one, like the new post form does, so it doesn't go live before its date
+func scheduleFuturePost(post *Post, now time.Time) {
+	if post.Status == StatusPublished && post.Date.After(now) {
+		post.Status, post.PublishAt = StatusScheduled, post.Date
+	}
+}
+
+// readMarkdown reads posts from .md and .markdown files in dir
+func readMarkdown(dir string, loc *time.Location) ([]importItem, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't read "+dir)
+	}
+	var items []importItem
+	for _, file := range files {
+		ext := strings.ToLower(filepath.Ext(file.Name()))
+		if file.IsDir() || (ext != ".md" && ext != ".markdown") {
+			continue
+		}
+		item := importItem{Source: file.Name()}
+		data, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, errors.Wrap(err, "can't read "+file.Name())
+		}
+		fields, body, err := parseFrontMatter(data)
+		if err != nil {
+			item.Problem = err.Error()
+			items = append(items, item)
+			continue
+		}
+		first := func(key string) string {
+			if len(fields[key]) == 0 {
+				return ""
+			}
+			return fields[key][0]
+		}
+		item.Post.Title = asciiPunctuation.Replace(first("title"))
+		item.Post.Body = strings.TrimSpace(asciiPunctuation.Replace(body))
+		item.Post.Tags = importTags(append(append([]string(nil), fields["tags"]...), fields["categories"]...))
+		item.Post.Status = StatusPublished
+		if first("draft") == "true" || first("published") == "false" {
+			item.Post.Status = StatusDraft
+		}
+
+		date := first("date")
+		if date == "" {
+			if m := jekyllNamePattern.FindStringSubmatch(file.Name()); m != nil {
+				date = m[1]
+			}
+		}
+		if date == "" {
+			item.Problem = "no date"
+		} else if item.Post.Date, err = parseImportDate(date, loc); err != nil {
+			item.Problem = err.Error()
+		}
+		scheduleFuturePost(&item.Post, time.Now())
+		// scheduled posts of a takeout are drafts with the time to publish them
+		if at := first("publishat"); at != "" && item.Problem == "" {
+			if item.Post.PublishAt, err = parseImportDate(at, loc); err != nil {
+				item.Problem = err.Error()
+			} else {
+				item.Post.Status = StatusScheduled
+			}
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// validatePost checks what addPost and addDraft check before anything is changed
+func validatePost(post Post) error {
+	_, err := govalidator.ValidateStruct(post)
+	if err == nil {
+		err = checkTags(post.Tags)
+	}
+	return err
+}
+
+// importPost adds a post written elsewhere, it takes its place by date
+// among the posts instead of becoming the newest one
+func (u *User) importPost(post Post) error {
+	if !post.IsPublished() {
+		err := u.addDraft(post)
+		if err == nil && post.Status == StatusScheduled {
+			wakeScheduler()
+		}
+		return err
+	}
+	err := validatePost(post)
+	if err != nil {
+		return err
+	}
+	u.LastPostID++
+	post.ID = u.LastPostID
+	post.Status = StatusPublished
+	u.Posts = insertPost(u.Posts, post)
+	u.PostCount++
+	postIndex.add(u.Username, post)
+	return nil
+}
+
+// addDatedPost adds a post dated by a blog client, it takes its place by date
+// like an imported post and is announced like a new one
+func (u *User) addDatedPost(post Post) error {
+	err := u.importPost(post)
+	if err != nil {
+		return err
+	}
+	post = *u.getPost(u.LastPostID)
+	u.federatePost("Create", post)
+	u.sendWebmentions(post)
+	return nil
+}
+
+// hasPost tells whether the user has a post or a draft with the title and date,
+// importing the same file again doesn't make copies
+func (u *User) hasPost(title string, date time.Time) bool {
+	for _, posts := range [][]Post{u.Posts, u.Drafts} {
+		for _, p := range posts {
+			if p.Title == title && p.Date.Equal(date) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// importItems adds the items to the user's posts, the ones that fail
+// validation are reported as skipped. With dryRun nothing is added.
+func (u *User) importItems(items []importItem, dryRun bool) importReport {
+	var report importReport
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].Post.Date.Before(items[j].Post.Date)
+	})
+	for _, item := range items {
+		if item.Problem == "" && u.hasPost(item.Post.Title, item.Post.Date) {
+			item.Problem = "already imported"
+		}
+		if item.Problem == "" {
+			if err := validatePost(item.Post); err != nil {
+				item.Problem = err.Error()
+			}
+		}
+		if item.Problem != "" {
+			report.Skipped = append(report.Skipped, item)
+			continue
+		}
+		if !dryRun {
+			err := u.importPost(item.Post)
+			if err != nil {
+				item.Problem = err.Error()
+				report.Skipped = append(report.Skipped, item)
+				continue
+			}
+		}
+		report.Imported++
+	}
+	return report
+}
+
+// importCommand is "import [-dry-run] [-timezone zone] <username> <file.xml|dir>"
+func importCommand(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	flags.SetOutput(out)
+	dryRun := flags.Bool("dry-run", false, "only report what would be imported")
+	zone := flags.String("timezone", "", "zone of dates without an offset, the user's one by default")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return errors.New(commandUsage)
+	}
+	us := getUser(flags.Arg(0))
+	if us == nil {
+		return errors.Errorf("user %s doesn't exist", flags.Arg(0))
+	}
+	loc := us.location()
+	if *zone != "" {
+		loc, err = time.LoadLocation(*zone)
+		if err != nil {
+			return errors.Wrap(err, "unknown time zone")
+		}
+	}
+
+	src := flags.Arg(1)
+	info, err := os.Stat(src)
+	if err != nil {
+		return errors.Wrap(err, "nothing to import")
+	}
+	var items []importItem
+	if info.IsDir() {
+		items, err = readMarkdown(src, loc)
+	} else {
+		var data []byte
+		data, err = ioutil.ReadFile(src)
+		if err == nil {
+			items, err = readWXR(bytes.NewReader(data), loc)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	report := us.importItems(items, *dryRun)
+	if !*dryRun && report.Imported > 0 {
+		err = us.refreshUserInfo()
+		if err != nil {
+			return err
+		}
+		wakeScheduler()
+	}
+	verb := "imported"
+	if *dryRun {
+		verb = "would be imported"
+	}
+	fmt.Fprintf(out, "%d posts %s for %s, %d skipped\n", report.Imported, verb, us.Username, len(report.Skipped))
+	for _, item := range report.Skipped {
+		fmt.Fprintf(out, "  skipped %s %q: %s\n", item.Source, item.Post.Title, item.Problem)
+	}
+	return nil
+}
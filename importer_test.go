@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTMLToText(t *testing.T) {
+	text := htmlToText("<!-- wp:paragraph --><p>It&#8217;s <b>bold</b></p>\n\n\n<p>next&nbsp;line<br/>end</p>")
+	if text != "It's bold\n\nnext line\nend" {
+		t.Errorf("TestHTMLToText --> FAILED")
+	}
+}
+
+func TestParseFrontMatter(t *testing.T) {
+	data := "---\ntitle: \"Quoted: yes\"\ntags: [a, 'b c']\ncategories:\n  - x\n  - y # comment\nmeta:\n  nested: 1\n---\nbody\n"
+	fields, body, err := parseFrontMatter([]byte(data))
+	if err != nil || body != "body\n" || fields["title"][0] != "Quoted: yes" ||
+		strings.Join(fields["tags"], "|") != "a|b c" || strings.Join(fields["categories"], "|") != "x|y" {
+		t.Errorf("TestParseFrontMatter --> FAILED")
+	}
+	if _, _, err := parseFrontMatter([]byte("no front matter")); err == nil {
+		t.Errorf("TestParseFrontMatter --> FAILED")
+	}
+	if _, _, err := parseFrontMatter([]byte("---\ntitle: x\n")); err == nil {
+		t.Errorf("TestParseFrontMatter --> FAILED")
+	}
+}
+
+func TestReadWXR(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "import", "wordpress.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	moscow, _ := time.LoadLocation("Europe/Moscow")
+	items, err := readWXR(f, moscow)
+	// the page isn't a post
+	if err != nil || len(items) != 4 {
+		t.Fatal("TestReadWXR --> FAILED", err)
+	}
+	hello := items[0].Post
+	if hello.Title != "Hello & welcome" || hello.Body != "It's my first post.\n\nSecond line..." ||
+		strings.Join(hello.Tags, ",") != "golang,web-development" || hello.Status != StatusPublished ||
+		!hello.Date.Equal(time.Date(2017, 3, 1, 9, 0, 0, 0, time.UTC)) {
+		t.Errorf("TestReadWXR --> FAILED")
+	}
+	// a draft has no GMT date, its local one is used
+	draft := items[1].Post
+	if draft.Status != StatusDraft || !draft.Date.Equal(time.Date(2017, 4, 1, 7, 0, 0, 0, time.UTC)) {
+		t.Errorf("TestReadWXR --> FAILED")
+	}
+	if _, err := readWXR(strings.NewReader("not xml"), time.UTC); err == nil {
+		t.Errorf("TestReadWXR --> FAILED")
+	}
+}
+
+func TestReadMarkdown(t *testing.T) {
+	items, err := readMarkdown(filepath.Join("testdata", "import", "markdown"), time.UTC)
+	if err != nil || len(items) != 7 {
+		t.Fatal("TestReadMarkdown --> FAILED", err)
+	}
+	bySource := make(map[string]importItem)
+	for _, item := range items {
+		bySource[item.Source] = item
+	}
+	jekyll := bySource["2018-02-03-jekyll-post.md"]
+	if jekyll.Problem != "" || jekyll.Post.Title != "Jekyll post" || jekyll.Post.Body != "Written in *Markdown*." ||
+		strings.Join(jekyll.Post.Tags, ",") != "notes,go-lang" || !jekyll.Post.Date.Equal(time.Date(2018, 2, 3, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("TestReadMarkdown --> FAILED")
+	}
+	hugo := bySource["hugo-post.md"]
+	if hugo.Post.Body != "Hugo **body**." || strings.Join(hugo.Post.Tags, ",") != "hugo,static-sites" ||
+		!hugo.Post.Date.Equal(time.Date(2018, 3, 4, 7, 30, 0, 0, time.UTC)) || hugo.Post.Status != StatusPublished {
+		t.Errorf("TestReadMarkdown --> FAILED")
+	}
+	if bySource["hugo-draft.markdown"].Post.Status != StatusDraft || bySource["no-date.md"].Problem != "no date" ||
+		bySource["no-front-matter.md"].Problem == "" {
+		t.Errorf("TestReadMarkdown --> FAILED")
+	}
+	// posts dated in the future and scheduled posts of a takeout wait for their time
+	future := bySource["future-post.md"].Post
+	if future.Status != StatusScheduled || !future.PublishAt.Equal(time.Date(2999, 1, 2, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("TestReadMarkdown --> FAILED")
+	}
+	scheduled := bySource["takeout-scheduled.md"].Post
+	if scheduled.Status != StatusScheduled || !scheduled.PublishAt.Equal(time.Date(2999, 3, 4, 5, 6, 0, 0, time.UTC)) ||
+		!scheduled.Date.Equal(time.Date(2018, 4, 5, 16, 17, 0, 0, time.UTC)) {
+		t.Errorf("TestReadMarkdown --> FAILED")
+	}
+}
+
+func TestImportCommand(t *testing.T) {
+	defer func() {
+		users = nil
+		os.Remove("data/accounts/testUser.txt")
+	}()
+	us := &User{Username: "testUser", Password: "testPassword", ID: 1, Role: RoleAuthor, TimeZone: "UTC"}
+	users = append(users, us)
+	us.addPost(Post{Title: "newest", Body: "body", Date: time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)})
+	src := filepath.Join("testdata", "import", "wordpress.xml")
+
+	var out bytes.Buffer
+	err := importCommand([]string{"-dry-run", "testUser", src}, &out)
+	if err != nil || len(us.Posts) != 1 || !strings.Contains(out.String(), "2 posts would be imported for testUser, 2 skipped") {
+		t.Errorf("TestImportCommand --> FAILED")
+	}
+
+	out.Reset()
+	err = importCommand([]string{"testUser", src}, &out)
+	if err != nil || len(us.Posts) != 2 || len(us.Drafts) != 1 || us.PostCount != 2 ||
+		!strings.Contains(out.String(), `skipped item 5 "A very long title`) {
+		t.Errorf("TestImportCommand --> FAILED")
+	}
+	// imported posts are older, so they go after the newest one
+	if us.Posts[0].Title != "newest" || us.Posts[1].Title != "Hello & welcome" || us.Posts[1].ID != 2 {
+		t.Errorf("TestImportCommand --> FAILED")
+	}
+	saved, _ := readAccount("testUser")
+	if len(saved.Posts) != 2 {
+		t.Errorf("TestImportCommand --> FAILED")
+	}
+
+	out.Reset()
+	err = importCommand([]string{"testUser", src}, &out)
+	if err != nil || len(us.Posts) != 2 || !strings.Contains(out.String(), "already imported") {
+		t.Errorf("TestImportCommand --> FAILED")
+	}
+	if importCommand([]string{"nobody", src}, &out) == nil || importCommand([]string{"testUser", "missing.xml"}, &out) == nil {
+		t.Errorf("TestImportCommand --> FAILED")
+	}
+}
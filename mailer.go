@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"src/github.com/pkg/errors"
+)
+
+// Mailer delivers plain text messages to a single recipient.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+var mailer Mailer = &FileMailer{Dir: "data/mail"}
+
+// SMTPMailer sends messages through an SMTP relay.
+// Auth may be nil for relays that don't require it.
+type SMTPMailer struct {
+	Addr string
+	From string
+	Auth smtp.Auth
+}
+
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	msg := buildMessage(m.From, to, subject, body)
+	err := smtp.SendMail(m.Addr, m.Auth, m.From, []string{to}, msg)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("can't send mail to %s via %s", to, m.Addr))
+	}
+	return nil
+}
+
+// FileMailer doesn't send anything: every message is written to Dir as
+// an .eml file and logged, which is enough for local development and tests.
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+func (m *FileMailer) Send(to, subject, body string) error {
+	err := os.MkdirAll(m.Dir, 0700)
+	if err != nil {
+		return errors.Wrap(err, "can't create mail directory")
+	}
+	from := m.From
+	if from == "" {
+		from = "golangBlog <noreply@localhost>"
+	}
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), sanitizeFileName(to))
+	path := filepath.Join(m.Dir, name)
+	err = ioutil.WriteFile(path, buildMessage(from, to, subject, body), 0600)
+	if err != nil {
+		return errors.Wrap(err, "can't write mail file")
+	}
+	log.Printf("mail to %s (%s) saved to %s\n", to, subject, path)
+	return nil
+}
+
+// newMailerFromEnv returns an SMTPMailer when BLOG_SMTP_ADDR is set
+// and the default FileMailer otherwise.
+func newMailerFromEnv() Mailer {
+	from := os.Getenv("BLOG_MAIL_FROM")
+	addr := os.Getenv("BLOG_SMTP_ADDR")
+	if addr == "" {
+		return &FileMailer{Dir: "data/mail", From: from}
+	}
+	if from == "" {
+		from = "noreply@" + strings.Split(addr, ":")[0]
+	}
+	m := &SMTPMailer{Addr: addr, From: from}
+	if user := os.Getenv("BLOG_SMTP_USER"); user != "" {
+		m.Auth = smtp.PlainAuth("", user, os.Getenv("BLOG_SMTP_PASSWORD"), strings.Split(addr, ":")[0])
+	}
+	return m
+}
+
+func buildMessage(from, to, subject, body string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+	return b.Bytes()
+}
+
+func sanitizeFileName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, s)
+}
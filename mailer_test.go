@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type testMailer struct {
+	to, subject, body []string
+	// whether storeMu was held while a message was sent
+	locked bool
+}
+
+func (m *testMailer) Send(to, subject, body string) error {
+	if storeMu.TryLock() {
+		storeMu.Unlock()
+	} else {
+		m.locked = true
+	}
+	m.to = append(m.to, to)
+	m.subject = append(m.subject, subject)
+	m.body = append(m.body, body)
+	return nil
+}
+
+func TestFileMailer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := &FileMailer{Dir: filepath.Join(dir, "out"), From: "blog@localhost"}
+	if err := m.Send("user@example.com", "Hello", "line1\nline2"); err != nil {
+		t.Errorf("TestFileMailer --> FAILED")
+		return
+	}
+	files, _ := ioutil.ReadDir(m.Dir)
+	if len(files) != 1 || !strings.HasSuffix(files[0].Name(), "-user_example.com.eml") {
+		t.Errorf("TestFileMailer --> FAILED")
+		return
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(m.Dir, files[0].Name()))
+	msg := string(data)
+	if !strings.Contains(msg, "From: blog@localhost\r\n") || !strings.Contains(msg, "To: user@example.com\r\n") ||
+		!strings.Contains(msg, "Subject: Hello\r\n") || !strings.HasSuffix(msg, "\r\n\r\nline1\r\nline2") {
+		t.Errorf("TestFileMailer --> FAILED")
+	}
+}
+
+func TestNewMailerFromEnv(t *testing.T) {
+	defer os.Unsetenv("BLOG_SMTP_ADDR")
+	os.Unsetenv("BLOG_SMTP_ADDR")
+	if _, ok := newMailerFromEnv().(*FileMailer); !ok {
+		t.Errorf("TestNewMailerFromEnv --> FAILED")
+	}
+	os.Setenv("BLOG_SMTP_ADDR", "mail.example.com:25")
+	m, ok := newMailerFromEnv().(*SMTPMailer)
+	if !ok || m.Addr != "mail.example.com:25" || m.From != "noreply@mail.example.com" || m.Auth != nil {
+		t.Errorf("TestNewMailerFromEnv --> FAILED")
+	}
+}
@@ -1,48 +1,93 @@
 package main
 
 import (
+	"bytes"
 	"net/http"
 	"fmt"
 	"log"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 	"encoding/json"
 	"io/ioutil"
 
 	"src/github.com/julienschmidt/httprouter"
 	"src/github.com/asaskevich/govalidator"
+	"src/github.com/pkg/errors"
 )
 
-func startServer(addr string, handler http.Handler) {
+// loadUsers reads all accounts from data/accounts
+func loadUsers() error {
 	files, err := ioutil.ReadDir("data/accounts")
 	if err != nil {
-		log.Println(err, "reading directory error")
-		return
+		return errors.Wrap(err, "reading directory error")
 	}
 	for _, file := range files {
 		data, err := ioutil.ReadFile("data/accounts/" + file.Name())
 		if err != nil {
-			log.Println(err, "reading file error")
-			return
+			return errors.Wrap(err, "reading file error")
+		}
+
+		data, applied, err := migrateAccount(data)
+		if err != nil {
+			return errors.Wrap(err, "migration error: "+file.Name())
 		}
 
 		us := User{}
 
 		err = json.Unmarshal(data, &us)
 		if err != nil {
-			log.Println(err, "unmarshal error")
-			return
+			return errors.Wrap(err, "unmarshal error")
+		}
+
+		if len(applied) > 0 {
+			err = us.refreshUserInfo()
+			if err != nil {
+				return err
+			}
 		}
 
 		_, err = govalidator.ValidateStruct(us)
 		if err != nil {
-			log.Printf("can't upload data to program: user:%s ID:%v doesn't pass validation\n",
+			return errors.Errorf("can't upload data to program: user:%s ID:%v doesn't pass validation",
 				us.Username, us.ID)
-			return
 		}
 
 		users = append(users, &us)
-		ID++
+		postIndex.addUser(&us)
+		// deleted accounts leave gaps, so the count of accounts can be taken
+		if us.ID >= ID {
+			ID = us.ID + 1
+		}
+	}
+
+	return nil
+}
+
+func startServer(addr string, handler http.Handler) {
+	key, err := loadSecretKey("data/secret.key")
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	secretKey = key
+
+	err = loadUsers()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	err = serveAdminSocket(adminSocket)
+	if err != nil {
+		log.Println(err)
+		return
 	}
+	startScheduler()
+	startDelivery()
+	startInbox()
+	startWebmentions()
 
 	fmt.Print("Server started at ", addr, "\n\n")
 	http.ListenAndServe(addr, handler)
@@ -70,27 +115,158 @@ func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	fmt.Printf("[%s] %s, %s %s\n-\n", r.Method, r.RemoteAddr, r.URL.Path, time.Since(start))
 }
 
+// bufferedResponse keeps a response in memory until storeMu is released
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bufferedResponse) Write(data []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	return b.body.Write(data)
+}
+
+// locked serves a handler that reads or changes users under storeMu.
+// The form is read before and the response is sent after storeMu is held,
+// so slow clients don't hold up the others. Handlers of uploads and files
+// aren't wrapped, they take storeMu only around their use of users.
+func locked(next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		// what FormValue would read under storeMu
+		r.ParseMultipartForm(32 << 20)
+		resp := &bufferedResponse{header: make(http.Header)}
+		func() {
+			storeMu.Lock()
+			defer storeMu.Unlock()
+			next(resp, r, ps)
+		}()
+		for name, values := range resp.header {
+			w.Header()[name] = values
+		}
+		if resp.status == 0 {
+			resp.status = http.StatusOK
+		}
+		w.WriteHeader(resp.status)
+		w.Write(resp.body.Bytes())
+	}
+}
+
 func main() {
+	if u := os.Getenv("BLOG_BASE_URL"); u != "" {
+		baseURL = strings.TrimRight(u, "/")
+	}
+	mailer = newMailerFromEnv()
+	if n, err := strconv.Atoi(os.Getenv("BLOG_POSTS_PER_PAGE")); err == nil && n > 0 {
+		postsPerPage, timelinePageSize = n, n
+	}
+	if n, err := strconv.Atoi(os.Getenv("BLOG_USERS_PER_PAGE")); err == nil && n > 0 {
+		usersPerPage = n
+	}
+
+	if len(os.Args) > 1 {
+		err := command(os.Args[1:], os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	httpMux := httprouter.New()
 
-	httpMux.GET("/", mainGetHandler)
-	httpMux.POST("/", mainPostHandler)
-	httpMux.GET("/logout", logoutHandler)
-	httpMux.GET("/users/:username/newPost", newPostGetHandler)
-	httpMux.POST("/users/:username/newPost", newPostPostHandler)
-	httpMux.GET("/users/:username/newPostInvalidSymbols", newPostInvalidSymbolsGetHandler)
-	httpMux.POST("/users/:username/newPostInvalidSymbols", newPostPostHandler)
-	httpMux.GET("/register", registerGetHandler)
-	httpMux.POST("/register", registerPostHandler)
-	httpMux.GET("/registerUsernameAlreadyTaken", registerUsernameAlreadyTakenGetHandler)
-	httpMux.POST("/registerUsernameAlreadyTaken", registerPostHandler)
-	httpMux.GET("/registerInvalidSymbols", registerInvalidSymbolsGetHandler)
-	httpMux.POST("/registerInvalidSymbols", registerPostHandler)
-	httpMux.GET("/incorrectPassword", incorrectPasswordGetHandler)
-	httpMux.POST("/incorrectPassword", mainPostHandler)
-	httpMux.GET("/registerSuccess", registerSuccessHandler)
-	httpMux.GET("/userList", userListHandler)
-	httpMux.GET("/users/:username/", usersHandler)
+	httpMux.GET("/", locked(mainGetHandler))
+	httpMux.POST("/", locked(mainPostHandler))
+	httpMux.GET("/logout", locked(logoutHandler))
+	httpMux.GET("/users/:username/newPost", requireRole(locked(newPostGetHandler), writers...))
+	httpMux.POST("/users/:username/newPost", requireRole(newPostPostHandler, writers...))
+	httpMux.GET("/users/:username/newPostInvalidSymbols", requireRole(locked(newPostInvalidSymbolsGetHandler), writers...))
+	httpMux.POST("/users/:username/newPostInvalidSymbols", requireRole(newPostPostHandler, writers...))
+	httpMux.GET("/register", locked(registerGetHandler))
+	httpMux.POST("/register", locked(registerPostHandler))
+	httpMux.GET("/registerUsernameAlreadyTaken", locked(registerUsernameAlreadyTakenGetHandler))
+	httpMux.POST("/registerUsernameAlreadyTaken", locked(registerPostHandler))
+	httpMux.GET("/registerInvalidSymbols", locked(registerInvalidSymbolsGetHandler))
+	httpMux.POST("/registerInvalidSymbols", locked(registerPostHandler))
+	httpMux.GET("/incorrectPassword", locked(incorrectPasswordGetHandler))
+	httpMux.POST("/incorrectPassword", locked(mainPostHandler))
+	httpMux.GET("/registerSuccess", locked(registerSuccessHandler))
+	httpMux.GET("/forgotPassword", locked(forgotPasswordGetHandler))
+	httpMux.POST("/forgotPassword", forgotPasswordPostHandler)
+	httpMux.GET("/forgotPasswordSent", locked(forgotPasswordSentHandler))
+	httpMux.GET("/resetPassword", locked(resetPasswordGetHandler))
+	httpMux.POST("/resetPassword", locked(resetPasswordPostHandler))
+	httpMux.GET("/resetPasswordSuccess", locked(resetPasswordSuccessHandler))
+	httpMux.GET("/login2fa", locked(login2FAGetHandler))
+	httpMux.POST("/login2fa", locked(login2FAPostHandler))
+	httpMux.GET("/tooManyCodes", locked(tooManyCodesGetHandler))
+	httpMux.GET("/users/:username/avatar.png", locked(identiconHandler))
+	httpMux.GET("/users/:username/avatar.svg", locked(identiconHandler))
+	httpMux.GET("/users/:username/profile", locked(profileGetHandler))
+	httpMux.POST("/users/:username/profile", profilePostHandler)
+	httpMux.GET("/users/:username/email", locked(emailGetHandler))
+	httpMux.POST("/users/:username/email", locked(emailPostHandler))
+	httpMux.GET("/users/:username/2fa", locked(twoFactorGetHandler))
+	httpMux.POST("/users/:username/2fa", locked(twoFactorPostHandler))
+	httpMux.GET("/users/:username/timezone", locked(timeZoneGetHandler))
+	httpMux.POST("/users/:username/timezone", locked(timeZonePostHandler))
+	httpMux.GET("/users/:username/2fa/qr.png", locked(twoFactorQRHandler))
+	httpMux.POST("/users/:username/takeout", requireRole(locked(takeoutHandler), roles...))
+	httpMux.GET("/users/:username/takeout.zip", requireRole(takeoutDownloadHandler, roles...))
+	httpMux.GET("/.well-known/webfinger", locked(webfingerHandler))
+	httpMux.GET("/users/:username/actor", actorHandler)
+	httpMux.GET("/users/:username/outbox", locked(outboxHandler))
+	httpMux.GET("/users/:username/followers", locked(followersHandler))
+	httpMux.POST("/users/:username/inbox", inboxHandler)
+	httpMux.POST("/webmention", locked(webmentionHandler))
+	httpMux.GET("/micropub", locked(micropubGetHandler))
+	httpMux.POST("/micropub", micropubPostHandler)
+	httpMux.POST("/xmlrpc", xmlrpcHandler)
+	httpMux.GET("/users/:username/tokens", requireRole(locked(tokensGetHandler), writers...))
+	httpMux.POST("/users/:username/tokens", requireRole(locked(tokensPostHandler), writers...))
+	httpMux.POST("/users/:username/tokens/:id/revoke", requireRole(locked(revokeTokenHandler), writers...))
+	httpMux.GET("/userList", locked(userListHandler))
+	httpMux.POST("/users/:username/uploads", requireRole(uploadHandler, writers...))
+	httpMux.GET("/media/:name", mediaHandler)
+	httpMux.GET("/search", locked(searchHandler))
+	httpMux.GET("/tags/:tag", locked(tagHandler))
+	httpMux.GET("/tags/:tag/feed.xml", locked(tagFeedHandler))
+	httpMux.GET("/api/search", locked(searchAPIHandler))
+	httpMux.GET("/users/:username/", locked(usersHandler))
+	httpMux.GET("/users/:username/feed.json", locked(userFeedHandler))
+	httpMux.GET("/sitemap.xml", locked(sitemapHandler))
+	httpMux.GET("/sitemaps/:page", locked(sitemapPageHandler))
+	httpMux.POST("/users/:username/follow", requireRole(locked(followHandler), roles...))
+	httpMux.POST("/users/:username/unfollow", requireRole(locked(unfollowHandler), roles...))
+	httpMux.GET("/users/:username/posts/:id", locked(postHandler))
+	httpMux.GET("/users/:username/drafts", requireRole(locked(draftsHandler), writers...))
+	httpMux.POST("/users/:username/drafts/:id/publish", requireRole(locked(publishDraftHandler), writers...))
+	httpMux.POST("/users/:username/drafts/:id/schedule", requireRole(locked(scheduleDraftHandler), writers...))
+	httpMux.POST("/users/:username/drafts/:id/delete", requireRole(locked(deleteDraftHandler), writers...))
+	httpMux.GET("/users/:username/posts/:id/edit", requireRole(locked(editPostGetHandler), writers...))
+	httpMux.POST("/users/:username/posts/:id/edit", requireRole(locked(editPostPostHandler), writers...))
+	httpMux.POST("/users/:username/posts/:id/delete", requireRole(locked(deletePostHandler), writers...))
+	httpMux.GET("/users/:username/posts/:id/history", locked(historyHandler))
+	httpMux.POST("/users/:username/posts/:id/revisions/:rev/restore", requireRole(locked(restoreRevisionHandler), writers...))
+	httpMux.POST("/users/:username/posts/:id/comments", requireRole(locked(newCommentHandler), roles...))
+	httpMux.POST("/users/:username/posts/:id/comments/:cid/delete", requireRole(locked(deleteCommentHandler), roles...))
+	httpMux.GET("/accountDisabled", locked(accountDisabledGetHandler))
+	httpMux.GET("/admin", requireRole(locked(adminHandler), RoleAdmin, RoleModerator))
+	httpMux.GET("/admin/users/:username", requireRole(locked(adminUserHandler), RoleAdmin, RoleModerator))
+	httpMux.POST("/admin/users/:username/disable", requireRole(locked(adminDisableHandler), RoleAdmin))
+	httpMux.POST("/admin/users/:username/enable", requireRole(locked(adminEnableHandler), RoleAdmin))
+	httpMux.POST("/admin/users/:username/role", requireRole(locked(adminRoleHandler), RoleAdmin))
+	httpMux.POST("/admin/users/:username/password", requireRole(locked(adminPasswordHandler), RoleAdmin))
+	httpMux.POST("/admin/users/:username/posts/:id/delete", requireRole(locked(adminDeletePostHandler), RoleAdmin, RoleModerator))
 	httpMux.ServeFiles("/images/*filepath", http.Dir("./images"))
 	httpMux.ServeFiles("/users/:username/images/*filepath", http.Dir("./images"))
 
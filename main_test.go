@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"src/github.com/julienschmidt/httprouter"
+)
+
+// storeChecker remembers whether storeMu was held while a client was read from or written to
+type storeChecker struct {
+	*httptest.ResponseRecorder
+	body   io.Reader
+	locked bool
+}
+
+func (c *storeChecker) check() {
+	if !storeMu.TryLock() {
+		c.locked = true
+		return
+	}
+	storeMu.Unlock()
+}
+
+func (c *storeChecker) Read(p []byte) (int, error) {
+	c.check()
+	return c.body.Read(p)
+}
+
+func (c *storeChecker) Write(p []byte) (int, error) {
+	c.check()
+	return c.ResponseRecorder.Write(p)
+}
+
+func TestLocked(t *testing.T) {
+	handler := locked(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		if storeMu.TryLock() {
+			storeMu.Unlock()
+			t.Errorf("TestLocked --> FAILED")
+		}
+		http.SetCookie(w, &http.Cookie{Name: "a", Value: "b"})
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, r.FormValue("x"))
+	})
+	c := &storeChecker{ResponseRecorder: httptest.NewRecorder(), body: strings.NewReader("x=sent")}
+	req := httptest.NewRequest("POST", "http://127.0.0.1/", c)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	handler(c, req, nil)
+	if c.locked || c.Code != http.StatusCreated || c.Body.String() != "sent" || c.Result().Cookies()[0].Value != "b" {
+		t.Errorf("TestLocked --> FAILED")
+	}
+
+	// a redirect without a body and an empty response
+	for path, status := range map[string]int{"/redirect": http.StatusFound, "/empty": http.StatusOK} {
+		handler = locked(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+			if r.URL.Path == "/redirect" {
+				http.Redirect(w, r, "/", http.StatusFound)
+			}
+		})
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "http://127.0.0.1"+path, nil), nil)
+		if w.Code != status {
+			t.Errorf("TestLocked --> FAILED: %s", path)
+		}
+	}
+}
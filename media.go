@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"src/github.com/julienschmidt/httprouter"
+	"src/github.com/pkg/errors"
+)
+
+const (
+	maxUploadSize = 5 << 20
+	// images bigger than that are refused before decoding
+	maxImagePixels = 40000000
+	maxImages      = 4
+	thumbnailSize  = 320
+)
+
+// mediaDir keeps uploaded images named after the sha256 of their content
+var mediaDir = "data/media"
+
+// extensions of stored images by sniffed content types, gifs are stored as png
+var imageTypes = map[string]string{
+	"image/jpeg": "jpg",
+	"image/png":  "png",
+	"image/gif":  "png",
+}
+
+var mediaNamePattern = regexp.MustCompile(`^[0-9a-f]{64}(_thumb)?\.(jpg|png)$`)
+
+// Upload is an image uploaded by a user, Name is the file name in mediaDir
+type Upload struct {
+	Name   string
+	Width  int
+	Height int
+	Size   int
+	Date   time.Time
+}
+
+func thumbName(name string) string {
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext) + "_thumb" + ext
+}
+
+// thumbnail scales img down to fit into a size x size square averaging
+// the pixels each new pixel covers, smaller images are returned as is
+func thumbnail(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return img
+	}
+	tw, th := size, maxInt(h*size/w, 1)
+	if h > w {
+		tw, th = maxInt(w*size/h, 1), size
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		y0, y1 := b.Min.Y+y*h/th, b.Min.Y+(y+1)*h/th
+		for x := 0; x < tw; x++ {
+			x0, x1 := b.Min.X+x*w/tw, b.Min.X+(x+1)*w/tw
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, bl, a, n = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{uint8(r / n >> 8), uint8(g / n >> 8), uint8(bl / n >> 8), uint8(a / n >> 8)})
+		}
+	}
+	return dst
+}
+
+func encodeImage(img image.Image, ext string) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	if ext == "jpg" {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	return buf.Bytes(), err
+}
+
+// storeImage checks that data is an image and saves it with a thumbnail.
+// The image is decoded and encoded again, so EXIF and other metadata
+// like the location a photo was taken at never reach the disk.
+func storeImage(data []byte) (Upload, error) {
+	if len(data) > maxUploadSize {
+		return Upload{}, errors.Errorf("image is bigger than %d bytes", maxUploadSize)
+	}
+	ext, ok := imageTypes[http.DetectContentType(data)]
+	if !ok {
+		return Upload{}, errors.Errorf("%s isn't an allowed image type", http.DetectContentType(data))
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return Upload{}, errors.Wrap(err, "can't read image size")
+	}
+	if config.Width*config.Height > maxImagePixels {
+		return Upload{}, errors.Errorf("image %dx%d is too big", config.Width, config.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return Upload{}, errors.Wrap(err, "can't decode image")
+	}
+	clean, err := encodeImage(img, ext)
+	if err != nil {
+		return Upload{}, errors.Wrap(err, "can't encode image")
+	}
+	thumb, err := encodeImage(thumbnail(img, thumbnailSize), ext)
+	if err != nil {
+		return Upload{}, errors.Wrap(err, "can't encode thumbnail")
+	}
+
+	sum := sha256.Sum256(clean)
+	upload := Upload{
+		Name:   hex.EncodeToString(sum[:]) + "." + ext,
+		Width:  config.Width,
+		Height: config.Height,
+		Size:   len(clean),
+		Date:   time.Now().UTC(),
+	}
+	err = os.MkdirAll(mediaDir, 0700)
+	if err != nil {
+		return Upload{}, errors.Wrap(err, "can't create media directory")
+	}
+	// the same content has the same name, so existing files are kept
+	for name, content := range map[string][]byte{upload.Name: clean, thumbName(upload.Name): thumb} {
+		path := filepath.Join(mediaDir, name)
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+		err = writeMediaFile(path, content)
+		if err != nil {
+			return Upload{}, errors.Wrap(err, "can't save image")
+		}
+	}
+	return upload, nil
+}
+
+// writeMediaFile writes through a temporary file, so a file of mediaDir is
+// never seen half written by requests or a backup running meanwhile
+func writeMediaFile(path string, content []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// addUpload remembers the image among uploads of the user
+func (u *User) addUpload(upload Upload) {
+	for _, up := range u.Uploads {
+		if up.Name == upload.Name {
+			return
+		}
+	}
+	u.Uploads = append(u.Uploads, upload)
+}
+
+func (u User) HasUpload(name string) bool {
+	for _, up := range u.Uploads {
+		if up.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// limitUploads caps the size of a request carrying up to maxImages images
+func limitUploads(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImages*maxUploadSize+1<<20)
+}
+
+// storeImageFiles stores images sent as files of a multipart form.
+// Decoding images is slow, so it's called without storeMu.
+func storeImageFiles(files []*multipart.FileHeader) ([]Upload, error) {
+	var uploads []Upload
+	for _, fh := range files {
+		f, err := fh.Open()
+		if err != nil {
+			return nil, errors.Wrap(err, "can't open uploaded file")
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(f, maxUploadSize+1))
+		f.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "can't read uploaded file")
+		}
+		upload, err := storeImage(data)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("can't store %s", fh.Filename))
+		}
+		uploads = append(uploads, upload)
+	}
+	return uploads, nil
+}
+
+// formImages stores images sent in the "images" field of a multipart form
+// of a new post, it's called without storeMu
+func formImages(r *http.Request) ([]Upload, error) {
+	var files []*multipart.FileHeader
+	if r.MultipartForm != nil {
+		files = r.MultipartForm.File["images"]
+	}
+	if len(r.Form["attach"])+len(files) > maxImages {
+		return nil, errors.Errorf("a post can have up to %d images, got %d", maxImages, len(r.Form["attach"])+len(files))
+	}
+	return storeImageFiles(files)
+}
+
+// postImages returns names of images to attach to a new post: earlier uploads
+// of the user chosen in the "attach" field and images stored by formImages.
+// The stored images become uploads of the user once the post is added.
+func postImages(u *User, r *http.Request, uploads []Upload) ([]string, error) {
+	var names []string
+	for _, name := range r.Form["attach"] {
+		if !u.HasUpload(name) {
+			return nil, errors.Errorf("user:%s ID:%v doesn't have upload %s", u.Username, u.ID, name)
+		}
+		names = append(names, name)
+	}
+	for _, upload := range uploads {
+		names = append(names, upload.Name)
+	}
+	return names, nil
+}
+
+// discardUploads removes files of images stored for a request that failed,
+// it's called under storeMu. Files are named after their content, so the
+// ones that are uploads of some user stay.
+func discardUploads(uploads []Upload) {
+	for _, upload := range uploads {
+		used := false
+		for _, us := range users {
+			if us.HasUpload(upload.Name) {
+				used = true
+				break
+			}
+		}
+		if !used {
+			os.Remove(filepath.Join(mediaDir, upload.Name))
+			os.Remove(filepath.Join(mediaDir, thumbName(upload.Name)))
+		}
+	}
+}
+
+type uploadJSON struct {
+	Name      string `json:"name"`
+	URL       string `json:"url"`
+	Thumbnail string `json:"thumbnail"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+}
+
+// uploadHandler stores an image sent in the "image" field and answers with its links
+func uploadHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	storeMu.Lock()
+	usernameCookie, err := sessionCookie(r)
+	storeMu.Unlock()
+	if err == http.ErrNoCookie {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if usernameCookie.Value != ps.ByName("username") {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize+1<<20)
+	f, _, err := r.FormFile("image")
+	if err != nil {
+		http.Error(w, "an image is expected in the \"image\" field", http.StatusBadRequest)
+		return
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(f, maxUploadSize+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	upload, err := storeImage(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	storeMu.Lock()
+	// the account may have been deleted or disabled meanwhile
+	us := getUser(usernameCookie.Value)
+	if us == nil || us.Disabled {
+		storeMu.Unlock()
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	us.addUpload(upload)
+	err = us.refreshUserInfo()
+	storeMu.Unlock()
+	if err != nil {
+		panic(err)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(uploadJSON{
+		Name:      upload.Name,
+		URL:       baseURL + "/media/" + upload.Name,
+		Thumbnail: baseURL + "/media/" + thumbName(upload.Name),
+		Width:     upload.Width,
+		Height:    upload.Height,
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// mediaHandler serves stored images. Names are checked instead of using
+// ServeFiles so that the directory can't be listed.
+func mediaHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	name := ps.ByName("name")
+	if !mediaNamePattern.MatchString(name) {
+		http.NotFound(w, r)
+		return
+	}
+	// content never changes for a name
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeFile(w, r, filepath.Join(mediaDir, name))
+}
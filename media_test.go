@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"src/github.com/julienschmidt/httprouter"
+)
+
+func testImage(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 200, 255})
+		}
+	}
+	return img
+}
+
+func testPNG(w, h int) []byte {
+	var buf bytes.Buffer
+	png.Encode(&buf, testImage(w, h))
+	return buf.Bytes()
+}
+
+// withMediaDir points mediaDir to a temporary directory for a test
+func withMediaDir(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "media")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := mediaDir
+	mediaDir = dir
+	return func() {
+		mediaDir = old
+		os.RemoveAll(dir)
+	}
+}
+
+func TestThumbnail(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 640, 200))
+	for x := 0; x < 640; x++ {
+		for y := 0; y < 200; y++ {
+			if x%2 == 0 {
+				img.Set(x, y, color.RGBA{255, 255, 255, 255})
+			} else {
+				img.Set(x, y, color.RGBA{0, 0, 0, 255})
+			}
+		}
+	}
+	thumb := thumbnail(img, 320)
+	if thumb.Bounds().Dx() != 320 || thumb.Bounds().Dy() != 100 {
+		t.Errorf("TestThumbnail --> FAILED")
+	}
+	// every thumbnail pixel averages a white and a black column
+	r, _, _, _ := thumb.At(10, 10).RGBA()
+	if r>>8 < 120 || r>>8 > 135 {
+		t.Errorf("TestThumbnail --> FAILED")
+	}
+	small := testImage(10, 20)
+	if thumbnail(small, 320) != image.Image(small) {
+		t.Errorf("TestThumbnail --> FAILED")
+	}
+}
+
+func TestStoreImage(t *testing.T) {
+	defer withMediaDir(t)()
+
+	upload, err := storeImage(testPNG(400, 100))
+	if err != nil || !mediaNamePattern.MatchString(upload.Name) || !strings.HasSuffix(upload.Name, ".png") ||
+		upload.Width != 400 || upload.Height != 100 {
+		t.Errorf("TestStoreImage --> FAILED")
+	}
+	f, err := os.Open(filepath.Join(mediaDir, thumbName(upload.Name)))
+	if err != nil {
+		t.Errorf("TestStoreImage --> FAILED")
+	} else {
+		config, _, err := image.DecodeConfig(f)
+		f.Close()
+		if err != nil || config.Width != 320 || config.Height != 80 {
+			t.Errorf("TestStoreImage --> FAILED")
+		}
+	}
+	// the same image is stored once under the same name
+	again, err := storeImage(testPNG(400, 100))
+	if err != nil || again.Name != upload.Name {
+		t.Errorf("TestStoreImage --> FAILED")
+	}
+
+	if _, err := storeImage([]byte("<html><script>alert(1)</script></html>")); err == nil {
+		t.Errorf("TestStoreImage --> FAILED")
+	}
+	// a png header with garbage after it
+	if _, err := storeImage(append(testPNG(2, 2)[:20], 1, 2, 3)); err == nil {
+		t.Errorf("TestStoreImage --> FAILED")
+	}
+}
+
+func TestStoreImageStripsEXIF(t *testing.T) {
+	defer withMediaDir(t)()
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, testImage(50, 50), nil)
+	data := buf.Bytes()
+	// put an APP1 EXIF segment right after the SOI marker
+	exif := append([]byte{0xFF, 0xE1, 0x00, 0x16}, []byte("Exif\x00\x00GPS 55.7558N 37.6")...)
+	exif = exif[:0x16+2]
+	withExif := append(append(append([]byte{}, data[:2]...), exif...), data[2:]...)
+	if _, err := jpeg.Decode(bytes.NewReader(withExif)); err != nil {
+		t.Fatal(err)
+	}
+
+	upload, err := storeImage(withExif)
+	if err != nil || !strings.HasSuffix(upload.Name, ".jpg") {
+		t.Errorf("TestStoreImageStripsEXIF --> FAILED")
+		return
+	}
+	stored, _ := ioutil.ReadFile(filepath.Join(mediaDir, upload.Name))
+	if bytes.Contains(stored, []byte("Exif")) || bytes.Contains(stored, []byte("GPS")) {
+		t.Errorf("TestStoreImageStripsEXIF --> FAILED")
+	}
+}
+
+func multipartRequest(url, field string, files ...[]byte) *http.Request {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("title", "title")
+	mw.WriteField("body", "body")
+	for _, data := range files {
+		fw, _ := mw.CreateFormFile(field, "picture.png")
+		fw.Write(data)
+	}
+	mw.Close()
+	req := httptest.NewRequest("POST", url, &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+// pausedReader waits for resume before it's read the first time
+type pausedReader struct {
+	io.Reader
+	started, resume chan bool
+	once            sync.Once
+}
+
+func (p *pausedReader) Read(data []byte) (int, error) {
+	p.once.Do(func() {
+		p.started <- true
+		<-p.resume
+	})
+	return p.Reader.Read(data)
+}
+
+func TestUploadHandler(t *testing.T) {
+	defer withMediaDir(t)()
+	defer func() {
+		users = nil
+		os.Remove("data/accounts/testUser.txt")
+	}()
+	users = append(users, &User{Username: "testUser", Password: "testPassword", ID: 1})
+
+	req := multipartRequest("http://127.0.0.1/users/testUser/uploads", "image", testPNG(30, 30))
+	req.AddCookie(sessionFor("testUser"))
+	w := httptest.NewRecorder()
+
+	uploadHandler(w, req, httprouter.Params{{"username", "testUser"}})
+
+	var resp uploadJSON
+	err := json.Unmarshal(w.Body.Bytes(), &resp)
+	us := getUser("testUser")
+	if w.Code != http.StatusCreated || err != nil || resp.URL != baseURL+"/media/"+resp.Name ||
+		len(us.Uploads) != 1 || us.Uploads[0].Name != resp.Name {
+		t.Errorf("TestUploadHandler --> FAILED")
+	}
+
+	req = multipartRequest("http://127.0.0.1/users/testUser/uploads", "image", []byte("GIF89a not really"))
+	req.AddCookie(sessionFor("testUser"))
+	w = httptest.NewRecorder()
+	uploadHandler(w, req, httprouter.Params{{"username", "testUser"}})
+	if w.Code != http.StatusBadRequest || len(us.Uploads) != 1 {
+		t.Errorf("TestUploadHandler --> FAILED")
+	}
+
+	// the image is stored while another request holds storeMu,
+	// it's taken once the session is checked and the body is read
+	req = multipartRequest("http://127.0.0.1/users/testUser/uploads", "image", testPNG(40, 30))
+	req.AddCookie(sessionFor("testUser"))
+	body := &pausedReader{Reader: req.Body, started: make(chan bool), resume: make(chan bool)}
+	req.Body = ioutil.NopCloser(body)
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w := httptest.NewRecorder()
+		uploadHandler(w, req, httprouter.Params{{"username", "testUser"}})
+		done <- w
+	}()
+	<-body.started
+	storeMu.Lock()
+	close(body.resume)
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		if files, _ := filepath.Glob(filepath.Join(mediaDir, "*.png")); len(files) == 4 {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			storeMu.Unlock()
+			t.Fatal("TestUploadHandler --> FAILED")
+		}
+	}
+	storeMu.Unlock()
+	if w := <-done; w.Code != http.StatusCreated || len(us.Uploads) != 2 {
+		t.Errorf("TestUploadHandler --> FAILED")
+	}
+
+	// the account is deleted while the image is read
+	req = multipartRequest("http://127.0.0.1/users/testUser/uploads", "image", testPNG(50, 30))
+	req.AddCookie(sessionFor("testUser"))
+	body = &pausedReader{Reader: req.Body, started: make(chan bool), resume: make(chan bool)}
+	req.Body = ioutil.NopCloser(body)
+	go func() {
+		w := httptest.NewRecorder()
+		uploadHandler(w, req, httprouter.Params{{"username", "testUser"}})
+		done <- w
+	}()
+	<-body.started
+	storeMu.Lock()
+	err = deleteUser(us)
+	storeMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(body.resume)
+	if w := <-done; w.Code != http.StatusForbidden {
+		t.Errorf("TestUploadHandler --> FAILED")
+	}
+}
+
+func TestNewPostPostHandlerImages(t *testing.T) {
+	defer withMediaDir(t)()
+	defer func() {
+		users = nil
+		os.Remove("data/accounts/testUser.txt")
+	}()
+	users = append(users, &User{Username: "testUser", Password: "testPassword", ID: 1})
+
+	req := multipartRequest("http://127.0.0.1/users/testUser/newPost", "images", testPNG(30, 30), testPNG(40, 30))
+	req.AddCookie(sessionFor("testUser"))
+	w := httptest.NewRecorder()
+
+	newPostPostHandler(w, req, httprouter.Params{{"username", "testUser"}})
+
+	us := getUser("testUser")
+	if us.PostCount != 1 || len(us.Posts[0].Images) != 2 || len(us.Uploads) != 2 ||
+		us.Posts[0].Images[1] != us.Uploads[1].Name {
+		t.Errorf("TestNewPostPostHandlerImages --> FAILED")
+	}
+
+	// attaching someone else's image isn't allowed, the new image isn't kept
+	req = multipartRequest("http://127.0.0.1/users/testUser/newPost", "images", testPNG(50, 30))
+	req.AddCookie(sessionFor("testUser"))
+	req.ParseMultipartForm(1 << 20)
+	req.Form.Add("attach", strings.Repeat("a", 64)+".png")
+	w = httptest.NewRecorder()
+	newPostPostHandler(w, req, httprouter.Params{{"username", "testUser"}})
+	l, _ := w.Result().Location()
+	files, _ := ioutil.ReadDir(mediaDir)
+	if l.Path != "/users/testUser/newPostInvalidSymbols" || us.PostCount != 1 || len(us.Uploads) != 2 || len(files) != 4 {
+		t.Errorf("TestNewPostPostHandlerImages --> FAILED")
+	}
+
+	// nor are images of an invalid post stored
+	req = multipartRequest("http://127.0.0.1/users/testUser/newPost", "images", testPNG(60, 30))
+	req.AddCookie(sessionFor("testUser"))
+	req.ParseMultipartForm(1 << 20)
+	req.Form.Set("title", "")
+	w = httptest.NewRecorder()
+	newPostPostHandler(w, req, httprouter.Params{{"username", "testUser"}})
+	l, _ = w.Result().Location()
+	files, _ = ioutil.ReadDir(mediaDir)
+	if l.Path != "/users/testUser/newPostInvalidSymbols" || us.PostCount != 1 || len(us.Uploads) != 2 || len(files) != 4 {
+		t.Errorf("TestNewPostPostHandlerImages --> FAILED")
+	}
+}
+
+func TestNewPostPostHandlerOtherUser(t *testing.T) {
+	defer withMediaDir(t)()
+	defer func() {
+		users = nil
+	}()
+	users = append(users, &User{Username: "testUser", Password: "testPassword", ID: 1})
+	users = append(users, &User{Username: "otherUser", Password: "testPassword", ID: 2})
+
+	// neither the post nor its image is stored for another or a missing account
+	for _, username := range []string{"testUser", "nobody"} {
+		req := multipartRequest("http://127.0.0.1/users/"+username+"/newPost", "images", testPNG(30, 30))
+		req.AddCookie(sessionFor("otherUser"))
+		w := httptest.NewRecorder()
+
+		newPostPostHandler(w, req, httprouter.Params{{"username", username}})
+
+		files, _ := ioutil.ReadDir(mediaDir)
+		if w.Code != http.StatusForbidden || getUser("testUser").PostCount != 0 || len(files) != 0 {
+			t.Errorf("TestNewPostPostHandlerOtherUser --> FAILED")
+		}
+	}
+
+	req := httptest.NewRequest("GET", "http://127.0.0.1/users/testUser/newPost", nil)
+	req.AddCookie(sessionFor("otherUser"))
+	w := httptest.NewRecorder()
+	newPostGetHandler(w, req, httprouter.Params{{"username", "testUser"}})
+	if w.Code != http.StatusForbidden {
+		t.Errorf("TestNewPostPostHandlerOtherUser --> FAILED")
+	}
+}
+
+func TestMediaHandler(t *testing.T) {
+	defer withMediaDir(t)()
+	upload, _ := storeImage(testPNG(30, 30))
+
+	for name, code := range map[string]int{
+		upload.Name:            200,
+		thumbName(upload.Name): 200,
+		"../accounts/x.txt":    404,
+		"":                     404,
+	} {
+		req := httptest.NewRequest("GET", "http://127.0.0.1/media/"+name, nil)
+		w := httptest.NewRecorder()
+		mediaHandler(w, req, httprouter.Params{{"name", name}})
+		if w.Code != code {
+			t.Errorf("TestMediaHandler --> FAILED: %s", name)
+		}
+	}
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"src/github.com/julienschmidt/httprouter"
+	"src/github.com/pkg/errors"
+)
+
+// The MetaWeblog API (http://xmlrpc.com/metaWeblogApi.html) with the Blogger
+// methods editors call along with it. Every user has one blog, so blog IDs
+// editors send are ignored and posts are found by their IDs among the posts
+// and drafts of the user logged in.
+
+var htmlImagePattern = regexp.MustCompile(`(?is)<img\b[^>]*>`)
+
+// xmlrpcArgs are params of a call, getters give zero values for missing
+// params or params of another type
+type xmlrpcArgs []interface{}
+
+func (a xmlrpcArgs) string(i int) string {
+	if i >= len(a) {
+		return ""
+	}
+	switch v := a[i].(type) {
+	case string:
+		return v
+	case int:
+		// some editors send post IDs as ints
+		return strconv.Itoa(v)
+	}
+	return ""
+}
+
+func (a xmlrpcArgs) int(i int) int {
+	if i < len(a) {
+		if n, ok := a[i].(int); ok {
+			return n
+		}
+	}
+	n, _ := strconv.Atoi(a.string(i))
+	return n
+}
+
+// bool is true for missing params, they are publish flags
+func (a xmlrpcArgs) bool(i int) bool {
+	if i < len(a) {
+		if b, ok := a[i].(bool); ok {
+			return b
+		}
+	}
+	return true
+}
+
+func (a xmlrpcArgs) structAt(i int) map[string]interface{} {
+	if i < len(a) {
+		if m, ok := a[i].(map[string]interface{}); ok {
+			return m
+		}
+	}
+	return map[string]interface{}{}
+}
+
+type metaweblogMethod struct {
+	// the least number of params and the position of the username,
+	// the password follows it
+	params int
+	userAt int
+	// the app token scope the method needs when a token is the password
+	scope string
+	call  func(u *User, args xmlrpcArgs) (interface{}, error)
+	// store, when set, does the slow part of the call without storeMu
+	// once the login is checked and returns the args call gets
+	store func(args xmlrpcArgs) (xmlrpcArgs, error)
+}
+
+var metaweblogMethods = map[string]metaweblogMethod{
+	"blogger.getUsersBlogs":     {3, 1, "", getUsersBlogs, nil},
+	"metaWeblog.getUsersBlogs":  {3, 1, "", getUsersBlogs, nil},
+	"metaWeblog.getCategories":  {3, 1, "", getCategories, nil},
+	"metaWeblog.newPost":        {4, 1, "create", newPostMethod, nil},
+	"metaWeblog.editPost":       {4, 1, "update", editPostMethod, nil},
+	"metaWeblog.getPost":        {3, 1, "", getPostMethod, nil},
+	"metaWeblog.getRecentPosts": {4, 1, "", getRecentPosts, nil},
+	"metaWeblog.deletePost":     {4, 2, "delete", deletePostMethod, nil},
+	"blogger.deletePost":        {4, 2, "delete", deletePostMethod, nil},
+	"metaWeblog.newMediaObject": {4, 1, "create", newMediaObject, storeMediaObject},
+}
+
+func faultf(code int, format string, args ...interface{}) error {
+	return xmlrpcFault{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// metaweblogLogin checks the password of the user. Users with two-factor
+// authentication on use an app token as the password instead.
+func metaweblogLogin(username, password, scope string) (*User, error) {
+	us := getUser(username)
+	if us != nil && !us.Disabled && us.CanPost() {
+		if tokenUser, token := userByToken(password); tokenUser == us {
+			if scope != "" && !token.HasScope(scope) {
+				return nil, faultf(403, "the token doesn't allow to %s", scope)
+			}
+			err := us.useToken(token, time.Now())
+			if err != nil {
+				return nil, err
+			}
+			return us, nil
+		}
+		if !us.TwoFactorEnabled() && tryToLogIn(username, password) == Correct {
+			return us, nil
+		}
+	}
+	return nil, faultf(403, "Bad login/pass combination.")
+}
+
+// callMetaweblog logs in and calls the method under storeMu. The store
+// step of the method runs between two logins without it, so the user is
+// looked up again after it.
+func callMetaweblog(m metaweblogMethod, args xmlrpcArgs) (interface{}, error) {
+	username, password := args.string(m.userAt), args.string(m.userAt+1)
+	if m.store != nil {
+		storeMu.Lock()
+		_, err := metaweblogLogin(username, password, m.scope)
+		storeMu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		args, err = m.store(args)
+		if err != nil {
+			return nil, err
+		}
+	}
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	us, err := metaweblogLogin(username, password, m.scope)
+	if err != nil {
+		return nil, err
+	}
+	return m.call(us, args)
+}
+
+// xmlrpcHandler serves calls of MetaWeblog editors, faults are sent with
+// the 200 status as XML-RPC wants
+func xmlrpcHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	// media objects come base64 encoded in the call
+	r.Body = http.MaxBytesReader(w, r.Body, 2*maxUploadSize)
+	var result interface{}
+	method, args, err := parseXMLRPCCall(r.Body)
+	if err != nil {
+		err = faultf(faultParse, "%v", err)
+	} else if m, ok := metaweblogMethods[method]; !ok {
+		err = faultf(faultUnknownMethod, "method %s isn't supported", method)
+	} else if len(args) < m.params {
+		err = faultf(faultInvalidParams, "%s needs %d params, got %d", method, m.params, len(args))
+	} else {
+		result, err = callMetaweblog(m, args)
+	}
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.Write(xmlrpcResponse(result, err))
+}
+
+func getUsersBlogs(u *User, _ xmlrpcArgs) (interface{}, error) {
+	name := u.DisplayName
+	if name == "" {
+		name = u.Username
+	}
+	return []interface{}{map[string]interface{}{
+		"blogid":   u.Username,
+		"blogName": name,
+		"url":      baseURL + "/users/" + u.Username + "/",
+		"isAdmin":  u.HasRole(RoleAdmin),
+	}}, nil
+}
+
+// getCategories gives the tags of the user as categories
+func getCategories(u *User, _ xmlrpcArgs) (interface{}, error) {
+	seen := make(map[string]bool)
+	var tags []string
+	for _, posts := range [][]Post{u.Posts, u.Drafts} {
+		for _, p := range posts {
+			for _, tag := range p.Tags {
+				if !seen[tag] {
+					seen[tag] = true
+					tags = append(tags, tag)
+				}
+			}
+		}
+	}
+	sort.Strings(tags)
+	categories := []interface{}{}
+	for _, tag := range tags {
+		categories = append(categories, map[string]interface{}{
+			"categoryId":   tag,
+			"categoryName": tag,
+			"title":        tag,
+			"description":  tag,
+			"htmlUrl":      baseURL + "/tags/" + tag,
+			"rssUrl":       baseURL + "/tags/" + tag + "/feed.xml",
+		})
+	}
+	return categories, nil
+}
+
+// metaweblogStruct describes a post the way editors expect
+func metaweblogStruct(username string, p Post) map[string]interface{} {
+	status := "publish"
+	if !p.IsPublished() {
+		status = "draft"
+	}
+	categories := []string{}
+	categories = append(categories, p.Tags...)
+	return map[string]interface{}{
+		"postid":           strconv.Itoa(p.ID),
+		"userid":           username,
+		"title":            p.Title,
+		"description":      p.Body,
+		"categories":       categories,
+		"mt_keywords":      strings.Join(p.Tags, ","),
+		"dateCreated":      p.Date,
+		"date_created_gmt": p.Date,
+		"link":             postURL(username, p.ID),
+		"permaLink":        postURL(username, p.ID),
+		"post_status":      status,
+	}
+}
+
+// metaweblogTags reads tags of a post struct from categories and mt_keywords,
+// it tells whether the struct has any of them
+func metaweblogTags(content map[string]interface{}) ([]string, bool) {
+	var names []string
+	categories, hasCategories := content["categories"].([]interface{})
+	for _, c := range categories {
+		if s, ok := c.(string); ok {
+			names = append(names, s)
+		}
+	}
+	keywords, hasKeywords := content["mt_keywords"].(string)
+	if hasKeywords {
+		names = append(names, strings.Split(keywords, ",")...)
+	}
+	var tags []string
+	seen := make(map[string]bool)
+	for _, name := range names {
+		tag := tagSlug(name)
+		if tag != "" && !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	return tags, hasCategories || hasKeywords
+}
+
+// htmlImages returns names of the uploads of the user shown in the HTML,
+// editors put images they uploaded with newMediaObject there
+func htmlImages(u *User, s string) []string {
+	var names []string
+	for _, tag := range htmlImagePattern.FindAllString(s, -1) {
+		for _, attr := range htmlAttrPattern.FindAllStringSubmatch(tag, -1) {
+			if strings.ToLower(attr[1]) != "src" {
+				continue
+			}
+			src := strings.TrimPrefix(strings.Trim(attr[2], `"'`), baseURL)
+			name := strings.TrimPrefix(src, "/media/")
+			if name != src && u.HasUpload(name) {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+func stringField(content map[string]interface{}, name string) (string, bool) {
+	s, ok := content[name].(string)
+	return s, ok
+}
+
+// newPostMethod adds a post, a draft when it isn't published, or
+// a scheduled post when it's published with a date in the future,
+// a post with a date in the past takes its place among the others
+func newPostMethod(u *User, args xmlrpcArgs) (interface{}, error) {
+	content := args.structAt(3)
+	title, _ := stringField(content, "title")
+	description, _ := stringField(content, "description")
+	tags, _ := metaweblogTags(content)
+	post := Post{
+		Title:  title,
+		Body:   htmlToText(description),
+		Date:   time.Now().UTC(),
+		Tags:   tags,
+		Images: htmlImages(u, description),
+	}
+	if len(post.Images) > maxImages {
+		return nil, faultf(400, "a post can have up to %d images, got %d", maxImages, len(post.Images))
+	}
+	date, dated := content["dateCreated"].(time.Time)
+	if dated {
+		post.Date = date
+	}
+	var err error
+	switch {
+	case !args.bool(4):
+		err = u.addDraft(post)
+	case post.Date.After(time.Now()):
+		post.Status, post.PublishAt = StatusScheduled, post.Date
+		err = u.addDraft(post)
+		wakeScheduler()
+	case dated:
+		err = u.addDatedPost(post)
+	default:
+		err = u.addPost(post)
+	}
+	if err != nil {
+		return nil, faultf(400, "%v", err)
+	}
+	err = u.refreshUserInfo()
+	if err != nil {
+		return nil, err
+	}
+	return strconv.Itoa(u.LastPostID), nil
+}
+
+// ownPost finds a post or a draft of the user by the ID an editor sent
+func (u *User) ownPost(id string) (*Post, error) {
+	n, err := strconv.Atoi(id)
+	if err == nil {
+		if post := u.getPost(n); post != nil {
+			return post, nil
+		}
+		if draft := u.getDraft(n); draft != nil {
+			return draft, nil
+		}
+	}
+	return nil, faultf(404, "user:%s ID:%v doesn't have a post with ID %s", u.Username, u.ID, id)
+}
+
+// editPostMethod edits the title, the body and tags the struct has,
+// a draft is published when the publish flag is set. Images stay the same.
+func editPostMethod(u *User, args xmlrpcArgs) (interface{}, error) {
+	post, err := u.ownPost(args.string(0))
+	if err != nil {
+		return nil, err
+	}
+	content := args.structAt(3)
+	rev := Revision{Author: u.Username, Date: time.Now().UTC(), Title: post.Title, Body: post.Body, Tags: post.Tags}
+	if title, ok := stringField(content, "title"); ok {
+		rev.Title = title
+	}
+	if description, ok := stringField(content, "description"); ok {
+		rev.Body = htmlToText(description)
+	}
+	if tags, ok := metaweblogTags(content); ok {
+		rev.Tags = tags
+	}
+	id := post.ID
+	err = u.editPost(id, rev)
+	// scheduled posts keep their time
+	if err == nil && post.Status == StatusDraft && args.bool(4) {
+		err = u.publishDraft(id, time.Now())
+	}
+	if err != nil {
+		return nil, faultf(400, "%v", err)
+	}
+	err = u.refreshUserInfo()
+	if err != nil {
+		return nil, err
+	}
+	return true, nil
+}
+
+func getPostMethod(u *User, args xmlrpcArgs) (interface{}, error) {
+	post, err := u.ownPost(args.string(0))
+	if err != nil {
+		return nil, err
+	}
+	return metaweblogStruct(u.Username, *post), nil
+}
+
+// getRecentPosts gives the latest posts and drafts, newest first
+func getRecentPosts(u *User, args xmlrpcArgs) (interface{}, error) {
+	n := args.int(3)
+	if n <= 0 || n > 100 {
+		n = 100
+	}
+	all := append(append([]Post(nil), u.Drafts...), u.Posts...)
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].Date.After(all[j].Date)
+	})
+	if len(all) > n {
+		all = all[:n]
+	}
+	posts := []interface{}{}
+	for _, p := range all {
+		posts = append(posts, metaweblogStruct(u.Username, p))
+	}
+	return posts, nil
+}
+
+// deletePostMethod takes the Blogger params: appkey, postid, username, password
+func deletePostMethod(u *User, args xmlrpcArgs) (interface{}, error) {
+	post, err := u.ownPost(args.string(1))
+	if err != nil {
+		return nil, err
+	}
+	if post.IsPublished() {
+		err = u.deletePost(post.ID)
+	} else {
+		err = u.deleteDraft(post.ID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = u.refreshUserInfo()
+	if err != nil {
+		return nil, err
+	}
+	return true, nil
+}
+
+// storeMediaObject stores the image of newMediaObject the way uploads do,
+// it's called without storeMu and puts the upload in place of the object
+func storeMediaObject(args xmlrpcArgs) (xmlrpcArgs, error) {
+	bits, ok := args.structAt(3)["bits"].([]byte)
+	if !ok {
+		return nil, faultf(faultInvalidParams, "the media object doesn't have bits")
+	}
+	upload, err := storeImage(bits)
+	if err != nil {
+		return nil, faultf(400, "%v", errors.Wrap(err, "can't store media object"))
+	}
+	stored := append(xmlrpcArgs{}, args...)
+	stored[3] = upload
+	return stored, nil
+}
+
+// newMediaObject gives the user the image storeMediaObject stored
+func newMediaObject(u *User, args xmlrpcArgs) (interface{}, error) {
+	upload := args[3].(Upload)
+	u.addUpload(upload)
+	err := u.refreshUserInfo()
+	if err != nil {
+		return nil, err
+	}
+	// gifs are stored as png
+	mediaType := "image/png"
+	if filepath.Ext(upload.Name) == ".jpg" {
+		mediaType = "image/jpeg"
+	}
+	return map[string]interface{}{
+		"file": upload.Name,
+		"url":  baseURL + "/media/" + upload.Name,
+		"type": mediaType,
+	}, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// callXMLRPC sends a call with the params already encoded as values
+func callXMLRPC(method string, params ...string) string {
+	body := "<methodCall><methodName>" + method + "</methodName><params>"
+	for _, p := range params {
+		body += "<param><value>" + p + "</value></param>"
+	}
+	body += "</params></methodCall>"
+	req := httptest.NewRequest("POST", baseURL+"/xmlrpc", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	xmlrpcHandler(w, req, nil)
+	return w.Body.String()
+}
+
+// resultOf decodes a response the way calls are decoded
+func resultOf(t *testing.T, resp string) interface{} {
+	resp = strings.Replace(resp, "methodResponse", "methodCall", -1)
+	resp = strings.Replace(resp, "<methodCall>", "<methodCall><methodName>response</methodName>", 1)
+	_, params, err := parseXMLRPCCall(strings.NewReader(resp))
+	if err != nil || len(params) != 1 {
+		t.Fatal("can't decode response", resp)
+	}
+	return params[0]
+}
+
+func TestMetaweblogLogin(t *testing.T) {
+	us := &User{Username: "testUser", Password: "testPassword", ID: 1, Role: RoleAuthor}
+	token, appToken, _ := newAppToken("editor", []string{"update"}, time.Now())
+	us.Tokens = append(us.Tokens, appToken)
+	users = append(users, us, &User{Username: "reader", Password: "testPassword", ID: 2, Role: RoleReader})
+	defer func() {
+		users = nil
+		os.Remove("data/accounts/testUser.txt")
+	}()
+
+	if u, err := metaweblogLogin("testUser", "testPassword", "create"); u != us || err != nil {
+		t.Errorf("TestMetaweblogLogin --> FAILED")
+	}
+	if u, err := metaweblogLogin("testUser", token, "update"); u != us || err != nil {
+		t.Errorf("TestMetaweblogLogin --> FAILED")
+	}
+	for _, c := range [][3]string{
+		{"testUser", "wrong", ""},
+		{"testUser", token, "create"},
+		{"reader", "testPassword", ""},
+		{"nobody", "testPassword", ""},
+	} {
+		if _, err := metaweblogLogin(c[0], c[1], c[2]); err == nil {
+			t.Errorf("TestMetaweblogLogin --> FAILED: %v", c)
+		}
+	}
+	// the password isn't enough with two-factor authentication on
+	us.TOTPSecret = "secret"
+	if _, err := metaweblogLogin("testUser", "testPassword", ""); err == nil {
+		t.Errorf("TestMetaweblogLogin --> FAILED")
+	}
+	if _, err := metaweblogLogin("testUser", token, ""); err != nil {
+		t.Errorf("TestMetaweblogLogin --> FAILED")
+	}
+}
+
+func TestMetaweblogPosts(t *testing.T) {
+	defer withMediaDir(t)()
+	us := &User{Username: "testUser", Password: "testPassword", ID: 1, Role: RoleAuthor}
+	users = append(users, us)
+	defer func() {
+		users = nil
+		os.Remove("data/accounts/testUser.txt")
+		for len(webmentionQueue) > 0 {
+			<-webmentionQueue
+		}
+	}()
+	login := []string{"<string>testUser</string>", "<string>testPassword</string>"}
+
+	media := callXMLRPC("metaWeblog.newMediaObject", append(append([]string{"1"}, login...),
+		"<struct><member><name>name</name><value>a.gif</value></member><member><name>bits</name><value><base64>"+
+			base64.StdEncoding.EncodeToString(testPNG(10, 10))+"</base64></value></member></struct>")...)
+	object, ok := resultOf(t, media).(map[string]interface{})
+	if !ok || len(us.Uploads) != 1 || object["url"] != baseURL+"/media/"+us.Uploads[0].Name || object["type"] != "image/png" {
+		t.Fatal("TestMetaweblogPosts --> FAILED", media)
+	}
+	// nothing is stored without a login
+	callXMLRPC("metaWeblog.newMediaObject", "1", "<string>testUser</string>", "<string>wrong</string>",
+		"<struct><member><name>bits</name><value><base64>"+base64.StdEncoding.EncodeToString(testPNG(20, 20))+"</base64></value></member></struct>")
+	if files, _ := ioutil.ReadDir(mediaDir); len(files) != 2 || len(us.Uploads) != 1 {
+		t.Errorf("TestMetaweblogPosts --> FAILED")
+	}
+
+	content := `<struct><member><name>title</name><value>hello</value></member>` +
+		`<member><name>description</name><value>&lt;p&gt;some &lt;b&gt;text&lt;/b&gt;&lt;/p&gt;&lt;img src="` + object["url"].(string) + `"&gt;</value></member>` +
+		`<member><name>categories</name><value><array><data><value>Web Development</value></data></array></value></member></struct>`
+	resp := callXMLRPC("metaWeblog.newPost", append(append([]string{"1"}, login...), content, "<boolean>1</boolean>")...)
+	post := us.getPost(1)
+	if resultOf(t, resp) != "1" || post == nil || post.Body != "some text" || post.Tags[0] != "web-development" ||
+		len(post.Images) != 1 {
+		t.Fatal("TestMetaweblogPosts --> FAILED", resp)
+	}
+	resp = callXMLRPC("metaWeblog.newPost", append(append([]string{"1"}, login...),
+		"<struct><member><name>title</name><value>draft</value></member><member><name>description</name><value>later</value></member></struct>",
+		"<boolean>0</boolean>")...)
+	if resultOf(t, resp) != "2" || us.getDraft(2) == nil {
+		t.Fatal("TestMetaweblogPosts --> FAILED", resp)
+	}
+	// the same validation as the new post form
+	resp = callXMLRPC("metaWeblog.newPost", append(append([]string{"1"}, login...),
+		"<struct><member><name>title</name><value>no body</value></member></struct>", "<boolean>1</boolean>")...)
+	if !strings.Contains(resp, "<fault>") || len(us.Posts) != 1 {
+		t.Errorf("TestMetaweblogPosts --> FAILED")
+	}
+
+	// editing the draft with the publish flag publishes it
+	resp = callXMLRPC("metaWeblog.editPost", append(append([]string{"<string>2</string>"}, login...),
+		"<struct><member><name>mt_keywords</name><value>Go, notes</value></member></struct>", "<boolean>1</boolean>")...)
+	if resultOf(t, resp) != true || us.getPost(2) == nil || strings.Join(us.getPost(2).Tags, ",") != "go,notes" ||
+		us.getPost(2).Body != "later" {
+		t.Fatal("TestMetaweblogPosts --> FAILED", resp)
+	}
+
+	resp = callXMLRPC("metaWeblog.getRecentPosts", append(append([]string{"1"}, login...), "<int>10</int>")...)
+	recent, ok := resultOf(t, resp).([]interface{})
+	if !ok || len(recent) != 2 || recent[0].(map[string]interface{})["postid"] != "2" {
+		t.Errorf("TestMetaweblogPosts --> FAILED: %s", resp)
+	}
+	resp = callXMLRPC("metaWeblog.getPost", append([]string{"<int>1</int>"}, login...)...)
+	got, ok := resultOf(t, resp).(map[string]interface{})
+	if !ok || got["title"] != "hello" || got["link"] != postURL("testUser", 1) || got["post_status"] != "publish" {
+		t.Errorf("TestMetaweblogPosts --> FAILED: %s", resp)
+	}
+	if !strings.Contains(callXMLRPC("metaWeblog.getCategories", append([]string{"1"}, login...)...), "web-development") {
+		t.Errorf("TestMetaweblogPosts --> FAILED")
+	}
+
+	resp = callXMLRPC("blogger.deletePost", append(append([]string{"", "1"}, login...), "<boolean>1</boolean>")...)
+	if resultOf(t, resp) != true || us.getPost(1) != nil {
+		t.Errorf("TestMetaweblogPosts --> FAILED: %s", resp)
+	}
+	saved, _ := readAccount("testUser")
+	if len(saved.Posts) != 1 || len(saved.Uploads) != 1 {
+		t.Errorf("TestMetaweblogPosts --> FAILED")
+	}
+
+	for _, resp := range []string{
+		callXMLRPC("metaWeblog.getPost", append([]string{"1"}, login...)...),
+		callXMLRPC("metaWeblog.getPost", "1", "testUser", "wrong"),
+		callXMLRPC("metaWeblog.getPost", "1"),
+		callXMLRPC("wp.getOptions", "1", "testUser", "testPassword"),
+	} {
+		if !strings.Contains(resp, "<fault>") {
+			t.Errorf("TestMetaweblogPosts --> FAILED: %s", resp)
+		}
+	}
+
+	// a back-dated post goes after newer ones
+	resp = callXMLRPC("metaWeblog.newPost", append(append([]string{"1"}, login...),
+		"<struct><member><name>title</name><value>old</value></member><member><name>description</name><value>old</value></member>"+
+			"<member><name>dateCreated</name><value><dateTime.iso8601>20190102T03:04:05</dateTime.iso8601></value></member></struct>",
+		"<boolean>1</boolean>")...)
+	if resultOf(t, resp) != "3" || len(us.Posts) != 2 || us.Posts[0].ID != 2 || us.Posts[1].ID != 3 {
+		t.Errorf("TestMetaweblogPosts --> FAILED: %s", resp)
+	}
+}
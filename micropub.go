@@ -0,0 +1,816 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"src/github.com/julienschmidt/httprouter"
+	"src/github.com/pkg/errors"
+)
+
+// Micropub (https://www.w3.org/TR/micropub/) lets apps and editors publish
+// to the blog. They authenticate with tokens users create on the tokens
+// page, posts made through it go the same addPost validation path as the
+// ones of the new post form.
+
+// scopes a token can be given, they are the Micropub actions it allows
+var tokenScopes = []string{"create", "update", "delete"}
+
+// AppToken lets an app act for the user, only the hash of the token is kept
+type AppToken struct {
+	// the start of the hash, it names the token in links
+	ID      string
+	Name    string
+	Hash    string
+	Scopes  []string
+	Created time.Time
+	// the tokens page shows the day, so it's saved once a day
+	LastUsed time.Time
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAppToken returns a token to show to the user once and its record to store
+func newAppToken(name string, scopes []string, now time.Time) (string, AppToken, error) {
+	buf := make([]byte, 24)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", AppToken{}, errors.Wrap(err, "can't generate token")
+	}
+	token := hex.EncodeToString(buf)
+	hash := hashToken(token)
+	return token, AppToken{ID: hash[:12], Name: name, Hash: hash, Scopes: scopes, Created: now.UTC()}, nil
+}
+
+func (t AppToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// userByToken finds the enabled user the token belongs to
+func userByToken(token string) (*User, *AppToken) {
+	if token == "" {
+		return nil, nil
+	}
+	hash := hashToken(token)
+	for _, us := range users {
+		if t := us.tokenByHash(hash); t != nil && !us.Disabled {
+			return us, t
+		}
+	}
+	return nil, nil
+}
+
+func (u *User) tokenByHash(hash string) *AppToken {
+	for i := range u.Tokens {
+		if u.Tokens[i].Hash == hash {
+			return &u.Tokens[i]
+		}
+	}
+	return nil
+}
+
+// useToken notes that the token of u is used now
+func (u *User) useToken(t *AppToken, now time.Time) error {
+	saved := t.LastUsed.Format("2006-01-02") == now.UTC().Format("2006-01-02")
+	t.LastUsed = now.UTC()
+	if saved {
+		return nil
+	}
+	return u.refreshUserInfo()
+}
+
+func (u *User) revokeToken(id string) bool {
+	for i, t := range u.Tokens {
+		if t.ID == id {
+			u.Tokens = append(u.Tokens[:i], u.Tokens[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+type tokensPage struct {
+	*User
+	// the token just created, it's shown once
+	NewToken string
+	Invalid  bool
+	Scopes   []string
+	Endpoint string
+	XMLRPC   string
+}
+
+func tokensGetHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	usernameCookie, err := sessionCookie(r)
+	if err == http.ErrNoCookie {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	if usernameCookie.Value != ps.ByName("username") {
+		http.Redirect(w, r, "/users/"+usernameCookie.Value, http.StatusFound)
+		return
+	}
+	renderTokens(w, tokensPage{User: getUser(usernameCookie.Value), Invalid: r.FormValue("invalid") != ""})
+}
+
+func renderTokens(w http.ResponseWriter, page tokensPage) {
+	page.Scopes, page.Endpoint, page.XMLRPC = tokenScopes, baseURL+"/micropub", baseURL+"/xmlrpc"
+	tpl, err := template.ParseFiles("templates/header.html", "templates/tokens.html")
+	if err != nil {
+		panic(err)
+	}
+
+	err = tpl.ExecuteTemplate(w, "tokens", page)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// tokensPostHandler creates a token with the name and scopes of the form
+func tokensPostHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	usernameCookie, err := sessionCookie(r)
+	if err == http.ErrNoCookie {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	username := ps.ByName("username")
+	if usernameCookie.Value != username {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	us := getUser(username)
+	name := strings.TrimSpace(r.FormValue("name"))
+	var scopes []string
+	for _, s := range tokenScopes {
+		for _, chosen := range r.Form["scope"] {
+			if s == chosen {
+				scopes = append(scopes, s)
+				break
+			}
+		}
+	}
+	if name == "" || len(name) > 40 || len(scopes) == 0 {
+		http.Redirect(w, r, "/users/"+username+"/tokens?invalid=1", http.StatusFound)
+		return
+	}
+	token, t, err := newAppToken(name, scopes, time.Now())
+	if err != nil {
+		panic(err)
+	}
+	us.Tokens = append(us.Tokens, t)
+	err = us.refreshUserInfo()
+	if err != nil {
+		panic(err)
+	}
+	renderTokens(w, tokensPage{User: us, NewToken: token})
+}
+
+func revokeTokenHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	usernameCookie, err := sessionCookie(r)
+	if err == http.ErrNoCookie {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	username := ps.ByName("username")
+	if usernameCookie.Value != username {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	us := getUser(username)
+	if !us.revokeToken(ps.ByName("id")) {
+		http.NotFound(w, r)
+		return
+	}
+	err = us.refreshUserInfo()
+	if err != nil {
+		panic(err)
+	}
+	http.Redirect(w, r, "/users/"+username+"/tokens", http.StatusFound)
+}
+
+// micropubError answers with an error of the Micropub spec
+func micropubError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": code, "error_description": description})
+}
+
+func writeMicropubJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// micropubFault is an error a Micropub request is answered with
+type micropubFault struct {
+	status      int
+	code        string
+	description string
+	// the scope the token lacks, for insufficient_scope
+	scope string
+}
+
+func (f micropubFault) Error() string {
+	return f.description
+}
+
+func (f micropubFault) write(w http.ResponseWriter) {
+	if f.scope == "" {
+		micropubError(w, f.status, f.code, f.description)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(f.status)
+	json.NewEncoder(w).Encode(map[string]string{"error": f.code, "scope": f.scope,
+		"error_description": f.description})
+}
+
+// micropubToken returns the token sent in the Authorization header
+// or in the access_token field of a form
+func micropubToken(r *http.Request) (string, error) {
+	header := r.Header.Get("Authorization")
+	form := ""
+	if r.Method == "POST" && !isJSON(r) {
+		form = r.PostFormValue("access_token")
+	}
+	if header != "" && form != "" {
+		return "", micropubFault{http.StatusBadRequest, "invalid_request", "token is sent both in the header and in the body", ""}
+	}
+	token := form
+	if header != "" {
+		if !strings.HasPrefix(header, "Bearer ") {
+			return "", micropubFault{http.StatusUnauthorized, "unauthorized", "a Bearer token is expected", ""}
+		}
+		token = strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	}
+	if token == "" {
+		return "", micropubFault{http.StatusUnauthorized, "unauthorized", "no access token", ""}
+	}
+	return token, nil
+}
+
+// micropubLogin finds the user of the token and notes the token is used,
+// it's called under storeMu
+func micropubLogin(token, scope string) (*User, error) {
+	us, t := userByToken(token)
+	err := checkAppToken(us, t, scope)
+	if err != nil {
+		return nil, err
+	}
+	err = us.useToken(t, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return us, nil
+}
+
+// micropubRelogin looks the user of micropubLogin up again each time
+// storeMu is taken anew, the account may have been deleted or disabled
+// or the token revoked meanwhile
+func micropubRelogin(username, token, scope string) (*User, error) {
+	us := getUser(username)
+	var t *AppToken
+	if us != nil && !us.Disabled {
+		t = us.tokenByHash(hashToken(token))
+	}
+	if t == nil {
+		us = nil
+	}
+	err := checkAppToken(us, t, scope)
+	if err != nil {
+		return nil, err
+	}
+	return us, nil
+}
+
+// checkAppToken checks that the token is found and lets the user do
+// what the scope names
+func checkAppToken(us *User, t *AppToken, scope string) error {
+	if us == nil {
+		return micropubFault{http.StatusUnauthorized, "unauthorized", "the token is invalid or revoked", ""}
+	}
+	if !us.CanPost() {
+		return micropubFault{http.StatusForbidden, "forbidden", "user:" + us.Username + " can't post", ""}
+	}
+	if scope != "" && !t.HasScope(scope) {
+		return micropubFault{http.StatusForbidden, "insufficient_scope", "the token doesn't allow to " + scope, scope}
+	}
+	return nil
+}
+
+// micropubAuth logs in with the token of the request, it answers with
+// an error itself when there is no such user or the token doesn't have
+// the scope. It's called under storeMu by locked handlers.
+func micropubAuth(w http.ResponseWriter, r *http.Request, scope string) (*User, bool) {
+	token, err := micropubToken(r)
+	var us *User
+	if err == nil {
+		us, err = micropubLogin(token, scope)
+	}
+	if f, ok := err.(micropubFault); ok {
+		f.write(w)
+		return nil, false
+	}
+	if err != nil {
+		panic(err)
+	}
+	return us, true
+}
+
+func isJSON(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "application/json"
+}
+
+// ownPostByURL finds a post or a draft of the user by its link
+func (u *User) ownPostByURL(link string) *Post {
+	if post := u.postByURL(link); post != nil {
+		return post
+	}
+	var id int
+	_, err := fmt.Sscanf(strings.TrimPrefix(link, baseURL+"/users/"+u.Username+"/posts/"), "%d", &id)
+	if err != nil || link != postURL(u.Username, id) {
+		return nil
+	}
+	return u.getDraft(id)
+}
+
+// micropubGetHandler answers queries for the configuration and for posts
+func micropubGetHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	us, ok := micropubAuth(w, r, "")
+	if !ok {
+		return
+	}
+	switch r.FormValue("q") {
+	case "config":
+		writeMicropubJSON(w, map[string]interface{}{
+			"q":             []string{"config", "source", "syndicate-to"},
+			"syndicate-to":  []string{},
+			"post-types":    []map[string]string{{"type": "note", "name": "Post"}, {"type": "photo", "name": "Photo"}},
+			"post-statuses": []string{"published", "draft"},
+		})
+	case "syndicate-to":
+		writeMicropubJSON(w, map[string]interface{}{"syndicate-to": []string{}})
+	case "source":
+		post := us.ownPostByURL(r.FormValue("url"))
+		if post == nil {
+			micropubError(w, http.StatusBadRequest, "invalid_request", "url isn't a post of "+us.Username)
+			return
+		}
+		properties := postProperties(*post)
+		wanted := append(r.Form["properties[]"], r.Form["properties"]...)
+		if len(wanted) > 0 {
+			chosen := make(map[string]interface{})
+			for _, name := range wanted {
+				if v, ok := properties[name]; ok {
+					chosen[name] = v
+				}
+			}
+			writeMicropubJSON(w, map[string]interface{}{"properties": chosen})
+			return
+		}
+		writeMicropubJSON(w, map[string]interface{}{"type": []string{"h-entry"}, "properties": properties})
+	default:
+		micropubError(w, http.StatusBadRequest, "invalid_request", fmt.Sprintf("unknown query %q", r.FormValue("q")))
+	}
+}
+
+// postProperties describes the post as microformats2 properties
+func postProperties(p Post) map[string]interface{} {
+	status := "published"
+	if !p.IsPublished() {
+		status = "draft"
+	}
+	properties := map[string]interface{}{
+		"name":        []string{p.Title},
+		"content":     []string{p.Body},
+		"post-status": []string{status},
+	}
+	if !p.Date.IsZero() {
+		properties["published"] = []string{p.Date.UTC().Format(time.RFC3339)}
+	}
+	if len(p.Tags) > 0 {
+		properties["category"] = p.Tags
+	}
+	if len(p.Images) > 0 {
+		var photos []string
+		for _, name := range p.Images {
+			photos = append(photos, baseURL+"/media/"+name)
+		}
+		properties["photo"] = photos
+	}
+	return properties
+}
+
+// micropubRequest is a request in the JSON syntax, form requests
+// are turned into it as well
+type micropubRequest struct {
+	Type       []string                 `json:"type"`
+	Action     string                   `json:"action"`
+	URL        string                   `json:"url"`
+	Properties map[string][]interface{} `json:"properties"`
+	Replace    map[string][]interface{} `json:"replace"`
+	Add        map[string][]interface{} `json:"add"`
+	// either names of properties or values to delete from them
+	Delete json.RawMessage `json:"delete"`
+
+	photos []*multipart.FileHeader
+}
+
+// parseMicropub reads a request in either of the JSON, urlencoded
+// and multipart syntaxes
+func parseMicropub(r *http.Request) (micropubRequest, error) {
+	var req micropubRequest
+	if isJSON(r) {
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			return req, errors.Wrap(err, "can't decode request")
+		}
+		return req, nil
+	}
+	err := r.ParseMultipartForm(maxUploadSize)
+	if err != nil && err != http.ErrNotMultipart {
+		return req, errors.Wrap(err, "can't parse form")
+	}
+	req.Action = r.PostFormValue("action")
+	req.URL = r.PostFormValue("url")
+	if h := r.PostFormValue("h"); h != "" {
+		req.Type = []string{"h-" + h}
+	}
+	req.Properties = make(map[string][]interface{})
+	for key, values := range r.PostForm {
+		name := strings.TrimSuffix(key, "[]")
+		if name == "access_token" || name == "h" || name == "action" || name == "url" || strings.HasPrefix(name, "mp-") {
+			continue
+		}
+		for _, v := range values {
+			req.Properties[name] = append(req.Properties[name], v)
+		}
+	}
+	if r.MultipartForm != nil {
+		req.photos = append(r.MultipartForm.File["photo"], r.MultipartForm.File["photo[]"]...)
+	}
+	return req, nil
+}
+
+// propertyStrings returns the values of a property as text, HTML content
+// is turned into text and photos with alt texts give their links
+func propertyStrings(values []interface{}) ([]string, error) {
+	var strs []string
+	for _, v := range values {
+		switch v := v.(type) {
+		case string:
+			strs = append(strs, v)
+		case map[string]interface{}:
+			if s, ok := v["value"].(string); ok {
+				strs = append(strs, s)
+			} else if s, ok := v["html"].(string); ok {
+				strs = append(strs, htmlToText(s))
+			} else {
+				return nil, errors.New("unsupported property value")
+			}
+		default:
+			return nil, errors.Errorf("unsupported property value %v", v)
+		}
+	}
+	return strs, nil
+}
+
+func firstString(values []interface{}) (string, error) {
+	strs, err := propertyStrings(values)
+	if err != nil || len(strs) == 0 {
+		return "", err
+	}
+	return strs[0], nil
+}
+
+// noteTitle makes a title for posts sent without a name of the first
+// words of the body, titles are required and short
+func noteTitle(body string) string {
+	words := strings.Fields(body)
+	title := ""
+	for _, word := range words {
+		if utf8.RuneCountInString(title)+utf8.RuneCountInString(word)+1 > 30 {
+			break
+		}
+		title = strings.TrimSpace(title + " " + word)
+	}
+	if title == "" && len(words) > 0 {
+		title = string([]rune(words[0])[:30])
+	}
+	return title
+}
+
+// micropubPhotos returns names of the images to attach: links to uploads
+// of the user and photos stored from files of a multipart request, which
+// become uploads of the user once the post is added
+func micropubPhotos(u *User, links []string, uploads []Upload) ([]string, error) {
+	var names []string
+	for _, link := range links {
+		name := strings.TrimPrefix(link, baseURL+"/media/")
+		if !u.HasUpload(name) {
+			return nil, errors.Errorf("%s isn't an image uploaded by %s", link, u.Username)
+		}
+		names = append(names, name)
+	}
+	for _, upload := range uploads {
+		names = append(names, upload.Name)
+	}
+	return names, nil
+}
+
+// micropubPostHandler creates, updates and deletes posts. storeMu is
+// taken only around the use of users and the user is looked up again
+// each time, the response is written without it.
+func micropubPostHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	limitUploads(w, r)
+	req, err := parseMicropub(r)
+	if err != nil {
+		micropubError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	// actions are named after the scopes allowing them
+	scope := req.Action
+	if scope == "" {
+		scope = "create"
+	}
+	if scope != "create" && scope != "update" && scope != "delete" {
+		micropubError(w, http.StatusBadRequest, "invalid_request", fmt.Sprintf("action %q isn't supported", req.Action))
+		return
+	}
+	token, err := micropubToken(r)
+	username := ""
+	if err == nil {
+		storeMu.Lock()
+		var us *User
+		us, err = micropubLogin(token, scope)
+		if err == nil {
+			username = us.Username
+		}
+		storeMu.Unlock()
+	}
+
+	status := http.StatusNoContent
+	if err == nil {
+		switch scope {
+		case "create":
+			var link string
+			link, err = micropubCreate(username, token, req)
+			if err == nil {
+				w.Header().Set("Location", link)
+				status = http.StatusCreated
+			}
+		case "update", "delete":
+			storeMu.Lock()
+			var us *User
+			us, err = micropubRelogin(username, token, scope)
+			if err == nil && scope == "update" {
+				err = us.micropubUpdate(req)
+			} else if err == nil {
+				err = us.micropubDelete(req.URL)
+			}
+			storeMu.Unlock()
+		}
+	}
+	if f, ok := err.(micropubFault); ok {
+		f.write(w)
+		return
+	}
+	if err != nil {
+		micropubError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	w.WriteHeader(status)
+}
+
+// micropubCreate adds an h-entry as a post, or as a draft when its post-status
+// is draft, and returns its link. Posts published in the future are scheduled
+// like in the new post form. It takes storeMu once the photos are stored and
+// looks the user of the token up again then.
+func micropubCreate(username, token string, req micropubRequest) (string, error) {
+	if len(req.Type) != 1 || req.Type[0] != "h-entry" {
+		return "", errors.New("only h-entry can be created")
+	}
+	props := req.Properties
+	body, err := firstString(props["content"])
+	if err != nil {
+		return "", err
+	}
+	title, err := firstString(props["name"])
+	if err != nil {
+		return "", err
+	}
+	if title == "" {
+		title = noteTitle(body)
+	}
+	categories, err := propertyStrings(props["category"])
+	if err != nil {
+		return "", err
+	}
+	tags, err := parseTags(strings.Join(categories, ","))
+	if err != nil {
+		return "", err
+	}
+	post := Post{Title: title, Body: body, Tags: tags, Date: time.Now().UTC()}
+	published, _ := firstString(props["published"])
+	if published != "" {
+		post.Date, err = time.Parse(time.RFC3339, published)
+		if err != nil {
+			return "", errors.Errorf("published date %q isn't RFC 3339", published)
+		}
+		post.Date = post.Date.UTC()
+	}
+	status, _ := firstString(props["post-status"])
+	if status != "" && status != "published" && status != StatusDraft {
+		return "", errors.Errorf("post-status %q isn't supported", status)
+	}
+	if status == StatusDraft {
+		post.Status = StatusDraft
+	}
+	// photos are stored only for posts that are going to be kept,
+	// they are removed again when the post isn't added after all
+	err = validatePost(post)
+	if err != nil {
+		return "", err
+	}
+	links, err := propertyStrings(props["photo"])
+	if err != nil {
+		return "", err
+	}
+	if len(links)+len(req.photos) > maxImages {
+		return "", errors.Errorf("a post can have up to %d images, got %d", maxImages, len(links)+len(req.photos))
+	}
+	uploads, err := storeImageFiles(req.photos)
+	if err != nil {
+		return "", err
+	}
+
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	added := false
+	defer func() {
+		if !added {
+			discardUploads(uploads)
+		}
+	}()
+	u, err := micropubRelogin(username, token, "create")
+	if err != nil {
+		return "", err
+	}
+	post.Images, err = micropubPhotos(u, links, uploads)
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case status == StatusDraft:
+		err = u.addDraft(post)
+	case post.Date.After(time.Now()):
+		post.Status, post.PublishAt = StatusScheduled, post.Date
+		err = u.addDraft(post)
+		wakeScheduler()
+	case published != "":
+		err = u.addDatedPost(post)
+	default:
+		err = u.addPost(post)
+	}
+	if err != nil {
+		return "", err
+	}
+	added = true
+	for _, upload := range uploads {
+		u.addUpload(upload)
+	}
+	err = u.refreshUserInfo()
+	if err != nil {
+		return "", err
+	}
+	return postURL(u.Username, u.LastPostID), nil
+}
+
+// micropubUpdate edits the name, the content and categories of a post
+// like the edit form does
+func (u *User) micropubUpdate(req micropubRequest) error {
+	post := u.ownPostByURL(req.URL)
+	if post == nil {
+		return errors.New("url isn't a post of " + u.Username)
+	}
+	title, body, tags := post.Title, post.Body, append([]string(nil), post.Tags...)
+	for name, values := range req.Replace {
+		strs, err := propertyStrings(values)
+		if err != nil {
+			return err
+		}
+		switch name {
+		case "name", "content":
+			if len(strs) != 1 {
+				return errors.Errorf("%s needs one value", name)
+			}
+			if name == "name" {
+				title = strs[0]
+			} else {
+				body = strs[0]
+			}
+		case "category":
+			tags = strs
+		default:
+			return errors.Errorf("%s can't be replaced", name)
+		}
+	}
+	for name, values := range req.Add {
+		strs, err := propertyStrings(values)
+		if err != nil {
+			return err
+		}
+		if name != "category" {
+			return errors.Errorf("%s can't be added to", name)
+		}
+		tags = append(tags, strs...)
+	}
+	if len(req.Delete) > 0 {
+		var names []string
+		var values map[string][]interface{}
+		if json.Unmarshal(req.Delete, &names) != nil && json.Unmarshal(req.Delete, &values) != nil {
+			return errors.New("delete is neither a list of properties nor of values")
+		}
+		for _, name := range names {
+			if name != "category" {
+				return errors.Errorf("%s can't be deleted", name)
+			}
+			tags = nil
+		}
+		for name, vs := range values {
+			strs, err := propertyStrings(vs)
+			if err != nil {
+				return err
+			}
+			if name != "category" {
+				return errors.Errorf("values of %s can't be deleted", name)
+			}
+			for _, s := range strs {
+				tags = removeTag(tags, strings.ToLower(strings.TrimPrefix(s, "#")))
+			}
+		}
+	}
+	parsed, err := parseTags(strings.Join(tags, ","))
+	if err != nil {
+		return err
+	}
+	err = u.editPost(post.ID, Revision{
+		Author: u.Username,
+		Date:   time.Now().UTC(),
+		Title:  title,
+		Body:   body,
+		Tags:   parsed,
+	})
+	if err != nil {
+		return err
+	}
+	return u.refreshUserInfo()
+}
+
+func removeTag(tags []string, tag string) []string {
+	var kept []string
+	for _, t := range tags {
+		if t != tag {
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
+
+func (u *User) micropubDelete(link string) error {
+	post := u.ownPostByURL(link)
+	if post == nil {
+		return errors.New("url isn't a post of " + u.Username)
+	}
+	var err error
+	if post.IsPublished() {
+		err = u.deletePost(post.ID)
+	} else {
+		err = u.deleteDraft(post.ID)
+	}
+	if err != nil {
+		return err
+	}
+	return u.refreshUserInfo()
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withMicropub adds a user with a token of the scopes and returns the token
+func withMicropub(t *testing.T, scopes ...string) (*User, string, func()) {
+	us := &User{Username: "testUser", Password: "testPassword", ID: 1, Role: RoleAuthor}
+	token, appToken, err := newAppToken("app", scopes, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	us.Tokens = append(us.Tokens, appToken)
+	users = append(users, us)
+	return us, token, func() {
+		users = nil
+		os.Remove("data/accounts/testUser.txt")
+		for len(webmentionQueue) > 0 {
+			<-webmentionQueue
+		}
+	}
+}
+
+func sendMicropub(method, contentType, body, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, baseURL+"/micropub", strings.NewReader(body))
+	if method == "GET" {
+		req = httptest.NewRequest(method, baseURL+"/micropub?"+body, nil)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	if method == "GET" {
+		micropubGetHandler(w, req, nil)
+	} else {
+		micropubPostHandler(w, req, nil)
+	}
+	return w
+}
+
+const formType = "application/x-www-form-urlencoded"
+
+func TestAppTokens(t *testing.T) {
+	us, token, cleanup := withMicropub(t, "create")
+	defer cleanup()
+	found, appToken := userByToken(token)
+	if found != us || appToken.Hash == token || !appToken.HasScope("create") || appToken.HasScope("delete") {
+		t.Errorf("TestAppTokens --> FAILED")
+	}
+	if found, _ := userByToken(token + "x"); found != nil {
+		t.Errorf("TestAppTokens --> FAILED")
+	}
+	us.Disabled = true
+	if found, _ := userByToken(token); found != nil {
+		t.Errorf("TestAppTokens --> FAILED")
+	}
+	us.Disabled = false
+	if !us.revokeToken(appToken.ID) || us.revokeToken(appToken.ID) {
+		t.Errorf("TestAppTokens --> FAILED")
+	}
+	if found, _ := userByToken(token); found != nil {
+		t.Errorf("TestAppTokens --> FAILED")
+	}
+}
+
+func TestMicropubRelogin(t *testing.T) {
+	us, token, cleanup := withMicropub(t, "create")
+	defer cleanup()
+	if found, err := micropubRelogin("testUser", token, "create"); found != us || err != nil {
+		t.Errorf("TestMicropubRelogin --> FAILED: %v", err)
+	}
+	if _, err := micropubRelogin("testUser", token, "delete"); err.(micropubFault).code != "insufficient_scope" {
+		t.Errorf("TestMicropubRelogin --> FAILED: %v", err)
+	}
+	us.Disabled = true
+	if found, err := micropubRelogin("testUser", token, "create"); found != nil || err == nil {
+		t.Errorf("TestMicropubRelogin --> FAILED")
+	}
+	us.Disabled = false
+	us.revokeToken(us.Tokens[0].ID)
+	if found, err := micropubRelogin("testUser", token, "create"); found != nil || err == nil {
+		t.Errorf("TestMicropubRelogin --> FAILED")
+	}
+	users = nil
+	if found, err := micropubRelogin("testUser", token, "create"); found != nil || err == nil {
+		t.Errorf("TestMicropubRelogin --> FAILED")
+	}
+}
+
+func TestMicropubCreate(t *testing.T) {
+	us, token, cleanup := withMicropub(t, "create")
+	defer cleanup()
+
+	form := url.Values{"h": {"entry"}, "content": {"hello from my phone, a short note"}, "category[]": {"Go", "#phone"}}
+	w := sendMicropub("POST", formType, form.Encode(), token)
+	if w.Code != http.StatusCreated || w.Header().Get("Location") != postURL("testUser", 1) {
+		t.Fatal("TestMicropubCreate --> FAILED", w.Code, w.Body.String())
+	}
+	post := us.getPost(1)
+	if post.Title != "hello from my phone, a short" || strings.Join(post.Tags, ",") != "go,phone" {
+		t.Errorf("TestMicropubCreate --> FAILED: %+v", post)
+	}
+	saved, _ := readAccount("testUser")
+	if saved.PostCount != 1 || saved.Tokens[0].LastUsed.IsZero() {
+		t.Errorf("TestMicropubCreate --> FAILED")
+	}
+
+	// the token may also come in the form
+	form = url.Values{"h": {"entry"}, "name": {"titled"}, "content": {"body"}, "access_token": {token}}
+	if w := sendMicropub("POST", formType, form.Encode(), ""); w.Code != http.StatusCreated {
+		t.Errorf("TestMicropubCreate --> FAILED")
+	}
+
+	entry := `{"type":["h-entry"],"properties":{"name":["json"],"content":[{"html":"<p>rich <b>text</b></p>"}],` +
+		`"published":["2020-01-02T03:04:05+01:00"],"post-status":["draft"]}}`
+	w = sendMicropub("POST", "application/json", entry, token)
+	draft := us.getDraft(3)
+	if w.Code != http.StatusCreated || draft == nil || draft.Body != "rich text" ||
+		!draft.Date.Equal(time.Date(2020, 1, 2, 2, 4, 5, 0, time.UTC)) {
+		t.Errorf("TestMicropubCreate --> FAILED: %s", w.Body.String())
+	}
+
+	// a post published in the future waits for its time
+	at := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	entry = `{"type":["h-entry"],"properties":{"content":["later"],"published":["` + at.Format(time.RFC3339) + `"]}}`
+	w = sendMicropub("POST", "application/json", entry, token)
+	scheduled := us.getDraft(4)
+	if w.Code != http.StatusCreated || scheduled == nil || scheduled.Status != StatusScheduled ||
+		!scheduled.PublishAt.Equal(at) || us.getPost(4) != nil {
+		t.Errorf("TestMicropubCreate --> FAILED: %s", w.Body.String())
+	}
+
+	// invalid posts are refused by the same validation as the new post form
+	for _, body := range []string{
+		`{"type":["h-entry"],"properties":{"name":["a title that is far too long to be valid"],"content":["x"]}}`,
+		`{"type":["h-entry"],"properties":{"content":["x"],"category":["bad_tag!"]}}`,
+		`{"type":["h-card"],"properties":{"name":["me"]}}`,
+		`{"type":["h-entry"],"properties":{"content":["x"],"photo":["https://example.com/a.jpg"]}}`,
+		`{"type":["h-entry"]`,
+	} {
+		w := sendMicropub("POST", "application/json", body, token)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid_request") {
+			t.Errorf("TestMicropubCreate --> FAILED: %s", body)
+		}
+	}
+	if len(us.Posts) != 2 || len(us.Drafts) != 2 {
+		t.Errorf("TestMicropubCreate --> FAILED")
+	}
+
+	if w := sendMicropub("POST", formType, "h=entry&content=x", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("TestMicropubCreate --> FAILED")
+	}
+	if w := sendMicropub("POST", formType, "h=entry&content=x", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("TestMicropubCreate --> FAILED")
+	}
+	us.Role = RoleReader
+	if w := sendMicropub("POST", formType, "h=entry&content=x", token); w.Code != http.StatusForbidden {
+		t.Errorf("TestMicropubCreate --> FAILED")
+	}
+}
+
+func TestNoteTitle(t *testing.T) {
+	for body, title := range map[string]string{
+		"hello from my phone, a short note": "hello from my phone, a short",
+		"  ":                                "",
+		strings.Repeat("я", 40) + " и всё":  strings.Repeat("я", 30),
+		"привет из телефона, короткая заметка": "привет из телефона, короткая",
+	} {
+		if noteTitle(body) != title {
+			t.Errorf("TestNoteTitle --> FAILED: %s", body)
+		}
+	}
+}
+
+func TestMicropubPhotosAndDates(t *testing.T) {
+	us, token, cleanup := withMicropub(t, "create")
+	defer cleanup()
+	defer withMediaDir(t)()
+	send := func(name string, links ...string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		mw.WriteField("h", "entry")
+		mw.WriteField("name", name)
+		for _, link := range links {
+			mw.WriteField("photo[]", link)
+		}
+		mw.WriteField("content", "a photo")
+		fw, _ := mw.CreateFormFile("photo", "picture.png")
+		fw.Write(testPNG(30, 30))
+		mw.Close()
+		return sendMicropub("POST", mw.FormDataContentType(), body.String(), token)
+	}
+
+	// photos of invalid posts aren't stored
+	if w := send("a title that is far too long to be valid"); w.Code != http.StatusBadRequest {
+		t.Errorf("TestMicropubPhotosAndDates --> FAILED")
+	}
+	if files, _ := ioutil.ReadDir(mediaDir); len(us.Uploads) != 0 || len(files) != 0 {
+		t.Errorf("TestMicropubPhotosAndDates --> FAILED")
+	}
+	// nor are they kept when a link isn't an upload of the user
+	if w := send("photo", "https://example.com/a.jpg"); w.Code != http.StatusBadRequest {
+		t.Errorf("TestMicropubPhotosAndDates --> FAILED")
+	}
+	if files, _ := ioutil.ReadDir(mediaDir); len(us.Uploads) != 0 || len(files) != 0 {
+		t.Errorf("TestMicropubPhotosAndDates --> FAILED")
+	}
+	if w := send("photo"); w.Code != http.StatusCreated || len(us.Uploads) != 1 || len(us.getPost(1).Images) != 1 {
+		t.Errorf("TestMicropubPhotosAndDates --> FAILED")
+	}
+
+	// a post published in the past goes after newer ones
+	entry := `{"type":["h-entry"],"properties":{"name":["old"],"content":["old"],"published":["2019-01-02T03:04:05Z"]}}`
+	if w := sendMicropub("POST", "application/json", entry, token); w.Code != http.StatusCreated ||
+		w.Header().Get("Location") != postURL("testUser", 2) {
+		t.Fatal("TestMicropubPhotosAndDates --> FAILED")
+	}
+	if len(us.Posts) != 2 || us.Posts[0].ID != 1 || us.Posts[1].ID != 2 {
+		t.Errorf("TestMicropubPhotosAndDates --> FAILED")
+	}
+}
+
+func TestMicropubUpdateAndDelete(t *testing.T) {
+	us, token, cleanup := withMicropub(t, "create", "update")
+	defer cleanup()
+	us.addPost(Post{Title: "title", Body: "body", Tags: []string{"a", "b"}, Date: time.Now()})
+	link := postURL("testUser", 1)
+
+	update := `{"action":"update","url":"` + link + `","replace":{"content":["new body"]},"add":{"category":["c"]},` +
+		`"delete":{"category":["a"]}}`
+	w := sendMicropub("POST", "application/json", update, token)
+	post := us.getPost(1)
+	if w.Code != http.StatusNoContent || post.Body != "new body" || post.Title != "title" ||
+		strings.Join(post.Tags, ",") != "b,c" || len(post.Revisions) != 2 {
+		t.Fatal("TestMicropubUpdateAndDelete --> FAILED", w.Code, w.Body.String())
+	}
+	w = sendMicropub("POST", "application/json", `{"action":"update","url":"`+link+`","delete":["category"]}`, token)
+	if w.Code != http.StatusNoContent || len(post.Tags) != 0 {
+		t.Errorf("TestMicropubUpdateAndDelete --> FAILED")
+	}
+	for _, body := range []string{
+		`{"action":"update","url":"` + link + `","replace":{"name":["a title that is far too long to be valid"]}}`,
+		`{"action":"update","url":"` + link + `","delete":["content"]}`,
+		`{"action":"update","url":"` + postURL("testUser", 2) + `","replace":{"name":["x"]}}`,
+		`{"action":"undelete","url":"` + link + `"}`,
+	} {
+		if w := sendMicropub("POST", "application/json", body, token); w.Code != http.StatusBadRequest {
+			t.Errorf("TestMicropubUpdateAndDelete --> FAILED: %s", body)
+		}
+	}
+
+	// deleting needs its own scope
+	form := url.Values{"action": {"delete"}, "url": {link}}
+	w = sendMicropub("POST", formType, form.Encode(), token)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "insufficient_scope") || us.getPost(1) == nil {
+		t.Errorf("TestMicropubUpdateAndDelete --> FAILED")
+	}
+	us.Tokens[0].Scopes = append(us.Tokens[0].Scopes, "delete")
+	w = sendMicropub("POST", formType, form.Encode(), token)
+	if w.Code != http.StatusNoContent || us.getPost(1) != nil {
+		t.Errorf("TestMicropubUpdateAndDelete --> FAILED")
+	}
+	saved, _ := readAccount("testUser")
+	if saved.PostCount != 0 {
+		t.Errorf("TestMicropubUpdateAndDelete --> FAILED")
+	}
+}
+
+func TestMicropubQuery(t *testing.T) {
+	us, token, cleanup := withMicropub(t, "create")
+	defer cleanup()
+	us.addPost(Post{Title: "title", Body: "body", Tags: []string{"go"}, Images: []string{"a.png"}, Date: time.Now()})
+
+	var config struct {
+		Q []string
+	}
+	w := sendMicropub("GET", "", "q=config", token)
+	if w.Code != 200 || json.Unmarshal(w.Body.Bytes(), &config) != nil || len(config.Q) == 0 {
+		t.Errorf("TestMicropubQuery --> FAILED")
+	}
+
+	var source struct {
+		Type       []string
+		Properties map[string][]string
+	}
+	w = sendMicropub("GET", "", "q=source&url="+url.QueryEscape(postURL("testUser", 1)), token)
+	if w.Code != 200 || json.Unmarshal(w.Body.Bytes(), &source) != nil || source.Type[0] != "h-entry" ||
+		source.Properties["name"][0] != "title" || source.Properties["category"][0] != "go" ||
+		source.Properties["photo"][0] != baseURL+"/media/a.png" {
+		t.Errorf("TestMicropubQuery --> FAILED: %s", w.Body.String())
+	}
+	source.Properties = nil
+	w = sendMicropub("GET", "", "q=source&properties[]=content&url="+url.QueryEscape(postURL("testUser", 1)), token)
+	if json.Unmarshal(w.Body.Bytes(), &source) != nil || len(source.Properties) != 1 || source.Properties["content"][0] != "body" {
+		t.Errorf("TestMicropubQuery --> FAILED: %s", w.Body.String())
+	}
+
+	if w := sendMicropub("GET", "", "q=source&url=https://example.com/", token); w.Code != http.StatusBadRequest {
+		t.Errorf("TestMicropubQuery --> FAILED")
+	}
+	if w := sendMicropub("GET", "", "q=config", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("TestMicropubQuery --> FAILED")
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"src/github.com/pkg/errors"
+)
+
+// schemaVersion is the version of the account files format,
+// older files are upgraded by migrations when they are loaded
+const schemaVersion = 3
+
+// account is an account file decoded without the User type,
+// so migrations keep working with formats User can't read
+type account map[string]interface{}
+
+type migration struct {
+	// To is the version the migration upgrades from the previous one
+	To          int
+	Description string
+	Apply       func(account) error
+}
+
+// migrations upgrade account files one version at a time. Files saved before
+// versions were written don't have one and are treated as version 1, so
+// migrations must leave data that is already upgraded as it is.
+var migrations = []migration{
+	{2, "roles and post IDs", migrateRolesAndPostIDs},
+	{3, "UTC dates", migrateUTCDates},
+}
+
+// jsonInt reads a number decoded with UseNumber, anything else is 0
+func jsonInt(v interface{}) int {
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0
+	}
+	i, _ := n.Int64()
+	return int(i)
+}
+
+// objects returns the objects of the list at key, it's nil when there's no list
+func (a account) objects(key string) ([]map[string]interface{}, error) {
+	list, _ := a[key].([]interface{})
+	var objects []map[string]interface{}
+	for i, v := range list {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, errors.Errorf("%s[%d] isn't an object", key, i)
+		}
+		objects = append(objects, obj)
+	}
+	return objects, nil
+}
+
+// migrateRolesAndPostIDs gives a role to accounts created before roles
+// existed: the first user is the admin, others are authors. Posts get
+// IDs in the order they were written, the oldest post gets 1.
+func migrateRolesAndPostIDs(a account) error {
+	if role, _ := a["Role"].(string); role == "" {
+		a["Role"] = RoleAuthor
+		if jsonInt(a["id"]) == 1 {
+			a["Role"] = RoleAdmin
+		}
+	}
+	posts, err := a.objects("Posts")
+	if err != nil {
+		return err
+	}
+	last := jsonInt(a["LastPostID"])
+	// posts are kept newest first
+	for i := len(posts) - 1; i >= 0; i-- {
+		if jsonInt(posts[i]["ID"]) == 0 {
+			last++
+			posts[i]["ID"] = json.Number(fmt.Sprint(last))
+		}
+	}
+	a["LastPostID"] = json.Number(fmt.Sprint(last))
+	return nil
+}
+
+// migrateUTCDates rewrites dates saved with timeFormat in the server's
+// time zone as RFC 3339 in UTC
+func migrateUTCDates(a account) error {
+	for _, key := range []string{"Posts", "Drafts"} {
+		posts, err := a.objects(key)
+		if err != nil {
+			return err
+		}
+		for _, post := range posts {
+			err = convertDate(post, "Date")
+			if err != nil {
+				return err
+			}
+			comments, err := account(post).objects("Comments")
+			if err != nil {
+				return err
+			}
+			for _, c := range comments {
+				err = convertDate(c, "Date")
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func convertDate(obj map[string]interface{}, key string) error {
+	s, ok := obj[key].(string)
+	if !ok {
+		return nil
+	}
+	t, err := parseStoredTime(s)
+	if err != nil {
+		return err
+	}
+	obj[key] = t
+	return nil
+}
+
+// migrateAccount upgrades an account file to schemaVersion and returns
+// the migrations it needed, none for files that are up to date
+func migrateAccount(data []byte) ([]byte, []migration, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var a account
+	err := dec.Decode(&a)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "not an account")
+	}
+	version := jsonInt(a["SchemaVersion"])
+	if version == 0 {
+		version = 1
+	}
+	if version > schemaVersion {
+		return nil, nil, errors.Errorf("schema version %d is newer than %d, the file is saved by a newer version of the blog",
+			version, schemaVersion)
+	}
+	var applied []migration
+	for _, m := range migrations {
+		if m.To <= version {
+			continue
+		}
+		err = m.Apply(a)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, fmt.Sprintf("migration to version %d failed", m.To))
+		}
+		applied = append(applied, m)
+	}
+	if len(applied) == 0 {
+		return data, nil, nil
+	}
+	a["SchemaVersion"] = schemaVersion
+	data, err = json.Marshal(a)
+	return data, applied, err
+}
+
+// migrateAccounts upgrades the account files in dir, with dryRun it only tells what it would do
+func migrateAccounts(dir string, dryRun bool, out io.Writer) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return errors.Wrap(err, "reading directory error")
+	}
+	upgraded := 0
+	for _, file := range files {
+		path := filepath.Join(dir, file.Name())
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return errors.Wrap(err, "reading file error")
+		}
+		data, applied, err := migrateAccount(data)
+		if err != nil {
+			return errors.Wrap(err, file.Name())
+		}
+		if len(applied) == 0 {
+			fmt.Fprintf(out, "%s: up to date\n", file.Name())
+			continue
+		}
+		var steps []string
+		for _, m := range applied {
+			steps = append(steps, m.Description)
+		}
+		fmt.Fprintf(out, "%s: version %d -> %d: %s\n", file.Name(), applied[0].To-1, schemaVersion, strings.Join(steps, ", "))
+		upgraded++
+
+		// saved the way the server saves users so the result is checked too
+		us := User{}
+		err = json.Unmarshal(data, &us)
+		if err != nil {
+			return errors.Wrap(err, file.Name())
+		}
+		err = validateAccount(us)
+		if err != nil {
+			return errors.Wrap(err, file.Name())
+		}
+		if dryRun {
+			continue
+		}
+		data, err = json.Marshal(us)
+		if err == nil {
+			err = ioutil.WriteFile(path, data, 0600)
+		}
+		if err != nil {
+			return errors.Wrap(err, "can't save "+file.Name())
+		}
+	}
+	if dryRun {
+		fmt.Fprintf(out, "%d of %d accounts would be upgraded to version %d, nothing is changed\n",
+			upgraded, len(files), schemaVersion)
+	} else {
+		fmt.Fprintf(out, "%d of %d accounts are upgraded to version %d\n", upgraded, len(files), schemaVersion)
+	}
+	return nil
+}
+
+// migrateCommand is "migrate [-dry-run]", running tells whether the server is up
+func migrateCommand(args []string, running bool, out io.Writer) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	flags.SetOutput(out)
+	dryRun := flags.Bool("dry-run", false, "only show which accounts would be upgraded")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	// the running server has upgraded all accounts when it loaded them
+	// and would overwrite files changed under its feet
+	if running && !*dryRun {
+		return errors.New("the server is running, stop it before migrating")
+	}
+	return migrateAccounts("data/accounts", *dryRun, out)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fixtures in testdata/accounts are account files as each schema version saved them
+func migrateFixture(t *testing.T, name string) (User, []migration) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "accounts", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, applied, err := migrateAccount(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var us User
+	err = json.Unmarshal(data, &us)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if validateAccount(us) != nil || us.SchemaVersion != schemaVersion {
+		t.Errorf("migrateFixture %s --> FAILED", name)
+	}
+	return us, applied
+}
+
+func TestMigrateV1(t *testing.T) {
+	us, applied := migrateFixture(t, "v1.txt")
+	// posts are newest first, the oldest one gets ID 1
+	if len(applied) != 2 || us.Role != RoleAdmin || us.LastPostID != 2 || us.Posts[1].ID != 1 || us.Posts[0].ID != 2 {
+		t.Errorf("TestMigrateV1 --> FAILED")
+	}
+	date := time.Date(2018, 4, 5, 16, 17, 48, 0, time.Local)
+	if !us.Posts[0].Date.Equal(date) || us.Posts[0].Date.Location() != time.UTC {
+		t.Errorf("TestMigrateV1 --> FAILED")
+	}
+
+	data, _, err := migrateAccount([]byte(`{"Username":"ducker","id":2}`))
+	if err != nil || !strings.Contains(string(data), `"Role":"author"`) {
+		t.Errorf("TestMigrateV1 --> FAILED")
+	}
+}
+
+func TestMigrateV2(t *testing.T) {
+	us, _ := migrateFixture(t, "v2.txt")
+	if us.Role != RoleModerator || us.LastPostID != 5 || us.Posts[0].ID != 5 || us.Posts[1].ID != 2 ||
+		len(us.Following) != 1 || us.Email != "moder@example.com" {
+		t.Errorf("TestMigrateV2 --> FAILED")
+	}
+	if !us.Posts[0].Comments[0].Date.Equal(time.Date(2018, 4, 6, 11, 30, 0, 0, time.Local)) {
+		t.Errorf("TestMigrateV2 --> FAILED")
+	}
+}
+
+func TestMigrateV3(t *testing.T) {
+	us, applied := migrateFixture(t, "v3.txt")
+	// saved before versions were written, so it's upgraded without changes
+	if len(applied) != 2 || us.Role != RoleAuthor || us.LastPostID != 1 || us.TimeZone != "Europe/Moscow" ||
+		!us.Posts[0].Date.Equal(time.Date(2018, 6, 4, 7, 0, 0, 0, time.UTC)) ||
+		!us.Posts[0].Comments[0].Date.Equal(time.Date(2018, 6, 4, 8, 15, 30, 5e8, time.UTC)) {
+		t.Errorf("TestMigrateV3 --> FAILED")
+	}
+
+	saved, _ := json.Marshal(us)
+	again, applied, err := migrateAccount(saved)
+	if err != nil || len(applied) != 0 || !bytes.Equal(again, saved) {
+		t.Errorf("TestMigrateV3 --> FAILED")
+	}
+	if _, _, err := migrateAccount([]byte(`{"Username":"future","SchemaVersion":99}`)); err == nil {
+		t.Errorf("TestMigrateV3 --> FAILED")
+	}
+}
+
+func TestMigrateAccounts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"v1.txt", "v2.txt", "v3.txt"} {
+		data, _ := ioutil.ReadFile(filepath.Join("testdata", "accounts", name))
+		ioutil.WriteFile(filepath.Join(dir, name), data, 0600)
+	}
+	original, _ := ioutil.ReadFile(filepath.Join(dir, "v1.txt"))
+
+	var out bytes.Buffer
+	err = migrateAccounts(dir, true, &out)
+	changed, _ := ioutil.ReadFile(filepath.Join(dir, "v1.txt"))
+	if err != nil || !bytes.Equal(changed, original) || !strings.Contains(out.String(), "v1.txt: version 1 -> 3") ||
+		!strings.Contains(out.String(), "3 of 3 accounts would be upgraded") {
+		t.Errorf("TestMigrateAccounts --> FAILED")
+	}
+
+	out.Reset()
+	err = migrateAccounts(dir, false, &out)
+	if err != nil || !strings.Contains(out.String(), "3 of 3 accounts are upgraded") {
+		t.Errorf("TestMigrateAccounts --> FAILED")
+	}
+	out.Reset()
+	err = migrateAccounts(dir, false, &out)
+	if err != nil || !strings.Contains(out.String(), "v2.txt: up to date") || !strings.Contains(out.String(), "0 of 3") {
+		t.Errorf("TestMigrateAccounts --> FAILED")
+	}
+
+	if migrateCommand(nil, true, &out) == nil {
+		t.Errorf("TestMigrateAccounts --> FAILED")
+	}
+}
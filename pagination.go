@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// page sizes, can be changed with BLOG_POSTS_PER_PAGE and BLOG_USERS_PER_PAGE
+var postsPerPage = 10
+var usersPerPage = 50
+
+// Pagination holds links to the neighbour pages, empty when there is no such page
+type Pagination struct {
+	Page  int
+	Pages int
+	Prev  string
+	Next  string
+}
+
+// pageNumber reads the 1-based ?page parameter, anything invalid means the first page
+func pageNumber(r *http.Request) int {
+	page, err := strconv.Atoi(r.FormValue("page"))
+	if err != nil || page < 1 {
+		return 1
+	}
+	return page
+}
+
+// paginate returns the bounds of the page in a list of total items
+// and links to the neighbour pages of the same URL
+func paginate(r *http.Request, total, size int) (int, int, Pagination) {
+	p := Pagination{Pages: (total + size - 1) / size}
+	if p.Pages == 0 {
+		p.Pages = 1
+	}
+	// any page past the end is the same empty page, so huge
+	// numbers don't overflow the bounds
+	page := minInt(pageNumber(r), p.Pages+1)
+	p.Page = page
+	link := func(n int) string {
+		q := url.Values{}
+		for k, v := range r.URL.Query() {
+			q[k] = v
+		}
+		if n == 1 {
+			q.Del("page")
+		} else {
+			q.Set("page", strconv.Itoa(n))
+		}
+		if len(q) == 0 {
+			return r.URL.Path
+		}
+		return r.URL.Path + "?" + q.Encode()
+	}
+	if page > 1 {
+		p.Prev = link(minInt(page-1, p.Pages))
+	}
+	if page < p.Pages {
+		p.Next = link(page + 1)
+	}
+	start := minInt((page-1)*size, total)
+	return start, minInt(start+size, total), p
+}
+
+// setLinkHeader advertises the neighbour pages with rel=prev and rel=next
+func (p Pagination) setLinkHeader(w http.ResponseWriter) {
+	var links []string
+	if p.Prev != "" {
+		links = append(links, "<"+p.Prev+`>; rel="prev"`)
+	}
+	if p.Next != "" {
+		links = append(links, "<"+p.Next+`>; rel="next"`)
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+}
+
+// postsPage returns posts of the page from start to end, newest first
+func (u User) postsPage(start, end int) []Post {
+	if start >= len(u.Posts) {
+		return nil
+	}
+	if end > len(u.Posts) {
+		end = len(u.Posts)
+	}
+	return u.Posts[start:end]
+}
+
+// usersPage returns the users from start to end, sorted by username
+func usersPage(start, end int) []*User {
+	sorted := make([]*User, len(users))
+	copy(sorted, users)
+	sort.Slice(sorted, func(i, j int) bool {
+		return strings.ToLower(sorted[i].Username) < strings.ToLower(sorted[j].Username)
+	})
+	if start >= len(sorted) {
+		return nil
+	}
+	if end > len(sorted) {
+		end = len(sorted)
+	}
+	return sorted[start:end]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"src/github.com/julienschmidt/httprouter"
+)
+
+func TestPaginate(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://127.0.0.1/userList?page=2&sort=name", nil)
+	start, end, p := paginate(req, 25, 10)
+	if start != 10 || end != 20 || p.Page != 2 || p.Pages != 3 ||
+		p.Prev != "/userList?sort=name" || p.Next != "/userList?page=3&sort=name" {
+		t.Errorf("TestPaginate --> FAILED")
+	}
+
+	req = httptest.NewRequest("GET", "http://127.0.0.1/userList?page=3", nil)
+	start, end, p = paginate(req, 25, 10)
+	if start != 20 || end != 25 || p.Next != "" || p.Prev != "/userList?page=2" {
+		t.Errorf("TestPaginate --> FAILED")
+	}
+
+	// pages past the end are empty but still link back
+	req = httptest.NewRequest("GET", "http://127.0.0.1/userList?page=9", nil)
+	start, end, p = paginate(req, 25, 10)
+	if start != 25 || end != 25 || p.Next != "" || p.Prev != "/userList?page=3" {
+		t.Errorf("TestPaginate --> FAILED")
+	}
+
+	req = httptest.NewRequest("GET", "http://127.0.0.1/userList?page=1000000000000000000", nil)
+	start, end, p = paginate(req, 25, 10)
+	if start != 25 || end != 25 || p.Page != 4 || p.Prev != "/userList?page=3" {
+		t.Errorf("TestPaginate --> FAILED")
+	}
+
+	req = httptest.NewRequest("GET", "http://127.0.0.1/userList?page=-1", nil)
+	start, end, p = paginate(req, 0, 10)
+	if start != 0 || end != 0 || p.Page != 1 || p.Pages != 1 || p.Prev != "" || p.Next != "" {
+		t.Errorf("TestPaginate --> FAILED")
+	}
+}
+
+func TestSetLinkHeader(t *testing.T) {
+	w := httptest.NewRecorder()
+	Pagination{Prev: "/a", Next: "/a?page=3"}.setLinkHeader(w)
+	if w.Header().Get("Link") != `</a>; rel="prev", </a?page=3>; rel="next"` {
+		t.Errorf("TestSetLinkHeader --> FAILED")
+	}
+
+	w = httptest.NewRecorder()
+	Pagination{}.setLinkHeader(w)
+	if w.Header().Get("Link") != "" {
+		t.Errorf("TestSetLinkHeader --> FAILED")
+	}
+}
+
+func TestUsersHandlerSecondPage(t *testing.T) {
+	defer func() {
+		users = nil
+	}()
+	us := &User{Username: "testUser", Password: "testPassword", ID: 1}
+	for i := 1; i <= postsPerPage+2; i++ {
+		us.Posts = append([]Post{{ID: i, Title: fmt.Sprintf("title%03d", i), Body: "body"}}, us.Posts...)
+	}
+	us.PostCount = len(us.Posts)
+	users = append(users, us, &User{Username: "reader", Password: "testPassword", ID: 2})
+
+	req := httptest.NewRequest("GET", "http://127.0.0.1/users/testUser?page=2", nil)
+	req.AddCookie(sessionFor("reader"))
+	w := httptest.NewRecorder()
+
+	usersHandler(w, req, httprouter.Params{{"username", "testUser"}})
+
+	body := w.Body.String()
+	if w.Code != 200 || !strings.Contains(body, "title002") || strings.Contains(body, "title003") ||
+		!strings.Contains(body, `rel="prev"`) || w.Header().Get("Link") != `</users/testUser>; rel="prev"` {
+		t.Errorf("TestUsersHandlerSecondPage --> FAILED")
+	}
+}
+
+func TestUserListHandlerPages(t *testing.T) {
+	defer func(size int) {
+		users = nil
+		usersPerPage = size
+	}(usersPerPage)
+	usersPerPage = 2
+	for _, name := range []string{"carol", "Bob", "alice"} {
+		users = append(users, &User{Username: name, Password: "testPassword"})
+	}
+
+	req := httptest.NewRequest("GET", "http://127.0.0.1/userList", nil)
+	req.AddCookie(sessionFor("alice"))
+	w := httptest.NewRecorder()
+
+	userListHandler(w, req, nil)
+
+	body := w.Body.String()
+	if !strings.Contains(body, "population is 3") || !strings.Contains(body, "Bob") || strings.Contains(body, "carol") ||
+		w.Header().Get("Link") != `</userList?page=2>; rel="next"` {
+		t.Errorf("TestUserListHandlerPages --> FAILED")
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"src/github.com/asaskevich/govalidator"
+	"src/github.com/julienschmidt/httprouter"
+	"src/github.com/pkg/errors"
+)
+
+// DisplayedName is the display name of the user or the username when it isn't set
+func (u User) DisplayedName() string {
+	if u.DisplayName != "" {
+		return u.DisplayName
+	}
+	return u.Username
+}
+
+// AvatarURL links the thumbnail of the avatar or the identicon of the user
+func (u User) AvatarURL() string {
+	if u.Avatar == "" {
+		return "/users/" + u.Username + "/avatar.png"
+	}
+	return "/media/" + thumbName(u.Avatar)
+}
+
+// displayName is DisplayedName for templates having only a username
+func displayName(username string) string {
+	us := getUser(username)
+	if us == nil {
+		return username
+	}
+	return us.DisplayedName()
+}
+
+func avatarURL(username string) string {
+	us := getUser(username)
+	if us == nil {
+		return "/users/" + username + "/avatar.png"
+	}
+	return us.AvatarURL()
+}
+
+// cleanProfileText trims s and drops control characters, newlines are kept if multiline
+func cleanProfileText(s string, multiline bool) string {
+	s = strings.Replace(s, "\r\n", "\n", -1)
+	return strings.TrimSpace(strings.Map(func(r rune) rune {
+		if r == '\n' && multiline {
+			return r
+		}
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, s))
+}
+
+// normalizeWebsite adds a scheme to addresses like "example.com"
+func normalizeWebsite(s string) string {
+	s = strings.TrimSpace(s)
+	lower := strings.ToLower(s)
+	if s == "" || strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://") {
+		return s
+	}
+	return "http://" + s
+}
+
+// setProfile changes profile fields of the user if all of them are valid
+func (u *User) setProfile(displayName, bio, website string) error {
+	changed := *u
+	changed.DisplayName = cleanProfileText(displayName, false)
+	changed.Bio = cleanProfileText(bio, true)
+	changed.Website = normalizeWebsite(website)
+	_, err := govalidator.ValidateStruct(changed)
+	if err != nil {
+		return errors.Wrap(err, "invalid profile")
+	}
+	u.DisplayName, u.Bio, u.Website = changed.DisplayName, changed.Bio, changed.Website
+	return nil
+}
+
+type profilePage struct {
+	*User
+	Invalid bool
+}
+
+func profileGetHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	usernameCookie, err := sessionCookie(r)
+	if err == http.ErrNoCookie {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	if usernameCookie.Value != ps.ByName("username") {
+		http.Redirect(w, r, "/users/"+usernameCookie.Value, http.StatusFound)
+		return
+	}
+	tpl, err := parseTemplates("templates/header.html", "templates/profile.html")
+	if err != nil {
+		panic(err)
+	}
+
+	err = tpl.ExecuteTemplate(w, "profile", profilePage{getUser(usernameCookie.Value), r.FormValue("invalid") != ""})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func profilePostHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	storeMu.Lock()
+	usernameCookie, err := sessionCookie(r)
+	storeMu.Unlock()
+	if err == http.ErrNoCookie {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	username := ps.ByName("username")
+	if usernameCookie.Value != username {
+		http.Redirect(w, r, "/users/"+usernameCookie.Value, http.StatusFound)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize+1<<20)
+	// the avatar is read and stored before storeMu is taken
+	var avatar *Upload
+	if f, _, err := r.FormFile("avatar"); err == nil {
+		data, err := ioutil.ReadAll(io.LimitReader(f, maxUploadSize+1))
+		f.Close()
+		var upload Upload
+		if err == nil {
+			upload, err = storeImage(data)
+		}
+		if err != nil {
+			http.Redirect(w, r, "/users/"+username+"/profile?invalid=1", http.StatusFound)
+			return
+		}
+		avatar = &upload
+	}
+
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	// the account may have been deleted or disabled meanwhile
+	us := getUser(username)
+	if us == nil || us.Disabled {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	err = us.setProfile(r.FormValue("displayName"), r.FormValue("bio"), r.FormValue("website"))
+	if err != nil {
+		http.Redirect(w, r, "/users/"+username+"/profile?invalid=1", http.StatusFound)
+		return
+	}
+
+	if avatar != nil {
+		us.addUpload(*avatar)
+		us.Avatar = avatar.Name
+	} else if r.FormValue("removeAvatar") != "" {
+		us.Avatar = ""
+	}
+	err = us.refreshUserInfo()
+	if err != nil {
+		panic(err)
+	}
+	http.Redirect(w, r, "/users/"+username, http.StatusFound)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"src/github.com/julienschmidt/httprouter"
+)
+
+func TestSetProfile(t *testing.T) {
+	us := &User{Username: "testUser", Password: "testPassword", ID: 1, Role: RoleAuthor}
+
+	err := us.setProfile("  Test\tUser ", "line one\r\nline two\x00", "example.com/me")
+	if err != nil || us.DisplayName != "TestUser" || us.Bio != "line one\nline two" ||
+		us.Website != "http://example.com/me" || us.DisplayedName() != "TestUser" {
+		t.Errorf("TestSetProfile --> FAILED")
+	}
+
+	for _, fields := range [][3]string{
+		{strings.Repeat("n", 41), "", ""},
+		{"", strings.Repeat("b", 301), ""},
+		{"", "", "not a website"},
+	} {
+		if us.setProfile(fields[0], fields[1], fields[2]) == nil || us.DisplayName != "TestUser" {
+			t.Errorf("TestSetProfile --> FAILED")
+		}
+	}
+
+	if us.setProfile("", "", "") != nil || us.DisplayedName() != "testUser" || us.Website != "" {
+		t.Errorf("TestSetProfile --> FAILED")
+	}
+}
+
+func TestProfilePostHandler(t *testing.T) {
+	defer withMediaDir(t)()
+	defer func() {
+		users = nil
+		os.Remove("data/accounts/testUser.txt")
+	}()
+	users = append(users, &User{Username: "testUser", Password: "testPassword", ID: 1, Role: RoleAuthor})
+
+	req := multipartRequest("http://127.0.0.1/users/testUser/profile", "avatar", testPNG(500, 500))
+	req.AddCookie(sessionFor("testUser"))
+	req.ParseMultipartForm(1 << 20)
+	req.Form.Set("displayName", "Tester")
+	req.Form.Set("bio", "I test things")
+	req.Form.Set("website", "https://example.com")
+	w := httptest.NewRecorder()
+
+	profilePostHandler(w, req, httprouter.Params{{"username", "testUser"}})
+
+	us := getUser("testUser")
+	l, _ := w.Result().Location()
+	if l.Path != "/users/testUser" || us.DisplayName != "Tester" || us.Bio != "I test things" ||
+		us.Avatar == "" || us.AvatarURL() != "/media/"+thumbName(us.Avatar) || len(us.Uploads) != 1 {
+		t.Errorf("TestProfilePostHandler --> FAILED")
+	}
+
+	req = httptest.NewRequest("POST", "http://127.0.0.1/users/testUser/profile", nil)
+	req.AddCookie(sessionFor("testUser"))
+	req.ParseForm()
+	req.Form.Set("displayName", "Tester")
+	req.Form.Set("website", "ftp://example.com")
+	req.Form.Set("removeAvatar", "1")
+	w = httptest.NewRecorder()
+	profilePostHandler(w, req, httprouter.Params{{"username", "testUser"}})
+	l, _ = w.Result().Location()
+	if l.RawQuery != "invalid=1" || us.Avatar == "" || us.Website != "https://example.com" {
+		t.Errorf("TestProfilePostHandler --> FAILED")
+	}
+
+	req.Form.Set("website", "")
+	w = httptest.NewRecorder()
+	profilePostHandler(w, req, httprouter.Params{{"username", "testUser"}})
+	if us.Avatar != "" || us.Bio != "" || us.Website != "" {
+		t.Errorf("TestProfilePostHandler --> FAILED")
+	}
+}
+
+func TestUserPageShowsProfile(t *testing.T) {
+	defer func() {
+		users = nil
+	}()
+	users = append(users, &User{Username: "testUser", Password: "testPassword", ID: 1,
+		DisplayName: "Tester", Bio: "hello <b>there</b>", Website: "https://example.com"})
+	users = append(users, &User{Username: "reader", Password: "testPassword", ID: 2})
+
+	req := httptest.NewRequest("GET", "http://127.0.0.1/users/testUser", nil)
+	req.AddCookie(sessionFor("reader"))
+	w := httptest.NewRecorder()
+	usersHandler(w, req, httprouter.Params{{"username", "testUser"}})
+
+	body := w.Body.String()
+	if !strings.Contains(body, "<i>Tester</i> (testUser)") || !strings.Contains(body, "hello &lt;b&gt;there&lt;/b&gt;") ||
+		!strings.Contains(body, `<a href="https://example.com" rel="nofollow ugc">`) {
+		t.Errorf("TestUserPageShowsProfile --> FAILED")
+	}
+
+	req = httptest.NewRequest("GET", "http://127.0.0.1/userList", nil)
+	req.AddCookie(sessionFor("reader"))
+	w = httptest.NewRecorder()
+	userListHandler(w, req, nil)
+	if !strings.Contains(w.Body.String(), `<a href="/users/testUser">Tester</a> (testUser)`) {
+		t.Errorf("TestUserPageShowsProfile --> FAILED")
+	}
+}
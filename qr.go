@@ -0,0 +1,444 @@
+package main
+
+import (
+	"image"
+	"image/color"
+
+	"src/github.com/pkg/errors"
+)
+
+// A minimal QR code encoder: byte mode, error correction level M,
+// versions 1 to 10, which is plenty for otpauth:// URIs.
+
+type qrBlockInfo struct {
+	ecPerBlock int
+	// number of blocks and data codewords per block in both groups
+	blocks1, data1 int
+	blocks2, data2 int
+}
+
+// level M parameters, indexed by version
+var qrBlocksM = []qrBlockInfo{
+	{},
+	{10, 1, 16, 0, 0},
+	{16, 1, 28, 0, 0},
+	{26, 1, 44, 0, 0},
+	{18, 2, 32, 0, 0},
+	{24, 2, 43, 0, 0},
+	{16, 4, 27, 0, 0},
+	{18, 4, 31, 0, 0},
+	{22, 2, 38, 2, 39},
+	{22, 3, 36, 2, 37},
+	{26, 4, 43, 1, 44},
+}
+
+var qrAlignment = [][]int{
+	{}, {}, {6, 18}, {6, 22}, {6, 26}, {6, 30}, {6, 34},
+	{6, 22, 38}, {6, 24, 42}, {6, 26, 46}, {6, 28, 50},
+}
+
+func (b qrBlockInfo) dataCodewords() int {
+	return b.blocks1*b.data1 + b.blocks2*b.data2
+}
+
+// QRCode is a square matrix of modules, true meaning dark
+type QRCode struct {
+	Size    int
+	modules [][]bool
+	isFunc  [][]bool
+}
+
+func (q *QRCode) Dark(x, y int) bool {
+	return q.modules[y][x]
+}
+
+// encodeQR builds the smallest QR code holding data
+func encodeQR(data []byte) (*QRCode, error) {
+	version := 0
+	for v := 1; v < len(qrBlocksM); v++ {
+		countBits := 8
+		if v >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+8*len(data) <= 8*qrBlocksM[v].dataCodewords() {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, errors.Errorf("%d bytes don't fit into a QR code", len(data))
+	}
+	codewords := qrAddECC(qrDataCodewords(data, version), qrBlocksM[version])
+
+	size := 17 + 4*version
+	q := &QRCode{Size: size, modules: make([][]bool, size), isFunc: make([][]bool, size)}
+	for i := range q.modules {
+		q.modules[i] = make([]bool, size)
+		q.isFunc[i] = make([]bool, size)
+	}
+	q.drawFunctionPatterns(version)
+	q.drawCodewords(codewords)
+
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormatBits(mask)
+		if p := q.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		q.applyMask(mask)
+	}
+	q.applyMask(best)
+	q.drawFormatBits(best)
+	return q, nil
+}
+
+func qrDataCodewords(data []byte, version int) []byte {
+	capacity := qrBlocksM[version].dataCodewords()
+	var bits []bool
+	put := func(val, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, val>>uint(i)&1 == 1)
+		}
+	}
+	put(4, 4) // byte mode
+	if version >= 10 {
+		put(len(data), 16)
+	} else {
+		put(len(data), 8)
+	}
+	for _, b := range data {
+		put(int(b), 8)
+	}
+	for i := 0; i < 4 && len(bits) < capacity*8; i++ {
+		bits = append(bits, false)
+	}
+	for len(bits)%8 != 0 {
+		bits = append(bits, false)
+	}
+	result := make([]byte, 0, capacity)
+	for i := 0; i < len(bits); i += 8 {
+		var b byte
+		for j := 0; j < 8; j++ {
+			if bits[i+j] {
+				b |= 1 << uint(7-j)
+			}
+		}
+		result = append(result, b)
+	}
+	for pad := byte(0xEC); len(result) < capacity; pad ^= 0xEC ^ 0x11 {
+		result = append(result, pad)
+	}
+	return result
+}
+
+// qrAddECC splits data into blocks, computes Reed-Solomon codewords
+// for each of them and interleaves the result
+func qrAddECC(data []byte, info qrBlockInfo) []byte {
+	var blocks, ecc [][]byte
+	for i := 0; i < info.blocks1+info.blocks2; i++ {
+		n := info.data1
+		if i >= info.blocks1 {
+			n = info.data2
+		}
+		blocks = append(blocks, data[:n])
+		ecc = append(ecc, reedSolomon(data[:n], info.ecPerBlock))
+		data = data[n:]
+	}
+	var result []byte
+	for i := 0; i < info.data1 || i < info.data2; i++ {
+		for _, b := range blocks {
+			if i < len(b) {
+				result = append(result, b[i])
+			}
+		}
+	}
+	for i := 0; i < info.ecPerBlock; i++ {
+		for _, e := range ecc {
+			result = append(result, e[i])
+		}
+	}
+	return result
+}
+
+var gfExp, gfLog [256]int
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = x
+		gfLog[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11D
+		}
+	}
+	gfExp[255] = gfExp[0]
+}
+
+func gfMul(a, b int) int {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[(gfLog[a]+gfLog[b])%255]
+}
+
+func reedSolomon(data []byte, degree int) []byte {
+	// generator polynomial (x - a^0)(x - a^1)...(x - a^(degree-1)),
+	// coefficients from the highest power, leading 1 omitted
+	gen := make([]int, degree)
+	gen[degree-1] = 1
+	root := 1
+	for i := 0; i < degree; i++ {
+		for j := 0; j < degree; j++ {
+			gen[j] = gfMul(gen[j], root)
+			if j+1 < degree {
+				gen[j] ^= gen[j+1]
+			}
+		}
+		root = gfMul(root, 2)
+	}
+	rem := make([]int, degree)
+	for _, b := range data {
+		factor := int(b) ^ rem[0]
+		copy(rem, rem[1:])
+		rem[degree-1] = 0
+		for i := range rem {
+			rem[i] ^= gfMul(gen[i], factor)
+		}
+	}
+	result := make([]byte, degree)
+	for i, r := range rem {
+		result[i] = byte(r)
+	}
+	return result
+}
+
+func (q *QRCode) set(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.isFunc[y][x] = true
+}
+
+func (q *QRCode) drawFunctionPatterns(version int) {
+	for i := 0; i < q.Size; i++ {
+		q.set(6, i, i%2 == 0)
+		q.set(i, 6, i%2 == 0)
+	}
+	q.drawFinder(3, 3)
+	q.drawFinder(q.Size-4, 3)
+	q.drawFinder(3, q.Size-4)
+
+	pos := qrAlignment[version]
+	last := len(pos) - 1
+	for i := range pos {
+		for j := range pos {
+			if i == 0 && j == 0 || i == 0 && j == last || i == last && j == 0 {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.set(pos[i]+dx, pos[j]+dy, maxInt(absInt(dx), absInt(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	// reserve format areas, they are drawn after masking
+	q.drawFormatBits(0)
+
+	if version >= 7 {
+		rem := version
+		for i := 0; i < 12; i++ {
+			rem = rem<<1 ^ (rem>>11)*0x1F25
+		}
+		bits := version<<12 | rem
+		for i := 0; i < 18; i++ {
+			dark := bits>>uint(i)&1 == 1
+			a, b := q.Size-11+i%3, i/3
+			q.set(a, b, dark)
+			q.set(b, a, dark)
+		}
+	}
+}
+
+func (q *QRCode) drawFinder(cx, cy int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			x, y := cx+dx, cy+dy
+			if x < 0 || x >= q.Size || y < 0 || y >= q.Size {
+				continue
+			}
+			d := maxInt(absInt(dx), absInt(dy))
+			q.set(x, y, d != 2 && d != 4)
+		}
+	}
+}
+
+// qrFormatBits returns the 15 bit format information for level M and mask
+func qrFormatBits(mask int) int {
+	data := 0<<3 | mask // level M is 00
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	return (data<<10 | rem) ^ 0x5412
+}
+
+func (q *QRCode) drawFormatBits(mask int) {
+	bits := qrFormatBits(mask)
+	bit := func(i int) bool { return bits>>uint(i)&1 == 1 }
+	for i := 0; i <= 5; i++ {
+		q.set(8, i, bit(i))
+	}
+	q.set(8, 7, bit(6))
+	q.set(8, 8, bit(7))
+	q.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		q.set(q.Size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.set(8, q.Size-15+i, bit(i))
+	}
+	q.set(8, q.Size-8, true)
+}
+
+func (q *QRCode) drawCodewords(data []byte) {
+	i := 0
+	for right := q.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < q.Size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = q.Size - 1 - vert
+				}
+				if !q.isFunc[y][x] && i < len(data)*8 {
+					q.modules[y][x] = data[i>>3]>>uint(7-i&7)&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+func (q *QRCode) applyMask(mask int) {
+	for y := 0; y < q.Size; y++ {
+		for x := 0; x < q.Size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !q.isFunc[y][x] {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores the symbol with the rules of ISO/IEC 18004 section 8.8.2,
+// the mask with the lowest score is used
+func (q *QRCode) penalty() int {
+	n := q.Size
+	at := func(x, y int, transpose bool) bool {
+		if transpose {
+			return q.modules[x][y]
+		}
+		return q.modules[y][x]
+	}
+	result := 0
+	for _, transpose := range []bool{false, true} {
+		for y := 0; y < n; y++ {
+			run := 1
+			for x := 1; x <= n; x++ {
+				if x < n && at(x, y, transpose) == at(x-1, y, transpose) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					result += run - 2
+				}
+				run = 1
+			}
+			for x := 0; x+11 <= n; x++ {
+				var pattern [11]bool
+				for k := range pattern {
+					pattern[k] = at(x+k, y, transpose)
+				}
+				if pattern == [11]bool{true, false, true, true, true, false, true, false, false, false, false} ||
+					pattern == [11]bool{false, false, false, false, true, false, true, true, true, false, true} {
+					result += 40
+				}
+			}
+		}
+	}
+	dark := 0
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			if q.modules[y][x] {
+				dark++
+			}
+			if x+1 < n && y+1 < n {
+				c := q.modules[y][x]
+				if c == q.modules[y][x+1] && c == q.modules[y+1][x] && c == q.modules[y+1][x+1] {
+					result += 3
+				}
+			}
+		}
+	}
+	result += absInt(dark*20-n*n*10) / (n * n) * 10
+	return result
+}
+
+// Image renders the code with scale pixels per module
+// and the standard quiet zone of 4 modules
+func (q *QRCode) Image(scale int) image.Image {
+	border := 4
+	side := (q.Size + 2*border) * scale
+	img := image.NewGray(image.Rect(0, 0, side, side))
+	for y := 0; y < side; y++ {
+		for x := 0; x < side; x++ {
+			mx, my := x/scale-border, y/scale-border
+			c := color.Gray{Y: 255}
+			if mx >= 0 && mx < q.Size && my >= 0 && my < q.Size && q.modules[my][mx] {
+				c = color.Gray{Y: 0}
+			}
+			img.SetGray(x, y, c)
+		}
+	}
+	return img
+}
+
+func absInt(a int) int {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestReedSolomon(t *testing.T) {
+	// "HELLO WORLD" 1-M example from the ISO/IEC 18004 tutorials
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+
+	if got := reedSolomon(data, 10); !bytes.Equal(got, want) {
+		t.Errorf("TestReedSolomon --> FAILED")
+	}
+}
+
+func TestQRFormatBits(t *testing.T) {
+	want := []int{0x5412, 0x5125, 0x5E7C, 0x5B4B, 0x45F9, 0x40CE, 0x4F97, 0x4AA0}
+	for mask, w := range want {
+		if qrFormatBits(mask) != w {
+			t.Errorf("TestQRFormatBits --> FAILED")
+		}
+	}
+}
+
+func TestQRDataCodewords(t *testing.T) {
+	got := qrDataCodewords([]byte("ab"), 1)
+	want := []byte{0x40, 0x26, 0x16, 0x20, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11}
+	if !bytes.Equal(got, want) {
+		t.Errorf("TestQRDataCodewords --> FAILED")
+	}
+}
+
+func TestEncodeQR(t *testing.T) {
+	q, err := encodeQR([]byte("hello"))
+	if err != nil || q.Size != 21 {
+		t.Errorf("TestEncodeQR --> FAILED")
+		return
+	}
+	// finder pattern corners and the dark module
+	if !q.Dark(0, 0) || !q.Dark(20, 0) || !q.Dark(0, 20) || q.Dark(7, 7) || !q.Dark(8, 13) {
+		t.Errorf("TestEncodeQR --> FAILED")
+	}
+
+	uri := totpURI("moreThan16Symbol", strings.Repeat("A", 32))
+	q, err = encodeQR([]byte(uri))
+	if err != nil || q.Size != 17+4*6 {
+		t.Errorf("TestEncodeQR --> FAILED")
+	}
+	// both copies of the format information agree
+	var first, second int
+	for i := 0; i < 8; i++ {
+		if q.Dark(q.Size-1-i, 8) {
+			second |= 1 << uint(i)
+		}
+	}
+	for i := 8; i < 15; i++ {
+		if q.Dark(8, q.Size-15+i) {
+			second |= 1 << uint(i)
+		}
+	}
+	for i := 0; i <= 5; i++ {
+		if q.Dark(8, i) {
+			first |= 1 << uint(i)
+		}
+	}
+	if first&0x3f != second&0x3f {
+		t.Errorf("TestEncodeQR --> FAILED")
+	}
+
+	if _, err := encodeQR(make([]byte, 300)); err == nil {
+		t.Errorf("TestEncodeQR --> FAILED")
+	}
+}
+
+func TestEncodeQRVersionInfo(t *testing.T) {
+	q, err := encodeQR(bytes.Repeat([]byte("x"), 150))
+	if err != nil || q.Size != 17+4*8 {
+		t.Errorf("TestEncodeQRVersionInfo --> FAILED")
+		return
+	}
+	// version 8 information is 001000010110111100
+	bits := 0
+	for i := 0; i < 18; i++ {
+		if q.Dark(q.Size-11+i%3, i/3) {
+			bits |= 1 << uint(i)
+		}
+	}
+	if bits != 0x085BC {
+		t.Errorf("TestEncodeQRVersionInfo --> FAILED")
+	}
+}
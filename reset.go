@@ -0,0 +1,345 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"src/github.com/asaskevich/govalidator"
+	"src/github.com/julienschmidt/httprouter"
+	"src/github.com/pkg/errors"
+)
+
+var secretKey []byte
+
+var resetTokenTTL = 30 * time.Minute
+
+// usedResetTokens remembers consumed tokens until they would expire, so
+// that a token can't be used twice even if the password was reset to the
+// same value. It's guarded by storeMu.
+var usedResetTokens = make(map[string]time.Time)
+
+// loadSecretKey reads the key used to sign tokens from path,
+// generating and saving a new one on the first run.
+func loadSecretKey(path string) ([]byte, error) {
+	key, err := ioutil.ReadFile(path)
+	if err == nil && len(key) >= 32 {
+		return key, nil
+	}
+	key = make([]byte, 32)
+	_, err = rand.Read(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't generate secret key")
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't create secret key directory")
+	}
+	err = ioutil.WriteFile(path, key, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't save secret key")
+	}
+	return key, nil
+}
+
+// sign returns a hex HMAC of parts joined with "|"
+func sign(parts ...string) string {
+	mac := hmac.New(sha256.New, secretKey)
+	mac.Write([]byte(strings.Join(parts, "|")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signedValue is "value|expires|signature", a value that can't be made up
+// or kept past expires without secretKey; purpose keeps values signed
+// for one use from being taken for another
+func signedValue(purpose, value string, expires time.Time) string {
+	unix := strconv.FormatInt(expires.Unix(), 10)
+	return value + "|" + unix + "|" + sign(purpose, value, unix)
+}
+
+// checkSignedValue returns the value of a signedValue that hasn't expired
+func checkSignedValue(purpose, signed string, now time.Time) (string, bool) {
+	parts := strings.Split(signed, "|")
+	if len(parts) != 3 {
+		return "", false
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || now.Unix() > expires {
+		return "", false
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(sign(purpose, parts[0], parts[1]))) {
+		return "", false
+	}
+	return parts[0], true
+}
+
+// makeResetToken returns a token allowing to set a new password for u.
+// The current password takes part in the signature, so the token stops
+// working as soon as the password is changed.
+func makeResetToken(u *User, now time.Time) string {
+	expires := strconv.FormatInt(now.Add(resetTokenTTL).Unix(), 10)
+	sig := sign("reset", u.Username, expires, u.Password)
+	return base64.RawURLEncoding.EncodeToString([]byte(u.Username + "|" + expires + "|" + sig))
+}
+
+// verifyResetToken returns the user the token was issued for and the
+// signature that identifies the token among the used ones
+func verifyResetToken(token string, now time.Time) (*User, string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "malformed reset token")
+	}
+	parts := strings.Split(string(raw), "|")
+	if len(parts) != 3 {
+		return nil, "", errors.New("malformed reset token")
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "malformed reset token")
+	}
+	if now.Unix() > expires {
+		return nil, "", errors.New("reset token expired")
+	}
+	us := getUser(parts[0])
+	if us == nil {
+		return nil, "", errors.New("reset token issued for nonexistent user")
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(sign("reset", us.Username, parts[1], us.Password))) {
+		return nil, "", errors.New("reset token signature mismatch")
+	}
+	return us, parts[2], nil
+}
+
+// checkResetToken returns the user the token was issued for and the
+// signature that names it among the used ones
+func checkResetToken(token string, now time.Time) (*User, string, error) {
+	us, sig, err := verifyResetToken(token, now)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, used := usedResetTokens[sig]; used {
+		return nil, "", errors.New("reset token already used")
+	}
+	return us, sig, nil
+}
+
+// useResetToken checks the token and marks it used in the same step under
+// storeMu, so that only one of concurrent requests can use it. Tokens that
+// would have expired by now are forgotten.
+func useResetToken(token string, now time.Time) (*User, error) {
+	us, sig, err := checkResetToken(token, now)
+	if err != nil {
+		return nil, err
+	}
+	for used, expires := range usedResetTokens {
+		if now.After(expires) {
+			delete(usedResetTokens, used)
+		}
+	}
+	usedResetTokens[sig] = now.Add(resetTokenTTL)
+	return us, nil
+}
+
+// resetMailBody returns the message with a reset link for u, it's built
+// under storeMu and sent without it since a mailer may be slow
+func resetMailBody(u *User) string {
+	link := baseURL + "/resetPassword?token=" + makeResetToken(u, time.Now())
+	return "Hello, " + u.Username + "!\n\n" +
+		"Someone asked to reset the password of your account. If it was you, follow the link below\n" +
+		"to choose a new password. The link works once and expires in " + resetTokenTTL.String() + ".\n\n" +
+		link + "\n\nIf you didn't ask for it just ignore this message.\n"
+}
+
+func forgotPasswordGetHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	usernameCookie, err := sessionCookie(r)
+	if err != http.ErrNoCookie {
+		http.Redirect(w, r, "/users/"+usernameCookie.Value, http.StatusFound)
+		return
+	}
+	tpl, err := template.ParseFiles("templates/noCookieHeader.html", "templates/forgotPassword.html")
+	if err != nil {
+		panic(err)
+	}
+
+	err = tpl.ExecuteTemplate(w, "forgotPassword", nil)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// forgotPasswordPostHandler holds storeMu only while the account is
+// looked up, the mail is sent after it's released
+func forgotPasswordPostHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	account := r.FormValue("account")
+	storeMu.Lock()
+	usernameCookie, err := sessionCookie(r)
+	if err != http.ErrNoCookie {
+		storeMu.Unlock()
+		http.Redirect(w, r, "/users/"+usernameCookie.Value, http.StatusFound)
+		return
+	}
+	us := getUser(account)
+	if us == nil {
+		us = getUserByEmail(account)
+	}
+	var to, body string
+	if us != nil {
+		to, body = us.Email, resetMailBody(us)
+	}
+	storeMu.Unlock()
+
+	// the answer is the same whether the account exists or not
+	if to != "" {
+		err = mailer.Send(to, "Password reset", body)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	http.Redirect(w, r, "/forgotPasswordSent", http.StatusFound)
+}
+
+func forgotPasswordSentHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	tpl, err := template.ParseFiles("templates/noCookieHeader.html", "templates/forgotPasswordSent.html")
+	if err != nil {
+		panic(err)
+	}
+
+	err = tpl.ExecuteTemplate(w, "forgotPasswordSent", nil)
+	if err != nil {
+		panic(err)
+	}
+}
+
+type resetPasswordPage struct {
+	Token          string
+	InvalidSymbols bool
+}
+
+func resetPasswordGetHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	token := r.FormValue("token")
+	if _, _, err := checkResetToken(token, time.Now()); err != nil {
+		tpl, err := template.ParseFiles("templates/noCookieHeader.html", "templates/resetPasswordInvalid.html")
+		if err != nil {
+			panic(err)
+		}
+
+		err = tpl.ExecuteTemplate(w, "resetPasswordInvalid", nil)
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+	tpl, err := template.ParseFiles("templates/noCookieHeader.html", "templates/resetPassword.html")
+	if err != nil {
+		panic(err)
+	}
+
+	err = tpl.ExecuteTemplate(w, "resetPassword", resetPasswordPage{
+		Token:          token,
+		InvalidSymbols: r.FormValue("invalid") != "",
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func resetPasswordPostHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	token := r.FormValue("token")
+	us, _, err := checkResetToken(token, time.Now())
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/resetPassword?token="+token, http.StatusFound)
+		return
+	}
+	changed := *us
+	changed.Password = r.FormValue("password")
+	_, err = govalidator.ValidateStruct(changed)
+	if err != nil {
+		http.Redirect(w, r, "/resetPassword?invalid=1&token="+token, http.StatusFound)
+		return
+	}
+	us, err = useResetToken(token, time.Now())
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/resetPassword?token="+token, http.StatusFound)
+		return
+	}
+	us.Password = changed.Password
+	err = us.refreshUserInfo()
+	if err != nil {
+		panic(err)
+	}
+	http.Redirect(w, r, "/resetPasswordSuccess", http.StatusFound)
+}
+
+func resetPasswordSuccessHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	tpl, err := template.ParseFiles("templates/noCookieHeader.html", "templates/resetPasswordSuccess.html")
+	if err != nil {
+		panic(err)
+	}
+
+	err = tpl.ExecuteTemplate(w, "resetPasswordSuccess", nil)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func emailGetHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	usernameCookie, err := sessionCookie(r)
+	if err == http.ErrNoCookie {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	if usernameCookie.Value != ps.ByName("username") {
+		http.Redirect(w, r, "/users/"+usernameCookie.Value, http.StatusFound)
+		return
+	}
+	tpl, err := template.ParseFiles("templates/header.html", "templates/email.html")
+	if err != nil {
+		panic(err)
+	}
+
+	err = tpl.ExecuteTemplate(w, "email", struct {
+		*User
+		InvalidSymbols bool
+	}{getUser(usernameCookie.Value), r.FormValue("invalid") != ""})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func emailPostHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	usernameCookie, err := sessionCookie(r)
+	if err == http.ErrNoCookie {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	username := ps.ByName("username")
+	if usernameCookie.Value != username {
+		http.Redirect(w, r, "/users/"+usernameCookie.Value, http.StatusFound)
+		return
+	}
+	us := getUser(username)
+	email := strings.TrimSpace(r.FormValue("email"))
+	if email != "" && (!govalidator.IsEmail(email) || getUserByEmail(email) != nil && getUserByEmail(email) != us) {
+		http.Redirect(w, r, "/users/"+username+"/email?invalid=1", http.StatusFound)
+		return
+	}
+	us.Email = email
+	err = us.refreshUserInfo()
+	if err != nil {
+		panic(err)
+	}
+	http.Redirect(w, r, "/users/"+username, http.StatusFound)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResetToken(t *testing.T) {
+	defer func() {
+		users = nil
+	}()
+	secretKey = []byte("0123456789abcdef0123456789abcdef")
+	users = append(users, &User{Username: "testUser", Password: "testPassword", ID: 1})
+	us := getUser("testUser")
+	now := time.Now()
+
+	token := makeResetToken(us, now)
+	if checked, _, err := checkResetToken(token, now); err != nil || checked != us {
+		t.Errorf("TestResetToken --> FAILED")
+	}
+	if _, _, err := checkResetToken(token, now.Add(resetTokenTTL+time.Second)); err == nil {
+		t.Errorf("TestResetToken --> FAILED")
+	}
+	if _, _, err := checkResetToken(token[:len(token)-2], now); err == nil {
+		t.Errorf("TestResetToken --> FAILED")
+	}
+	if _, _, err := checkResetToken("garbage", now); err == nil {
+		t.Errorf("TestResetToken --> FAILED")
+	}
+
+	us.Password = "newPassword"
+	if _, _, err := checkResetToken(token, now); err == nil {
+		t.Errorf("TestResetToken --> FAILED")
+	}
+}
+
+func TestUseResetToken(t *testing.T) {
+	defer func() {
+		users = nil
+		usedResetTokens = make(map[string]time.Time)
+	}()
+	secretKey = []byte("0123456789abcdef0123456789abcdef")
+	users = append(users, &User{Username: "testUser", Password: "testPassword", ID: 1})
+	now := time.Now()
+	token := makeResetToken(getUser("testUser"), now)
+
+	// only one of concurrent uses of the token gets the user
+	results := make(chan error)
+	for i := 0; i < 10; i++ {
+		go func() {
+			storeMu.Lock()
+			_, err := useResetToken(token, now)
+			storeMu.Unlock()
+			results <- err
+		}()
+	}
+	succeeded := 0
+	for i := 0; i < 10; i++ {
+		if <-results == nil {
+			succeeded++
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("TestUseResetToken --> FAILED")
+	}
+	if _, _, err := checkResetToken(token, now); err == nil {
+		t.Errorf("TestUseResetToken --> FAILED")
+	}
+
+	// used tokens are kept only while they could still be valid
+	later := now.Add(resetTokenTTL + time.Second)
+	users = append(users, &User{Username: "otherUser", Password: "testPassword", ID: 2})
+	if _, err := useResetToken(makeResetToken(getUser("otherUser"), later), later); err != nil || len(usedResetTokens) != 1 {
+		t.Errorf("TestUseResetToken --> FAILED")
+	}
+}
+
+func TestForgotPasswordPostHandler(t *testing.T) {
+	defer func(m Mailer) {
+		users = nil
+		mailer = m
+	}(mailer)
+	secretKey = []byte("0123456789abcdef0123456789abcdef")
+	tm := &testMailer{}
+	mailer = tm
+	users = append(users, &User{Username: "testUser", Password: "testPassword", Email: "test@example.com"})
+	users = append(users, &User{Username: "noEmail", Password: "testPassword"})
+
+	for _, account := range []string{"testUser", "TEST@example.com", "noEmail", "nobody"} {
+		req := httptest.NewRequest("POST", "http://127.0.0.1/forgotPassword", nil)
+		req.ParseForm()
+		req.Form.Set("account", account)
+		w := httptest.NewRecorder()
+
+		forgotPasswordPostHandler(w, req, nil)
+
+		result := w.Result()
+		l, _ := result.Location()
+		if result.StatusCode != 302 || l.Path != "/forgotPasswordSent" {
+			t.Errorf("TestForgotPasswordPostHandler --> FAILED")
+		}
+	}
+	if len(tm.to) != 2 || tm.to[0] != "test@example.com" || !strings.Contains(tm.body[0], baseURL+"/resetPassword?token=") ||
+		tm.locked {
+		t.Errorf("TestForgotPasswordPostHandler --> FAILED")
+	}
+}
+
+func TestResetPasswordPostHandler(t *testing.T) {
+	defer func() {
+		users = nil
+		os.Remove("data/accounts/testUser.txt")
+	}()
+	secretKey = []byte("0123456789abcdef0123456789abcdef")
+	users = append(users, &User{Username: "testUser", Password: "testPassword", ID: 1})
+	us := getUser("testUser")
+	token := makeResetToken(us, time.Now())
+
+	req := httptest.NewRequest("POST", "http://127.0.0.1/resetPassword", nil)
+	req.ParseForm()
+	req.Form.Set("token", token)
+	req.Form.Set("password", "{|}#")
+	w := httptest.NewRecorder()
+	resetPasswordPostHandler(w, req, nil)
+	l, _ := w.Result().Location()
+	if l.Query().Get("invalid") == "" || us.Password != "testPassword" {
+		t.Errorf("TestResetPasswordPostHandler --> FAILED")
+	}
+
+	req.Form.Set("password", "newPassword")
+	w = httptest.NewRecorder()
+	resetPasswordPostHandler(w, req, nil)
+	l, _ = w.Result().Location()
+	if l.Path != "/resetPasswordSuccess" || us.Password != "newPassword" {
+		t.Errorf("TestResetPasswordPostHandler --> FAILED")
+	}
+
+	// the token is single-use even when the same password is chosen again
+	us.Password = "testPassword"
+	token = makeResetToken(us, time.Now())
+	req.Form.Set("token", token)
+	req.Form.Set("password", "testPassword")
+	resetPasswordPostHandler(httptest.NewRecorder(), req, nil)
+	w = httptest.NewRecorder()
+	resetPasswordPostHandler(w, req, nil)
+	l, _ = w.Result().Location()
+	if l.Path != "/resetPassword" || l.Query().Get("invalid") != "" {
+		t.Errorf("TestResetPasswordPostHandler --> FAILED")
+	}
+}
+
+func TestResetPasswordGetHandlerInvalidToken(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://127.0.0.1/resetPassword?token=garbage", nil)
+	w := httptest.NewRecorder()
+
+	resetPasswordGetHandler(w, req, nil)
+
+	result := w.Result()
+	if result.StatusCode != 200 || !strings.Contains(w.Body.String(), "invalid, expired") {
+		t.Errorf("TestResetPasswordGetHandlerInvalidToken --> FAILED")
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"src/github.com/julienschmidt/httprouter"
+)
+
+// Revision is a version of a post
+type Revision struct {
+	// Number counts revisions of a post from 1
+	Number int
+	Author string
+	Date   time.Time
+	Title  string
+	Body   string
+	Tags   []string
+	// the number of the revision this one brought back, 0 for edits
+	RestoredFrom int
+}
+
+// History returns revisions of the post, oldest first. Posts that were never
+// edited don't store revisions, their only one is made of the post itself.
+func (p Post) History(owner string) []Revision {
+	if len(p.Revisions) > 0 {
+		return p.Revisions
+	}
+	return []Revision{{Number: 1, Author: owner, Date: p.Date, Title: p.Title, Body: p.Body, Tags: p.Tags}}
+}
+
+// lines splits the revision for diffing, the title and tags get a line each
+func (r Revision) lines() []string {
+	lines := []string{"# " + r.Title}
+	lines = append(lines, strings.Split(strings.Replace(r.Body, "\r\n", "\n", -1), "\n")...)
+	if len(r.Tags) > 0 {
+		lines = append(lines, "tags: "+strings.Join(r.Tags, ", "))
+	}
+	return lines
+}
+
+// DiffLine is a line of a diff, Op is "-" for removed lines,
+// "+" for added ones and " " for lines both versions have
+type DiffLine struct {
+	Op   string
+	Text string
+}
+
+// diffLines finds the shortest line diff turning a into b
+// with a longest common subsequence table
+func diffLines(a, b []string) []DiffLine {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = maxInt(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	var diff []DiffLine
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			diff = append(diff, DiffLine{" ", a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			diff = append(diff, DiffLine{"-", a[i]})
+			i++
+		default:
+			diff = append(diff, DiffLine{"+", b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		diff = append(diff, DiffLine{"-", a[i]})
+	}
+	for ; j < len(b); j++ {
+		diff = append(diff, DiffLine{"+", b[j]})
+	}
+	return diff
+}
+
+type historyPage struct {
+	Owner      *User
+	Post       *Post
+	Viewer     *User
+	Revisions  []Revision
+	From, To   int
+	Diff       []DiffLine
+	CanRestore bool
+}
+
+// findVisiblePost is findOwnPost that hides drafts from everyone but the owner
+func findVisiblePost(r *http.Request, ps httprouter.Params) (*User, *Post) {
+	us, post := findOwnPost(ps)
+	if post == nil || post.IsPublished() {
+		return us, post
+	}
+	usernameCookie, err := sessionCookie(r)
+	if err != nil || usernameCookie.Value != us.Username {
+		return us, nil
+	}
+	return us, post
+}
+
+// revisionNumber reads a revision number from s, def is used when it's missing or wrong
+func revisionNumber(s string, def, last int) int {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 || n > last {
+		return def
+	}
+	return n
+}
+
+func historyHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	usernameCookie, err := sessionCookie(r)
+	if err == http.ErrNoCookie {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	us, post := findVisiblePost(r, ps)
+	if post == nil {
+		http.NotFound(w, r)
+		return
+	}
+	history := post.History(us.Username)
+	page := historyPage{Owner: us, Post: post, Viewer: getUser(usernameCookie.Value),
+		CanRestore: usernameCookie.Value == us.Username}
+	page.To = revisionNumber(r.FormValue("to"), len(history), len(history))
+	page.From = revisionNumber(r.FormValue("from"), maxInt(page.To-1, 1), len(history))
+	page.Diff = diffLines(history[page.From-1].lines(), history[page.To-1].lines())
+	// newest first
+	for i := len(history) - 1; i >= 0; i-- {
+		page.Revisions = append(page.Revisions, history[i])
+	}
+	tpl, err := parseTemplates("templates/header.html", "templates/history.html")
+	if err != nil {
+		panic(err)
+	}
+
+	err = tpl.ExecuteTemplate(w, "history", page)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// restoreRevisionHandler makes an older revision the current one,
+// the restore is a new revision itself so nothing is lost
+func restoreRevisionHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	usernameCookie, err := sessionCookie(r)
+	if err == http.ErrNoCookie {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	if usernameCookie.Value != ps.ByName("username") {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	us, post := findOwnPost(ps)
+	if post == nil {
+		http.NotFound(w, r)
+		return
+	}
+	history := post.History(us.Username)
+	n := revisionNumber(ps.ByName("rev"), 0, len(history))
+	if n == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	old := history[n-1]
+	err = us.editPost(post.ID, Revision{
+		Author:       usernameCookie.Value,
+		Date:         time.Now().UTC(),
+		Title:        old.Title,
+		Body:         old.Body,
+		Tags:         old.Tags,
+		RestoredFrom: n,
+	})
+	if err != nil {
+		panic(err)
+	}
+	err = us.refreshUserInfo()
+	if err != nil {
+		panic(err)
+	}
+	http.Redirect(w, r, fmt.Sprintf("/users/%s/posts/%d/history", us.Username, post.ID), http.StatusFound)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"src/github.com/julienschmidt/httprouter"
+)
+
+func TestDiffLines(t *testing.T) {
+	a := []string{"one", "two", "three", "four"}
+	b := []string{"one", "three", "3.5", "four", "five"}
+	var got []string
+	for _, l := range diffLines(a, b) {
+		got = append(got, l.Op+l.Text)
+	}
+	want := []string{" one", "-two", " three", "+3.5", " four", "+five"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("TestDiffLines --> FAILED: %v", got)
+	}
+	if len(diffLines(nil, nil)) != 0 || diffLines(nil, []string{"x"})[0] != (DiffLine{"+", "x"}) {
+		t.Errorf("TestDiffLines --> FAILED")
+	}
+}
+
+func TestEditPostRevisions(t *testing.T) {
+	date := time.Date(2018, 4, 5, 10, 0, 0, 0, time.UTC)
+	us := User{Username: "testUser", Password: "testPassword", ID: 1}
+	us.addPost(Post{Title: "title", Body: "body", Date: date})
+	if len(us.Posts[0].Revisions) != 0 || len(us.Posts[0].History("testUser")) != 1 {
+		t.Errorf("TestEditPostRevisions --> FAILED")
+	}
+
+	us.editPost(1, Revision{Author: "testUser", Date: date.Add(time.Hour), Title: "title", Body: "new body"})
+	history := us.Posts[0].History("testUser")
+	if len(history) != 2 || history[0].Number != 1 || history[0].Body != "body" || !history[0].Date.Equal(date) ||
+		history[1].Number != 2 || history[1].Body != "new body" || !us.Posts[0].Date.Equal(date) {
+		t.Errorf("TestEditPostRevisions --> FAILED")
+	}
+
+	// saving the same content doesn't make a revision
+	us.editPost(1, Revision{Author: "testUser", Date: date.Add(2 * time.Hour), Title: "title", Body: "new body"})
+	if len(us.Posts[0].Revisions) != 2 {
+		t.Errorf("TestEditPostRevisions --> FAILED")
+	}
+}
+
+func TestHistoryHandler(t *testing.T) {
+	defer func() {
+		users = nil
+	}()
+	users = append(users, &User{Username: "testUser", Password: "testPassword", ID: 1})
+	users = append(users, &User{Username: "reader", Password: "testPassword", ID: 2})
+	us := getUser("testUser")
+	us.addPost(Post{Title: "title", Body: "first line\nsecond line", Date: time.Now().UTC()})
+	us.editPost(1, Revision{Author: "testUser", Date: time.Now().UTC(), Title: "title", Body: "first line\nchanged line"})
+	us.editPost(1, Revision{Author: "testUser", Date: time.Now().UTC(), Title: "new title", Body: "first line\nchanged line"})
+
+	req := httptest.NewRequest("GET", "http://127.0.0.1/users/testUser/posts/1/history?from=1&to=2", nil)
+	req.AddCookie(sessionFor("reader"))
+	w := httptest.NewRecorder()
+
+	historyHandler(w, req, httprouter.Params{{"username", "testUser"}, {"id", "1"}})
+
+	body := w.Body.String()
+	if w.Code != 200 || !strings.Contains(body, "Changes from #1 to #2") || !strings.Contains(body, `class="removed">- second line`) ||
+		!strings.Contains(body, `class="added">&#43; changed line`) || strings.Contains(body, "new title</div>") ||
+		strings.Contains(body, "restore</button>") {
+		t.Errorf("TestHistoryHandler --> FAILED")
+	}
+
+	// drafts are visible to the owner only
+	us.addDraft(Post{Title: "draft", Body: "body"})
+	req = httptest.NewRequest("GET", "http://127.0.0.1/users/testUser/posts/2/history", nil)
+	req.AddCookie(sessionFor("reader"))
+	w = httptest.NewRecorder()
+	historyHandler(w, req, httprouter.Params{{"username", "testUser"}, {"id", "2"}})
+	if w.Code != http.StatusNotFound {
+		t.Errorf("TestHistoryHandler --> FAILED")
+	}
+}
+
+func TestRestoreRevisionHandler(t *testing.T) {
+	defer func() {
+		users = nil
+		os.Remove("data/accounts/testUser.txt")
+	}()
+	users = append(users, &User{Username: "testUser", Password: "testPassword", ID: 1})
+	users = append(users, &User{Username: "reader", Password: "testPassword", ID: 2})
+	us := getUser("testUser")
+	us.addPost(Post{Title: "title", Body: "original", Date: time.Now().UTC(), Tags: []string{"go"}})
+	us.editPost(1, Revision{Author: "testUser", Date: time.Now().UTC(), Title: "title", Body: "vandalized"})
+	req := httptest.NewRequest("POST", "http://127.0.0.1/users/testUser/posts/1/revisions/1/restore", nil)
+	req.AddCookie(sessionFor("reader"))
+	w := httptest.NewRecorder()
+
+	restoreRevisionHandler(w, req, httprouter.Params{{"username", "testUser"}, {"id", "1"}, {"rev", "1"}})
+	if w.Code != http.StatusForbidden || us.Posts[0].Body != "vandalized" {
+		t.Errorf("TestRestoreRevisionHandler --> FAILED")
+	}
+
+	req.Header.Del("Cookie")
+	req.AddCookie(sessionFor("testUser"))
+	w = httptest.NewRecorder()
+	restoreRevisionHandler(w, req, httprouter.Params{{"username", "testUser"}, {"id", "1"}, {"rev", "1"}})
+	p := us.Posts[0]
+	l, _ := w.Result().Location()
+	if l.Path != "/users/testUser/posts/1/history" || p.Body != "original" || p.Tags[0] != "go" ||
+		len(p.Revisions) != 3 || p.Revisions[2].RestoredFrom != 1 {
+		t.Errorf("TestRestoreRevisionHandler --> FAILED")
+	}
+
+	w = httptest.NewRecorder()
+	restoreRevisionHandler(w, req, httprouter.Params{{"username", "testUser"}, {"id", "1"}, {"rev", "9"}})
+	if w.Code != http.StatusNotFound {
+		t.Errorf("TestRestoreRevisionHandler --> FAILED")
+	}
+}
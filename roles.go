@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+
+	"src/github.com/julienschmidt/httprouter"
+)
+
+const (
+	RoleAdmin     = "admin"
+	RoleModerator = "moderator"
+	RoleAuthor    = "author"
+	RoleReader    = "reader"
+)
+
+var roles = []string{RoleAdmin, RoleModerator, RoleAuthor, RoleReader}
+
+// writers are the roles allowed to publish posts
+var writers = []string{RoleAdmin, RoleModerator, RoleAuthor}
+
+func (u User) HasRole(roles ...string) bool {
+	for _, r := range roles {
+		if u.Role == r {
+			return true
+		}
+	}
+	return false
+}
+
+func (u User) CanPost() bool {
+	return u.HasRole(writers...)
+}
+
+// requireRole lets the request through only for logged in users
+// that aren't disabled and have one of the roles. storeMu is held only
+// while the user is checked, next takes it itself.
+func requireRole(next httprouter.Handle, roles ...string) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		storeMu.Lock()
+		usernameCookie, err := sessionCookie(r)
+		allowed := false
+		if err == nil {
+			us := getUser(usernameCookie.Value)
+			allowed = us.HasRole(roles...)
+		}
+		storeMu.Unlock()
+		if err == http.ErrNoCookie {
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+		if !allowed {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r, ps)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"src/github.com/julienschmidt/httprouter"
+)
+
+func TestRequireRole(t *testing.T) {
+	defer func() {
+		users = nil
+	}()
+	users = append(users, &User{Username: "testAdmin", Password: "testPassword", ID: 1, Role: RoleAdmin})
+	users = append(users, &User{Username: "testReader", Password: "testPassword", ID: 2, Role: RoleReader})
+	users = append(users, &User{Username: "testDisabled", Password: "testPassword", ID: 3, Role: RoleAdmin, Disabled: true})
+	ok := func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		w.WriteHeader(http.StatusTeapot)
+	}
+	handler := requireRole(ok, RoleAdmin, RoleModerator)
+
+	cases := map[string]int{
+		"":             http.StatusFound,
+		"testAdmin":    http.StatusTeapot,
+		"testReader":   http.StatusForbidden,
+		"testDisabled": http.StatusFound,
+	}
+	for username, status := range cases {
+		req := httptest.NewRequest("GET", "http://127.0.0.1/admin", nil)
+		if username != "" {
+			req.AddCookie(sessionFor(username))
+		}
+		w := httptest.NewRecorder()
+
+		handler(w, req, nil)
+
+		if w.Result().StatusCode != status {
+			t.Errorf("TestRequireRole --> FAILED")
+		}
+	}
+
+	// a cookie made up by hand or of an account deleted since isn't a session
+	users = append(users, &User{Username: "testDeleted", Password: "testPassword", ID: 4, Role: RoleAdmin})
+	deleted := sessionFor("testDeleted").Value
+	users = users[:3]
+	for _, value := range []string{"testAdmin", "testAdmin|9999999999|forged", deleted} {
+		req := httptest.NewRequest("GET", "http://127.0.0.1/admin", nil)
+		req.AddCookie(&http.Cookie{Name: "username", Value: value})
+		w := httptest.NewRecorder()
+		handler(w, req, nil)
+		if w.Result().StatusCode != http.StatusFound {
+			t.Errorf("TestRequireRole --> FAILED")
+		}
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"src/github.com/julienschmidt/httprouter"
+	"src/github.com/pkg/errors"
+)
+
+// words of a title count as much as titleWeight words of a body
+const titleWeight = 3
+
+// searchDoc identifies a post in the index
+type searchDoc struct {
+	author string
+	id     int
+}
+
+type searchDocStats struct {
+	length int
+	terms  []string
+}
+
+// searchIndex is an inverted index of posts: for every term it keeps
+// the posts having it and how many times it occurs there
+type searchIndex struct {
+	mu       sync.RWMutex
+	postings map[string]map[searchDoc]int
+	docs     map[searchDoc]searchDocStats
+	// sum of lengths of all documents, for the average length
+	totalLength int
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		postings: make(map[string]map[searchDoc]int),
+		docs:     make(map[searchDoc]searchDocStats),
+	}
+}
+
+// postIndex is updated by addPost, editPost and deletePost
+var postIndex = newSearchIndex()
+
+type tokenSpan struct {
+	start, end int
+}
+
+// tokenSpans finds words in s: runs of letters and digits of any script
+func tokenSpans(s string) []tokenSpan {
+	var spans []tokenSpan
+	start := -1
+	for i, r := range s {
+		inWord := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if inWord && start < 0 {
+			start = i
+		} else if !inWord && start >= 0 {
+			spans = append(spans, tokenSpan{start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		spans = append(spans, tokenSpan{start, len(s)})
+	}
+	return spans
+}
+
+func normalizeTerm(word string) string {
+	return stem(strings.ToLower(word))
+}
+
+// tokenize splits s into normalized terms
+func tokenize(s string) []string {
+	var terms []string
+	for _, span := range tokenSpans(s) {
+		terms = append(terms, normalizeTerm(s[span.start:span.end]))
+	}
+	return terms
+}
+
+// add indexes the post of author, replacing the previous version of it
+func (idx *searchIndex) add(author string, p Post) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	doc := searchDoc{author, p.ID}
+	idx.remove(doc)
+
+	freq := make(map[string]int)
+	length := 0
+	for _, term := range tokenize(p.Title) {
+		freq[term] += titleWeight
+		length += titleWeight
+	}
+	for _, term := range tokenize(p.Body) {
+		freq[term]++
+		length++
+	}
+	for _, tag := range p.Tags {
+		for _, term := range tokenize(tag) {
+			freq[term] += titleWeight
+			length += titleWeight
+		}
+	}
+	stats := searchDocStats{length: length}
+	for term, n := range freq {
+		if idx.postings[term] == nil {
+			idx.postings[term] = make(map[searchDoc]int)
+		}
+		idx.postings[term][doc] = n
+		stats.terms = append(stats.terms, term)
+	}
+	idx.docs[doc] = stats
+	idx.totalLength += length
+}
+
+// delete removes the post of author from the index
+func (idx *searchIndex) delete(author string, id int) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.remove(searchDoc{author, id})
+}
+
+// remove must be called with the lock held
+func (idx *searchIndex) remove(doc searchDoc) {
+	stats, ok := idx.docs[doc]
+	if !ok {
+		return
+	}
+	for _, term := range stats.terms {
+		delete(idx.postings[term], doc)
+		if len(idx.postings[term]) == 0 {
+			delete(idx.postings, term)
+		}
+	}
+	delete(idx.docs, doc)
+	idx.totalLength -= stats.length
+}
+
+// addUser indexes all posts of the user
+func (idx *searchIndex) addUser(u *User) {
+	for _, p := range u.Posts {
+		idx.add(u.Username, p)
+	}
+}
+
+// search returns the documents having every term with their BM25 scores
+func (idx *searchIndex) search(terms []string) map[searchDoc]float64 {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	if len(terms) == 0 || len(idx.docs) == 0 {
+		return nil
+	}
+	// start from the rarest term, the result can't be bigger than its postings
+	lists := make([]map[searchDoc]int, 0, len(terms))
+	for _, term := range terms {
+		list, ok := idx.postings[term]
+		if !ok {
+			return nil
+		}
+		lists = append(lists, list)
+	}
+	sort.Slice(lists, func(i, j int) bool { return len(lists[i]) < len(lists[j]) })
+
+	const k1, b = 1.2, 0.75
+	n := float64(len(idx.docs))
+	avgLength := float64(idx.totalLength) / n
+	scores := make(map[searchDoc]float64)
+	for doc := range lists[0] {
+		score := 0.0
+		for _, list := range lists {
+			tf, ok := list[doc]
+			if !ok {
+				score = -1
+				break
+			}
+			df := float64(len(list))
+			idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+			norm := k1 * (1 - b + b*float64(idx.docs[doc].length)/avgLength)
+			score += idf * float64(tf) * (k1 + 1) / (float64(tf) + norm)
+		}
+		if score >= 0 {
+			scores[doc] = score
+		}
+	}
+	return scores
+}
+
+// highlight escapes text and wraps words matching any of terms into <mark>
+func highlight(text string, terms map[string]bool) template.HTML {
+	var b strings.Builder
+	last := 0
+	for _, span := range tokenSpans(text) {
+		word := text[span.start:span.end]
+		if !terms[normalizeTerm(word)] {
+			continue
+		}
+		b.WriteString(template.HTMLEscapeString(text[last:span.start]))
+		b.WriteString("<mark>" + template.HTMLEscapeString(word) + "</mark>")
+		last = span.end
+	}
+	b.WriteString(template.HTMLEscapeString(text[last:]))
+	return template.HTML(b.String())
+}
+
+// searchQuery is the text to look for with optional filters,
+// From and To are dates like 2018-04-05, both days are included
+type searchQuery struct {
+	Text   string
+	Author string
+	From   string
+	To     string
+
+	terms    []string
+	from, to time.Time
+}
+
+const searchDateFormat = "2006-01-02"
+
+// parseSearchQuery reads the query from the request, dates are taken in loc
+func parseSearchQuery(r *http.Request, loc *time.Location) (searchQuery, error) {
+	q := searchQuery{
+		Text:   strings.TrimSpace(r.FormValue("q")),
+		Author: strings.TrimSpace(r.FormValue("author")),
+		From:   strings.TrimSpace(r.FormValue("from")),
+		To:     strings.TrimSpace(r.FormValue("to")),
+	}
+	q.terms = tokenize(q.Text)
+	var err error
+	if q.From != "" {
+		q.from, err = time.ParseInLocation(searchDateFormat, q.From, loc)
+		if err != nil {
+			return q, errors.Wrap(err, "invalid start date")
+		}
+	}
+	if q.To != "" {
+		q.to, err = time.ParseInLocation(searchDateFormat, q.To, loc)
+		if err != nil {
+			return q, errors.Wrap(err, "invalid end date")
+		}
+		q.to = q.to.AddDate(0, 0, 1)
+	}
+	return q, nil
+}
+
+func (q searchQuery) matches(author string, p Post) bool {
+	if q.Author != "" && !strings.EqualFold(q.Author, author) {
+		return false
+	}
+	if !q.from.IsZero() && p.Date.Before(q.from) {
+		return false
+	}
+	if !q.to.IsZero() && !p.Date.Before(q.to) {
+		return false
+	}
+	return true
+}
+
+type searchHit struct {
+	Author string
+	Post   Post
+	Score  float64
+}
+
+// run finds posts matching the query, the best first and newer first among equal ones
+func (q searchQuery) run() []searchHit {
+	var hits []searchHit
+	for doc, score := range postIndex.search(q.terms) {
+		us := getUser(doc.author)
+		if us == nil {
+			continue
+		}
+		p := us.getPost(doc.id)
+		if p == nil || !q.matches(us.Username, *p) {
+			continue
+		}
+		hits = append(hits, searchHit{Author: us.Username, Post: *p, Score: score})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		if !hits[i].Post.Date.Equal(hits[j].Post.Date) {
+			return hits[i].Post.Date.After(hits[j].Post.Date)
+		}
+		if hits[i].Author != hits[j].Author {
+			return hits[i].Author < hits[j].Author
+		}
+		return hits[i].Post.ID > hits[j].Post.ID
+	})
+	return hits
+}
+
+// searchUsers returns users whose names contain any word of the text
+func searchUsers(text string) []*User {
+	var words []string
+	for _, span := range tokenSpans(text) {
+		words = append(words, strings.ToLower(text[span.start:span.end]))
+	}
+	var found []*User
+	for _, us := range usersPage(0, len(users)) {
+		name := strings.ToLower(us.Username)
+		for _, word := range words {
+			if strings.Contains(name, word) {
+				found = append(found, us)
+				break
+			}
+		}
+	}
+	return found
+}
+
+type highlightedHit struct {
+	searchHit
+	Title template.HTML
+	Body  template.HTML
+}
+
+type searchPage struct {
+	Query   searchQuery
+	Viewer  *User
+	Users   []*User
+	Hits    []highlightedHit
+	Total   int
+	Pages   Pagination
+	Invalid bool
+}
+
+func searchHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	usernameCookie, err := sessionCookie(r)
+	if err == http.ErrNoCookie {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	viewer := getUser(usernameCookie.Value)
+	q, err := parseSearchQuery(r, viewer.location())
+	page := searchPage{Query: q, Viewer: viewer, Invalid: err != nil}
+	if err == nil && q.Text != "" {
+		hits := q.run()
+		start, end, pages := paginate(r, len(hits), postsPerPage)
+		pages.setLinkHeader(w)
+		page.Total, page.Pages = len(hits), pages
+		terms := make(map[string]bool)
+		for _, term := range q.terms {
+			terms[term] = true
+		}
+		for _, hit := range hits[start:end] {
+			page.Hits = append(page.Hits, highlightedHit{
+				searchHit: hit,
+				Title:     highlight(hit.Post.Title, terms),
+				Body:      highlight(hit.Post.Body, terms),
+			})
+		}
+		if pages.Page == 1 {
+			page.Users = searchUsers(q.Text)
+		}
+	}
+	tpl, err := parseTemplates("templates/header.html", "templates/search.html", "templates/pagination.html")
+	if err != nil {
+		panic(err)
+	}
+
+	err = tpl.ExecuteTemplate(w, "search", page)
+	if err != nil {
+		panic(err)
+	}
+}
+
+type searchResultJSON struct {
+	Author string    `json:"author"`
+	ID     int       `json:"id"`
+	Title  string    `json:"title"`
+	Body   string    `json:"body"`
+	Date   time.Time `json:"date"`
+	URL    string    `json:"url"`
+	Score  float64   `json:"score"`
+}
+
+type searchResponseJSON struct {
+	Query string             `json:"query"`
+	Total int                `json:"total"`
+	Page  int                `json:"page"`
+	Pages int                `json:"pages"`
+	Users []string           `json:"users"`
+	Posts []searchResultJSON `json:"posts"`
+}
+
+// searchAPIHandler answers the same queries as the search page with JSON
+func searchAPIHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	usernameCookie, err := sessionCookie(r)
+	if err == http.ErrNoCookie {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	q, err := parseSearchQuery(r, getUser(usernameCookie.Value).location())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	hits := q.run()
+	start, end, pages := paginate(r, len(hits), postsPerPage)
+	pages.setLinkHeader(w)
+	resp := searchResponseJSON{Query: q.Text, Total: len(hits), Page: pages.Page, Pages: pages.Pages,
+		Users: []string{}, Posts: []searchResultJSON{}}
+	if pages.Page == 1 {
+		for _, us := range searchUsers(q.Text) {
+			resp.Users = append(resp.Users, us.Username)
+		}
+	}
+	for _, hit := range hits[start:end] {
+		resp.Posts = append(resp.Posts, searchResultJSON{
+			Author: hit.Author,
+			ID:     hit.Post.ID,
+			Title:  hit.Post.Title,
+			Body:   hit.Post.Body,
+			Date:   hit.Post.Date,
+			URL:    postURL(hit.Author, hit.Post.ID),
+			Score:  hit.Score,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	err = json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenize(t *testing.T) {
+	terms := tokenize("Posting my thoughts, ПРИВЕТ мир! go2 42")
+	want := []string{"post", "my", "thought", "привет", "мир", "go2", "42"}
+	if strings.Join(terms, " ") != strings.Join(want, " ") {
+		t.Errorf("TestTokenize --> FAILED")
+	}
+}
+
+func TestSearchIndex(t *testing.T) {
+	idx := newSearchIndex()
+	idx.add("alice", Post{ID: 1, Title: "Gophers", Body: "about gophers and rabbits"})
+	idx.add("alice", Post{ID: 2, Title: "Rabbits", Body: "rabbits only"})
+	idx.add("bob", Post{ID: 1, Title: "Cooking", Body: "a gopher recipe"})
+
+	scores := idx.search(tokenize("gopher"))
+	if len(scores) != 2 || scores[searchDoc{"alice", 1}] <= scores[searchDoc{"bob", 1}] {
+		t.Errorf("TestSearchIndex --> FAILED")
+	}
+	// every term is required
+	scores = idx.search(tokenize("gophers rabbit"))
+	if len(scores) != 1 || scores[searchDoc{"alice", 1}] == 0 {
+		t.Errorf("TestSearchIndex --> FAILED")
+	}
+	if len(idx.search(tokenize("gopher unknown"))) != 0 {
+		t.Errorf("TestSearchIndex --> FAILED")
+	}
+
+	idx.add("bob", Post{ID: 1, Title: "Cooking", Body: "a carrot recipe"})
+	if len(idx.search(tokenize("gopher"))) != 1 || len(idx.search(tokenize("carrots"))) != 1 {
+		t.Errorf("TestSearchIndex --> FAILED")
+	}
+	idx.delete("alice", 1)
+	idx.delete("alice", 2)
+	if len(idx.search(tokenize("gopher"))) != 0 || len(idx.search(tokenize("rabbits"))) != 0 ||
+		len(idx.docs) != 1 || idx.totalLength != titleWeight+3 {
+		t.Errorf("TestSearchIndex --> FAILED")
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	terms := map[string]bool{"post": true}
+	got := highlight("Posted <b>posts</b>, postal", terms)
+	want := "<mark>Posted</mark> &lt;b&gt;<mark>posts</mark>&lt;/b&gt;, postal"
+	if string(got) != want {
+		t.Errorf("TestHighlight --> FAILED")
+	}
+}
+
+func addSearchPosts() {
+	postIndex = newSearchIndex()
+	alice := &User{Username: "alice", Password: "testPassword", ID: 1}
+	bob := &User{Username: "bob", Password: "testPassword", ID: 2}
+	users = append(users, alice, bob)
+	alice.addPost(Post{Title: "Gophers", Body: "gophers are great", Date: time.Date(2018, 4, 5, 10, 0, 0, 0, time.UTC)})
+	alice.addPost(Post{Title: "Again", Body: "more about a gopher", Date: time.Date(2018, 5, 1, 10, 0, 0, 0, time.UTC)})
+	bob.addPost(Post{Title: "Hi", Body: "bob likes the gopher too", Date: time.Date(2018, 4, 6, 10, 0, 0, 0, time.UTC)})
+}
+
+func TestSearchHandler(t *testing.T) {
+	defer func() {
+		users = nil
+		postIndex = newSearchIndex()
+	}()
+	addSearchPosts()
+
+	req := httptest.NewRequest("GET", "http://127.0.0.1/search?q=gopher&author=alice&to=2018-04-30", nil)
+	req.AddCookie(sessionFor("bob"))
+	w := httptest.NewRecorder()
+
+	searchHandler(w, req, nil)
+
+	body := w.Body.String()
+	if w.Code != 200 || !strings.Contains(body, "1 posts found") || !strings.Contains(body, "<mark>Gophers</mark>") ||
+		strings.Contains(body, "bob likes") {
+		t.Errorf("TestSearchHandler --> FAILED")
+	}
+
+	req = httptest.NewRequest("GET", "http://127.0.0.1/search?q=bob&from=april", nil)
+	req.AddCookie(sessionFor("bob"))
+	w = httptest.NewRecorder()
+	searchHandler(w, req, nil)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "Please enter dates") {
+		t.Errorf("TestSearchHandler --> FAILED")
+	}
+}
+
+func TestSearchAPIHandler(t *testing.T) {
+	defer func() {
+		users = nil
+		postIndex = newSearchIndex()
+	}()
+	addSearchPosts()
+
+	req := httptest.NewRequest("GET", "http://127.0.0.1/api/search?q=bob+gopher", nil)
+	w := httptest.NewRecorder()
+	searchAPIHandler(w, req, nil)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("TestSearchAPIHandler --> FAILED")
+	}
+
+	req.AddCookie(sessionFor("alice"))
+	w = httptest.NewRecorder()
+	searchAPIHandler(w, req, nil)
+
+	var resp searchResponseJSON
+	err := json.Unmarshal(w.Body.Bytes(), &resp)
+	if err != nil || resp.Total != 1 || len(resp.Posts) != 1 || resp.Posts[0].Author != "bob" ||
+		resp.Posts[0].URL != baseURL+"/users/bob/posts/1" || len(resp.Users) != 1 || resp.Users[0] != "bob" {
+		t.Errorf("TestSearchAPIHandler --> FAILED")
+	}
+
+	// edits and deletions are searchable right away
+	getUser("alice").editPost(1, Revision{Title: "Gophers", Body: "nothing here"})
+	getUser("alice").deletePost(2)
+	req = httptest.NewRequest("GET", "http://127.0.0.1/api/search?q=gopher", nil)
+	req.AddCookie(sessionFor("alice"))
+	w = httptest.NewRecorder()
+	searchAPIHandler(w, req, nil)
+	err = json.Unmarshal(w.Body.Bytes(), &resp)
+	if err != nil || resp.Total != 2 {
+		t.Errorf("TestSearchAPIHandler --> FAILED")
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"src/github.com/julienschmidt/httprouter"
+)
+
+// Sitemaps (https://www.sitemaps.org/protocol.html) list pages of users,
+// their posts and tags. A sitemap holds up to sitemapSize URLs, past that
+// /sitemap.xml is an index of /sitemaps/N.xml.
+
+var sitemapSize = 50000
+
+const sitemapNamespace = "http://www.sitemaps.org/schemas/sitemap/0.9"
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+
+	lastMod time.Time
+}
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapIndex struct {
+	XMLName  xml.Name     `xml:"sitemapindex"`
+	XMLNS    string       `xml:"xmlns,attr"`
+	Sitemaps []sitemapURL `xml:"sitemap"`
+}
+
+func newSitemapURL(loc string, lastMod time.Time) sitemapURL {
+	u := sitemapURL{Loc: loc, lastMod: lastMod}
+	if !lastMod.IsZero() {
+		u.LastMod = lastMod.UTC().Format(time.RFC3339)
+	}
+	return u
+}
+
+// sitemapURLs lists pages of users that aren't disabled in the order they
+// registered, each followed by their posts, then tags in alphabetical order
+func sitemapURLs() []sitemapURL {
+	var urls []sitemapURL
+	tags := make(map[string]time.Time)
+	for _, us := range users {
+		if us.Disabled {
+			continue
+		}
+		var latest time.Time
+		var posts []sitemapURL
+		for _, p := range us.Posts {
+			modified := p.Modified()
+			if modified.After(latest) {
+				latest = modified
+			}
+			for _, tag := range p.Tags {
+				if modified.After(tags[tag]) {
+					tags[tag] = modified
+				}
+			}
+			posts = append(posts, newSitemapURL(postURL(us.Username, p.ID), modified))
+		}
+		urls = append(urls, newSitemapURL(baseURL+"/users/"+us.Username+"/", latest))
+		urls = append(urls, posts...)
+	}
+	var names []string
+	for tag := range tags {
+		names = append(names, tag)
+	}
+	sort.Strings(names)
+	for _, tag := range names {
+		urls = append(urls, newSitemapURL(baseURL+"/tags/"+tag, tags[tag]))
+	}
+	return urls
+}
+
+func writeSitemapXML(w http.ResponseWriter, v interface{}) {
+	data, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	w.Write(data)
+}
+
+// sitemapHandler serves the sitemap, or the index of sitemaps
+// when there are too many URLs for one
+func sitemapHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	urls := sitemapURLs()
+	if len(urls) <= sitemapSize {
+		writeSitemapXML(w, sitemapURLSet{XMLNS: sitemapNamespace, URLs: urls})
+		return
+	}
+	index := sitemapIndex{XMLNS: sitemapNamespace}
+	for start, n := 0, 1; start < len(urls); start, n = start+sitemapSize, n+1 {
+		end := start + sitemapSize
+		if end > len(urls) {
+			end = len(urls)
+		}
+		var latest time.Time
+		for _, u := range urls[start:end] {
+			if u.lastMod.After(latest) {
+				latest = u.lastMod
+			}
+		}
+		index.Sitemaps = append(index.Sitemaps, newSitemapURL(fmt.Sprintf("%s/sitemaps/%d.xml", baseURL, n), latest))
+	}
+	writeSitemapXML(w, index)
+}
+
+// sitemapPageHandler serves one of the sitemaps listed in the index
+func sitemapPageHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	page := ps.ByName("page")
+	n, err := strconv.Atoi(strings.TrimSuffix(page, ".xml"))
+	urls := sitemapURLs()
+	pages := (len(urls) + sitemapSize - 1) / sitemapSize
+	if err != nil || !strings.HasSuffix(page, ".xml") || n < 1 || n > pages || pages == 1 {
+		http.NotFound(w, r)
+		return
+	}
+	start := (n - 1) * sitemapSize
+	end := start + sitemapSize
+	if end > len(urls) {
+		end = len(urls)
+	}
+	writeSitemapXML(w, sitemapURLSet{XMLNS: sitemapNamespace, URLs: urls[start:end]})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"src/github.com/julienschmidt/httprouter"
+)
+
+func getSitemap(t *testing.T, url string, handler httprouter.Handle, ps httprouter.Params, v interface{}) int {
+	return getDecoded(t, xml.Unmarshal, httptest.NewRequest("GET", url, nil), handler, ps, v)
+}
+
+func TestSitemap(t *testing.T) {
+	date := time.Date(2018, 4, 5, 11, 0, 0, 0, time.UTC)
+	alice := &User{Username: "alice", Posts: []Post{
+		{ID: 2, Title: "b", Body: "b", Date: date.Add(time.Hour), Tags: []string{"web"}},
+		{ID: 1, Title: "a", Body: "a", Date: date, Tags: []string{"go", "web"},
+			Revisions: []Revision{{Number: 1, Date: date}, {Number: 2, Date: date.Add(3 * time.Hour)}}},
+	}}
+	users = append(users, alice, &User{Username: "gone", Disabled: true, Posts: []Post{{ID: 1, Date: date}}},
+		&User{Username: "bob"})
+	defer func() { users = nil }()
+
+	var set sitemapURLSet
+	if getSitemap(t, "http://127.0.0.1/sitemap.xml", sitemapHandler, nil, &set) != 200 {
+		t.Fatal("TestSitemap --> FAILED")
+	}
+	var locs []string
+	for _, u := range set.URLs {
+		locs = append(locs, u.Loc+" "+u.LastMod)
+	}
+	want := []string{
+		baseURL + "/users/alice/ 2018-04-05T14:00:00Z",
+		postURL("alice", 2) + " 2018-04-05T12:00:00Z",
+		postURL("alice", 1) + " 2018-04-05T14:00:00Z",
+		baseURL + "/users/bob/ ",
+		baseURL + "/tags/go 2018-04-05T14:00:00Z",
+		baseURL + "/tags/web 2018-04-05T14:00:00Z",
+	}
+	if len(locs) != len(want) {
+		t.Fatalf("TestSitemap --> FAILED: %v", locs)
+	}
+	for i := range want {
+		if locs[i] != want[i] {
+			t.Errorf("TestSitemap --> FAILED: %s", locs[i])
+		}
+	}
+
+	// past sitemapSize URLs the sitemap is an index
+	defer func(size int) { sitemapSize = size }(sitemapSize)
+	sitemapSize = 4
+	var index sitemapIndex
+	if getSitemap(t, "http://127.0.0.1/sitemap.xml", sitemapHandler, nil, &index) != 200 || len(index.Sitemaps) != 2 ||
+		index.Sitemaps[1].Loc != baseURL+"/sitemaps/2.xml" || index.Sitemaps[1].LastMod != "2018-04-05T14:00:00Z" {
+		t.Fatalf("TestSitemap --> FAILED: %+v", index)
+	}
+	set = sitemapURLSet{}
+	if getSitemap(t, index.Sitemaps[1].Loc, sitemapPageHandler, httprouter.Params{{"page", "2.xml"}}, &set) != 200 ||
+		len(set.URLs) != 2 || set.URLs[0].Loc != baseURL+"/tags/go" {
+		t.Errorf("TestSitemap --> FAILED: %+v", set)
+	}
+	for _, page := range []string{"3.xml", "0.xml", "1", "x.xml", "9223372036854775807.xml", "-9223372036854775808.xml"} {
+		if getSitemap(t, "http://127.0.0.1/sitemaps/"+page, sitemapPageHandler, httprouter.Params{{"page", page}}, &set) != 404 {
+			t.Errorf("TestSitemap --> FAILED: %s", page)
+		}
+	}
+}
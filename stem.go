@@ -0,0 +1,180 @@
+package main
+
+import "strings"
+
+// stem reduces an english word to its stem with the Porter algorithm,
+// so that "posting", "posted" and "posts" are found by each other.
+// The word must be lower case, words with other letters are returned as is.
+func stem(w string) string {
+	if len(w) <= 2 {
+		return w
+	}
+	for i := 0; i < len(w); i++ {
+		if w[i] < 'a' || w[i] > 'z' {
+			return w
+		}
+	}
+	w = stemStep1a(w)
+	w = stemStep1b(w)
+	w = stemStep1c(w)
+	w = applyStemRules(w, stemStep2, 0)
+	w = applyStemRules(w, stemStep3, 0)
+	w = applyStemRules(w, stemStep4, 1)
+	return stemStep5(w)
+}
+
+func isConsonant(w string, i int) bool {
+	switch w[i] {
+	case 'a', 'e', 'i', 'o', 'u':
+		return false
+	case 'y':
+		return i == 0 || !isConsonant(w, i-1)
+	}
+	return true
+}
+
+// measure counts the vowel-consonant sequences of w, [C](VC){m}[V]
+func measure(w string) int {
+	m, i := 0, 0
+	for i < len(w) && isConsonant(w, i) {
+		i++
+	}
+	for i < len(w) {
+		for i < len(w) && !isConsonant(w, i) {
+			i++
+		}
+		if i == len(w) {
+			break
+		}
+		for i < len(w) && isConsonant(w, i) {
+			i++
+		}
+		m++
+	}
+	return m
+}
+
+func hasVowel(w string) bool {
+	for i := range w {
+		if !isConsonant(w, i) {
+			return true
+		}
+	}
+	return false
+}
+
+func endsWithDoubleConsonant(w string) bool {
+	n := len(w)
+	return n >= 2 && w[n-1] == w[n-2] && isConsonant(w, n-1)
+}
+
+// endsWithCVC tells whether w ends with consonant-vowel-consonant
+// where the last consonant is not w, x or y, like "hop" or "fil"
+func endsWithCVC(w string) bool {
+	n := len(w)
+	if n < 3 || !isConsonant(w, n-3) || isConsonant(w, n-2) || !isConsonant(w, n-1) {
+		return false
+	}
+	return w[n-1] != 'w' && w[n-1] != 'x' && w[n-1] != 'y'
+}
+
+func stemStep1a(w string) string {
+	switch {
+	case strings.HasSuffix(w, "sses"), strings.HasSuffix(w, "ies"):
+		return w[:len(w)-2]
+	case strings.HasSuffix(w, "ss"):
+		return w
+	case strings.HasSuffix(w, "s"):
+		return w[:len(w)-1]
+	}
+	return w
+}
+
+func stemStep1b(w string) string {
+	if strings.HasSuffix(w, "eed") {
+		if measure(w[:len(w)-3]) > 0 {
+			return w[:len(w)-1]
+		}
+		return w
+	}
+	for _, suffix := range []string{"ed", "ing"} {
+		if !strings.HasSuffix(w, suffix) || !hasVowel(w[:len(w)-len(suffix)]) {
+			continue
+		}
+		w = w[:len(w)-len(suffix)]
+		switch {
+		case strings.HasSuffix(w, "at"), strings.HasSuffix(w, "bl"), strings.HasSuffix(w, "iz"):
+			return w + "e"
+		case endsWithDoubleConsonant(w) && !strings.HasSuffix(w, "l") &&
+			!strings.HasSuffix(w, "s") && !strings.HasSuffix(w, "z"):
+			return w[:len(w)-1]
+		case measure(w) == 1 && endsWithCVC(w):
+			return w + "e"
+		}
+		return w
+	}
+	return w
+}
+
+func stemStep1c(w string) string {
+	if strings.HasSuffix(w, "y") && hasVowel(w[:len(w)-1]) {
+		return w[:len(w)-1] + "i"
+	}
+	return w
+}
+
+type stemRule struct {
+	suffix, replacement string
+}
+
+// longer suffixes go before the shorter ones they end with
+var stemStep2 = []stemRule{
+	{"ational", "ate"}, {"tional", "tion"}, {"enci", "ence"}, {"anci", "ance"}, {"izer", "ize"},
+	{"bli", "ble"}, {"alli", "al"}, {"entli", "ent"}, {"eli", "e"}, {"ousli", "ous"},
+	{"ization", "ize"}, {"ation", "ate"}, {"ator", "ate"}, {"alism", "al"}, {"iveness", "ive"},
+	{"fulness", "ful"}, {"ousness", "ous"}, {"aliti", "al"}, {"iviti", "ive"}, {"biliti", "ble"},
+	{"logi", "log"},
+}
+
+var stemStep3 = []stemRule{
+	{"icate", "ic"}, {"ative", ""}, {"alize", "al"}, {"iciti", "ic"}, {"ical", "ic"},
+	{"ful", ""}, {"ness", ""},
+}
+
+var stemStep4 = []stemRule{
+	{"al", ""}, {"ance", ""}, {"ence", ""}, {"er", ""}, {"ic", ""}, {"able", ""}, {"ible", ""},
+	{"ant", ""}, {"ement", ""}, {"ment", ""}, {"ent", ""}, {"ion", ""}, {"ou", ""}, {"ism", ""},
+	{"ate", ""}, {"iti", ""}, {"ous", ""}, {"ive", ""}, {"ize", ""},
+}
+
+// applyStemRules replaces the first matching suffix when the rest of the word
+// has a measure greater than m, other rules aren't tried after a match
+func applyStemRules(w string, rules []stemRule, m int) string {
+	for _, rule := range rules {
+		if !strings.HasSuffix(w, rule.suffix) {
+			continue
+		}
+		rest := w[:len(w)-len(rule.suffix)]
+		if rule.suffix == "ion" && !strings.HasSuffix(rest, "s") && !strings.HasSuffix(rest, "t") {
+			return w
+		}
+		if measure(rest) > m {
+			return rest + rule.replacement
+		}
+		return w
+	}
+	return w
+}
+
+func stemStep5(w string) string {
+	if strings.HasSuffix(w, "e") {
+		rest := w[:len(w)-1]
+		if m := measure(rest); m > 1 || m == 1 && !endsWithCVC(rest) {
+			w = rest
+		}
+	}
+	if strings.HasSuffix(w, "ll") && measure(w) > 1 {
+		w = w[:len(w)-1]
+	}
+	return w
+}
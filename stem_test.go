@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestStem(t *testing.T) {
+	words := map[string]string{
+		"caresses":        "caress",
+		"ponies":          "poni",
+		"cats":            "cat",
+		"agreed":          "agre",
+		"feed":            "feed",
+		"plastered":       "plaster",
+		"motoring":        "motor",
+		"sing":            "sing",
+		"hopping":         "hop",
+		"falling":         "fall",
+		"filing":          "file",
+		"happy":           "happi",
+		"relational":      "relat",
+		"conditional":     "condit",
+		"generalizations": "gener",
+		"hopefulness":     "hope",
+		"adoption":        "adopt",
+		"controlling":     "control",
+		"rate":            "rate",
+		"posts":           "post",
+		"posted":          "post",
+		"posting":         "post",
+		"go":              "go",
+		"привет":          "привет",
+		"2018":            "2018",
+	}
+	for word, want := range words {
+		if got := stem(word); got != want {
+			t.Errorf("TestStem --> FAILED: %s -> %s, want %s", word, got, want)
+		}
+	}
+}
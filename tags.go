@@ -0,0 +1,165 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"src/github.com/julienschmidt/httprouter"
+	"src/github.com/pkg/errors"
+)
+
+const maxTags = 5
+
+var tagPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,19}$`)
+
+// parseTags reads tags separated with commas or spaces like "go, web #news",
+// tags are lower cased and repeated ones are dropped
+func parseTags(s string) ([]string, error) {
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	})
+	var tags []string
+	seen := make(map[string]bool)
+	for _, f := range fields {
+		tag := strings.ToLower(strings.TrimPrefix(f, "#"))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	return tags, checkTags(tags)
+}
+
+// checkTags makes sure tags are valid: up to maxTags of lower case latin
+// letters, digits and dashes, not longer than 20 symbols each
+func checkTags(tags []string) error {
+	if len(tags) > maxTags {
+		return errors.Errorf("a post can have up to %d tags, got %d", maxTags, len(tags))
+	}
+	for _, tag := range tags {
+		if !tagPattern.MatchString(tag) {
+			return errors.Errorf("invalid tag %q", tag)
+		}
+	}
+	return nil
+}
+
+func (p Post) HasTag(tag string) bool {
+	for _, t := range p.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// TagCount is a tag of a tag cloud, Size is a font size from 100 to 200 percent growing with Count
+type TagCount struct {
+	Tag   string
+	Count int
+	Size  int
+}
+
+// TagCloud counts tags used in posts of the user, in alphabetical order
+func (u User) TagCloud() []TagCount {
+	counts := make(map[string]int)
+	max := 0
+	for _, p := range u.Posts {
+		for _, tag := range p.Tags {
+			counts[tag]++
+			if counts[tag] > max {
+				max = counts[tag]
+			}
+		}
+	}
+	cloud := make([]TagCount, 0, len(counts))
+	for tag, n := range counts {
+		cloud = append(cloud, TagCount{Tag: tag, Count: n, Size: 100 + 100*(n-1)/maxInt(max-1, 1)})
+	}
+	sort.Slice(cloud, func(i, j int) bool { return cloud[i].Tag < cloud[j].Tag })
+	return cloud
+}
+
+// postsWithTag collects posts of all users having the tag, in the timeline order.
+// Disabled accounts are left out like in their feeds and the sitemap.
+func postsWithTag(tag string) []TimelineEntry {
+	var entries []TimelineEntry
+	for _, us := range users {
+		if us.Disabled {
+			continue
+		}
+		for _, p := range us.Posts {
+			if p.HasTag(tag) {
+				entries = append(entries, TimelineEntry{Author: us.Username, Post: p})
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if !a.Date.Equal(b.Date) {
+			return a.Date.After(b.Date)
+		}
+		if a.Author != b.Author {
+			return a.Author < b.Author
+		}
+		return a.ID > b.ID
+	})
+	return entries
+}
+
+type tagPage struct {
+	Tag     string
+	Viewer  *User
+	Entries []TimelineEntry
+	Total   int
+	Pages   Pagination
+}
+
+func tagHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	usernameCookie, err := sessionCookie(r)
+	if err == http.ErrNoCookie {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	tag := ps.ByName("tag")
+	if !tagPattern.MatchString(tag) {
+		http.NotFound(w, r)
+		return
+	}
+	entries := postsWithTag(tag)
+	start, end, pages := paginate(r, len(entries), postsPerPage)
+	pages.setLinkHeader(w)
+	tpl, err := parseTemplates("templates/header.html", "templates/tag.html", "templates/pagination.html")
+	if err != nil {
+		panic(err)
+	}
+
+	err = tpl.ExecuteTemplate(w, "tag", tagPage{
+		Tag:     tag,
+		Viewer:  getUser(usernameCookie.Value),
+		Entries: entries[start:end],
+		Total:   len(entries),
+		Pages:   pages,
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// tagFeedHandler serves the newest posts with the tag as RSS,
+// feed readers don't log in so it's open to everyone
+func tagFeedHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	tag := ps.ByName("tag")
+	if !tagPattern.MatchString(tag) {
+		http.NotFound(w, r)
+		return
+	}
+	entries := postsWithTag(tag)
+	if len(entries) > feedSize {
+		entries = entries[:feedSize]
+	}
+	writeRSS(w, "#"+tag, baseURL+"/tags/"+tag, "Posts tagged with "+tag, entries)
+}
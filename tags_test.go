@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"src/github.com/julienschmidt/httprouter"
+)
+
+func TestParseTags(t *testing.T) {
+	tags, err := parseTags(" Go, web #news,go\tgo-lang ")
+	if err != nil || strings.Join(tags, " ") != "go web news go-lang" {
+		t.Errorf("TestParseTags --> FAILED")
+	}
+	if tags, err := parseTags(""); err != nil || len(tags) != 0 {
+		t.Errorf("TestParseTags --> FAILED")
+	}
+	for _, s := range []string{"a, b, c, d, e, f", "-go", "tag!", "привет", "averyveryverylongtag1"} {
+		if _, err := parseTags(s); err == nil {
+			t.Errorf("TestParseTags --> FAILED: %s", s)
+		}
+	}
+}
+
+func TestTagCloud(t *testing.T) {
+	us := User{Posts: []Post{{Tags: []string{"go", "web"}}, {Tags: []string{"go"}}, {Tags: []string{"go", "news"}}}}
+	cloud := us.TagCloud()
+	if len(cloud) != 3 || cloud[0] != (TagCount{"go", 3, 200}) || cloud[1] != (TagCount{"news", 1, 100}) ||
+		cloud[2].Tag != "web" {
+		t.Errorf("TestTagCloud --> FAILED")
+	}
+}
+
+func addTaggedPosts() {
+	date := time.Date(2018, 4, 5, 10, 0, 0, 0, time.UTC)
+	alice := &User{Username: "alice", Password: "testPassword", ID: 1}
+	bob := &User{Username: "bob", Password: "testPassword", ID: 2}
+	users = append(users, alice, bob)
+	alice.addPost(Post{Title: "first", Body: "body", Date: date, Tags: []string{"go"}})
+	bob.addPost(Post{Title: "second", Body: "body", Date: date.Add(time.Hour), Tags: []string{"go", "web"}})
+	alice.addPost(Post{Title: "third", Body: "body", Date: date.Add(2 * time.Hour), Tags: []string{"web"}})
+}
+
+func TestPostsWithTag(t *testing.T) {
+	defer func() {
+		users = nil
+	}()
+	addTaggedPosts()
+
+	entries := postsWithTag("go")
+	if len(entries) != 2 || entries[0].Title != "second" || entries[0].Author != "bob" || entries[1].Title != "first" {
+		t.Errorf("TestPostsWithTag --> FAILED")
+	}
+	if len(postsWithTag("nothing")) != 0 {
+		t.Errorf("TestPostsWithTag --> FAILED")
+	}
+	getUser("bob").Disabled = true
+	if entries := postsWithTag("go"); len(entries) != 1 || entries[0].Author != "alice" {
+		t.Errorf("TestPostsWithTag --> FAILED")
+	}
+}
+
+func TestAddPostInvalidTags(t *testing.T) {
+	us := User{Username: "testUser", Password: "testPassword", ID: 1}
+	if us.addPost(Post{Title: "title", Body: "body", Tags: []string{"Not valid"}}) == nil || us.PostCount != 0 {
+		t.Errorf("TestAddPostInvalidTags --> FAILED")
+	}
+}
+
+func TestTagHandler(t *testing.T) {
+	defer func() {
+		users = nil
+	}()
+	addTaggedPosts()
+
+	req := httptest.NewRequest("GET", "http://127.0.0.1/tags/web", nil)
+	req.AddCookie(sessionFor("alice"))
+	w := httptest.NewRecorder()
+
+	tagHandler(w, req, httprouter.Params{{"tag", "web"}})
+
+	body := w.Body.String()
+	if w.Code != 200 || !strings.Contains(body, "2 posts are tagged") || !strings.Contains(body, "third") ||
+		strings.Contains(body, "first") {
+		t.Errorf("TestTagHandler --> FAILED")
+	}
+
+	w = httptest.NewRecorder()
+	tagHandler(w, req, httprouter.Params{{"tag", "Bad!"}})
+	if w.Code != http.StatusNotFound {
+		t.Errorf("TestTagHandler --> FAILED")
+	}
+}
+
+func TestTagFeedHandler(t *testing.T) {
+	defer func() {
+		users = nil
+	}()
+	addTaggedPosts()
+
+	req := httptest.NewRequest("GET", "http://127.0.0.1/tags/go/feed.xml", nil)
+	w := httptest.NewRecorder()
+
+	tagFeedHandler(w, req, httprouter.Params{{"tag", "go"}})
+
+	var feed rssFeed
+	err := xml.Unmarshal(w.Body.Bytes(), &feed)
+	if err != nil || w.Header().Get("Content-Type") != "application/rss+xml; charset=utf-8" ||
+		len(feed.Channel.Items) != 2 || feed.Channel.Items[0].Link != baseURL+"/users/bob/posts/1" ||
+		feed.Channel.Items[0].PubDate != "Thu, 05 Apr 2018 11:00:00 +0000" ||
+		strings.Join(feed.Channel.Items[0].Categories, " ") != "go web" {
+		t.Errorf("TestTagFeedHandler --> FAILED")
+	}
+}
+
+func TestNewPostPostHandlerInvalidTags(t *testing.T) {
+	defer func() {
+		users = nil
+	}()
+	users = append(users, &User{Username: "testUser", Password: "testPassword", ID: 1})
+	req := httptest.NewRequest("POST", "http://127.0.0.1/users/testUser/newPost", nil)
+	req.AddCookie(sessionFor("testUser"))
+	req.ParseForm()
+	req.Form.Set("title", "title")
+	req.Form.Set("body", "body")
+	req.Form.Set("tags", "good, bad!")
+	w := httptest.NewRecorder()
+
+	newPostPostHandler(w, req, httprouter.Params{{"username", "testUser"}})
+
+	l, _ := w.Result().Location()
+	if l.Path != "/users/testUser/newPostInvalidSymbols" || getUser("testUser").PostCount != 0 {
+		t.Errorf("TestNewPostPostHandlerInvalidTags --> FAILED")
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"src/github.com/julienschmidt/httprouter"
+	"src/github.com/pkg/errors"
+)
+
+const (
+	TakeoutPending = "pending"
+	TakeoutReady   = "ready"
+	TakeoutFailed  = "failed"
+)
+
+// takeoutDir keeps the last prepared archive of every user who asked for one
+var takeoutDir = "data/takeouts"
+
+// archives are removed when they are asked for after takeoutTTL
+const takeoutTTL = 7 * 24 * time.Hour
+
+// Takeout is the state of the data archive of a user, it's guarded by storeMu
+type Takeout struct {
+	Status  string
+	Created time.Time
+	Size    int64
+	Error   string
+}
+
+// takeouts are archives being prepared or prepared since the start,
+// older ones are found in takeoutDir
+var takeouts = make(map[string]*Takeout)
+
+// takeoutJobs lets tests wait for archives being written
+var takeoutJobs sync.WaitGroup
+
+func takeoutPath(username string) string {
+	return filepath.Join(takeoutDir, username+".zip")
+}
+
+// Takeout returns the state of the user's archive, nil when there's none
+// or it has expired
+func (u User) Takeout() *Takeout {
+	t, ok := takeouts[u.Username]
+	if !ok {
+		info, err := os.Stat(takeoutPath(u.Username))
+		if err != nil {
+			return nil
+		}
+		t = &Takeout{Status: TakeoutReady, Created: info.ModTime(), Size: info.Size()}
+	}
+	if t.Status == TakeoutReady && time.Since(t.Created) > takeoutTTL {
+		return nil
+	}
+	return t
+}
+
+// removeTakeout forgets the archive of the user and removes its file,
+// an archive still being written is removed once it's done
+func removeTakeout(username string) error {
+	delete(takeouts, username)
+	err := os.Remove(takeoutPath(username))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "can't remove the takeout archive")
+	}
+	return nil
+}
+
+// takeoutProfile is the account without the password and 2FA secrets
+type takeoutProfile struct {
+	Username         string
+	ID               int
+	Role             string
+	Email            string
+	DisplayName      string
+	Bio              string
+	Website          string
+	Avatar           string
+	TimeZone         string
+	Following        []string
+	RemoteFollowers  []RemoteFollower
+	TwoFactorEnabled bool
+	PostCount        int
+	Uploads          []Upload
+}
+
+// takeoutComment is a comment the user wrote together with the post it's under
+type takeoutComment struct {
+	PostAuthor string
+	PostID     int
+	PostTitle  string
+	ID         int
+	ParentID   int
+	Body       string
+	Date       time.Time
+}
+
+// takeoutFile is a file of the archive, Media is the name of a file in
+// mediaDir to copy when Data is nil
+type takeoutFile struct {
+	Name  string
+	Data  []byte
+	Media string
+}
+
+// yamlQuote quotes s for front matter the import command reads back
+func yamlQuote(s string) string {
+	if !strings.Contains(s, `"`) {
+		return `"` + s + `"`
+	}
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// postMarkdown renders the post as a Markdown file with front matter
+func postMarkdown(p Post) []byte {
+	var b strings.Builder
+	b.WriteString("---\n")
+	fmt.Fprintf(&b, "title: %s\n", yamlQuote(p.Title))
+	fmt.Fprintf(&b, "date: %s\n", p.Date.UTC().Format(time.RFC3339))
+	if len(p.Tags) > 0 {
+		fmt.Fprintf(&b, "tags: [%s]\n", strings.Join(p.Tags, ", "))
+	}
+	if !p.IsPublished() {
+		b.WriteString("draft: true\n")
+	}
+	if p.Status == StatusScheduled {
+		fmt.Fprintf(&b, "publishAt: %s\n", p.PublishAt.UTC().Format(time.RFC3339))
+	}
+	b.WriteString("---\n")
+	b.WriteString(p.Body)
+	b.WriteString("\n")
+	for _, name := range p.Images {
+		fmt.Fprintf(&b, "\n![image](../media/%s)\n", name)
+	}
+	return []byte(b.String())
+}
+
+// collectTakeout puts together the files of the user's archive. It's called
+// under storeMu and only media files are read later, their names are
+// sha256 sums of the content, so they never change.
+func collectTakeout(us *User) ([]takeoutFile, error) {
+	var files []takeoutFile
+	add := func(name string, v interface{}) error {
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return errors.Wrap(err, "can't encode "+name)
+		}
+		files = append(files, takeoutFile{Name: name, Data: data})
+		return nil
+	}
+
+	err := add("profile.json", takeoutProfile{
+		Username:         us.Username,
+		ID:               us.ID,
+		Role:             us.Role,
+		Email:            us.Email,
+		DisplayName:      us.DisplayName,
+		Bio:              us.Bio,
+		Website:          us.Website,
+		Avatar:           us.Avatar,
+		TimeZone:         us.TimeZone,
+		Following:        us.Following,
+		RemoteFollowers:  us.RemoteFollowers,
+		TwoFactorEnabled: us.TwoFactorEnabled(),
+		PostCount:        us.PostCount,
+		Uploads:          us.Uploads,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range append(append([]Post(nil), us.Posts...), us.Drafts...) {
+		dir := "posts"
+		if !p.IsPublished() {
+			dir = "drafts"
+		}
+		name := fmt.Sprintf("%s/%d", dir, p.ID)
+		err = add(name+".json", p)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, takeoutFile{Name: name + ".md", Data: postMarkdown(p)})
+	}
+
+	comments := []takeoutComment{}
+	for _, author := range users {
+		for _, p := range author.Posts {
+			for _, c := range p.Comments {
+				if c.Author == us.Username {
+					comments = append(comments, takeoutComment{author.Username, p.ID, p.Title, c.ID, c.ParentID, c.Body, c.Date})
+				}
+			}
+		}
+	}
+	err = add("comments.json", comments)
+	if err != nil {
+		return nil, err
+	}
+
+	// avatars and post images are uploads too, they are listed
+	// separately for accounts saved before uploads were remembered
+	media := make(map[string]bool)
+	var names []string
+	for _, up := range us.Uploads {
+		names = append(names, up.Name)
+	}
+	for _, p := range append(append([]Post(nil), us.Posts...), us.Drafts...) {
+		names = append(names, p.Images...)
+	}
+	if us.Avatar != "" {
+		names = append(names, us.Avatar)
+	}
+	for _, name := range names {
+		if !media[name] {
+			media[name] = true
+			files = append(files, takeoutFile{Name: "media/" + name, Media: name})
+		}
+	}
+	return files, nil
+}
+
+// writeTakeout writes the files into a zip archive at dst
+func writeTakeout(files []takeoutFile, dst string) (int64, error) {
+	err := os.MkdirAll(filepath.Dir(dst), 0700)
+	if err != nil {
+		return 0, errors.Wrap(err, "can't create takeout directory")
+	}
+	tmp := dst + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, errors.Wrap(err, "can't create archive")
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+	zw := zip.NewWriter(f)
+
+	var missing []string
+	for _, file := range files {
+		var src io.ReadCloser = ioutil.NopCloser(bytes.NewReader(file.Data))
+		if file.Data == nil {
+			src, err = os.Open(filepath.Join(mediaDir, file.Media))
+			if os.IsNotExist(err) {
+				missing = append(missing, file.Media)
+				continue
+			}
+			if err != nil {
+				return 0, errors.Wrap(err, "can't read "+file.Media)
+			}
+		}
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: file.Name, Method: zip.Deflate, Modified: time.Now()})
+		if err == nil {
+			_, err = io.Copy(w, src)
+		}
+		src.Close()
+		if err != nil {
+			return 0, errors.Wrap(err, "can't write "+file.Name)
+		}
+	}
+
+	readme := "profile.json    your account without the password\n" +
+		"posts/          published posts as JSON and Markdown\n" +
+		"drafts/         drafts and scheduled posts\n" +
+		"comments.json   comments you wrote under any post\n" +
+		"media/          images you uploaded\n"
+	if len(missing) > 0 {
+		readme += "\nthese images couldn't be found on the server:\n" + strings.Join(missing, "\n") + "\n"
+	}
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: "README.txt", Method: zip.Deflate, Modified: time.Now()})
+	if err == nil {
+		_, err = io.WriteString(w, readme)
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = f.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		return 0, errors.Wrap(err, "can't write archive")
+	}
+	info, err := os.Stat(dst)
+	if err != nil {
+		return 0, errors.Wrap(err, "can't write archive")
+	}
+	return info.Size(), nil
+}
+
+// startTakeout prepares the archive of the user in the background,
+// it's called under storeMu
+func startTakeout(us *User) error {
+	if t := us.Takeout(); t != nil && t.Status == TakeoutPending {
+		return nil
+	}
+	files, err := collectTakeout(us)
+	if err != nil {
+		return err
+	}
+	username := us.Username
+	pending := &Takeout{Status: TakeoutPending, Created: time.Now()}
+	takeouts[username] = pending
+
+	takeoutJobs.Add(1)
+	go func() {
+		defer takeoutJobs.Done()
+		size, err := writeTakeout(files, takeoutPath(username))
+
+		storeMu.Lock()
+		defer storeMu.Unlock()
+		if takeouts[username] != pending {
+			// the account was deleted meanwhile
+			os.Remove(takeoutPath(username))
+			return
+		}
+		t := &Takeout{Status: TakeoutReady, Created: time.Now(), Size: size}
+		if err != nil {
+			log.Println(err)
+			t = &Takeout{Status: TakeoutFailed, Created: time.Now(), Error: err.Error()}
+		}
+		takeouts[username] = t
+	}()
+	return nil
+}
+
+func takeoutHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	usernameCookie, err := sessionCookie(r)
+	if err != nil || usernameCookie.Value != ps.ByName("username") {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	err = startTakeout(getUser(usernameCookie.Value))
+	if err != nil {
+		panic(err)
+	}
+	http.Redirect(w, r, "/users/"+usernameCookie.Value, http.StatusFound)
+}
+
+// takeoutDownloadHandler serves the prepared archive to its owner only
+func takeoutDownloadHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	// the archive is opened under storeMu and sent without it,
+	// a new archive replaces the file instead of writing into it
+	storeMu.Lock()
+	usernameCookie, err := sessionCookie(r)
+	if err != nil || usernameCookie.Value != ps.ByName("username") {
+		storeMu.Unlock()
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	us := getUser(usernameCookie.Value)
+	t := us.Takeout()
+	if t == nil {
+		// an expired archive isn't kept
+		os.Remove(takeoutPath(us.Username))
+		delete(takeouts, us.Username)
+	}
+	var f *os.File
+	if t != nil && t.Status == TakeoutReady {
+		f, err = os.Open(takeoutPath(us.Username))
+	}
+	storeMu.Unlock()
+	if t == nil || t.Status != TakeoutReady || err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf(`attachment; filename="%s-%s.zip"`, us.Username, t.Created.UTC().Format("20060102")))
+	w.Header().Set("Cache-Control", "private, no-store")
+	http.ServeContent(w, r, "", t.Created, f)
+}
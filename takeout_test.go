@@ -0,0 +1,183 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"src/github.com/julienschmidt/httprouter"
+)
+
+func TestPostMarkdown(t *testing.T) {
+	post := Post{Title: `Say "hi"`, Body: "body", Date: time.Date(2018, 4, 5, 16, 17, 0, 0, time.UTC),
+		Tags: []string{"go", "web"}, Status: StatusDraft, Images: []string{"a.png"}}
+	md := postMarkdown(post)
+	fields, body, err := parseFrontMatter(md)
+	if err != nil || fields["title"][0] != `Say "hi"` || fields["date"][0] != "2018-04-05T16:17:00Z" ||
+		strings.Join(fields["tags"], ",") != "go,web" || fields["draft"][0] != "true" ||
+		body != "body\n\n![image](../media/a.png)\n" {
+		t.Errorf("TestPostMarkdown --> FAILED")
+	}
+	if yamlQuote("it's") != `"it's"` || yamlQuote(`it's "x"`) != `'it''s "x"'` {
+		t.Errorf("TestPostMarkdown --> FAILED")
+	}
+}
+
+func TestTakeout(t *testing.T) {
+	defer withMediaDir(t)()
+	dir, err := ioutil.TempDir("", "takeouts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldDir := takeoutDir
+	takeoutDir = dir
+	defer func() {
+		takeoutDir = oldDir
+		os.RemoveAll(dir)
+		takeouts = make(map[string]*Takeout)
+		users = nil
+	}()
+
+	upload, _ := storeImage(testPNG(30, 30))
+	us := &User{Username: "testUser", Password: "testPassword", ID: 1, Role: RoleAuthor,
+		TOTPSecret: "SECRET", Uploads: []Upload{upload}}
+	other := &User{Username: "otherUser", Password: "testPassword", ID: 2, Role: RoleAuthor}
+	users = append(users, us, other)
+	us.addPost(Post{Title: "mine", Body: "body", Date: time.Now(), Images: []string{upload.Name}})
+	us.addDraft(Post{Title: "draft", Body: "later", Date: time.Now()})
+	other.addPost(Post{Title: "theirs", Body: "body", Date: time.Now()})
+	other.Posts[0].addComment(Comment{Author: "testUser", Body: "nice", Date: time.Now()})
+	other.Posts[0].addComment(Comment{Author: "otherUser", Body: "thanks", Date: time.Now()})
+
+	request := func(method, url, username string, handler httprouter.Handle) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, nil)
+		req.AddCookie(sessionFor(username))
+		w := httptest.NewRecorder()
+		handler(w, req, httprouter.Params{{"username", "testUser"}})
+		return w
+	}
+
+	if us.Takeout() != nil || request("GET", "http://127.0.0.1/users/testUser/takeout.zip", "testUser", takeoutDownloadHandler).Code != 404 {
+		t.Errorf("TestTakeout --> FAILED")
+	}
+	w := request("POST", "http://127.0.0.1/users/testUser/takeout", "testUser", takeoutHandler)
+	if w.Code != http.StatusFound {
+		t.Errorf("TestTakeout --> FAILED")
+	}
+	takeoutJobs.Wait()
+	if us.Takeout() == nil || us.Takeout().Status != TakeoutReady {
+		t.Fatal("TestTakeout --> FAILED")
+	}
+	page := request("GET", "http://127.0.0.1/users/testUser", "testUser", usersHandler)
+	if !strings.Contains(page.Body.String(), `<a href="/users/testUser/takeout.zip">Download your data</a>`) {
+		t.Errorf("TestTakeout --> FAILED")
+	}
+
+	if request("GET", "http://127.0.0.1/users/testUser/takeout.zip", "otherUser", takeoutDownloadHandler).Code != http.StatusForbidden {
+		t.Errorf("TestTakeout --> FAILED")
+	}
+	w = request("GET", "http://127.0.0.1/users/testUser/takeout.zip", "testUser", takeoutDownloadHandler)
+	if w.Code != 200 || w.Header().Get("Content-Type") != "application/zip" {
+		t.Fatal("TestTakeout --> FAILED")
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string][]byte)
+	for _, f := range zr.File {
+		r, _ := f.Open()
+		files[f.Name], _ = ioutil.ReadAll(r)
+		r.Close()
+	}
+	var comments []takeoutComment
+	json.Unmarshal(files["comments.json"], &comments)
+	if len(comments) != 1 || comments[0].PostAuthor != "otherUser" || comments[0].Body != "nice" {
+		t.Errorf("TestTakeout --> FAILED")
+	}
+	if files["posts/1.json"] == nil || files["posts/1.md"] == nil || files["drafts/2.md"] == nil ||
+		files["media/"+upload.Name] == nil || files["README.txt"] == nil {
+		t.Errorf("TestTakeout --> FAILED")
+	}
+	// secrets stay on the server
+	if bytes.Contains(files["profile.json"], []byte("testPassword")) || bytes.Contains(files["profile.json"], []byte("SECRET")) {
+		t.Errorf("TestTakeout --> FAILED")
+	}
+
+	// archives are only kept for a while
+	takeouts["testUser"].Created = time.Now().Add(-takeoutTTL - time.Hour)
+	w = request("GET", "http://127.0.0.1/users/testUser/takeout.zip", "testUser", takeoutDownloadHandler)
+	if _, err := os.Stat(takeoutPath("testUser")); w.Code != 404 || !os.IsNotExist(err) || us.Takeout() != nil {
+		t.Errorf("TestTakeout --> FAILED")
+	}
+}
+
+func TestTakeoutOfDeletedAccount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "takeouts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldDir := takeoutDir
+	takeoutDir = dir
+	defer func() {
+		takeoutDir = oldDir
+		os.RemoveAll(dir)
+		takeouts = make(map[string]*Takeout)
+		users = nil
+		os.Remove("data/accounts/testUser.txt")
+	}()
+	us := &User{Username: "testUser", Password: "testPassword", ID: 1, Role: RoleAuthor, Email: "test@example.com"}
+	users = append(users, us)
+	err = startTakeout(us)
+	if err != nil {
+		t.Fatal(err)
+	}
+	takeoutJobs.Wait()
+	err = deleteUser(us)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(takeoutPath("testUser")); !os.IsNotExist(err) || takeouts["testUser"] != nil {
+		t.Errorf("TestTakeoutOfDeletedAccount --> FAILED")
+	}
+
+	// the archive of the deleted account doesn't go to the next one of the name
+	form := url.Values{"account": {"testUser"}, "password": {"newPassword"}}
+	req := httptest.NewRequest("POST", "http://127.0.0.1/register", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	registerPostHandler(httptest.NewRecorder(), req, nil)
+	if newUser := getUser("testUser"); newUser == nil || newUser == us {
+		t.Fatal("TestTakeoutOfDeletedAccount --> FAILED")
+	}
+	req = httptest.NewRequest("GET", "http://127.0.0.1/users/testUser/takeout.zip", nil)
+	req.AddCookie(sessionFor("testUser"))
+	w := httptest.NewRecorder()
+	takeoutDownloadHandler(w, req, httprouter.Params{{"username", "testUser"}})
+	if w.Code != http.StatusNotFound {
+		t.Errorf("TestTakeoutOfDeletedAccount --> FAILED")
+	}
+
+	// an archive being written when the account is deleted isn't kept
+	users = append(users, us)
+	storeMu.Lock()
+	err = startTakeout(us)
+	if err == nil {
+		err = deleteUser(us)
+	}
+	storeMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	takeoutJobs.Wait()
+	if _, err := os.Stat(takeoutPath("testUser")); !os.IsNotExist(err) || takeouts["testUser"] != nil {
+		t.Errorf("TestTakeoutOfDeletedAccount --> FAILED")
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+	_ "time/tzdata"
+
+	"src/github.com/julienschmidt/httprouter"
+	"src/github.com/pkg/errors"
+)
+
+// parseStoredTime reads a time saved in an account file. Dates used to be
+// saved with timeFormat in the server's local time zone, they are converted
+// to UTC without losing anything since they had only seconds anyway.
+func parseStoredTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t.UTC(), nil
+	}
+	t, err := time.ParseInLocation(timeFormat, s, time.Local)
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, fmt.Sprintf("can't parse stored time %q", s))
+	}
+	return t.UTC(), nil
+}
+
+func (p *Post) UnmarshalJSON(data []byte) error {
+	type plain Post
+	aux := struct {
+		*plain
+		Date string
+	}{plain: (*plain)(p)}
+	err := json.Unmarshal(data, &aux)
+	if err != nil {
+		return err
+	}
+	p.Date, err = parseStoredTime(aux.Date)
+	return err
+}
+
+func (c *Comment) UnmarshalJSON(data []byte) error {
+	type plain Comment
+	aux := struct {
+		*plain
+		Date string
+	}{plain: (*plain)(c)}
+	err := json.Unmarshal(data, &aux)
+	if err != nil {
+		return err
+	}
+	c.Date, err = parseStoredTime(aux.Date)
+	return err
+}
+
+// location returns the time zone the user wants to see dates in
+func (u *User) location() *time.Location {
+	if u == nil || u.TimeZone == "" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(u.TimeZone)
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+var templateFuncs = template.FuncMap{
+	"localTime":   localTime,
+	"ago":         func(t time.Time) string { return ago(t, time.Now()) },
+	"thumb":       thumbName,
+	"displayName": displayName,
+	"avatar":      avatarURL,
+}
+
+// localTime formats t for the viewer, a nil viewer gets the server time zone
+func localTime(t time.Time, viewer *User) string {
+	return t.In(viewer.location()).Format("02 Jan 2006 15:04 MST")
+}
+
+// ago renders the distance between t and now like "3 hours ago"
+func ago(t, now time.Time) string {
+	d := now.Sub(t)
+	format := "%s ago"
+	if d < 0 {
+		d = -d
+		format = "in %s"
+	}
+	var amount int
+	var unit string
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		amount, unit = int(d/time.Minute), "minute"
+	case d < 24*time.Hour:
+		amount, unit = int(d/time.Hour), "hour"
+	case d < 30*24*time.Hour:
+		amount, unit = int(d/(24*time.Hour)), "day"
+	case d < 365*24*time.Hour:
+		amount, unit = int(d/(30*24*time.Hour)), "month"
+	default:
+		amount, unit = int(d/(365*24*time.Hour)), "year"
+	}
+	if amount != 1 {
+		unit += "s"
+	}
+	return fmt.Sprintf(format, fmt.Sprintf("%d %s", amount, unit))
+}
+
+var commonTimeZones = []string{
+	"UTC", "Europe/London", "Europe/Berlin", "Europe/Kiev", "Europe/Moscow", "Asia/Yekaterinburg",
+	"Asia/Novosibirsk", "Asia/Vladivostok", "Asia/Tokyo", "Asia/Shanghai", "Asia/Kolkata",
+	"Australia/Sydney", "America/New_York", "America/Chicago", "America/Denver", "America/Los_Angeles",
+	"America/Sao_Paulo",
+}
+
+func timeZoneGetHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	usernameCookie, err := sessionCookie(r)
+	if err == http.ErrNoCookie {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	if usernameCookie.Value != ps.ByName("username") {
+		http.Redirect(w, r, "/users/"+usernameCookie.Value, http.StatusFound)
+		return
+	}
+	tpl, err := parseTemplates("templates/header.html", "templates/timeZone.html")
+	if err != nil {
+		panic(err)
+	}
+
+	err = tpl.ExecuteTemplate(w, "timeZone", struct {
+		*User
+		Zones   []string
+		Now     time.Time
+		Invalid bool
+	}{getUser(usernameCookie.Value), commonTimeZones, time.Now(), r.FormValue("invalid") != ""})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func timeZonePostHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	usernameCookie, err := sessionCookie(r)
+	if err == http.ErrNoCookie {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	username := ps.ByName("username")
+	if usernameCookie.Value != username {
+		http.Redirect(w, r, "/users/"+usernameCookie.Value, http.StatusFound)
+		return
+	}
+	zone := strings.TrimSpace(r.FormValue("zone"))
+	// "Local" would mean the server zone, which is what an empty value does
+	if _, err := time.LoadLocation(zone); err != nil || zone == "Local" {
+		http.Redirect(w, r, "/users/"+username+"/timezone?invalid=1", http.StatusFound)
+		return
+	}
+	us := getUser(username)
+	us.TimeZone = zone
+	err = us.refreshUserInfo()
+	if err != nil {
+		panic(err)
+	}
+	http.Redirect(w, r, "/users/"+username, http.StatusFound)
+}
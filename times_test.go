@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"src/github.com/julienschmidt/httprouter"
+)
+
+func TestParseStoredTime(t *testing.T) {
+	legacy, err := parseStoredTime("04.05.2018 16:17:48")
+	want := time.Date(2018, 4, 5, 16, 17, 48, 0, time.Local).UTC()
+	if err != nil || !legacy.Equal(want) || legacy.Location() != time.UTC {
+		t.Errorf("TestParseStoredTime --> FAILED")
+	}
+	modern, err := parseStoredTime("2018-05-04T13:17:48.5Z")
+	if err != nil || !modern.Equal(time.Date(2018, 5, 4, 13, 17, 48, 5e8, time.UTC)) {
+		t.Errorf("TestParseStoredTime --> FAILED")
+	}
+	if zero, err := parseStoredTime(""); err != nil || !zero.IsZero() {
+		t.Errorf("TestParseStoredTime --> FAILED")
+	}
+	if _, err := parseStoredTime("yesterday"); err == nil {
+		t.Errorf("TestParseStoredTime --> FAILED")
+	}
+}
+
+func TestUnmarshalLegacyAccount(t *testing.T) {
+	data := `{"Username":"admin","Password":"123123123","id":1,"PostCount":1,"Posts":[` +
+		`{"Title":"how are you","Body":"my dear visitors?","Date":"04.05.2018 16:17:48",` +
+		`"Comments":[{"ID":1,"Author":"ducker","Body":"fine","Date":"04.05.2018 16:20:00"}]}]}`
+	us := User{}
+	if err := json.Unmarshal([]byte(data), &us); err != nil {
+		t.Errorf("TestUnmarshalLegacyAccount --> FAILED")
+		return
+	}
+	post := us.Posts[0]
+	if post.Title != "how are you" || !post.Date.Equal(time.Date(2018, 4, 5, 16, 17, 48, 0, time.Local)) ||
+		!post.Comments[0].Date.Equal(time.Date(2018, 4, 5, 16, 20, 0, 0, time.Local)) {
+		t.Errorf("TestUnmarshalLegacyAccount --> FAILED")
+	}
+
+	// saved again in RFC 3339 and read back without any loss
+	saved, _ := json.Marshal(us)
+	again := User{}
+	if err := json.Unmarshal(saved, &again); err != nil || !again.Posts[0].Date.Equal(post.Date) ||
+		again.Posts[0].Comments[0].Author != "ducker" {
+		t.Errorf("TestUnmarshalLegacyAccount --> FAILED")
+	}
+}
+
+func TestAgo(t *testing.T) {
+	now := time.Date(2018, 5, 4, 16, 0, 0, 0, time.UTC)
+	cases := map[time.Duration]string{
+		10 * time.Second:             "just now",
+		time.Minute:                  "1 minute ago",
+		3*time.Hour + 59*time.Minute: "3 hours ago",
+		25 * time.Hour:               "1 day ago",
+		40 * 24 * time.Hour:          "1 month ago",
+		800 * 24 * time.Hour:         "2 years ago",
+		-2 * time.Hour:               "in 2 hours",
+	}
+	for d, want := range cases {
+		if got := ago(now.Add(-d), now); got != want {
+			t.Errorf("TestAgo --> FAILED")
+		}
+	}
+}
+
+func TestLocalTime(t *testing.T) {
+	moment := time.Date(2018, 5, 4, 13, 17, 0, 0, time.UTC)
+	if localTime(moment, &User{TimeZone: "Europe/Moscow"}) != "04 May 2018 16:17 MSK" {
+		t.Errorf("TestLocalTime --> FAILED")
+	}
+	if localTime(moment, &User{TimeZone: "UTC"}) != "04 May 2018 13:17 UTC" {
+		t.Errorf("TestLocalTime --> FAILED")
+	}
+	if localTime(moment, nil) != moment.In(time.Local).Format("02 Jan 2006 15:04 MST") {
+		t.Errorf("TestLocalTime --> FAILED")
+	}
+}
+
+func TestTimeZonePostHandler(t *testing.T) {
+	defer func() {
+		users = nil
+		os.Remove("data/accounts/testUser.txt")
+	}()
+	users = append(users, &User{Username: "testUser", Password: "testPassword", ID: 1})
+	req := httptest.NewRequest("POST", "http://127.0.0.1/users/testUser/timezone", nil)
+	req.AddCookie(sessionFor("testUser"))
+	req.ParseForm()
+
+	req.Form.Set("zone", "Mars/Olympus")
+	w := httptest.NewRecorder()
+	timeZonePostHandler(w, req, httprouter.Params{{"username", "testUser"}})
+	l, _ := w.Result().Location()
+	if l.Query().Get("invalid") == "" || getUser("testUser").TimeZone != "" {
+		t.Errorf("TestTimeZonePostHandler --> FAILED")
+	}
+
+	req.Form.Set("zone", "Asia/Tokyo")
+	w = httptest.NewRecorder()
+	timeZonePostHandler(w, req, httprouter.Params{{"username", "testUser"}})
+	l, _ = w.Result().Location()
+	if l.Path != "/users/testUser" || getUser("testUser").TimeZone != "Asia/Tokyo" {
+		t.Errorf("TestTimeZonePostHandler --> FAILED")
+	}
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"image/png"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"src/github.com/julienschmidt/httprouter"
+	"src/github.com/pkg/errors"
+)
+
+// RFC 6238 parameters, the defaults understood by every authenticator app
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	totpIssuer = "golangBlog"
+)
+
+var recoveryCodeCount = 8
+
+var pending2FATTL = 5 * time.Minute
+
+// max2FAFailures wrong codes end a pending login, the password is then
+// refused for twoFactorBackoff, which doubles with every lockout up to
+// maxTwoFactorBackoff until a code is right
+const max2FAFailures = 5
+
+var (
+	twoFactorBackoff    = time.Minute
+	maxTwoFactorBackoff = time.Hour
+)
+
+// twoFactorFailures counts wrong codes of a user, it's guarded by storeMu
+type twoFactorFailures struct {
+	count    int
+	lockouts int
+	until    time.Time
+}
+
+var failed2FA = make(map[string]*twoFactorFailures)
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func newTOTPSecret() (string, error) {
+	buf := make([]byte, 20)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", errors.Wrap(err, "can't generate TOTP secret")
+	}
+	return base32NoPadding.EncodeToString(buf), nil
+}
+
+// hotp implements RFC 4226 with HMAC-SHA1
+func hotp(key []byte, counter uint64, digits int) string {
+	mac := hmac.New(sha1.New, key)
+	binary.Write(mac, binary.BigEndian, counter)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, code%mod)
+}
+
+// checkTOTP looks for code in the current time step and its neighbours
+// to tolerate clock drift. It returns the matched time step.
+func checkTOTP(secret, code string, now time.Time) (int64, bool) {
+	key, err := base32NoPadding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	step := now.Unix() / totpPeriod
+	for _, s := range []int64{step - 1, step, step + 1} {
+		if hmac.Equal([]byte(hotp(key, uint64(s), totpDigits)), []byte(code)) {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+func totpURI(username, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", totpIssuer)
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+username) + "?" + v.Encode()
+}
+
+func (u User) TwoFactorEnabled() bool {
+	return u.TOTPSecret != ""
+}
+
+// verifySecondFactor accepts either a TOTP code or an unused recovery code.
+// A TOTP code can't be used twice, a recovery code is removed once used.
+func (u *User) verifySecondFactor(code string, now time.Time) bool {
+	code = strings.Replace(strings.TrimSpace(code), " ", "", -1)
+	if step, ok := checkTOTP(u.TOTPSecret, code, now); ok {
+		if step <= u.TOTPLastStep {
+			return false
+		}
+		u.TOTPLastStep = step
+		return true
+	}
+	hashed := hashRecoveryCode(code)
+	for i, rc := range u.RecoveryCodes {
+		if hmac.Equal([]byte(rc), []byte(hashed)) {
+			u.RecoveryCodes = append(u.RecoveryCodes[:i], u.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.Replace(code, "-", "", -1))))
+	return hex.EncodeToString(sum[:])
+}
+
+// newRecoveryCodes returns codes to show to the user once
+// and their hashes to store
+func newRecoveryCodes() ([]string, []string, error) {
+	const alphabet = "abcdefghijkmnpqrstuvwxyz23456789"
+	var codes, hashes []string
+	for i := 0; i < recoveryCodeCount; i++ {
+		buf := make([]byte, 10)
+		_, err := rand.Read(buf)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "can't generate recovery codes")
+		}
+		for j := range buf {
+			buf[j] = alphabet[int(buf[j])%len(alphabet)]
+		}
+		code := string(buf[:5]) + "-" + string(buf[5:])
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// the pending2fa cookie proves that the password was correct
+// while the second factor is being asked for
+func makePending2FA(username string, now time.Time) string {
+	return signedValue("2fa", username, now.Add(pending2FATTL))
+}
+
+func checkPending2FA(value string, now time.Time) (string, bool) {
+	return checkSignedValue("2fa", value, now)
+}
+
+// twoFactorLocked tells whether the password step of the user is refused for now
+func twoFactorLocked(username string, now time.Time) bool {
+	f := failed2FA[username]
+	return f != nil && now.Before(f.until)
+}
+
+// start2FA gives a login that passed the password step new attempts
+func start2FA(username string) {
+	if f := failed2FA[username]; f != nil {
+		f.count = 0
+	}
+}
+
+// fail2FA counts a wrong code and tells whether the pending login is over
+func fail2FA(username string, now time.Time) bool {
+	f := failed2FA[username]
+	if f == nil {
+		f = &twoFactorFailures{}
+		failed2FA[username] = f
+	}
+	f.count++
+	if f.count < max2FAFailures {
+		return false
+	}
+	backoff := twoFactorBackoff
+	for i := 0; i < f.lockouts && backoff < maxTwoFactorBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxTwoFactorBackoff {
+		backoff = maxTwoFactorBackoff
+	}
+	f.lockouts++
+	f.until = now.Add(backoff)
+	return true
+}
+
+func login2FAGetHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	c, err := r.Cookie("pending2fa")
+	if err == http.ErrNoCookie {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	if _, ok := checkPending2FA(c.Value, time.Now()); !ok {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	tpl, err := template.ParseFiles("templates/noCookieHeader.html", "templates/login2fa.html")
+	if err != nil {
+		panic(err)
+	}
+
+	err = tpl.ExecuteTemplate(w, "login2fa", r.FormValue("invalid") != "")
+	if err != nil {
+		panic(err)
+	}
+}
+
+func login2FAPostHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	c, err := r.Cookie("pending2fa")
+	if err == http.ErrNoCookie {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	username, ok := checkPending2FA(c.Value, time.Now())
+	us := getUser(username)
+	if !ok || us == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	// a login that ran out of attempts starts over with the password
+	if f := failed2FA[username]; f != nil && f.count >= max2FAFailures {
+		http.SetCookie(w, &http.Cookie{Name: "pending2fa", Path: "/", MaxAge: -1})
+		http.Redirect(w, r, "/tooManyCodes", http.StatusFound)
+		return
+	}
+	if !us.verifySecondFactor(r.FormValue("code"), time.Now()) {
+		if fail2FA(username, time.Now()) {
+			http.SetCookie(w, &http.Cookie{Name: "pending2fa", Path: "/", MaxAge: -1})
+			http.Redirect(w, r, "/tooManyCodes", http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, "/login2fa?invalid=1", http.StatusFound)
+		return
+	}
+	delete(failed2FA, username)
+	err = us.refreshUserInfo()
+	if err != nil {
+		panic(err)
+	}
+	http.SetCookie(w, &http.Cookie{Name: "pending2fa", Path: "/", MaxAge: -1})
+	logIn(w, r, username)
+}
+
+func tooManyCodesGetHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	tpl, err := template.ParseFiles("templates/noCookieHeader.html", "templates/tooManyCodes.html")
+	if err != nil {
+		panic(err)
+	}
+
+	err = tpl.ExecuteTemplate(w, "tooManyCodes", nil)
+	if err != nil {
+		panic(err)
+	}
+}
+
+type twoFactorPage struct {
+	*User
+	Secret         string
+	Invalid        bool
+	RecoveryCodes  []string
+	RecoveryRemain int
+}
+
+func twoFactorGetHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	usernameCookie, err := sessionCookie(r)
+	if err == http.ErrNoCookie {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	if usernameCookie.Value != ps.ByName("username") {
+		http.Redirect(w, r, "/users/"+usernameCookie.Value, http.StatusFound)
+		return
+	}
+	us := getUser(usernameCookie.Value)
+	page := twoFactorPage{User: us, Invalid: r.FormValue("invalid") != "", RecoveryRemain: len(us.RecoveryCodes)}
+	if !us.TwoFactorEnabled() {
+		// a new secret is offered until it's confirmed with a valid code
+		if us.totpPending == "" {
+			us.totpPending, err = newTOTPSecret()
+			if err != nil {
+				panic(err)
+			}
+		}
+		page.Secret = us.totpPending
+	}
+	tpl, err := template.ParseFiles("templates/header.html", "templates/twoFactor.html")
+	if err != nil {
+		panic(err)
+	}
+
+	err = tpl.ExecuteTemplate(w, "twoFactor", page)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func twoFactorPostHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	usernameCookie, err := sessionCookie(r)
+	if err == http.ErrNoCookie {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	username := ps.ByName("username")
+	if usernameCookie.Value != username {
+		http.Redirect(w, r, "/users/"+usernameCookie.Value, http.StatusFound)
+		return
+	}
+	us := getUser(username)
+	code := strings.TrimSpace(r.FormValue("code"))
+	var codes []string
+
+	switch r.FormValue("action") {
+	case "enable":
+		step, ok := checkTOTP(us.totpPending, code, time.Now())
+		if us.TwoFactorEnabled() || !ok {
+			http.Redirect(w, r, "/users/"+username+"/2fa?invalid=1", http.StatusFound)
+			return
+		}
+		var hashes []string
+		codes, hashes, err = newRecoveryCodes()
+		if err != nil {
+			panic(err)
+		}
+		us.TOTPSecret, us.totpPending, us.TOTPLastStep, us.RecoveryCodes = us.totpPending, "", step, hashes
+	case "recoveryCodes":
+		if !us.TwoFactorEnabled() || !us.verifySecondFactor(code, time.Now()) {
+			http.Redirect(w, r, "/users/"+username+"/2fa?invalid=1", http.StatusFound)
+			return
+		}
+		codes, us.RecoveryCodes, err = newRecoveryCodes()
+		if err != nil {
+			panic(err)
+		}
+	case "disable":
+		if !us.TwoFactorEnabled() || !us.verifySecondFactor(code, time.Now()) {
+			http.Redirect(w, r, "/users/"+username+"/2fa?invalid=1", http.StatusFound)
+			return
+		}
+		us.TOTPSecret, us.TOTPLastStep, us.RecoveryCodes = "", 0, nil
+	default:
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	err = us.refreshUserInfo()
+	if err != nil {
+		panic(err)
+	}
+	if codes == nil {
+		http.Redirect(w, r, "/users/"+username+"/2fa", http.StatusFound)
+		return
+	}
+
+	// recovery codes are stored hashed, so this is the only time they are shown
+	tpl, err := template.ParseFiles("templates/header.html", "templates/twoFactor.html")
+	if err != nil {
+		panic(err)
+	}
+
+	err = tpl.ExecuteTemplate(w, "twoFactor", twoFactorPage{User: us, RecoveryCodes: codes, RecoveryRemain: len(codes)})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func twoFactorQRHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	usernameCookie, err := sessionCookie(r)
+	if err == http.ErrNoCookie || usernameCookie.Value != ps.ByName("username") {
+		http.NotFound(w, r)
+		return
+	}
+	us := getUser(usernameCookie.Value)
+	if us == nil || us.totpPending == "" {
+		http.NotFound(w, r)
+		return
+	}
+	qr, err := encodeQR([]byte(totpURI(us.Username, us.totpPending)))
+	if err != nil {
+		panic(err)
+	}
+	var buf bytes.Buffer
+	err = png.Encode(&buf, qr.Image(6))
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	_, err = w.Write(buf.Bytes())
+	if err != nil {
+		log.Println(err)
+	}
+}
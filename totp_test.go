@@ -0,0 +1,225 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"src/github.com/julienschmidt/httprouter"
+)
+
+func TestHOTP(t *testing.T) {
+	// RFC 6238 appendix B, SHA1
+	key := []byte("12345678901234567890")
+	cases := map[int64]string{
+		59:         "94287082",
+		1111111109: "07081804",
+		1234567890: "89005924",
+		2000000000: "69279037",
+	}
+	for unix, want := range cases {
+		if got := hotp(key, uint64(unix/totpPeriod), 8); got != want {
+			t.Errorf("TestHOTP --> FAILED")
+		}
+	}
+}
+
+func TestCheckTOTP(t *testing.T) {
+	secret := base32NoPadding.EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(1111111109, 0)
+
+	if step, ok := checkTOTP(secret, "081804", now); !ok || step != 1111111109/totpPeriod {
+		t.Errorf("TestCheckTOTP --> FAILED")
+	}
+	if _, ok := checkTOTP(secret, "081804", now.Add(totpPeriod*time.Second)); !ok {
+		t.Errorf("TestCheckTOTP --> FAILED")
+	}
+	if _, ok := checkTOTP(secret, "081804", now.Add(3*totpPeriod*time.Second)); ok {
+		t.Errorf("TestCheckTOTP --> FAILED")
+	}
+	if _, ok := checkTOTP(secret, "000000", now); ok {
+		t.Errorf("TestCheckTOTP --> FAILED")
+	}
+}
+
+func TestVerifySecondFactor(t *testing.T) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil || len(codes) != recoveryCodeCount {
+		t.Errorf("TestVerifySecondFactor --> FAILED")
+		return
+	}
+	us := &User{
+		Username:      "testUser",
+		TOTPSecret:    base32NoPadding.EncodeToString([]byte("12345678901234567890")),
+		RecoveryCodes: hashes,
+	}
+	now := time.Unix(1111111109, 0)
+
+	if !us.verifySecondFactor("081804", now) {
+		t.Errorf("TestVerifySecondFactor --> FAILED")
+	}
+	// replay of the same code
+	if us.verifySecondFactor("081804", now) {
+		t.Errorf("TestVerifySecondFactor --> FAILED")
+	}
+	if !us.verifySecondFactor(codes[3], now) || len(us.RecoveryCodes) != recoveryCodeCount-1 {
+		t.Errorf("TestVerifySecondFactor --> FAILED")
+	}
+	if us.verifySecondFactor(codes[3], now) {
+		t.Errorf("TestVerifySecondFactor --> FAILED")
+	}
+}
+
+func TestPending2FA(t *testing.T) {
+	secretKey = []byte("0123456789abcdef0123456789abcdef")
+	now := time.Now()
+	value := makePending2FA("testUser", now)
+
+	if username, ok := checkPending2FA(value, now); !ok || username != "testUser" {
+		t.Errorf("TestPending2FA --> FAILED")
+	}
+	if _, ok := checkPending2FA(value, now.Add(pending2FATTL+time.Second)); ok {
+		t.Errorf("TestPending2FA --> FAILED")
+	}
+	if _, ok := checkPending2FA("admin"+value[len("testUser"):], now); ok {
+		t.Errorf("TestPending2FA --> FAILED")
+	}
+}
+
+func TestMainPostHandlerTwoFactor(t *testing.T) {
+	defer func() {
+		users = nil
+		os.Remove("data/accounts/testUser.txt")
+	}()
+	secretKey = []byte("0123456789abcdef0123456789abcdef")
+	secret := base32NoPadding.EncodeToString([]byte("12345678901234567890"))
+	users = append(users, &User{Username: "testUser", Password: "testPassword", ID: 1, TOTPSecret: secret})
+
+	req := httptest.NewRequest("POST", "http://127.0.0.1/", nil)
+	req.ParseForm()
+	req.Form.Set("username", "testUser")
+	req.Form.Set("password", "testPassword")
+	w := httptest.NewRecorder()
+
+	mainPostHandler(w, req, nil)
+
+	result := w.Result()
+	l, _ := result.Location()
+	if result.StatusCode != 302 || l.Path != "/login2fa" || result.Cookies()[0].Name != "pending2fa" {
+		t.Errorf("TestMainPostHandlerTwoFactor --> FAILED")
+		return
+	}
+	pending := result.Cookies()[0]
+
+	key, _ := base32NoPadding.DecodeString(secret)
+	req = httptest.NewRequest("POST", "http://127.0.0.1/login2fa", nil)
+	req.AddCookie(&http.Cookie{Name: pending.Name, Value: pending.Value})
+	req.ParseForm()
+	req.Form.Set("code", "000000")
+	w = httptest.NewRecorder()
+	login2FAPostHandler(w, req, nil)
+	l, _ = w.Result().Location()
+	if l.Path != "/login2fa" || len(w.Result().Cookies()) != 0 {
+		t.Errorf("TestMainPostHandlerTwoFactor --> FAILED")
+	}
+
+	req.Form.Set("code", hotp(key, uint64(time.Now().Unix()/totpPeriod), totpDigits))
+	w = httptest.NewRecorder()
+	login2FAPostHandler(w, req, nil)
+	result = w.Result()
+	l, _ = result.Location()
+	if l.Path != "/users/testUser" || result.Cookies()[1].Name != "username" {
+		t.Fatal("TestMainPostHandlerTwoFactor --> FAILED")
+	}
+	if username, ok := checkSignedValue(sessionPurpose(getUser("testUser")), result.Cookies()[1].Value, time.Now()); !ok || username != "testUser" {
+		t.Errorf("TestMainPostHandlerTwoFactor --> FAILED")
+	}
+}
+
+func TestLogin2FAFailures(t *testing.T) {
+	defer func() {
+		users = nil
+		failed2FA = make(map[string]*twoFactorFailures)
+		os.Remove("data/accounts/testUser.txt")
+	}()
+	secretKey = []byte("0123456789abcdef0123456789abcdef")
+	secret := base32NoPadding.EncodeToString([]byte("12345678901234567890"))
+	users = append(users, &User{Username: "testUser", Password: "testPassword", ID: 1, TOTPSecret: secret})
+	key, _ := base32NoPadding.DecodeString(secret)
+
+	logInWithPassword := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "http://127.0.0.1/", nil)
+		req.ParseForm()
+		req.Form.Set("username", "testUser")
+		req.Form.Set("password", "testPassword")
+		w := httptest.NewRecorder()
+		mainPostHandler(w, req, nil)
+		return w
+	}
+	sendCode := func(pending *http.Cookie, code string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "http://127.0.0.1/login2fa", nil)
+		req.AddCookie(&http.Cookie{Name: pending.Name, Value: pending.Value})
+		req.ParseForm()
+		req.Form.Set("code", code)
+		w := httptest.NewRecorder()
+		login2FAPostHandler(w, req, nil)
+		return w
+	}
+
+	pending := logInWithPassword().Result().Cookies()[0]
+	for i := 1; i < max2FAFailures; i++ {
+		l, _ := sendCode(pending, "000000").Result().Location()
+		if l.Path != "/login2fa" {
+			t.Fatal("TestLogin2FAFailures --> FAILED")
+		}
+	}
+	w := sendCode(pending, "000000")
+	l, _ := w.Result().Location()
+	if l.Path != "/tooManyCodes" || w.Result().Cookies()[0].MaxAge != -1 {
+		t.Fatal("TestLogin2FAFailures --> FAILED")
+	}
+	// the pending login is over even with the right code
+	valid := hotp(key, uint64(time.Now().Unix()/totpPeriod), totpDigits)
+	if l, _ := sendCode(pending, valid).Result().Location(); l.Path != "/tooManyCodes" {
+		t.Errorf("TestLogin2FAFailures --> FAILED")
+	}
+	// and the password is refused during the backoff
+	if l, _ := logInWithPassword().Result().Location(); l.Path != "/tooManyCodes" {
+		t.Errorf("TestLogin2FAFailures --> FAILED")
+	}
+
+	// the backoff doubles with every lockout
+	failed2FA["testUser"].until = time.Time{}
+	pending = logInWithPassword().Result().Cookies()[0]
+	for i := 0; i < max2FAFailures; i++ {
+		sendCode(pending, "000000")
+	}
+	if f := failed2FA["testUser"]; f.lockouts != 2 || f.until.Sub(time.Now()) <= twoFactorBackoff {
+		t.Errorf("TestLogin2FAFailures --> FAILED")
+	}
+
+	failed2FA["testUser"].until = time.Time{}
+	pending = logInWithPassword().Result().Cookies()[0]
+	if l, _ := sendCode(pending, valid).Result().Location(); l.Path != "/users/testUser" || failed2FA["testUser"] != nil {
+		t.Errorf("TestLogin2FAFailures --> FAILED")
+	}
+}
+
+func TestTwoFactorQRHandler(t *testing.T) {
+	defer func() {
+		users = nil
+	}()
+	users = append(users, &User{Username: "testUser", Password: "testPassword", ID: 1, totpPending: "JBSWY3DPEHPK3PXP"})
+	req := httptest.NewRequest("GET", "http://127.0.0.1/users/testUser/2fa/qr.png", nil)
+	req.AddCookie(sessionFor("testUser"))
+	w := httptest.NewRecorder()
+
+	twoFactorQRHandler(w, req, httprouter.Params{{"username", "testUser"}})
+
+	result := w.Result()
+	if result.StatusCode != 200 || result.Header.Get("Content-Type") != "image/png" {
+		t.Errorf("TestTwoFactorQRHandler --> FAILED")
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"src/github.com/julienschmidt/httprouter"
+	"src/github.com/pkg/errors"
+)
+
+// Webmentions (https://www.w3.org/TR/webmention/) tell posts about pages
+// linking them and other sites about pages our posts link. Sources are
+// fetched in the background since they are on servers we don't control.
+
+// Mention is a page of another site linking the post
+type Mention struct {
+	Source string
+	Title  string
+	// when the link was last checked
+	Date time.Time
+}
+
+// httpClient is what webmentions need of http.Client
+type httpClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// webmentionClient fetches pages for webmentions, tests put
+// a client that can reach local servers here
+var webmentionClient httpClient = federationClient
+
+// pages bigger than that aren't read
+const maxMentionPage = 1 << 20
+
+// webmentionJob is a received webmention to verify or, when Send
+// is set, a link of our post to tell the target about
+type webmentionJob struct {
+	Source string
+	Target string
+	Send   bool
+}
+
+var webmentionQueue = make(chan webmentionJob, 100)
+
+var (
+	// links in post bodies, trailing punctuation isn't part of them
+	bodyLinkPattern    = regexp.MustCompile(`https?://[^\s<>"']+[^\s<>"'.,;:!?)]`)
+	htmlLinkTagPattern = regexp.MustCompile(`(?is)<(a|link)\b[^>]*>`)
+	htmlAttrPattern    = regexp.MustCompile(`(?is)([a-z-]+)\s*=\s*("[^"]*"|'[^']*'|[^\s"'>]+)`)
+	htmlTitlePattern   = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	linkHeaderPattern  = regexp.MustCompile(`<([^>]*)>\s*;([^,]*)`)
+	linkRelPattern     = regexp.MustCompile(`(?i)rel\s*=\s*"?([^";]*)"?`)
+)
+
+type htmlLink struct {
+	Rel  []string
+	Href string
+}
+
+// htmlLinks returns links of a and link tags in the order they appear
+func htmlLinks(page string) []htmlLink {
+	var links []htmlLink
+	for _, tag := range htmlLinkTagPattern.FindAllString(page, -1) {
+		var link htmlLink
+		hasHref := false
+		for _, attr := range htmlAttrPattern.FindAllStringSubmatch(tag, -1) {
+			value := html.UnescapeString(strings.Trim(attr[2], `"'`))
+			switch strings.ToLower(attr[1]) {
+			case "href":
+				link.Href, hasHref = value, true
+			case "rel":
+				link.Rel = strings.Fields(strings.ToLower(value))
+			}
+		}
+		// tags without href don't link anything, empty ones link the page itself
+		if hasHref {
+			links = append(links, link)
+		}
+	}
+	return links
+}
+
+func hasRel(rels []string, rel string) bool {
+	for _, r := range rels {
+		if r == rel {
+			return true
+		}
+	}
+	return false
+}
+
+// webLink checks that s is an absolute http or https URL
+func webLink(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.Errorf("%q isn't a web link", s)
+	}
+	return u, nil
+}
+
+// mentionedPost returns the post a webmention targets
+func mentionedPost(target string) (*User, *Post) {
+	prefix := baseURL + "/users/"
+	if !strings.HasPrefix(target, prefix) {
+		return nil, nil
+	}
+	us := getUser(strings.SplitN(strings.TrimPrefix(target, prefix), "/", 2)[0])
+	if us == nil || us.Disabled {
+		return nil, nil
+	}
+	return us, us.postByURL(target)
+}
+
+// webmentionHandler takes a webmention and leaves it for the webmention worker
+func webmentionHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	source, target := r.FormValue("source"), r.FormValue("target")
+	_, err := webLink(source)
+	if err == nil {
+		_, err = webLink(target)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if source == target {
+		http.Error(w, "source and target are the same", http.StatusBadRequest)
+		return
+	}
+	if _, post := mentionedPost(target); post == nil {
+		http.Error(w, "target isn't a post of this site", http.StatusBadRequest)
+		return
+	}
+	select {
+	case webmentionQueue <- webmentionJob{Source: source, Target: target}:
+		w.WriteHeader(http.StatusAccepted)
+		io.WriteString(w, "webmention is going to be checked\n")
+	default:
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "Too many webmentions, try again later", http.StatusServiceUnavailable)
+	}
+}
+
+// fetchPage gets a page for webmentions, up to maxMentionPage of it is read
+func fetchPage(link string) (*http.Response, string, error) {
+	req, err := http.NewRequest("GET", link, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Accept", "text/html, text/plain;q=0.9")
+	req.Header.Set("User-Agent", federationUserAgent)
+	resp, err := webmentionClient.Do(req)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "can't fetch "+link)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxMentionPage))
+	if err != nil {
+		return nil, "", errors.Wrap(err, "can't read "+link)
+	}
+	return resp, string(data), nil
+}
+
+// verifyWebmention fetches the source and keeps the mention on the target
+// post if the source links it. A source that doesn't link the post anymore
+// takes its mention away.
+func verifyWebmention(source, target string) error {
+	resp, page, err := fetchPage(source)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusGone {
+		return errors.Errorf("%s answered %s", source, resp.Status)
+	}
+	mention := Mention{Source: source, Date: time.Now().UTC()}
+	links := false
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	switch {
+	case resp.StatusCode == http.StatusGone:
+	case mediaType == "text/html" || mediaType == "application/xhtml+xml":
+		for _, link := range htmlLinks(page) {
+			if link.Href == target {
+				links = true
+				break
+			}
+		}
+		if m := htmlTitlePattern.FindStringSubmatch(page); m != nil {
+			mention.Title = htmlToText(m[1])
+			if title := []rune(mention.Title); len(title) > 100 {
+				mention.Title = string(title[:100])
+			}
+		}
+	case mediaType == "text/plain":
+		links = strings.Contains(page, target)
+	}
+
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	us, post := mentionedPost(target)
+	if post == nil {
+		return nil
+	}
+	changed := post.removeMention(source)
+	if links {
+		post.Mentions = append(post.Mentions, mention)
+		changed = true
+	}
+	if !changed {
+		return errors.Errorf("%s doesn't link %s", source, target)
+	}
+	return us.refreshUserInfo()
+}
+
+func (p *Post) removeMention(source string) bool {
+	for i, m := range p.Mentions {
+		if m.Source == source {
+			p.Mentions = append(p.Mentions[:i], p.Mentions[i+1:]...)
+			p.Changed = time.Now().UTC()
+			return true
+		}
+	}
+	return false
+}
+
+// discoverEndpoint finds the webmention endpoint of the target in its Link
+// headers or its HTML, it's empty when the target doesn't take webmentions
+func discoverEndpoint(target string) (string, error) {
+	resp, page, err := fetchPage(target)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("%s answered %s", target, resp.Status)
+	}
+	endpoint := ""
+	found := false
+	for _, header := range resp.Header["Link"] {
+		for _, m := range linkHeaderPattern.FindAllStringSubmatch(header, -1) {
+			rel := linkRelPattern.FindStringSubmatch(m[2])
+			if rel != nil && hasRel(strings.Fields(strings.ToLower(rel[1])), "webmention") {
+				endpoint, found = m[1], true
+				break
+			}
+		}
+		if found {
+			break
+		}
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !found && mediaType == "text/html" {
+		for _, link := range htmlLinks(page) {
+			if hasRel(link.Rel, "webmention") {
+				endpoint, found = link.Href, true
+				break
+			}
+		}
+	}
+	if !found {
+		return "", nil
+	}
+	// relative to the page after redirects
+	u, err := resp.Request.URL.Parse(endpoint)
+	if err != nil {
+		return "", errors.Wrap(err, "bad webmention endpoint")
+	}
+	if _, err := webLink(u.String()); err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+// sendWebmention tells the target that the source links it
+func sendWebmention(source, target string) error {
+	endpoint, err := discoverEndpoint(target)
+	if err != nil || endpoint == "" {
+		return err
+	}
+	form := url.Values{"source": {source}, "target": {target}}
+	req, err := http.NewRequest("POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", federationUserAgent)
+	resp, err := webmentionClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "can't send webmention to "+endpoint)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("%s answered %s", endpoint, resp.Status)
+	}
+	return nil
+}
+
+// sendWebmentions queues webmentions for the links of a new post,
+// links to the blog itself don't need them
+func (u User) sendWebmentions(p Post) {
+	seen := make(map[string]bool)
+	for _, link := range bodyLinkPattern.FindAllString(p.Body, -1) {
+		if seen[link] || strings.HasPrefix(link, baseURL+"/") {
+			continue
+		}
+		seen[link] = true
+		select {
+		case webmentionQueue <- webmentionJob{Source: postURL(u.Username, p.ID), Target: link, Send: true}:
+		default:
+			log.Println("webmention queue is full, not sending to", link)
+		}
+	}
+}
+
+func processWebmention(job webmentionJob) error {
+	if job.Send {
+		return sendWebmention(job.Source, job.Target)
+	}
+	return verifyWebmention(job.Source, job.Target)
+}
+
+// startWebmentions checks received webmentions and sends ours in the background
+func startWebmentions() {
+	go func() {
+		for job := range webmentionQueue {
+			err := processWebmention(job)
+			if err != nil {
+				log.Println("webmention:", err)
+			}
+		}
+	}()
+}
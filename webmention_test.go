@@ -0,0 +1,189 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"src/github.com/julienschmidt/httprouter"
+)
+
+// withWebmentions lets webmentions reach test servers
+func withWebmentions() func() {
+	old := webmentionClient
+	webmentionClient = http.DefaultClient
+	return func() {
+		webmentionClient = old
+		users = nil
+		os.Remove("data/accounts/testUser.txt")
+		for len(webmentionQueue) > 0 {
+			<-webmentionQueue
+		}
+	}
+}
+
+func TestHTMLLinks(t *testing.T) {
+	links := htmlLinks(`<link rel="Webmention stylesheet" href='/wm?a=1&amp;b=2'><a name="x">no link</a>` +
+		`<A HREF=http://example.com/>x</A><a href="">self</a>`)
+	if len(links) != 3 || !hasRel(links[0].Rel, "webmention") || links[0].Href != "/wm?a=1&b=2" ||
+		links[1].Href != "http://example.com/" || links[2].Href != "" {
+		t.Errorf("TestHTMLLinks --> FAILED")
+	}
+	body := "see https://example.com/a, (https://example.com/b) and http://x.org/c?d=1."
+	found := bodyLinkPattern.FindAllString(body, -1)
+	if strings.Join(found, " ") != "https://example.com/a https://example.com/b http://x.org/c?d=1" {
+		t.Errorf("TestHTMLLinks --> FAILED")
+	}
+}
+
+func TestWebmentionHandler(t *testing.T) {
+	defer withWebmentions()()
+	us := &User{Username: "testUser", Password: "testPassword", ID: 1, Role: RoleAuthor}
+	users = append(users, us)
+	us.addPost(Post{Title: "title", Body: "body", Date: time.Now()})
+
+	for _, form := range []url.Values{
+		{"source": {"https://example.com/"}, "target": {postURL("testUser", 2)}},
+		{"source": {"ftp://example.com/"}, "target": {postURL("testUser", 1)}},
+		{"source": {postURL("testUser", 1)}, "target": {postURL("testUser", 1)}},
+		{"source": {"https://example.com/"}, "target": {"https://example.com/other"}},
+	} {
+		req := httptest.NewRequest("POST", "http://localhost:8080/webmention", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		webmentionHandler(w, req, nil)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("TestWebmentionHandler --> FAILED: %v", form)
+		}
+	}
+
+	form := url.Values{"source": {"https://example.com/"}, "target": {postURL("testUser", 1)}}
+	req := httptest.NewRequest("POST", "http://localhost:8080/webmention", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	webmentionHandler(w, req, nil)
+	if w.Code != http.StatusAccepted || len(webmentionQueue) != 1 {
+		t.Errorf("TestWebmentionHandler --> FAILED")
+	}
+	if job := <-webmentionQueue; job.Send || job.Source != "https://example.com/" {
+		t.Errorf("TestWebmentionHandler --> FAILED")
+	}
+}
+
+func TestVerifyWebmention(t *testing.T) {
+	defer withWebmentions()()
+	us := &User{Username: "testUser", Password: "testPassword", ID: 1, Role: RoleAuthor}
+	users = append(users, us)
+	us.addPost(Post{Title: "title", Body: "body", Date: time.Now()})
+	target := postURL("testUser", 1)
+
+	var mu sync.Mutex
+	page := `<html><title>A &amp; B</title><p>read <a href="` + target + `">this</a></p></html>`
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/page":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte(page))
+		case "/plain":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("see " + target))
+		default:
+			w.WriteHeader(http.StatusGone)
+		}
+	}))
+	defer site.Close()
+
+	err := verifyWebmention(site.URL+"/page", target)
+	post := us.getPost(1)
+	if err != nil || len(post.Mentions) != 1 || post.Mentions[0].Title != "A & B" {
+		t.Fatal("TestVerifyWebmention --> FAILED", err)
+	}
+	// a mention sent again is updated, not repeated
+	if verifyWebmention(site.URL+"/page", target) != nil || verifyWebmention(site.URL+"/plain", target) != nil ||
+		len(post.Mentions) != 2 {
+		t.Errorf("TestVerifyWebmention --> FAILED")
+	}
+	saved, _ := readAccount("testUser")
+	if len(saved.Posts[0].Mentions) != 2 {
+		t.Errorf("TestVerifyWebmention --> FAILED")
+	}
+
+	req := httptest.NewRequest("GET", target, nil)
+	req.AddCookie(sessionFor("testUser"))
+	w := httptest.NewRecorder()
+	postHandler(w, req, httprouter.Params{{"username", "testUser"}, {"id", "1"}})
+	if !strings.Contains(w.Body.String(), `rel="nofollow ugc">A &amp; B</a>`) ||
+		w.Header().Get("Link") != "<"+baseURL+`/webmention>; rel="webmention"` {
+		t.Errorf("TestVerifyWebmention --> FAILED")
+	}
+
+	// the link is gone from the page, so is the mention
+	mu.Lock()
+	page = "<html>nothing here</html>"
+	mu.Unlock()
+	if verifyWebmention(site.URL+"/page", target) != nil || verifyWebmention(site.URL+"/deleted", target) == nil ||
+		len(post.Mentions) != 1 || post.Mentions[0].Source != site.URL+"/plain" {
+		t.Errorf("TestVerifyWebmention --> FAILED")
+	}
+
+	// long titles are cut by characters
+	mu.Lock()
+	page = `<html><title>` + strings.Repeat("я", 120) + `</title><a href="` + target + `">this</a></html>`
+	mu.Unlock()
+	if verifyWebmention(site.URL+"/page", target) != nil || len(post.Mentions) != 2 ||
+		post.Mentions[1].Title != strings.Repeat("я", 100) {
+		t.Errorf("TestVerifyWebmention --> FAILED")
+	}
+}
+
+func TestSendWebmentions(t *testing.T) {
+	defer withWebmentions()()
+	var mu sync.Mutex
+	received := make(map[string]url.Values)
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/header":
+			w.Header().Add("Link", `<https://example.com/feed>; rel="alternate", </endpoint/a>; rel="webmention"`)
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<link rel="webmention" href="/wrong">`))
+		case "/html":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<html><a href="/x">x</a><link rel="webmention" href="endpoint/b"></html>`))
+		case "/none":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<html></html>`))
+		default:
+			r.ParseForm()
+			mu.Lock()
+			received[r.URL.Path] = r.PostForm
+			mu.Unlock()
+			w.WriteHeader(http.StatusAccepted)
+		}
+	}))
+	defer site.Close()
+
+	us := &User{Username: "testUser", Password: "testPassword", ID: 1, Role: RoleAuthor}
+	users = append(users, us)
+	us.addPost(Post{Title: "links", Body: "see " + site.URL + "/header, " + site.URL + "/html and " + site.URL + "/none." +
+		" " + baseURL + "/users/testUser/", Date: time.Now()})
+	if len(webmentionQueue) != 3 {
+		t.Fatal("TestSendWebmentions --> FAILED", len(webmentionQueue))
+	}
+	for len(webmentionQueue) > 0 {
+		job := <-webmentionQueue
+		if !job.Send || processWebmention(job) != nil {
+			t.Errorf("TestSendWebmentions --> FAILED: %s", job.Target)
+		}
+	}
+	if len(received) != 2 || received["/endpoint/a"].Get("target") != site.URL+"/header" ||
+		received["/endpoint/b"].Get("source") != postURL("testUser", 1) {
+		t.Errorf("TestSendWebmentions --> FAILED")
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"src/github.com/pkg/errors"
+)
+
+// XML-RPC (http://xmlrpc.com/spec.md) is what MetaWeblog is spoken over.
+// Values are decoded into string, int, bool, float64, time.Time, []byte,
+// map[string]interface{} and []interface{}, and encoded back from them.
+
+// fault codes of the interoperability conventions, methods use HTTP-like ones
+const (
+	faultParse         = -32700
+	faultUnknownMethod = -32601
+	faultInvalidParams = -32602
+	faultInternal      = -32603
+	xmlrpcDateFormat   = "20060102T15:04:05"
+)
+
+// xmlrpcFault is an error the caller is told about
+type xmlrpcFault struct {
+	Code    int
+	Message string
+}
+
+func (f xmlrpcFault) Error() string {
+	return fmt.Sprintf("fault %d: %s", f.Code, f.Message)
+}
+
+type xmlrpcMember struct {
+	Name  string      `xml:"name"`
+	Value xmlrpcValue `xml:"value"`
+}
+
+type xmlrpcStruct struct {
+	Members []xmlrpcMember `xml:"member"`
+}
+
+type xmlrpcArray struct {
+	Values []xmlrpcValue `xml:"data>value"`
+}
+
+type xmlrpcValue struct {
+	Int      *string       `xml:"int"`
+	I4       *string       `xml:"i4"`
+	Boolean  *string       `xml:"boolean"`
+	String   *string       `xml:"string"`
+	Double   *string       `xml:"double"`
+	DateTime *string       `xml:"dateTime.iso8601"`
+	Base64   *string       `xml:"base64"`
+	Struct   *xmlrpcStruct `xml:"struct"`
+	Array    *xmlrpcArray  `xml:"array"`
+	Nil      *struct{}     `xml:"nil"`
+	// a value without a type element is a string
+	Text string `xml:",chardata"`
+}
+
+type xmlrpcCall struct {
+	Method string        `xml:"methodName"`
+	Params []xmlrpcValue `xml:"params>param>value"`
+}
+
+// parseXMLRPCDate takes the format of the spec with or without a zone,
+// dates without one are taken as UTC
+func parseXMLRPCDate(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range []string{xmlrpcDateFormat, xmlrpcDateFormat + "Z07:00", xmlrpcDateFormat + "Z0700",
+		"2006-01-02T15:04:05Z07:00", "2006-01-02T15:04:05"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, errors.Errorf("unknown date format %q", s)
+}
+
+func (v xmlrpcValue) decode() (interface{}, error) {
+	switch {
+	case v.Int != nil || v.I4 != nil:
+		s := v.Int
+		if s == nil {
+			s = v.I4
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(*s))
+		if err != nil {
+			return nil, errors.Errorf("bad int %q", *s)
+		}
+		return n, nil
+	case v.Boolean != nil:
+		switch strings.TrimSpace(*v.Boolean) {
+		case "1":
+			return true, nil
+		case "0":
+			return false, nil
+		}
+		return nil, errors.Errorf("bad boolean %q", *v.Boolean)
+	case v.String != nil:
+		return *v.String, nil
+	case v.Double != nil:
+		f, err := strconv.ParseFloat(strings.TrimSpace(*v.Double), 64)
+		if err != nil {
+			return nil, errors.Errorf("bad double %q", *v.Double)
+		}
+		return f, nil
+	case v.DateTime != nil:
+		return parseXMLRPCDate(*v.DateTime)
+	case v.Base64 != nil:
+		data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(*v.Base64), ""))
+		if err != nil {
+			return nil, errors.Wrap(err, "bad base64")
+		}
+		return data, nil
+	case v.Struct != nil:
+		m := make(map[string]interface{})
+		for _, member := range v.Struct.Members {
+			value, err := member.Value.decode()
+			if err != nil {
+				return nil, err
+			}
+			m[member.Name] = value
+		}
+		return m, nil
+	case v.Array != nil:
+		values := []interface{}{}
+		for _, item := range v.Array.Values {
+			value, err := item.decode()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	case v.Nil != nil:
+		return nil, nil
+	}
+	return v.Text, nil
+}
+
+// parseXMLRPCCall reads the method name and the params of a call
+func parseXMLRPCCall(r io.Reader) (string, []interface{}, error) {
+	var call xmlrpcCall
+	err := xml.NewDecoder(r).Decode(&call)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "can't parse call")
+	}
+	if call.Method == "" {
+		return "", nil, errors.New("call without methodName")
+	}
+	var params []interface{}
+	for _, p := range call.Params {
+		value, err := p.decode()
+		if err != nil {
+			return "", nil, err
+		}
+		params = append(params, value)
+	}
+	return strings.TrimSpace(call.Method), params, nil
+}
+
+func writeXMLRPCValue(buf *bytes.Buffer, v interface{}) {
+	buf.WriteString("<value>")
+	switch v := v.(type) {
+	case string:
+		buf.WriteString("<string>")
+		xml.EscapeText(buf, []byte(v))
+		buf.WriteString("</string>")
+	case int:
+		fmt.Fprintf(buf, "<int>%d</int>", v)
+	case bool:
+		if v {
+			buf.WriteString("<boolean>1</boolean>")
+		} else {
+			buf.WriteString("<boolean>0</boolean>")
+		}
+	case time.Time:
+		fmt.Fprintf(buf, "<dateTime.iso8601>%s</dateTime.iso8601>", v.UTC().Format(xmlrpcDateFormat))
+	case []byte:
+		fmt.Fprintf(buf, "<base64>%s</base64>", base64.StdEncoding.EncodeToString(v))
+	case []string:
+		buf.WriteString("<array><data>")
+		for _, s := range v {
+			writeXMLRPCValue(buf, s)
+		}
+		buf.WriteString("</data></array>")
+	case []interface{}:
+		buf.WriteString("<array><data>")
+		for _, item := range v {
+			writeXMLRPCValue(buf, item)
+		}
+		buf.WriteString("</data></array>")
+	case map[string]interface{}:
+		// members in a stable order
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		buf.WriteString("<struct>")
+		for _, name := range names {
+			buf.WriteString("<member><name>")
+			xml.EscapeText(buf, []byte(name))
+			buf.WriteString("</name>")
+			writeXMLRPCValue(buf, v[name])
+			buf.WriteString("</member>")
+		}
+		buf.WriteString("</struct>")
+	default:
+		panic(fmt.Sprintf("xmlrpc: can't encode %T", v))
+	}
+	buf.WriteString("</value>")
+}
+
+// xmlrpcResponse encodes the result of a call, or the fault when err isn't nil
+func xmlrpcResponse(result interface{}, err error) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header + "<methodResponse>")
+	if err != nil {
+		fault, ok := err.(xmlrpcFault)
+		if !ok {
+			fault = xmlrpcFault{Code: faultInternal, Message: err.Error()}
+		}
+		buf.WriteString("<fault>")
+		writeXMLRPCValue(&buf, map[string]interface{}{"faultCode": fault.Code, "faultString": fault.Message})
+		buf.WriteString("</fault>")
+	} else {
+		buf.WriteString("<params><param>")
+		writeXMLRPCValue(&buf, result)
+		buf.WriteString("</param></params>")
+	}
+	buf.WriteString("</methodResponse>\n")
+	return buf.Bytes()
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseXMLRPCCall(t *testing.T) {
+	call := `<?xml version="1.0"?>
+<methodCall>
+  <methodName>metaWeblog.newPost</methodName>
+  <params>
+    <param><value>1</value></param>
+    <param><value><string>user &amp; co</string></value></param>
+    <param><value><i4>42</i4></value></param>
+    <param><value><struct>
+      <member><name>title</name><value>hello</value></member>
+      <member><name>dateCreated</name><value><dateTime.iso8601>20200102T03:04:05</dateTime.iso8601></value></member>
+      <member><name>categories</name><value><array><data>
+        <value>go</value><value><string>web</string></value>
+      </data></array></value></member>
+      <member><name>bits</name><value><base64>aGk=</base64></value></member>
+    </struct></value></param>
+    <param><value><boolean>0</boolean></value></param>
+    <param><value><struct></struct></value></param>
+  </params>
+</methodCall>`
+	method, params, err := parseXMLRPCCall(strings.NewReader(call))
+	if err != nil || method != "metaWeblog.newPost" || len(params) != 6 {
+		t.Fatal("TestParseXMLRPCCall --> FAILED", err)
+	}
+	content := params[3].(map[string]interface{})
+	if params[0] != "1" || params[1] != "user & co" || params[2] != 42 || params[4] != false ||
+		content["title"] != "hello" || !content["dateCreated"].(time.Time).Equal(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)) ||
+		content["categories"].([]interface{})[1] != "web" || string(content["bits"].([]byte)) != "hi" ||
+		len(params[5].(map[string]interface{})) != 0 {
+		t.Errorf("TestParseXMLRPCCall --> FAILED: %#v", params)
+	}
+
+	for _, bad := range []string{
+		`<methodCall><params></params></methodCall>`,
+		`<methodCall><methodName>x</methodName><params><param><value><int>one</int></value></param></params></methodCall>`,
+		`<methodCall><methodName>x</methodName><params><param><value><boolean>yes</boolean></value></param></params></methodCall>`,
+		`not xml`,
+	} {
+		if _, _, err := parseXMLRPCCall(strings.NewReader(bad)); err == nil {
+			t.Errorf("TestParseXMLRPCCall --> FAILED: %s", bad)
+		}
+	}
+}
+
+func TestXMLRPCResponse(t *testing.T) {
+	result := map[string]interface{}{
+		"b": []interface{}{1, true, "<x>"},
+		"a": time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	resp := string(xmlrpcResponse(result, nil))
+	want := "<params><param><value><struct><member><name>a</name><value><dateTime.iso8601>20200102T03:04:05</dateTime.iso8601></value></member>" +
+		"<member><name>b</name><value><array><data><value><int>1</int></value><value><boolean>1</boolean></value>" +
+		"<value><string>&lt;x&gt;</string></value></data></array></value></member></struct></value></param></params>"
+	if !strings.Contains(resp, want) {
+		t.Errorf("TestXMLRPCResponse --> FAILED: %s", resp)
+	}
+	fault := string(xmlrpcResponse(nil, faultf(404, "no post")))
+	if !strings.Contains(fault, "<fault><value><struct><member><name>faultCode</name><value><int>404</int></value></member>") ||
+		!strings.Contains(fault, "<string>no post</string>") {
+		t.Errorf("TestXMLRPCResponse --> FAILED: %s", fault)
+	}
+}